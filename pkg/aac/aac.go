@@ -205,3 +205,77 @@ func BuildAACSeqHeader(asc []byte) ([]byte, error) {
 	copy(ret[2:], asc)
 	return ret, nil
 }
+
+// ADTS头中与解码相关的字段
+type ADTSHeader struct {
+	AudioObjectType        uint8
+	SamplingFrequencyIndex uint8
+	ChannelConfiguration   uint8
+
+	HeaderLength int // protection_absent为0时包含2字节crc
+	FrameLength  int // 包含ADTS头的整帧大小
+}
+
+// @param <b> 以ADTS头开始的数据，函数调用结束后，内部不持有<b>内存块
+//
+func ParseADTSHeader(b []byte) (h ADTSHeader, err error) {
+	if len(b) < 7 || b[0] != 0xFF || b[1]&0xF0 != 0xF0 {
+		return h, ErrAAC
+	}
+	h.HeaderLength = 7
+	if b[1]&0x01 == 0 {
+		h.HeaderLength = 9
+	}
+	h.AudioObjectType = (b[2] >> 6) + 1
+	h.SamplingFrequencyIndex = (b[2] >> 2) & 0x0F
+	h.ChannelConfiguration = (b[2]&0x01)<<2 | b[3]>>6
+	h.FrameLength = int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+	if h.FrameLength < h.HeaderLength {
+		return h, ErrAAC
+	}
+	return
+}
+
+// @return 2字节的AAC Audio Specifc Config，返回的内存块为新申请的独立内存块
+//
+func (h *ADTSHeader) AudioSpecificConfig() []byte {
+	// <ISO_IEC_14496-3.pdf>, <1.6.2.1 AudioSpecificConfig>
+	// audioObjectType [5b], samplingFrequencyIndex [4b], channelConfiguration [4b], 其余3位为0
+	asc := make([]byte, 2)
+	asc[0] = h.AudioObjectType<<3 | h.SamplingFrequencyIndex>>1
+	asc[1] = (h.SamplingFrequencyIndex&0x01)<<7 | h.ChannelConfiguration<<3
+	return asc
+}
+
+// AudioSpecificConfig中与解码相关的字段
+type AudioSpecificConfig struct {
+	AudioObjectType        uint8
+	SamplingFrequencyIndex uint8
+	ChannelConfiguration   uint8
+}
+
+var samplingFrequencyTable = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// @param <asc> AAC Audio Specifc Config，注意，如果是rtmp/flv的message/tag，应去除Seq Header头部的2个字节
+//
+func ParseAudioSpecificConfig(asc []byte) (c AudioSpecificConfig, err error) {
+	if len(asc) < minASCLength {
+		return c, ErrAAC
+	}
+	// <ISO_IEC_14496-3.pdf>, <1.6.2.1 AudioSpecificConfig>
+	c.AudioObjectType = asc[0] >> 3
+	c.SamplingFrequencyIndex = (asc[0]&0x07)<<1 | asc[1]>>7
+	c.ChannelConfiguration = (asc[1] >> 3) & 0x0F
+	if int(c.SamplingFrequencyIndex) >= len(samplingFrequencyTable) {
+		return c, ErrAAC
+	}
+	return c, nil
+}
+
+// @return 采样率，比如44100
+func (c AudioSpecificConfig) SamplingFrequency() int {
+	if int(c.SamplingFrequencyIndex) >= len(samplingFrequencyTable) {
+		return 0
+	}
+	return samplingFrequencyTable[c.SamplingFrequencyIndex]
+}
@@ -50,3 +50,32 @@ func TestCorner(t *testing.T) {
 	_, _, err = ParseAACSeqHeader(nil)
 	assert.IsNotNil(t, err)
 }
+
+func TestParseADTSHeader(t *testing.T) {
+	var adts ADTS
+	err := adts.InitWithAACAudioSpecificConfig(goldenSH[2:])
+	assert.Equal(t, nil, err)
+	header, err := adts.CalcADTSHeader(100)
+	assert.Equal(t, nil, err)
+
+	h, err := ParseADTSHeader(header)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 7, h.HeaderLength)
+	assert.Equal(t, 107, h.FrameLength)
+	assert.Equal(t, goldenSH[2:4], h.AudioSpecificConfig())
+
+	_, err = ParseADTSHeader(header[:6])
+	assert.IsNotNil(t, err)
+	_, err = ParseADTSHeader([]byte{0xff, 0xf1, 0x4c, 0x80, 0x00, 0x1f, 0xfc})
+	assert.IsNotNil(t, err)
+}
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	c, err := ParseAudioSpecificConfig(goldenSH[2:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, AudioSpecificConfig{AudioObjectType: 2, SamplingFrequencyIndex: 3, ChannelConfiguration: 2}, c)
+	assert.Equal(t, 48000, c.SamplingFrequency())
+
+	_, err = ParseAudioSpecificConfig([]byte{0x12})
+	assert.IsNotNil(t, err)
+}
@@ -332,3 +332,44 @@ func CaptureAVCC2AnnexB(w io.Writer, payload []byte) error {
 	}
 	return nil
 }
+
+// 遍历AnnexB格式的数据，每找到一个nalu（不包含start code）回调一次
+//
+// 支持3字节以及4字节的start code，<nals>不以start code开头时返回错误
+//
+func IterateNALUAnnexB(nals []byte, handler func(nal []byte)) error {
+	prev := -1 // 上一个nalu的起始位置
+	i := 0
+	for i+3 <= len(nals) {
+		if nals[i] == 0 && nals[i+1] == 0 && nals[i+2] == 1 {
+			if prev == -1 {
+				// 首个start code之前只允许出现0x00
+				for _, v := range nals[:i] {
+					if v != 0 {
+						return ErrAVC
+					}
+				}
+			}
+			if prev != -1 {
+				end := i
+				if end > prev && nals[end-1] == 0 {
+					end--
+				}
+				if end > prev {
+					handler(nals[prev:end])
+				}
+			}
+			i += 3
+			prev = i
+			continue
+		}
+		i++
+	}
+	if prev == -1 {
+		return ErrAVC
+	}
+	if prev < len(nals) {
+		handler(nals[prev:])
+	}
+	return nil
+}
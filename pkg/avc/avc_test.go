@@ -149,3 +149,21 @@ func TestParsePPS_Case2(t *testing.T) {
 	assert.Equal(t, uint32(1280), ctx.Width)
 	assert.Equal(t, uint32(960), ctx.Height)
 }
+
+func TestIterateNALUAnnexB(t *testing.T) {
+	var nals [][]byte
+	in := []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4, 5}
+	err := IterateNALUAnnexB(in, func(nal []byte) {
+		nals = append(nals, nal)
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(nals))
+	assert.Equal(t, []byte{0x67, 1, 2}, nals[0])
+	assert.Equal(t, []byte{0x68, 3}, nals[1])
+	assert.Equal(t, []byte{0x65, 4, 5}, nals[2])
+
+	err = IterateNALUAnnexB([]byte{0x65, 0, 0, 1, 0x41}, func(nal []byte) {})
+	assert.Equal(t, ErrAVC, err)
+	err = IterateNALUAnnexB([]byte{0x65, 1}, func(nal []byte) {})
+	assert.Equal(t, ErrAVC, err)
+}
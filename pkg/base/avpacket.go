@@ -24,4 +24,8 @@ type AVPacket struct {
 	Timestamp   uint32
 	PayloadType AVPacketPT
 	Payload     []byte
+
+	// 视频的PTS与DTS的差值，单位毫秒，对应rtmp/flv视频tag头中的CompositionTime
+	// 为0表示PTS等于DTS，目前只有remux.TS2AVPacket会填充
+	CompositionTime uint32
 }
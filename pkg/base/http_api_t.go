@@ -21,6 +21,10 @@ const (
 	DespParamMissing         = "param missing"
 	ErrorCodeSessionNotFound = 1003
 	DespSessionNotFound      = "session not found"
+	ErrorCodeStartFailed     = 1004
+	DespStartFailed          = "start failed"
+	ErrorCodeRecordNotFound  = 1005
+	DespRecordNotFound       = "record not found"
 )
 
 type HTTPResponseBasic struct {
@@ -66,3 +70,34 @@ type APICtrlKickOutSession struct {
 	StreamName string `json:"stream_name"`
 	SessionID  string `json:"session_id"`
 }
+
+type APICtrlStartUDPTSPushReq struct {
+	StreamName string `json:"stream_name"`
+	Addr       string `json:"addr"`
+	TTL        int    `json:"ttl"`
+	PCRPacing  bool   `json:"pcr_pacing"`
+}
+
+type APICtrlStopUDPTSPushReq struct {
+	StreamName string `json:"stream_name"`
+	Addr       string `json:"addr"`
+}
+
+// 录制中一段连续的时间，时间为Unix毫秒
+type RecordRange struct {
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Duration float64 `json:"duration"` // 单位秒
+}
+
+type RecordStream struct {
+	StreamName string        `json:"stream_name"`
+	Ranges     []RecordRange `json:"ranges"`
+}
+
+type APIRecordList struct {
+	HTTPResponseBasic
+	Data struct {
+		Streams []RecordStream `json:"streams"`
+	} `json:"data"`
+}
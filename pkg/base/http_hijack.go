@@ -0,0 +1,66 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpflv和httpts的session直接在连接上读取请求并写入数据，挂载到net/http上时，通过Hijack接管连接，
+// 并将已经被net/http解析的请求头还原到连接的数据之前，session依然可以按原始连接读取请求
+
+var ErrHTTPHijack = errors.New("lal.base: http response writer not support hijack")
+
+type hijackedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// 注意，HTTP/2不支持Hijack
+//
+// @return 读取时，先读到还原的请求头，再读到请求的body（如果有）以及后续数据
+func HijackHTTPConn(w http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, ErrHTTPHijack
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return &hijackedConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(PackHTTPRequestHeader(req)), brw.Reader),
+	}, nil
+}
+
+// 由net/http解析后的请求还原请求头，Host、Content-Length以及Transfer-Encoding不在req.Header中，需要单独写入
+func PackHTTPRequestHeader(req *http.Request) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI()))
+	buf.WriteString(fmt.Sprintf("Host: %s\r\n", req.Host))
+	if len(req.TransferEncoding) != 0 {
+		buf.WriteString(fmt.Sprintf("Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", ")))
+	} else if req.ContentLength > 0 {
+		buf.WriteString(fmt.Sprintf("Content-Length: %d\r\n", req.ContentLength))
+	}
+	_ = req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
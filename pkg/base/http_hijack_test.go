@@ -0,0 +1,63 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/nazahttp"
+)
+
+func TestHijackHTTPConn(t *testing.T) {
+	type result struct {
+		requestLine string
+		headers     map[string][]string
+		body        string
+	}
+	ch := make(chan result, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := HijackHTTPConn(w, req)
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+
+		// 与httpflv、httpts的session一样，按原始连接读取请求
+		r := bufio.NewReader(conn)
+		var res result
+		res.requestLine, res.headers, err = nazahttp.ReadHTTPHeader(r)
+		assert.Equal(t, nil, err)
+		body, err := ioutil.ReadAll(NewHTTPBodyReader(r, res.headers))
+		assert.Equal(t, nil, err)
+		res.body = string(body)
+		ch <- res
+		_, _ = conn.Write(PackHTTPPubResponse(http.StatusOK, "test"))
+	}))
+	defer srv.Close()
+
+	// body长度未知，使用chunked
+	req, err := http.NewRequest("POST", srv.URL+"/live/test.flv?token=abc", ioutil.NopCloser(strings.NewReader("flvdata")))
+	assert.Equal(t, nil, err)
+	req.Header.Set("X-Test", "1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	res := <-ch
+	assert.Equal(t, "POST /live/test.flv?token=abc HTTP/1.1", res.requestLine)
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), GetHTTPHeader(res.headers, "Host"))
+	assert.Equal(t, "chunked", GetHTTPHeader(res.headers, "Transfer-Encoding"))
+	assert.Equal(t, "1", GetHTTPHeader(res.headers, "X-Test"))
+	assert.Equal(t, "flvdata", res.body)
+}
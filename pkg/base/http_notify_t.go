@@ -54,3 +54,55 @@ type RTMPConnectInfo struct {
 	FlashVer   string `json:"flashVer"`
 	TCURL      string `json:"tcUrl"`
 }
+
+// HLS录制的切片被清理，时间为Unix毫秒
+type HLSPurgeInfo struct {
+	ServerID   string   `json:"server_id"`
+	AppName    string   `json:"app_name"`
+	StreamName string   `json:"stream_name"`
+	Reason     string   `json:"reason"` // "max_age"或者"quota"
+	Files      []string `json:"files"`
+	Bytes      int64    `json:"bytes"`
+	Start      int64    `json:"start"` // 被清理的切片中，最早的切片的开始时间
+	End        int64    `json:"end"`   // 被清理的切片中，最晚的切片的结束时间
+}
+
+// HLS文件上传到对象存储失败
+type HLSUploadFailInfo struct {
+	ServerID   string `json:"server_id"`
+	StreamName string `json:"stream_name"`
+	Filename   string `json:"filename"`
+	ObjectKey  string `json:"object_key"`
+	Reason     string `json:"reason"` // "queue_full"或者"error"
+	Error      string `json:"error"`
+}
+
+// HLS切片开始写入以及写入完成，时间为Unix毫秒
+type HLSMakeTSInfo struct {
+	ServerID       string  `json:"server_id"`
+	Event          string  `json:"event"` // "open"或者"close"
+	AppName        string  `json:"app_name"`
+	StreamName     string  `json:"stream_name"`
+	TSFile         string  `json:"ts_file"` // 切片文件的路径，byte range时为多个切片共用的文件
+	LiveM3U8File   string  `json:"live_m3u8_file"`
+	RecordM3U8File string  `json:"record_m3u8_file"`
+	ID             int     `json:"id"`       // 切片序号，与m3u8中的media sequence对应
+	Duration       float64 `json:"duration"` // 单位秒，open时为0
+	Discont        bool    `json:"discont"`  // 切片前是否有`#EXT-X-DISCONTINUITY`
+	Time           int64   `json:"time"`     // 切片开始时对应的本地时间
+	Offset         int64   `json:"offset"`   // byte range时，切片在文件中的位置
+	Length         int64   `json:"length"`   // byte range时，切片的长度，否则为0
+}
+
+// HLS的m3u8文件更新，时间为Unix毫秒
+type HLSMakeM3U8Info struct {
+	ServerID      string `json:"server_id"`
+	AppName       string `json:"app_name"`
+	StreamName    string `json:"stream_name"`
+	Type          string `json:"type"` // "live"或者"record"
+	M3U8File      string `json:"m3u8_file"`
+	MediaSequence int    `json:"media_sequence"` // m3u8中第一个切片的序号
+	LastID        int    `json:"last_id"`        // m3u8中最后一个切片的序号
+	IsLast        bool   `json:"is_last"`        // 是否写入了`#EXT-X-ENDLIST`
+	Time          int64  `json:"time"`           // 更新时的本地时间
+}
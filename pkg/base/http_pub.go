@@ -0,0 +1,87 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// httpflv和httpts推流（POST或PUT）共用的一些http辅助函数
+
+// 用于先读取连接的前几个字节判断请求类型，再将连接交给对应的session处理
+// Peek过的数据不会丢失，后续Read时依然可以读到
+type PeekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewPeekConn(conn net.Conn) *PeekConn {
+	return &PeekConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *PeekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// 判断是否为推流的http请求，也即method为POST或PUT
+//
+// @param b 请求的前几个字节，至少5字节
+func IsHTTPPublishRequest(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("POST ")) || bytes.HasPrefix(b, []byte("PUT "))
+}
+
+// 获取http header的值，key大小写不敏感，不存在时返回空字符串
+func GetHTTPHeader(headers map[string][]string, key string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// 根据请求头，返回读取http body的reader
+// 支持chunked、Content-Length，都没有时读取到连接关闭
+//
+// @param r 已经读取完请求头的连接
+func NewHTTPBodyReader(r io.Reader, headers map[string][]string) io.Reader {
+	if strings.EqualFold(GetHTTPHeader(headers, "Transfer-Encoding"), "chunked") {
+		return httputil.NewChunkedReader(r)
+	}
+	if cl := GetHTTPHeader(headers, "Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			return io.LimitReader(r, n)
+		}
+	}
+	return r
+}
+
+// 推流请求的回复，不带body
+func PackHTTPPubResponse(statusCode int, server string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n"+
+		"Server: %s\r\n"+
+		"Content-Length: 0\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", statusCode, http.StatusText(statusCode), server))
+}
@@ -19,6 +19,7 @@ const (
 	RTMPTypeIDUserControl        uint8 = 4
 	RTMPTypeIDWinAckSize         uint8 = 5
 	RTMPTypeIDBandwidth          uint8 = 6
+	RTMPTypeIDDataMessageAMF3    uint8 = 15
 	RTMPTypeIDCommandMessageAMF3 uint8 = 17
 	RTMPTypeIDCommandMessageAMF0 uint8 = 20
 
@@ -21,6 +21,8 @@ const (
 	ProtocolRTSP    = "RTSP"
 	ProtocolHTTPFLV = "HTTP-FLV"
 	ProtocolHTTPTS  = "HTTP-TS"
+	ProtocolUDPTS   = "UDP-TS"
+	ProtocolHLS     = "HLS"
 )
 
 type StatGroup struct {
@@ -32,6 +34,13 @@ type StatGroup struct {
 	StatPub     StatPub   `json:"pub"`
 	StatSubs    []StatSub `json:"subs"`
 	StatPull    StatPull  `json:"pull"`
+
+	VideoCodecRFC6381 string `json:"video_codec_rfc6381,omitempty"` // 比如`avc1.64001f`，用于ABR的master m3u8中的CODECS
+	AudioCodecRFC6381 string `json:"audio_codec_rfc6381,omitempty"` // 比如`mp4a.40.2`
+
+	PubBitratePeak int `json:"pub_bitrate_peak,omitempty"` // 推流码率（每5秒统计一次）的最大值，单位kbit/s，用于ABR的master m3u8中的BANDWIDTH
+
+	HLSUpload *StatHLSUpload `json:"hls_upload,omitempty"` // 开启了HLS上传到对象存储时不为nil
 }
 
 type StatPub struct {
@@ -96,3 +105,13 @@ func StatSession2Pull(ss StatSession) (ret StatPull) {
 	ret.Bitrate = ss.Bitrate
 	return
 }
+
+// HLS上传到对象存储的统计
+type StatHLSUpload struct {
+	SuccNum        uint64 `json:"succ_num"`
+	FailNum        uint64 `json:"fail_num"`  // 重试后依然失败的数量
+	RetryNum       uint64 `json:"retry_num"` // 重试的次数
+	DropNum        uint64 `json:"drop_num"`  // 上传队列满时丢弃的数量
+	UploadBytesSum uint64 `json:"upload_bytes_sum"`
+	LastError      string `json:"last_error"`
+}
@@ -22,10 +22,17 @@ const (
 	UKPFLVSubSession            = "FLVSUB"
 	UKPTSSubSession             = "TSSUB"
 	UKPFLVPullSession           = "FLVPULL"
+	UKPFLVPubSession            = "FLVPUB"
+	UKPTSPubSession             = "TSPUB"
+	UKPUDPTSPubSession          = "UDPTSPUB"
+	UKPUDPTSPushSession         = "UDPTSPUSH"
+	UKPHLSPullSession           = "HLSPULL"
+	UKPHLSSubSession            = "HLSSUB"
 
-	UKPGroup    = "GROUP"
-	UKPHLSMuxer = "HLSMUXER"
-	UKPStreamer = "STREAMER"
+	UKPGroup     = "GROUP"
+	UKPHLSMuxer  = "HLSMUXER"
+	UKPDASHMuxer = "DASHMUXER"
+	UKPStreamer  = "STREAMER"
 )
 
 func GenUniqueKey(prefix string) string {
@@ -25,6 +25,7 @@ var ErrURL = errors.New("lal.url: fxxk")
 
 const (
 	DefaultRTMPPort  = 1935
+	DefaultRTMPSPort = 443
 	DefaultHTTPPort  = 80
 	DefaultHTTPSPort = 443
 	DefaultRTSPPort  = 554
@@ -113,12 +114,17 @@ func ParseURL(rawURL string, defaultPort int) (ctx URLContext, err error) {
 	return ctx, nil
 }
 
+// 支持rtmp以及rtmps（RTMP over TLS）两种scheme，rtmps的默认端口为443
 func ParseRTMPURL(rawURL string) (ctx URLContext, err error) {
-	ctx, err = ParseURL(rawURL, DefaultRTMPPort)
+	defaultPort := DefaultRTMPPort
+	if strings.HasPrefix(rawURL, "rtmps://") {
+		defaultPort = DefaultRTMPSPort
+	}
+	ctx, err = ParseURL(rawURL, defaultPort)
 	if err != nil {
 		return
 	}
-	if ctx.Scheme != "rtmp" || ctx.Host == "" || ctx.Path == "" {
+	if (ctx.Scheme != "rtmp" && ctx.Scheme != "rtmps") || ctx.Host == "" || ctx.Path == "" {
 		return ctx, ErrURL
 	}
 
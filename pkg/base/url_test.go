@@ -203,12 +203,29 @@ func TestParseRTMPURL(t *testing.T) {
 			RawQuery:              "",
 			RawURLWithoutUserInfo: "rtmp://127.0.0.1/test110",
 		},
+		"rtmps://live-api-s.facebook.com/rtmp/abc": {
+			URL:                   "rtmps://live-api-s.facebook.com/rtmp/abc",
+			Scheme:                "rtmps",
+			StdHost:               "live-api-s.facebook.com",
+			HostWithPort:          "live-api-s.facebook.com:443",
+			Host:                  "live-api-s.facebook.com",
+			Port:                  443,
+			PathWithRawQuery:      "/rtmp/abc",
+			Path:                  "/rtmp/abc",
+			PathWithoutLastItem:   "rtmp",
+			LastItemOfPath:        "abc",
+			RawQuery:              "",
+			RawURLWithoutUserInfo: "rtmps://live-api-s.facebook.com/rtmp/abc",
+		},
 	}
 	for k, v := range golden {
 		ctx, err := ParseRTMPURL(k)
 		assert.Equal(t, nil, err)
 		assert.Equal(t, v, ctx, k)
 	}
+
+	_, err := ParseRTMPURL("http://127.0.0.1/live/test110")
+	assert.Equal(t, ErrURL, err)
 }
 
 func TestParseRTSPURL(t *testing.T) {
@@ -62,6 +62,9 @@ var (
 	// e.g. lal0.12.3
 	LALHLSTSServer string
 
+	// e.g. lal0.12.3
+	LALDASHServer string
+
 	// e.g. lal0.12.3
 	LALRTSPOptionsResponseServer string
 
@@ -116,6 +119,7 @@ func init() {
 	LALHTTPFLVSubSessionServer = LALLibraryName + LALVersionDot
 	LALHLSM3U8Server = LALLibraryName + LALVersionDot
 	LALHLSTSServer = LALLibraryName + LALVersionDot
+	LALDASHServer = LALLibraryName + LALVersionDot
 	LALRTSPOptionsResponseServer = LALLibraryName + LALVersionDot
 	LALHTTPTSSubSessionServer = LALLibraryName + LALVersionDot
 	LALHTTPAPIServer = LALLibraryName + LALVersionDot
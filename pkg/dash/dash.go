@@ -0,0 +1,44 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package dash
+
+import (
+	"errors"
+)
+
+// MPEG-DASH直播输出
+//
+// ISO_IEC_23009-1 Dynamic adaptive streaming over HTTP (DASH)
+// https://dashif.org/guidelines/
+//
+// 每路流的输出目录下：
+// manifest.mpd          // type="dynamic"，SegmentTemplate + SegmentTimeline，流结束后改为type="static"
+// video-init.mp4        // 视频初始化分片
+// video-<time>.m4s      // 视频媒体分片，time为分片起始时间，单位为timescale
+// audio-init.mp4
+// audio-<time>.m4s
+//
+// 音频和视频分别为一个AdaptationSet，分片文件使用pkg/fmp4生成
+// 移出mpd的分片文件，再保留FragmentNum个分片后删除
+
+var ErrDASH = errors.New("lal.dash: fxxk")
+
+type MuxerConfig struct {
+	Enable             bool   `json:"enable"`   // 如果false，则不生成dash文件
+	OutPath            string `json:"out_path"` // mpd和分片文件的输出根目录，注意，末尾需已'/'结束
+	FragmentDurationMS int    `json:"fragment_duration_ms"`
+	FragmentNum        int    `json:"fragment_num"` // mpd中每个track列出的分片数量
+}
+
+const (
+	mpdFilename = "manifest.mpd"
+
+	representationIDVideo = "video"
+	representationIDAudio = "audio"
+)
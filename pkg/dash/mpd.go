@@ -0,0 +1,159 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// 生成的mpd示例：
+//
+// <?xml version="1.0" encoding="utf-8"?>
+// <MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic" ...>
+//   <Period id="0" start="PT0S">
+//     <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">
+//       <Representation id="video" bandwidth="1200000" codecs="avc1.64001f" width="1280" height="720">
+//         <SegmentTemplate timescale="90000" presentationTimeOffset="0" initialization="$RepresentationID$-init.mp4" media="$RepresentationID$-$Time$.m4s">
+//           <SegmentTimeline>
+//             <S t="0" d="360000"/>
+//           </SegmentTimeline>
+//         </SegmentTemplate>
+//       </Representation>
+//     </AdaptationSet>
+//     <AdaptationSet id="1" contentType="audio" ...>
+//   </Period>
+// </MPD>
+
+const (
+	// 播放器距离直播最新位置的建议延时，为分片时长的倍数
+	presentationDelayNum = 3
+
+	mpdTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// @param isLast 流结束时，type改为static，去掉minimumUpdatePeriod等直播相关的属性，并写入mediaPresentationDuration，播放器不再更新mpd
+//
+func (m *Muxer) writeMPD(isLast bool) {
+	content := m.genMPD(isLast, time.Now())
+	if err := writeFileAtomic(content, m.mpdFilename); err != nil {
+		m.Log().Error("[%s] write mpd file error. err=%+v", m.UniqueKey, err)
+	}
+}
+
+func (m *Muxer) genMPD(isLast bool, now time.Time) []byte {
+	fragDuration := float64(m.config.FragmentDurationMS) / 1000
+
+	// 找出时长最长的分片
+	maxSegDuration := fragDuration
+	for _, tc := range []*trackContext{m.video, m.audio} {
+		if tc == nil || tc.track == nil {
+			continue
+		}
+		for _, seg := range tc.segments {
+			if d := float64(seg.d) / float64(tc.track.Timescale); d > maxSegDuration {
+				maxSegDuration = d
+			}
+		}
+	}
+
+	mpdType := "dynamic"
+	if isLast {
+		mpdType = "static"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	buf.WriteString(fmt.Sprintf("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"%s\"", mpdType))
+	buf.WriteString(fmt.Sprintf(" availabilityStartTime=\"%s\"", m.startTime.UTC().Format(mpdTimeFormat)))
+	buf.WriteString(fmt.Sprintf(" publishTime=\"%s\"", now.UTC().Format(mpdTimeFormat)))
+	if isLast {
+		buf.WriteString(fmt.Sprintf(" mediaPresentationDuration=\"PT%.3fS\"", m.windowDuration()))
+	} else {
+		buf.WriteString(fmt.Sprintf(" minimumUpdatePeriod=\"PT%.3fS\"", fragDuration))
+	}
+	buf.WriteString(fmt.Sprintf(" minBufferTime=\"PT%.3fS\"", fragDuration))
+	buf.WriteString(fmt.Sprintf(" maxSegmentDuration=\"PT%.3fS\"", maxSegDuration))
+	if !isLast {
+		buf.WriteString(fmt.Sprintf(" timeShiftBufferDepth=\"PT%.3fS\"", maxSegDuration*float64(m.config.FragmentNum)))
+		buf.WriteString(fmt.Sprintf(" suggestedPresentationDelay=\"PT%.3fS\"", fragDuration*presentationDelayNum))
+	}
+	buf.WriteString(">\n")
+	buf.WriteString("  <Period id=\"0\" start=\"PT0S\">\n")
+
+	if m.video != nil && m.video.track != nil {
+		tc := m.video
+		buf.WriteString("    <AdaptationSet id=\"0\" contentType=\"video\" mimeType=\"video/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n")
+		buf.WriteString(fmt.Sprintf("      <Representation id=\"%s\" bandwidth=\"%d\" codecs=\"%s\"", tc.id, bandwidth(tc), tc.track.Codec()))
+		if tc.track.Width != 0 && tc.track.Height != 0 {
+			buf.WriteString(fmt.Sprintf(" width=\"%d\" height=\"%d\"", tc.track.Width, tc.track.Height))
+		}
+		buf.WriteString(">\n")
+		m.writeSegmentTemplate(&buf, tc, isLast)
+		buf.WriteString("      </Representation>\n")
+		buf.WriteString("    </AdaptationSet>\n")
+	}
+
+	if m.audio != nil && m.audio.track != nil {
+		tc := m.audio
+		buf.WriteString("    <AdaptationSet id=\"1\" contentType=\"audio\" mimeType=\"audio/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n")
+		buf.WriteString(fmt.Sprintf("      <Representation id=\"%s\" bandwidth=\"%d\" codecs=\"%s\" audioSamplingRate=\"%d\">\n",
+			tc.id, bandwidth(tc), tc.track.Codec(), tc.track.Timescale))
+		buf.WriteString(fmt.Sprintf("        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n",
+			tc.track.ChannelCount))
+		m.writeSegmentTemplate(&buf, tc, isLast)
+		buf.WriteString("      </Representation>\n")
+		buf.WriteString("    </AdaptationSet>\n")
+	}
+
+	buf.WriteString("  </Period>\n")
+	buf.WriteString("</MPD>\n")
+	return buf.Bytes()
+}
+
+func (m *Muxer) writeSegmentTemplate(buf *bytes.Buffer, tc *trackContext, isLast bool) {
+	// 第一个分片的起始时间对应Period的起始位置
+	// 流结束后只能播放mpd中列出的分片，此时以列出的第一个分片作为起始位置
+	pto := uint64(m.baseTS) * uint64(tc.track.Timescale) / 1000
+	if isLast && len(tc.segments) != 0 {
+		pto = tc.segments[0].t
+	}
+	buf.WriteString(fmt.Sprintf("        <SegmentTemplate timescale=\"%d\" presentationTimeOffset=\"%d\" initialization=\"$RepresentationID$-init.mp4\" media=\"$RepresentationID$-$Time$.m4s\">\n",
+		tc.track.Timescale, pto))
+	buf.WriteString("          <SegmentTimeline>\n")
+	for _, seg := range tc.segments {
+		buf.WriteString(fmt.Sprintf("            <S t=\"%d\" d=\"%d\"/>\n", seg.t, seg.d))
+	}
+	buf.WriteString("          </SegmentTimeline>\n")
+	buf.WriteString("        </SegmentTemplate>\n")
+}
+
+// @return mpd中列出的分片的总时长，各track取最大值，单位秒
+func (m *Muxer) windowDuration() float64 {
+	var duration float64
+	for _, tc := range []*trackContext{m.video, m.audio} {
+		if tc == nil || tc.track == nil || len(tc.segments) == 0 {
+			continue
+		}
+		first, last := tc.segments[0], tc.segments[len(tc.segments)-1]
+		if d := float64(last.t+last.d-first.t) / float64(tc.track.Timescale); d > duration {
+			duration = d
+		}
+	}
+	return duration
+}
+
+// 还没有生成分片时，bandwidth为必填项，随便给个值
+func bandwidth(tc *trackContext) int {
+	if tc.bandwidth <= 0 {
+		return 1
+	}
+	return tc.bandwidth
+}
@@ -0,0 +1,437 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/avc"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/fmp4"
+	"github.com/souliot/siot-av/pkg/hevc"
+)
+
+const (
+	// AAC每帧的采样数
+	aacSamplesPerFrame = 1024
+
+	videoTrackID = 1
+	audioTrackID = 2
+)
+
+type Muxer struct {
+	UniqueKey string
+
+	streamName  string // const after init
+	outPath     string // const after init
+	mpdFilename string // const after init
+
+	config *MuxerConfig
+
+	videoPT     base.AVPacketPT
+	videoConfig []byte
+	width       int
+	height      int
+	audioConfig []byte
+
+	video       *trackContext
+	audio       *trackContext
+	initWritten bool
+	sequence    uint32
+
+	opened     bool
+	segStartTS uint32    // 当前分片的起始时间戳，单位毫秒
+	lastTS     uint32    // 最后一帧的时间戳，单位毫秒
+	baseTS     uint32    // 第一个分片的起始时间戳，对应Period的起始位置
+	startTime  time.Time // 第一个分片开始时的系统时间，写入mpd的availabilityStartTime
+
+	log log.Logger
+}
+
+type trackContext struct {
+	track  *fmp4.Track
+	id     string // RepresentationID
+	frames []frame
+
+	// 音频的dts使用帧数累加，保证SegmentTimeline连续，单位为timescale
+	nextDTS uint64
+
+	segments  []segmentInfo // mpd中列出的分片，最多FragmentNum个
+	expired   []segmentInfo // 移出mpd但还没有删除文件的分片，最多FragmentNum个
+	bandwidth int           // 最近一个分片的码率，单位bit/s
+}
+
+type frame struct {
+	ts   uint32 // dts，单位毫秒
+	cts  uint32 // pts - dts，单位毫秒
+	key  bool
+	data []byte
+}
+
+type segmentInfo struct {
+	t uint64 // 起始时间，单位为timescale
+	d uint64 // 时长，单位为timescale
+}
+
+func NewMuxer(streamName string, config *MuxerConfig, logger log.Logger) *Muxer {
+	uk := base.GenUniqueKey(base.UKPDASHMuxer)
+	op := getMuxerOutPath(config.OutPath, streamName)
+	m := &Muxer{
+		UniqueKey:   uk,
+		streamName:  streamName,
+		outPath:     op,
+		mpdFilename: op + mpdFilename,
+		config:      config,
+		log:         logger,
+	}
+	m.Log().Info("[%s] lifecycle new dash muxer. muxer=%p, streamName=%s", uk, m, streamName)
+	return m
+}
+
+func (m *Muxer) Log() log.Logger {
+	if m.log == nil {
+		m.log = log.DefaultBeeLogger
+	}
+	m.log.WithPrefix("pkg.dash.muxer")
+	return m.log
+}
+
+func (m *Muxer) Start() {
+	m.Log().Info("[%s] start dash muxer.", m.UniqueKey)
+	if !m.config.Enable {
+		return
+	}
+	if err := os.MkdirAll(m.outPath, 0777); err != nil {
+		m.Log().Error(err)
+	}
+}
+
+func (m *Muxer) Dispose() {
+	m.Log().Info("[%s] lifecycle dispose dash muxer.", m.UniqueKey)
+	m.closeSegment(m.lastTS, true)
+}
+
+func (m *Muxer) OutPath() string {
+	return m.outPath
+}
+
+// @param msg 函数调用结束后，内部不持有msg中的内存块
+//
+func (m *Muxer) FeedRTMPMessage(msg base.RTMPMsg) {
+	if !m.config.Enable {
+		return
+	}
+	switch msg.Header.MsgTypeID {
+	case base.RTMPTypeIDAudio:
+		m.feedAudio(msg)
+	case base.RTMPTypeIDVideo:
+		m.feedVideo(msg)
+	}
+}
+
+func (m *Muxer) feedVideo(msg base.RTMPMsg) {
+	if len(msg.Payload) < 5 {
+		return
+	}
+	var pt base.AVPacketPT
+	switch msg.Payload[0] & 0xF {
+	case base.RTMPCodecIDAVC:
+		pt = base.AVPacketPTAVC
+	case base.RTMPCodecIDHEVC:
+		pt = base.AVPacketPTHEVC
+	default:
+		return
+	}
+	key := msg.Payload[0]>>4 == base.RTMPFrameTypeKey
+
+	if key && msg.Payload[1] == base.RTMPAVCPacketTypeSeqHeader {
+		if m.initWritten {
+			// 分片已经引用了初始化分片，不再更新
+			if !bytes.Equal(msg.Payload[5:], m.videoConfig) {
+				m.Log().Warn("[%s] video seq header changed after init segment written, ignore.", m.UniqueKey)
+			}
+			return
+		}
+		m.videoPT = pt
+		m.videoConfig = append([]byte(nil), msg.Payload[5:]...)
+		m.width, m.height = parseVideoSize(pt, msg.Payload)
+		if m.video == nil {
+			m.video = &trackContext{id: representationIDVideo}
+		}
+		return
+	}
+	if m.videoConfig == nil || pt != m.videoPT {
+		return
+	}
+
+	ts := msg.Header.TimestampAbs
+	if !m.opened {
+		if !key {
+			return
+		}
+		m.openSegment(ts)
+	} else if key && ts >= m.segStartTS && ts-m.segStartTS >= uint32(m.config.FragmentDurationMS) {
+		m.closeSegment(ts, false)
+		m.openSegment(ts)
+	}
+	m.video.frames = append(m.video.frames, frame{
+		ts:   ts,
+		cts:  bele.BEUint24(msg.Payload[2:]),
+		key:  key,
+		data: append([]byte(nil), msg.Payload[5:]...),
+	})
+	m.lastTS = ts
+}
+
+func (m *Muxer) feedAudio(msg base.RTMPMsg) {
+	if len(msg.Payload) < 3 || msg.Payload[0]>>4 != base.RTMPSoundFormatAAC {
+		return
+	}
+
+	if msg.Payload[1] == base.RTMPAACPacketTypeSeqHeader {
+		if !m.initWritten {
+			m.audioConfig = append([]byte(nil), msg.Payload[2:]...)
+			if m.audio == nil {
+				m.audio = &trackContext{id: representationIDAudio}
+			}
+		}
+		return
+	}
+	if m.audioConfig == nil {
+		return
+	}
+
+	ts := msg.Header.TimestampAbs
+	if m.videoConfig == nil {
+		// 只有音频
+		if !m.opened {
+			m.openSegment(ts)
+		} else if ts >= m.segStartTS && ts-m.segStartTS >= uint32(m.config.FragmentDurationMS) {
+			m.closeSegment(ts, false)
+			m.openSegment(ts)
+		}
+	} else if !m.opened {
+		// 有视频时，从视频关键帧开始切片
+		return
+	}
+	m.audio.frames = append(m.audio.frames, frame{
+		ts:   ts,
+		data: append([]byte(nil), msg.Payload[2:]...),
+	})
+	if ts > m.lastTS {
+		m.lastTS = ts
+	}
+}
+
+func (m *Muxer) openSegment(ts uint32) {
+	if !m.initWritten && m.startTime.IsZero() {
+		m.startTime = time.Now()
+		m.baseTS = ts
+	}
+	m.opened = true
+	m.segStartTS = ts
+}
+
+// @param endTS 当前分片的结束时间戳，也即下一个分片的起始时间戳，单位毫秒
+//
+func (m *Muxer) closeSegment(endTS uint32, isLast bool) {
+	if !m.opened {
+		return
+	}
+	m.opened = false
+
+	if !m.initWritten {
+		if err := m.writeInit(); err != nil {
+			m.Log().Error("[%s] write init segment error. err=%+v", m.UniqueKey, err)
+			m.clearFrames()
+			return
+		}
+	}
+
+	m.sequence++
+	if m.video != nil && m.video.track != nil && len(m.video.frames) != 0 {
+		m.writeSegment(m.video, genVideoTrackFragment(m.video.track, m.video.frames, endTS))
+	}
+	if m.audio != nil && m.audio.track != nil && len(m.audio.frames) != 0 {
+		m.writeSegment(m.audio, m.genAudioTrackFragment())
+	}
+	m.clearFrames()
+
+	m.writeMPD(isLast)
+}
+
+func (m *Muxer) writeSegment(tc *trackContext, f fmp4.TrackFragment) {
+	var d uint64
+	for _, s := range f.Samples {
+		d += uint64(s.Duration)
+	}
+	content := fmp4.GenMediaSegment(m.sequence, []fmp4.TrackFragment{f})
+	filename := getSegmentFilename(m.outPath, tc.id, f.BaseDecodeTime)
+	if err := writeFileAtomic(content, filename); err != nil {
+		m.Log().Error("[%s] write dash segment error. err=%+v", m.UniqueKey, err)
+		return
+	}
+
+	if d != 0 {
+		tc.bandwidth = int(uint64(len(content)) * 8 * uint64(tc.track.Timescale) / d)
+	}
+	tc.segments = append(tc.segments, segmentInfo{t: f.BaseDecodeTime, d: d})
+	// 和hls相同，只保留窗口内的分片信息
+	if len(tc.segments) > m.config.FragmentNum {
+		n := len(tc.segments) - m.config.FragmentNum
+		tc.expired = append(tc.expired, tc.segments[:n]...)
+		tc.segments = tc.segments[n:]
+	}
+	// 移出窗口的分片文件延迟删除，播放者可能还在使用较旧的mpd下载
+	for len(tc.expired) > m.config.FragmentNum {
+		filename := getSegmentFilename(m.outPath, tc.id, tc.expired[0].t)
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			m.Log().Warn("[%s] remove dash segment error. err=%+v", m.UniqueKey, err)
+		}
+		tc.expired = tc.expired[1:]
+	}
+}
+
+func (m *Muxer) writeInit() error {
+	if m.video != nil {
+		track, err := fmp4.NewVideoTrack(videoTrackID, m.videoPT, m.videoConfig, m.width, m.height)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(fmp4.GenInitSegment([]*fmp4.Track{track}), getInitFilename(m.outPath, m.video.id)); err != nil {
+			return err
+		}
+		m.video.track = track
+	}
+	if m.audio != nil {
+		track, err := fmp4.NewAudioTrack(audioTrackID, m.audioConfig)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(fmp4.GenInitSegment([]*fmp4.Track{track}), getInitFilename(m.outPath, m.audio.id)); err != nil {
+			return err
+		}
+		m.audio.track = track
+	}
+	m.initWritten = true
+	return nil
+}
+
+func (m *Muxer) clearFrames() {
+	if m.video != nil {
+		m.video.frames = nil
+	}
+	if m.audio != nil {
+		m.audio.frames = nil
+	}
+}
+
+func (m *Muxer) genAudioTrackFragment() fmp4.TrackFragment {
+	tc := m.audio
+	timescale := uint64(tc.track.Timescale)
+
+	// 音频时间戳和累加的dts相差超过1秒时（比如时间戳跳跃），重新对齐
+	dts := uint64(tc.frames[0].ts) * timescale / 1000
+	if tc.nextDTS == 0 || tc.nextDTS > dts+timescale || dts > tc.nextDTS+timescale {
+		tc.nextDTS = dts
+	}
+
+	f := fmp4.TrackFragment{
+		Track:          tc.track,
+		BaseDecodeTime: tc.nextDTS,
+	}
+	for _, frame := range tc.frames {
+		f.Samples = append(f.Samples, fmp4.Sample{
+			Duration: aacSamplesPerFrame,
+			Data:     frame.data,
+		})
+	}
+	tc.nextDTS += uint64(len(tc.frames)) * aacSamplesPerFrame
+	return f
+}
+
+func genVideoTrackFragment(track *fmp4.Track, frames []frame, endTS uint32) fmp4.TrackFragment {
+	f := fmp4.TrackFragment{
+		Track:          track,
+		BaseDecodeTime: uint64(frames[0].ts) * 90,
+	}
+	var duration uint32
+	for i, frame := range frames {
+		next := endTS
+		if i+1 < len(frames) {
+			next = frames[i+1].ts
+		}
+		// 最后一帧没有结束时间时，沿用上一帧的时长
+		if next > frame.ts {
+			duration = (next - frame.ts) * 90
+		}
+		f.Samples = append(f.Samples, fmp4.Sample{
+			Duration:  duration,
+			CTSOffset: int32(frame.cts * 90),
+			Key:       frame.key,
+			Data:      frame.data,
+		})
+	}
+	return f
+}
+
+// 解析视频宽高，失败时返回0，不影响切片
+func parseVideoSize(pt base.AVPacketPT, seqHeader []byte) (width, height int) {
+	if pt == base.AVPacketPTAVC {
+		sps, _, err := avc.ParseSPSPPSFromSeqHeader(seqHeader)
+		if err != nil {
+			return
+		}
+		var ctx avc.Context
+		_ = avc.ParseSPS(sps, &ctx)
+		return int(ctx.Width), int(ctx.Height)
+	}
+
+	_, sps, _, err := hevc.ParseVPSSPSPPSFromSeqHeader(seqHeader)
+	if err != nil {
+		return
+	}
+	var ctx hevc.Context
+	_ = hevc.ParseSPS(sps, &ctx)
+	return int(ctx.PicWidthInLumaSamples), int(ctx.PicHeightInLumaSamples)
+}
+
+func getMuxerOutPath(rootOutPath string, streamName string) string {
+	return fmt.Sprintf("%s%s/", rootOutPath, streamName)
+}
+
+func getInitFilename(outPath string, representationID string) string {
+	return fmt.Sprintf("%s%s-init.mp4", outPath, representationID)
+}
+
+func getSegmentFilename(outPath string, representationID string, t uint64) string {
+	return fmt.Sprintf("%s%s-%d.m4s", outPath, representationID, t)
+}
+
+// 先写临时文件再改名，避免读到不完整的文件
+func writeFileAtomic(content []byte, filename string) error {
+	bak := filename + ".bak"
+	fp, err := os.Create(bak)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(content); err != nil {
+		_ = fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(bak, filename)
+}
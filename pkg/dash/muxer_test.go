@@ -0,0 +1,138 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package dash
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+var (
+	testAVCSeqHeader = []byte{
+		0x17, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x1a,
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00,
+		0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+		0x01, 0x00, 0x06, 0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0,
+	}
+	testAACSeqHeader = []byte{0xaf, 0x00, 0x12, 0x10}
+)
+
+func feedMuxer(m *Muxer, typeID uint8, ts uint32, payload []byte) {
+	m.FeedRTMPMessage(base.RTMPMsg{
+		Header: base.RTMPHeader{
+			MsgTypeID:    typeID,
+			MsgLen:       uint32(len(payload)),
+			TimestampAbs: ts,
+		},
+		Payload: payload,
+	})
+}
+
+func TestMuxer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dash")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+	}
+	m := NewMuxer("test", config, log.DefaultBeeLogger)
+	m.Start()
+
+	feedMuxer(m, base.RTMPTypeIDVideo, 1000, testAVCSeqHeader)
+	feedMuxer(m, base.RTMPTypeIDAudio, 1000, testAACSeqHeader)
+	// 每40毫秒一帧视频，每秒一个关键帧，44100采样率的音频每帧约23毫秒，音频和视频交错
+	var audioIndex int
+	for i := 0; i < 110; i++ {
+		frameType := base.RTMPAVCInterFrame
+		if i%25 == 0 {
+			frameType = base.RTMPAVCKeyFrame
+		}
+		ts := uint32(1000 + i*40)
+		feedMuxer(m, base.RTMPTypeIDVideo, ts, []byte{frameType, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x65, byte(i)})
+		for {
+			audioTS := uint32(1000 + audioIndex*1024*1000/44100)
+			if audioTS >= ts+40 {
+				break
+			}
+			feedMuxer(m, base.RTMPTypeIDAudio, audioTS, []byte{0xaf, 0x01, 0x21, 0x00})
+			audioIndex++
+		}
+	}
+
+	content, err := ioutil.ReadFile(m.mpdFilename)
+	assert.Equal(t, nil, err)
+	mpd := string(content)
+	assert.Equal(t, true, strings.Contains(mpd, `type="dynamic"`))
+	assert.Equal(t, true, strings.Contains(mpd, `minimumUpdatePeriod="PT1.000S"`))
+	assert.Equal(t, true, strings.Contains(mpd, `codecs="avc1.64001f" width="1280" height="720"`))
+	assert.Equal(t, true, strings.Contains(mpd, `codecs="mp4a.40.2" audioSamplingRate="44100"`))
+	assert.Equal(t, true, strings.Contains(mpd, `timescale="90000" presentationTimeOffset="90000"`))
+	// 已经生成4个视频分片，mpd中只保留最近的2个
+	assert.Equal(t, 2, len(m.video.segments))
+	assert.Equal(t, true, strings.Contains(mpd, `<S t="270000" d="90000"/>`))
+	assert.Equal(t, true, strings.Contains(mpd, `<S t="360000" d="90000"/>`))
+	assert.Equal(t, false, strings.Contains(mpd, `<S t="180000"`))
+
+	// 音频SegmentTimeline连续
+	a := m.audio.segments
+	assert.Equal(t, 2, len(a))
+	assert.Equal(t, a[0].t+a[0].d, a[1].t)
+
+	// 移出mpd的分片文件延迟删除
+	_, err = os.Stat(getSegmentFilename(m.outPath, representationIDVideo, 90000))
+	assert.Equal(t, nil, err)
+
+	_, err = os.Stat(getInitFilename(m.outPath, representationIDVideo))
+	assert.Equal(t, nil, err)
+	_, err = os.Stat(getInitFilename(m.outPath, representationIDAudio))
+	assert.Equal(t, nil, err)
+
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/dash/test/manifest.mpd", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "application/dash+xml", resp.Header().Get("Content-Type"))
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/dash/test/video-360000.m4s", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "styp", resp.Body.String()[4:8])
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/dash/test/video-1.m4s", nil))
+	assert.Equal(t, 404, resp.Code)
+
+	m.Dispose()
+	content, err = ioutil.ReadFile(m.mpdFilename)
+	assert.Equal(t, nil, err)
+	mpd = string(content)
+	assert.Equal(t, true, strings.Contains(mpd, `type="static"`))
+	assert.Equal(t, false, strings.Contains(mpd, "minimumUpdatePeriod"))
+	assert.Equal(t, false, strings.Contains(mpd, "timeShiftBufferDepth"))
+	assert.Equal(t, true, strings.Contains(mpd, "mediaPresentationDuration"))
+	// 只能播放mpd中列出的分片，以第一个分片作为起始位置
+	assert.Equal(t, true, strings.Contains(mpd, `timescale="90000" presentationTimeOffset="360000"`))
+	assert.Equal(t, true, strings.Contains(mpd, `<S t="360000" d="90000"/>`))
+
+	// 流结束时写入最后一个分片，最早的分片文件超过保留数量被删除
+	_, err = os.Stat(getSegmentFilename(m.outPath, representationIDVideo, 90000))
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(getSegmentFilename(m.outPath, representationIDVideo, 180000))
+	assert.Equal(t, nil, err)
+}
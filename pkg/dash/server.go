@@ -0,0 +1,113 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package dash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 和hls.Server相同，只提供文件读取，文件由Muxer生成
+//
+// http://127.0.0.1:8082/dash/test110/manifest.mpd  -> /tmp/lal/dash/test110/manifest.mpd
+// http://127.0.0.1:8082/dash/test110/video-0.m4s   -> /tmp/lal/dash/test110/video-0.m4s
+type Server struct {
+	addr    string
+	outPath string
+	ln      net.Listener
+	httpSrv *http.Server
+	log     log.Logger
+}
+
+func NewServer(addr string, outPath string, logger log.Logger) *Server {
+	s := &Server{
+		addr:    addr,
+		outPath: outPath,
+		log:     logger,
+	}
+	return s
+}
+
+func (s *Server) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.dash.server")
+	return s.log
+}
+
+func (s *Server) Listen() (err error) {
+	if s.ln, err = net.Listen("tcp", s.addr); err != nil {
+		return
+	}
+	s.httpSrv = &http.Server{Addr: s.addr, Handler: s}
+	s.Log().Info("start dash server listen. addr=%s", s.addr)
+	return
+}
+
+func (s *Server) RunLoop() error {
+	return s.httpSrv.Serve(s.ln)
+}
+
+func (s *Server) Dispose() {
+	if err := s.httpSrv.Close(); err != nil {
+		s.Log().Error(err)
+	}
+}
+
+func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	streamName, fileName := parseRequestPath(req.URL.Path)
+	var contentType string
+	switch filepath.Ext(fileName) {
+	case ".mpd":
+		contentType = "application/dash+xml"
+	case ".mp4":
+		contentType = "video/mp4"
+	case ".m4s":
+		contentType = "video/iso.segment"
+	}
+	if streamName == "" || contentType == "" {
+		s.Log().Warn("invalid dash request. path=%s", req.URL.Path)
+		resp.WriteHeader(404)
+		return
+	}
+
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s%s/%s", s.outPath, streamName, fileName))
+	if err != nil {
+		s.Log().Warn("%+v", err)
+		resp.WriteHeader(404)
+		return
+	}
+
+	resp.Header().Add("Content-Type", contentType)
+	resp.Header().Add("Server", base.LALDASHServer)
+	resp.Header().Add("Cache-Control", "no-cache")
+	resp.Header().Add("Access-Control-Allow-Origin", "*")
+	_, _ = resp.Write(content)
+}
+
+// @return 路径的最后两级，比如/dash/test110/manifest.mpd返回test110和manifest.mpd
+func parseRequestPath(path string) (streamName, fileName string) {
+	ss := strings.Split(path, "/")
+	if len(ss) < 2 {
+		return
+	}
+	streamName, fileName = ss[len(ss)-2], ss[len(ss)-1]
+	if streamName == ".." || strings.HasPrefix(fileName, ".") {
+		return "", ""
+	}
+	return
+}
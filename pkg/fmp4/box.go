@@ -0,0 +1,74 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package fmp4
+
+import (
+	"github.com/souliot/naza/pkg/bele"
+)
+
+// 按顺序写入box，box的大小在结束时回填
+type boxWriter struct {
+	b []byte
+}
+
+// @return box在b中的起始位置，用于end时回填大小
+func (w *boxWriter) start(typ string) int {
+	pos := len(w.b)
+	w.u32(0)
+	w.b = append(w.b, typ...)
+	return pos
+}
+
+func (w *boxWriter) startFull(typ string, version uint8, flags uint32) int {
+	pos := w.start(typ)
+	w.u32(uint32(version)<<24 | flags&0xFFFFFF)
+	return pos
+}
+
+func (w *boxWriter) end(pos int) {
+	bele.BEPutUint32(w.b[pos:], uint32(len(w.b)-pos))
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.b = append(w.b, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.b = append(w.b, uint8(v>>8), uint8(v))
+}
+
+func (w *boxWriter) u24(v uint32) {
+	w.b = append(w.b, uint8(v>>16), uint8(v>>8), uint8(v))
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.b = append(w.b, uint8(v>>24), uint8(v>>16), uint8(v>>8), uint8(v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *boxWriter) bytes(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.b = append(w.b, 0)
+	}
+}
+
+// 单位矩阵，用于mvhd和tkhd
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
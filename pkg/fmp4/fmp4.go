@@ -0,0 +1,424 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/aac"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// fragmented MP4（CMAF）的封装，供HLS以及DASH使用
+//
+// 初始化分片（init segment）: ftyp + moov
+// 媒体分片（media segment）:  styp + moof + mdat
+//
+// ISO_IEC_14496-12 ISO base media file format
+// ISO_IEC_14496-15 Carriage of NAL unit structured video
+// ISO_IEC_23000-19 Common media application format (CMAF)
+
+var ErrFMP4 = errors.New("lal.fmp4: fxxk")
+
+const (
+	VideoTimescale = 90000
+
+	// trun中sample_flags
+	sampleFlagsKey    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonKey = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+type Track struct {
+	ID          uint32
+	PayloadType base.AVPacketPT // AVC, HEVC, AAC
+	Timescale   uint32          // 视频使用VideoTimescale，音频使用采样率
+
+	// 视频为AVCDecoderConfigurationRecord或HEVCDecoderConfigurationRecord，也即rtmp seq header去除头部5个字节
+	// 音频为AudioSpecificConfig，也即rtmp seq header去除头部2个字节
+	Config []byte
+
+	Width        int // 视频
+	Height       int
+	ChannelCount int // 音频
+}
+
+type Sample struct {
+	Duration  uint32 // 单位为Track.Timescale，下同
+	CTSOffset int32  // pts - dts
+	Key       bool
+	Data      []byte // 视频为AVCC格式，音频为AAC raw frame
+}
+
+// 媒体分片中一个track的数据
+type TrackFragment struct {
+	Track          *Track
+	BaseDecodeTime uint64 // 第一个sample的dts
+	Samples        []Sample
+}
+
+// @param config 音频AudioSpecificConfig
+func NewAudioTrack(id uint32, config []byte) (*Track, error) {
+	asc, err := aac.ParseAudioSpecificConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Track{
+		ID:           id,
+		PayloadType:  base.AVPacketPTAAC,
+		Timescale:    uint32(asc.SamplingFrequency()),
+		Config:       append([]byte(nil), config...),
+		ChannelCount: int(asc.ChannelConfiguration),
+	}, nil
+}
+
+// @param config AVCDecoderConfigurationRecord或HEVCDecoderConfigurationRecord
+func NewVideoTrack(id uint32, pt base.AVPacketPT, config []byte, width, height int) (*Track, error) {
+	if pt != base.AVPacketPTAVC && pt != base.AVPacketPTHEVC {
+		return nil, ErrFMP4
+	}
+	if (pt == base.AVPacketPTAVC && len(config) < 4) || (pt == base.AVPacketPTHEVC && len(config) < 23) {
+		return nil, ErrFMP4
+	}
+	return &Track{
+		ID:          id,
+		PayloadType: pt,
+		Timescale:   VideoTimescale,
+		Config:      append([]byte(nil), config...),
+		Width:       width,
+		Height:      height,
+	}, nil
+}
+
+func (t *Track) IsVideo() bool {
+	return t.PayloadType == base.AVPacketPTAVC || t.PayloadType == base.AVPacketPTHEVC
+}
+
+// RFC6381中的codecs字符串，用于m3u8的CODECS以及mpd的codecs，比如avc1.64001f，mp4a.40.2
+func (t *Track) Codec() string {
+	switch t.PayloadType {
+	case base.AVPacketPTAVC:
+		return fmt.Sprintf("avc1.%02x%02x%02x", t.Config[1], t.Config[2], t.Config[3])
+	case base.AVPacketPTHEVC:
+		return hevcCodec(t.Config)
+	case base.AVPacketPTAAC:
+		return fmt.Sprintf("mp4a.40.%d", t.Config[0]>>3)
+	}
+	return ""
+}
+
+// ISO_IEC_14496-15 Annex E.3
+func hevcCodec(hvcc []byte) string {
+	profileSpace := hvcc[1] >> 6
+	tier := (hvcc[1] >> 5) & 0x01
+	profile := hvcc[1] & 0x1F
+	compat := bele.BEUint32(hvcc[2:])
+	level := hvcc[12]
+
+	// general_profile_compatibility_flags按位逆序
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | (compat>>uint(i))&0x01
+	}
+
+	var sb strings.Builder
+	sb.WriteString("hvc1.")
+	if profileSpace > 0 {
+		sb.WriteByte('A' + profileSpace - 1)
+	}
+	sb.WriteString(fmt.Sprintf("%d.%x.", profile, reversed))
+	if tier == 0 {
+		sb.WriteString("L")
+	} else {
+		sb.WriteString("H")
+	}
+	sb.WriteString(fmt.Sprintf("%d", level))
+
+	// general_constraint_indicator_flags，末尾为0的字节省略
+	constraint := hvcc[6:12]
+	n := len(constraint)
+	for n > 0 && constraint[n-1] == 0 {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		sb.WriteString(fmt.Sprintf(".%x", constraint[i]))
+	}
+	return sb.String()
+}
+
+// 生成初始化分片
+func GenInitSegment(tracks []*Track) []byte {
+	var w boxWriter
+
+	ftyp := w.start("ftyp")
+	w.bytes([]byte("iso6"))
+	w.u32(0)
+	w.bytes([]byte("iso6cmfcmp41"))
+	w.end(ftyp)
+
+	moov := w.start("moov")
+
+	mvhd := w.startFull("mvhd", 0, 0)
+	w.u32(0)    // creation_time
+	w.u32(0)    // modification_time
+	w.u32(1000) // timescale
+	w.u32(0)    // duration
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24)
+	w.u32(uint32(len(tracks) + 1)) // next_track_ID
+	w.end(mvhd)
+
+	for _, t := range tracks {
+		writeTrak(&w, t)
+	}
+
+	mvex := w.start("mvex")
+	for _, t := range tracks {
+		trex := w.startFull("trex", 0, 0)
+		w.u32(t.ID)
+		w.u32(1) // default_sample_description_index
+		w.u32(0) // default_sample_duration
+		w.u32(0) // default_sample_size
+		w.u32(0) // default_sample_flags
+		w.end(trex)
+	}
+	w.end(mvex)
+
+	w.end(moov)
+	return w.b
+}
+
+// 生成媒体分片，多个track的数据放在同一个moof和mdat中
+//
+// @param sequence 分片序号，从1开始递增
+func GenMediaSegment(sequence uint32, fragments []TrackFragment) []byte {
+	var w boxWriter
+
+	styp := w.start("styp")
+	w.bytes([]byte("msdh"))
+	w.u32(0)
+	w.bytes([]byte("msdhmsixcmfs"))
+	w.end(styp)
+
+	moofPos := len(w.b)
+	moof := w.start("moof")
+	mfhd := w.startFull("mfhd", 0, 0)
+	w.u32(sequence)
+	w.end(mfhd)
+
+	dataOffsetPos := make([]int, len(fragments))
+	for i, f := range fragments {
+		traf := w.start("traf")
+
+		tfhd := w.startFull("tfhd", 0, 0x020000) // default-base-is-moof
+		w.u32(f.Track.ID)
+		w.end(tfhd)
+
+		tfdt := w.startFull("tfdt", 1, 0)
+		w.u64(f.BaseDecodeTime)
+		w.end(tfdt)
+
+		// data-offset, sample-duration, sample-size, sample-flags, sample-composition-time-offset
+		trun := w.startFull("trun", 1, 0x000F01)
+		w.u32(uint32(len(f.Samples)))
+		dataOffsetPos[i] = len(w.b)
+		w.u32(0)
+		for _, s := range f.Samples {
+			w.u32(s.Duration)
+			w.u32(uint32(len(s.Data)))
+			if s.Key || !f.Track.IsVideo() {
+				w.u32(sampleFlagsKey)
+			} else {
+				w.u32(sampleFlagsNonKey)
+			}
+			w.u32(uint32(s.CTSOffset))
+		}
+		w.end(trun)
+
+		w.end(traf)
+	}
+	w.end(moof)
+
+	// data_offset为相对moof起始位置的偏移
+	offset := len(w.b) - moofPos + 8
+	for i, f := range fragments {
+		bele.BEPutUint32(w.b[dataOffsetPos[i]:], uint32(offset))
+		for _, s := range f.Samples {
+			offset += len(s.Data)
+		}
+	}
+
+	mdat := w.start("mdat")
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			w.bytes(s.Data)
+		}
+	}
+	w.end(mdat)
+	return w.b
+}
+
+func writeTrak(w *boxWriter, t *Track) {
+	trak := w.start("trak")
+
+	// flags: track_enabled, track_in_movie
+	tkhd := w.startFull("tkhd", 0, 0x000003)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.ID)
+	w.u32(0) // reserved
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate_group
+	if t.IsVideo() {
+		w.u16(0)
+	} else {
+		w.u16(0x0100) // volume
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.end(tkhd)
+
+	mdia := w.start("mdia")
+
+	mdhd := w.startFull("mdhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.Timescale)
+	w.u32(0)      // duration
+	w.u16(0x55C4) // language: und
+	w.u16(0)
+	w.end(mdhd)
+
+	hdlr := w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.IsVideo() {
+		w.bytes([]byte("vide"))
+		w.zeros(12)
+		w.bytes([]byte("VideoHandler\x00"))
+	} else {
+		w.bytes([]byte("soun"))
+		w.zeros(12)
+		w.bytes([]byte("SoundHandler\x00"))
+	}
+	w.end(hdlr)
+
+	minf := w.start("minf")
+	if t.IsVideo() {
+		vmhd := w.startFull("vmhd", 0, 1)
+		w.zeros(8)
+		w.end(vmhd)
+	} else {
+		smhd := w.startFull("smhd", 0, 0)
+		w.zeros(4)
+		w.end(smhd)
+	}
+
+	dinf := w.start("dinf")
+	dref := w.startFull("dref", 0, 0)
+	w.u32(1)
+	url := w.startFull("url ", 0, 1) // 数据在同一文件中
+	w.end(url)
+	w.end(dref)
+	w.end(dinf)
+
+	stbl := w.start("stbl")
+	stsd := w.startFull("stsd", 0, 0)
+	w.u32(1)
+	if t.IsVideo() {
+		writeVisualSampleEntry(w, t)
+	} else {
+		writeAudioSampleEntry(w, t)
+	}
+	w.end(stsd)
+	// fragmented MP4中，sample信息都在moof中，这里都是空表
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		pos := w.startFull(typ, 0, 0)
+		w.u32(0)
+		w.end(pos)
+	}
+	stsz := w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end(stsz)
+	w.end(stbl)
+
+	w.end(minf)
+	w.end(mdia)
+	w.end(trak)
+}
+
+func writeVisualSampleEntry(w *boxWriter, t *Track) {
+	// 注意，HLS中的HEVC需要使用hvc1，也即参数集只存放在hvcC中
+	typ, configTyp := "avc1", "avcC"
+	if t.PayloadType == base.AVPacketPTHEVC {
+		typ, configTyp = "hvc1", "hvcC"
+	}
+
+	entry := w.start(typ)
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.Width))
+	w.u16(uint16(t.Height))
+	w.u32(0x00480000) // horizresolution
+	w.u32(0x00480000) // vertresolution
+	w.u32(0)
+	w.u16(1) // frame_count
+	w.zeros(32)
+	w.u16(0x0018) // depth
+	w.u16(0xFFFF) // pre_defined
+	config := w.start(configTyp)
+	w.bytes(t.Config)
+	w.end(config)
+	w.end(entry)
+}
+
+func writeAudioSampleEntry(w *boxWriter, t *Track) {
+	entry := w.start("mp4a")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.ChannelCount))
+	w.u16(16) // samplesize
+	w.zeros(4)
+	w.u32(t.Timescale << 16)
+
+	// ISO_IEC_14496-1 ES_Descriptor
+	esds := w.startFull("esds", 0, 0)
+	asc := t.Config
+	w.u8(0x03) // ES_DescrTag
+	w.u8(uint8(3 + 2 + 13 + 2 + len(asc) + 3))
+	w.u16(uint16(t.ID)) // ES_ID
+	w.u8(0)
+	w.u8(0x04) // DecoderConfigDescrTag
+	w.u8(uint8(13 + 2 + len(asc)))
+	w.u8(0x40) // objectTypeIndication: Audio ISO/IEC 14496-3
+	w.u8(0x15) // streamType: AudioStream
+	w.u24(0)   // bufferSizeDB
+	w.u32(0)   // maxBitrate
+	w.u32(0)   // avgBitrate
+	w.u8(0x05) // DecSpecificInfoTag
+	w.u8(uint8(len(asc)))
+	w.bytes(asc)
+	w.u8(0x06) // SLConfigDescrTag
+	w.u8(1)
+	w.u8(0x02)
+	w.end(esds)
+
+	w.end(entry)
+}
@@ -0,0 +1,110 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package fmp4
+
+import (
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 查找路径上的box，返回box的内容（不包含box头）
+func findBox(b []byte, path ...string) []byte {
+	for len(b) >= 8 {
+		size := int(bele.BEUint32(b))
+		if size < 8 || size > len(b) {
+			return nil
+		}
+		if string(b[4:8]) == path[0] {
+			if len(path) == 1 {
+				return b[8:size]
+			}
+			return findBox(b[8:size], path[1:]...)
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+var (
+	goldenAVCC = []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x04, 0x67, 0x64, 0x00, 0x1f, 0x01, 0x00, 0x02, 0x68, 0xee}
+	goldenASC  = []byte{0x11, 0x90}
+)
+
+func TestGenInitSegment(t *testing.T) {
+	video, err := NewVideoTrack(1, base.AVPacketPTAVC, goldenAVCC, 1280, 720)
+	assert.Equal(t, nil, err)
+	audio, err := NewAudioTrack(2, goldenASC)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(48000), audio.Timescale)
+	assert.Equal(t, 2, audio.ChannelCount)
+
+	init := GenInitSegment([]*Track{video, audio})
+	assert.Equal(t, "iso6", string(findBox(init, "ftyp")[:4]))
+	assert.Equal(t, len(init), 8+len(findBox(init, "ftyp"))+8+len(findBox(init, "moov")))
+	assert.Equal(t, []byte("vide"), findBox(init, "moov", "trak", "mdia", "hdlr")[8:12])
+
+	stsd := findBox(init, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	assert.Equal(t, goldenAVCC, findBox(stsd[8:], "avc1")[78+8:])
+	trex := findBox(init, "moov", "mvex", "trex")
+	assert.Equal(t, uint32(1), bele.BEUint32(trex[4:]))
+
+	_, err = NewVideoTrack(1, base.AVPacketPTAAC, goldenAVCC, 0, 0)
+	assert.Equal(t, ErrFMP4, err)
+	_, err = NewAudioTrack(2, []byte{0x11})
+	assert.IsNotNil(t, err)
+}
+
+func TestGenMediaSegment(t *testing.T) {
+	video, _ := NewVideoTrack(1, base.AVPacketPTAVC, goldenAVCC, 1280, 720)
+	audio, _ := NewAudioTrack(2, goldenASC)
+
+	seg := GenMediaSegment(3, []TrackFragment{
+		{Track: video, BaseDecodeTime: 9000, Samples: []Sample{
+			{Duration: 3600, CTSOffset: 3600, Key: true, Data: []byte{1, 2, 3}},
+			{Duration: 3600, Data: []byte{4, 5}},
+		}},
+		{Track: audio, BaseDecodeTime: 4800, Samples: []Sample{
+			{Duration: 1024, Data: []byte{6}},
+		}},
+	})
+
+	moof := findBox(seg, "moof")
+	assert.Equal(t, uint32(3), bele.BEUint32(findBox(moof, "mfhd")[4:]))
+	traf := findBox(moof, "traf")
+	assert.Equal(t, uint64(9000), bele.BEUint64(findBox(traf, "tfdt")[4:]))
+
+	// data_offset指向mdat中的数据
+	trun := findBox(traf, "trun")
+	assert.Equal(t, uint32(2), bele.BEUint32(trun[4:]))
+	moofPos := 8 + len(findBox(seg, "styp"))
+	dataOffset := int(bele.BEUint32(trun[8:]))
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6}, seg[moofPos+dataOffset:])
+	assert.Equal(t, uint32(sampleFlagsKey), bele.BEUint32(trun[12+8:]))
+	assert.Equal(t, uint32(sampleFlagsNonKey), bele.BEUint32(trun[12+16+8:]))
+}
+
+func TestCodec(t *testing.T) {
+	video, _ := NewVideoTrack(1, base.AVPacketPTAVC, goldenAVCC, 0, 0)
+	assert.Equal(t, "avc1.64001f", video.Codec())
+	audio, _ := NewAudioTrack(2, goldenASC)
+	assert.Equal(t, "mp4a.40.2", audio.Codec())
+
+	hvcc := make([]byte, 23)
+	hvcc[0] = 1
+	hvcc[1] = 0x01
+	bele.BEPutUint32(hvcc[2:], 0x60000000)
+	hvcc[6] = 0x90
+	hvcc[12] = 93
+	hevc, err := NewVideoTrack(1, base.AVPacketPTHEVC, hvcc, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hvc1.1.6.L93.90", hevc.Codec())
+}
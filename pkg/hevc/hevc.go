@@ -49,6 +49,7 @@ var (
 	NALUTypeVPS         uint8 = 32 // 0x20
 	NALUTypeSPS         uint8 = 33 // 0x21
 	NALUTypePPS         uint8 = 34 // 0x22
+	NALUTypeAUD         uint8 = 35 // 0x23
 	NALUTypeSEI         uint8 = 39 // 0x27
 	NALUTypeSEISuffix   uint8 = 40 // 0x28
 )
@@ -0,0 +1,91 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ABR，也即多码率自适应
+//
+// 编码器将同一内容的多个码率分别作为不同的流推送，比如stream_1080、stream_720、stream_480，由上层（ABRProvider）将它们组合起来，
+// Server收到`/hls/<name>/master.m3u8`请求时，生成引用各码率m3u8的master m3u8
+//
+// 播放器在码率之间切换时，需要各码率的切片边界相同，见MuxerConfig.AlignFragment
+
+// ABR中的一个码率
+type Rendition struct {
+	StreamName string
+	Bandwidth  int    // 峰值码率，单位bit/s
+	Width      int    // 为0时不写入RESOLUTION
+	Height     int    //
+	Codecs     string // RFC6381格式，比如`avc1.64001f,mp4a.40.2`，为空时不写入CODECS
+}
+
+type ABRProvider interface {
+	// @param name master m3u8请求中的名称
+	//
+	// @return 按优先级排序的码率，第一个为播放器默认选择的码率，为空时表示不是ABR，Server按普通的m3u8处理
+	//
+	GetABRRenditions(name string) []Rendition
+}
+
+// master m3u8中各码率的URI为相对路径，比如`../stream_1080/playlist.m3u8`
+func GenABRMasterPlaylist(renditions []Rendition) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n\n")
+	for _, r := range renditions {
+		buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", r.Bandwidth))
+		if r.Width != 0 && r.Height != 0 {
+			buf.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", r.Width, r.Height))
+		}
+		if r.Codecs != "" {
+			buf.WriteString(fmt.Sprintf(",CODECS=\"%s\"", r.Codecs))
+		}
+		buf.WriteString("\n")
+		buf.WriteString(fmt.Sprintf("../%s/playlist.m3u8\n", r.StreamName))
+	}
+	return buf.Bytes()
+}
+
+// @return ok 请求不是ABR的master m3u8时为false
+func (s *Server) readABRPlaylist(ri requestInfo) (content []byte, ok bool) {
+	if s.abrProvider == nil || ri.fileName != "master.m3u8" {
+		return nil, false
+	}
+	renditions := s.abrProvider.GetABRRenditions(ri.streamName)
+	if len(renditions) == 0 {
+		return nil, false
+	}
+	return GenABRMasterPlaylist(renditions), true
+}
+
+// AlignFragment时，各码率在时间戳跨越切片时长整数倍之后的第一个关键帧切割，编码器的关键帧对齐时，切片边界相同
+//
+// @param startTS 当前切片的起始时间戳
+// @param d       切片时长，与时间戳的单位相同
+func alignedBoundary(startTS uint64, ts uint64, d uint64) bool {
+	if d == 0 {
+		return ts > startTS
+	}
+	return ts > startTS && ts/d > startTS/d
+}
+
+// AlignFragment时，第一个切片的序号由时间戳推算，使得各码率相同时间的切片序号相同
+//
+// @param ts 第一个切片的起始时间戳，毫秒 * 90
+func (m *Muxer) alignFragmentID(ts uint64) {
+	if !m.config.AlignFragment || m.config.FragmentDurationMS <= 0 || m.frag != 0 || m.nfrags != 0 {
+		return
+	}
+	m.fragIDOffset = int(ts / (uint64(m.config.FragmentDurationMS) * 90))
+}
@@ -0,0 +1,138 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 记录每个切片的起始时间戳，毫秒 * 90
+type abrTestObserver struct {
+	m     *Muxer
+	id2TS map[int]uint64
+}
+
+func (o *abrTestObserver) OnHLSMakeTS(info base.HLSMakeTSInfo) {
+	if info.Event != MakeTSEventOpen {
+		return
+	}
+	if o.m.fmp4Mode() {
+		o.id2TS[info.ID] = uint64(o.m.fmp4.segStartTS) * 90
+	} else {
+		o.id2TS[info.ID] = o.m.fragTS
+	}
+}
+
+func (o *abrTestObserver) OnHLSMakeM3U8(info base.HLSMakeM3U8Info) {
+}
+
+// 每秒一个关键帧，关键帧的时间戳与起始时间无关，模拟同一个编码器输出的多个码率
+func feedABRTestMuxer(m *Muxer, startMS int, endMS int) {
+	feedFMP4Muxer(m, base.RTMPTypeIDVideo, uint32(startMS), fmp4TestAVCSeqHeader)
+	feedFMP4Muxer(m, base.RTMPTypeIDAudio, uint32(startMS), fmp4TestAACSeqHeader)
+	for i := startMS / 40; i <= endMS/40; i++ {
+		frameType := base.RTMPAVCInterFrame
+		if i%25 == 0 {
+			frameType = base.RTMPAVCKeyFrame
+		}
+		payload := []byte{frameType, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x65, 0x01, 0x02, 0x03}
+		feedFMP4Muxer(m, base.RTMPTypeIDVideo, uint32(i*40), payload)
+		feedFMP4Muxer(m, base.RTMPTypeIDAudio, uint32(i*40+20), append([]byte{0xaf, 0x01}, bytes.Repeat([]byte{0x21}, 100)...))
+	}
+}
+
+func TestMuxerAlignFragment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsabr")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	for _, segmentType := range []string{SegmentTypeTS, SegmentTypeFMP4} {
+		config := &MuxerConfig{
+			Enable:             true,
+			OutPath:            dir + "/" + segmentType + "/",
+			FragmentDurationMS: 3000,
+			FragmentNum:        3,
+			SegmentType:        segmentType,
+			AlignFragment:      true,
+		}
+
+		// 两个码率的起始时间不同，切片的序号以及边界相同
+		feed := func(streamName string, startMS int) map[int]uint64 {
+			m := NewMuxer(streamName, config, nil, log.DefaultBeeLogger)
+			o := &abrTestObserver{m: m, id2TS: make(map[int]uint64)}
+			m.SetEventObserver(o)
+			m.Start()
+			feedABRTestMuxer(m, startMS, 10000)
+			m.Dispose()
+			return o.id2TS
+		}
+		assert.Equal(t, map[int]uint64{0: 0, 1: 3000 * 90, 2: 6000 * 90, 3: 9000 * 90}, feed("s_1080", 0))
+		assert.Equal(t, map[int]uint64{1: 4000 * 90, 2: 6000 * 90, 3: 9000 * 90}, feed("s_720", 4000))
+
+		content, err := ioutil.ReadFile(getM3U8Filename(getMuxerOutPath(config.OutPath, "s_720"), "s_720"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, strings.Contains(string(content), "#EXT-X-MEDIA-SEQUENCE:1\n"))
+	}
+}
+
+type abrTestProvider struct {
+	renditions []Rendition
+}
+
+func (p *abrTestProvider) GetABRRenditions(name string) []Rendition {
+	if name != "s" {
+		return nil
+	}
+	return p.renditions
+}
+
+func TestServerABRPlaylist(t *testing.T) {
+	renditions := []Rendition{
+		{StreamName: "s_1080", Bandwidth: 4000000, Width: 1920, Height: 1080, Codecs: "avc1.640028,mp4a.40.2"},
+		{StreamName: "s_480", Bandwidth: 800000},
+	}
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS=\"avc1.640028,mp4a.40.2\"\n" +
+		"../s_1080/playlist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000\n" +
+		"../s_480/playlist.m3u8\n"
+	assert.Equal(t, expected, string(GenABRMasterPlaylist(renditions)))
+
+	dir, err := ioutil.TempDir("", "hlsabr")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	s := NewServer("", dir+"/", log.DefaultBeeLogger)
+	s.SetABRProvider(&abrTestProvider{renditions: renditions})
+
+	// 鉴权参数追加到各码率的m3u8上
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/s/master.m3u8?token=abc", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "application/x-mpegurl", resp.Header().Get("Content-Type"))
+	body := resp.Body.String()
+	assert.Equal(t, true, strings.Contains(body, "\n../s_1080/playlist.m3u8?token=abc\n"))
+	assert.Equal(t, true, strings.Contains(body, "\n../s_480/playlist.m3u8?token=abc\n"))
+
+	// 不是ABR时按普通文件处理
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/other/master.m3u8", nil))
+	assert.Equal(t, 404, resp.Code)
+}
@@ -0,0 +1,414 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/remux"
+)
+
+var ErrHLSPullTimeout = errors.New("lal.hls: pull timeout")
+
+const (
+	// 直播m3u8，从倒数第几个TS开始拉取
+	liveStartSegmentNum = 3
+)
+
+type PullSessionOption struct {
+	// 单次下载m3u8或TS的超时时间，单位毫秒，如果为0，则没有超时时间
+	FetchTimeoutMS int
+
+	// m3u8持续没有更新的超时时间，单位毫秒，如果为0，则使用3倍的`#EXT-X-TARGETDURATION`
+	ReadTimeoutMS int
+}
+
+var defaultPullSessionOption = PullSessionOption{
+	FetchTimeoutMS: 10000,
+	ReadTimeoutMS:  0,
+}
+
+type ModPullSessionOption func(option *PullSessionOption)
+
+// 拉取远端（或本地文件）的m3u8，下载其中的TS，并转换为音视频参数以及AVPacket
+type PullSession struct {
+	UniqueKey string            // const after ctor
+	option    PullSessionOption // const after ctor
+
+	rawURL    string
+	isFile    bool
+	client    *http.Client
+	remuxer   *remux.TS2AVPacket
+	lastSeq   int64 // 最后一个已处理的TS的sequence，-1表示还没有处理过
+	lastFresh time.Time
+
+	m            sync.Mutex
+	disposed     bool
+	exitChan     chan struct{}
+	waitErrChan  chan error
+	gapNum       int
+	currConnStat connection.StatAtomic
+	prevConnStat connection.Stat
+	staleStat    *connection.Stat
+	stat         base.StatSession
+	log          log.Logger
+}
+
+func NewPullSession(logger log.Logger, modOptions ...ModPullSessionOption) *PullSession {
+	option := defaultPullSessionOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+
+	uk := base.GenUniqueKey(base.UKPHLSPullSession)
+	s := &PullSession{
+		UniqueKey:   uk,
+		option:      option,
+		client:      &http.Client{Timeout: time.Duration(option.FetchTimeoutMS) * time.Millisecond},
+		lastSeq:     -1,
+		exitChan:    make(chan struct{}),
+		waitErrChan: make(chan error, 1),
+		stat: base.StatSession{
+			Protocol:  base.ProtocolHLS,
+			SessionID: uk,
+			StartTime: time.Now().Format("2006-01-02 15:04:05.999"),
+		},
+		log: logger,
+	}
+	s.log.WithPrefix("pkg.hls.pull_session")
+	s.log.Info("[%s] lifecycle new hls PullSession. session=%p", uk, s)
+	return s
+}
+
+func (s *PullSession) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.hls.pull_session")
+	return s.log
+}
+
+// 如果没有错误发生，阻塞直到第一次获取m3u8成功，之后在协程中持续拉取
+//
+// @param rawURL 支持如下格式
+//
+//	http(s)://{domain}/{app_name}/{stream_name}.m3u8
+//	file:///{path}/{stream_name}.m3u8 或者本地文件路径
+//	如果是master playlist，选择码率最高的子m3u8
+//
+// @param onAVConfig, onAVPacket 与remux.TS2AVPacket中的回调相同，在拉流协程中回调
+func (s *PullSession) Pull(rawURL string, onAVConfig remux.OnAVConfig, onAVPacket remux.OnAVPacket) error {
+	s.Log().Debug("[%s] pull. url=%s", s.UniqueKey, rawURL)
+
+	if strings.HasPrefix(rawURL, "file://") {
+		s.isFile = true
+		rawURL = strings.TrimPrefix(rawURL, "file://")
+	} else if !strings.Contains(rawURL, "://") {
+		s.isFile = true
+	} else if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		return ErrHLS
+	}
+	s.rawURL = rawURL
+	s.m.Lock()
+	s.stat.RemoteAddr = rawURL
+	s.m.Unlock()
+
+	playlist, err := s.fetchPlaylist()
+	if err != nil {
+		return err
+	}
+	if len(playlist.Variants) != 0 {
+		variant := playlist.Variants[0]
+		for _, v := range playlist.Variants {
+			if v.Bandwidth > variant.Bandwidth {
+				variant = v
+			}
+		}
+		s.rawURL = s.resolve(variant.URI)
+		s.Log().Info("[%s] select variant. bandwidth=%d, url=%s", s.UniqueKey, variant.Bandwidth, s.rawURL)
+		if playlist, err = s.fetchPlaylist(); err != nil {
+			return err
+		}
+		if len(playlist.Variants) != 0 {
+			return ErrHLS
+		}
+	}
+
+	s.remuxer = remux.NewTS2AVPacket(s.UniqueKey, 0, onAVConfig, onAVPacket, s.log)
+	if !playlist.EndList && len(playlist.Segments) > liveStartSegmentNum {
+		s.lastSeq = playlist.Segments[len(playlist.Segments)-liveStartSegmentNum-1].Sequence
+	}
+
+	go s.runLoop(playlist)
+	return nil
+}
+
+// Pull成功后，调用该函数，可阻塞直到拉流结束
+// 点播m3u8（带`#EXT-X-ENDLIST`）全部处理完时，返回nil
+func (s *PullSession) Wait() <-chan error {
+	return s.waitErrChan
+}
+
+func (s *PullSession) Dispose() {
+	s.Log().Info("[%s] lifecycle dispose hls PullSession.", s.UniqueKey)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.disposed {
+		return
+	}
+	s.disposed = true
+	close(s.exitChan)
+}
+
+func (s *PullSession) URL() string {
+	return s.rawURL
+}
+
+func (s *PullSession) AppName() string {
+	return path.Base(path.Dir(s.urlPath()))
+}
+
+func (s *PullSession) StreamName() string {
+	return strings.TrimSuffix(path.Base(s.urlPath()), ".m3u8")
+}
+
+func (s *PullSession) RawQuery() string {
+	if s.isFile {
+		return ""
+	}
+	u, err := url.Parse(s.rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.RawQuery
+}
+
+func (s *PullSession) GetStat() base.StatSession {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stat.ReadBytesSum = s.currConnStat.ReadBytesSum.Load()
+	return s.stat
+}
+
+func (s *PullSession) UpdateStat(interval uint32) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	readBytesSum := s.currConnStat.ReadBytesSum.Load()
+	rDiff := readBytesSum - s.prevConnStat.ReadBytesSum
+	s.stat.ReadBitrate = int(rDiff * 8 / 1024 / uint64(interval))
+	s.stat.Bitrate = s.stat.ReadBitrate
+	s.prevConnStat.ReadBytesSum = readBytesSum
+}
+
+func (s *PullSession) IsAlive() (readAlive, writeAlive bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	readBytesSum := s.currConnStat.ReadBytesSum.Load()
+	if s.staleStat == nil {
+		s.staleStat = new(connection.Stat)
+		s.staleStat.ReadBytesSum = readBytesSum
+		return true, true
+	}
+
+	readAlive = !(readBytesSum-s.staleStat.ReadBytesSum == 0)
+	s.staleStat.ReadBytesSum = readBytesSum
+	return readAlive, true
+}
+
+func (s *PullSession) runLoop(playlist Playlist) {
+	s.lastFresh = time.Now()
+	for {
+		newNum, err := s.processPlaylist(playlist)
+		if err != nil {
+			s.waitErrChan <- err
+			return
+		}
+		if playlist.EndList {
+			s.remuxer.Flush()
+			s.Log().Info("[%s] playlist end.", s.UniqueKey)
+			s.waitErrChan <- nil
+			return
+		}
+
+		// 有新的TS时，等待一个TS的时长再刷新m3u8，否则等待一半
+		target := time.Duration(playlist.TargetDuration * float64(time.Second))
+		if target <= 0 {
+			target = time.Second
+		}
+		wait := target
+		if newNum == 0 {
+			wait = target / 2
+		}
+		readTimeout := time.Duration(s.option.ReadTimeoutMS) * time.Millisecond
+		if readTimeout == 0 {
+			readTimeout = 3 * target
+		}
+		if newNum == 0 && time.Since(s.lastFresh) > readTimeout {
+			s.waitErrChan <- ErrHLSPullTimeout
+			return
+		}
+
+		select {
+		case <-s.exitChan:
+			s.waitErrChan <- nil
+			return
+		case <-time.After(wait):
+		}
+
+		if playlist, err = s.fetchPlaylist(); err != nil {
+			s.waitErrChan <- err
+			return
+		}
+	}
+}
+
+// @return 新处理的TS数量
+func (s *PullSession) processPlaylist(playlist Playlist) (int, error) {
+	if len(playlist.Segments) != 0 && playlist.Segments[len(playlist.Segments)-1].Sequence < s.lastSeq {
+		// sequence回退，一般是对端重启了，从头开始拉取
+		s.Log().Warn("[%s] media sequence rollback. last=%d, curr=%d", s.UniqueKey, s.lastSeq, playlist.Segments[len(playlist.Segments)-1].Sequence)
+		s.lastSeq = -1
+		if len(playlist.Segments) > liveStartSegmentNum {
+			s.lastSeq = playlist.Segments[len(playlist.Segments)-liveStartSegmentNum-1].Sequence
+		}
+		s.remuxer.Flush()
+		s.remuxer.Discontinuity()
+	}
+
+	var n int
+	for _, seg := range playlist.Segments {
+		if seg.Sequence <= s.lastSeq {
+			continue
+		}
+		if s.isDisposed() {
+			return n, nil
+		}
+
+		if s.lastSeq != -1 && seg.Sequence != s.lastSeq+1 {
+			// 拉取速度跟不上，或者对端m3u8中的TS数量太少，中间的TS已经被移出了列表
+			s.gapNum++
+			s.Log().Warn("[%s] media sequence gap. last=%d, curr=%d, gaps=%d", s.UniqueKey, s.lastSeq, seg.Sequence, s.gapNum)
+			s.remuxer.Flush()
+			s.remuxer.Discontinuity()
+		} else if seg.Discontinuity {
+			s.remuxer.Flush()
+			s.remuxer.Discontinuity()
+		}
+
+		content, err := s.fetch(s.resolve(seg.URI))
+		if err != nil {
+			return n, err
+		}
+		s.remuxer.Feed(content)
+		s.remuxer.Flush()
+
+		s.lastSeq = seg.Sequence
+		s.lastFresh = time.Now()
+		n++
+	}
+	return n, nil
+}
+
+func (s *PullSession) fetchPlaylist() (Playlist, error) {
+	content, err := s.fetch(s.rawURL)
+	if err != nil {
+		return Playlist{}, err
+	}
+	return ParseM3U8(content)
+}
+
+func (s *PullSession) fetch(rawURL string) ([]byte, error) {
+	var content []byte
+	var err error
+	if s.isFile {
+		content, err = ioutil.ReadFile(rawURL)
+	} else {
+		content, err = s.fetchHTTP(rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.currConnStat.ReadBytesSum.Add(uint64(len(content)))
+	return content, nil
+}
+
+func (s *PullSession) fetchHTTP(rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.exitChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lal.hls: fetch failed. url=%s, status=%d", rawURL, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// 将m3u8中的相对路径转换为完整路径
+func (s *PullSession) resolve(uri string) string {
+	if s.isFile {
+		if filepath.IsAbs(uri) {
+			return uri
+		}
+		return filepath.Join(filepath.Dir(s.rawURL), uri)
+	}
+	base, err := url.Parse(s.rawURL)
+	if err != nil {
+		return uri
+	}
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return base.ResolveReference(ref).String()
+}
+
+func (s *PullSession) urlPath() string {
+	if s.isFile {
+		return filepath.ToSlash(s.rawURL)
+	}
+	u, err := url.Parse(s.rawURL)
+	if err != nil {
+		return s.rawURL
+	}
+	return u.Path
+}
+
+func (s *PullSession) isDisposed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.disposed
+}
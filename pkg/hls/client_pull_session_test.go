@@ -0,0 +1,77 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+// 一个TS文件，包含一个视频关键帧和一个音频帧，时间戳都为dts
+func genTestSegment(dts uint64) []byte {
+	var b []byte
+	b = append(b, mpegts.FixedFragmentHeader...)
+	raw := []byte{0, 0, 0, 1, 0x67, 0x64, 0x00, 0x1f, 0, 0, 0, 1, 0x68, 0xee, 0, 0, 0, 1, 0x65, 0x88}
+	mpegts.PackTSPacket(&mpegts.Frame{PTS: dts, DTS: dts, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Key: true, Raw: raw}, func(packet []byte) {
+		b = append(b, packet...)
+	})
+	adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, 1, 2, 3, 4}
+	mpegts.PackTSPacket(&mpegts.Frame{PTS: dts, DTS: dts, Pid: mpegts.PidAudio, Sid: mpegts.StreamIDAudio, Raw: adts}, func(packet []byte) {
+		b = append(b, packet...)
+	})
+	return b
+}
+
+func TestPullSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls_pull")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// 第二个TS之前不连续，时间戳从头开始
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "0.ts"), genTestSegment(90000), 0644))
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "1.ts"), genTestSegment(90000), 0644))
+	m3u8 := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:1.000,\n0.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:1.000,\n1.ts\n#EXT-X-ENDLIST\n"
+	assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(dir, "test.m3u8"), []byte(m3u8), 0644))
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	for _, rawURL := range []string{filepath.Join(dir, "test.m3u8"), srv.URL + "/test.m3u8"} {
+		var gotConfig bool
+		var pkts []base.AVPacket
+		session := NewPullSession(log.DefaultBeeLogger)
+		err = session.Pull(rawURL, func(asc, vps, sps, pps []byte) {
+			gotConfig = asc != nil && sps != nil
+		}, func(pkt base.AVPacket) {
+			pkts = append(pkts, pkt)
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, nil, <-session.Wait())
+		assert.Equal(t, "test", session.StreamName())
+
+		assert.Equal(t, true, gotConfig)
+		assert.Equal(t, 4, len(pkts))
+		assert.Equal(t, base.AVPacketPTAVC, pkts[0].PayloadType)
+		assert.Equal(t, uint32(0), pkts[0].Timestamp)
+		assert.Equal(t, base.AVPacketPTAAC, pkts[1].PayloadType)
+		assert.Equal(t, uint32(40), pkts[2].Timestamp)
+		assert.Equal(t, uint32(40), pkts[3].Timestamp)
+		session.Dispose()
+	}
+}
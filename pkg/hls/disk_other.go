@@ -0,0 +1,16 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package hls
+
+// 其他平台暂不支持获取磁盘剩余空间，Janitor不做低磁盘空间保护
+func diskFreeBytes(path string) (uint64, error) {
+	return 0, ErrHLS
+}
@@ -0,0 +1,439 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/aac"
+	"github.com/souliot/siot-av/pkg/avc"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+// 切片加密
+//
+// AES-128     整个切片使用AES-128-CBC加密，PKCS7填充
+// SAMPLE-AES  只加密视频slice以及AAC帧的部分数据，TS切片的PMT使用加密后的stream_type，只支持TS切片
+//
+// 每个切片前写入`#EXT-X-KEY`，IV为切片的序号
+// #EXT-X-KEY:METHOD=AES-128,URI="<keyID>.key",IV=0x00000000000000000000000000000005
+//
+// 密钥由KeyProvider生成，URI为相对路径时，播放器请求`<streamName>/<keyID>.key`，Server通过KeyProvider.GetKey获取密钥
+
+var (
+	ErrKeyNotFound    = errors.New("lal.hls: key not found")
+	ErrKeyUnavailable = errors.New("lal.hls: key unavailable")
+)
+
+const (
+	EncryptMethodAES128    = "AES-128"
+	EncryptMethodSampleAES = "SAMPLE-AES"
+
+	// SAMPLE-AES中，视频nalu开头不加密的字节数，以及每次加密16字节后，跳过的不加密字节数
+	sampleAESVideoLeader = 32
+	sampleAESVideoSkip   = 144
+	// SAMPLE-AES中，AAC帧开头不加密的字节数
+	sampleAESAudioLeader = 16
+
+	// 默认KeyProvider中，每路流最多保存的密钥数量
+	memoryKeyProviderMaxKeyNum = 1024
+)
+
+type KeyProvider interface {
+	// 生成新的密钥，每次轮换密钥时调用
+	//
+	// @return key 16字节的AES-128密钥
+	// @return uri 写入`#EXT-X-KEY`的URI，可以为相对路径`<keyID>.key`，此时由Server调用GetKey返回密钥，也可以是外部密钥服务的地址
+	GenKey(streamName string) (key []byte, uri string, err error)
+
+	// Server收到`<streamName>/<fileName>`的密钥请求，并且通过ServerObserver鉴权后调用
+	GetKey(streamName string, fileName string) ([]byte, error)
+}
+
+var (
+	keyProviderMutex sync.Mutex
+	keyProvider      KeyProvider = NewMemoryKeyProvider()
+)
+
+// 替换默认的KeyProvider，需要在Muxer以及Server开始工作前调用
+func SetKeyProvider(p KeyProvider) {
+	keyProviderMutex.Lock()
+	defer keyProviderMutex.Unlock()
+	keyProvider = p
+}
+
+func getKeyProvider() KeyProvider {
+	keyProviderMutex.Lock()
+	defer keyProviderMutex.Unlock()
+	return keyProvider
+}
+
+// 默认的KeyProvider，密钥随机生成，保存在内存中，进程重启后丢失
+type memoryKeyProvider struct {
+	m           sync.Mutex
+	stream2Keys map[string][]memoryKey
+}
+
+type memoryKey struct {
+	fileName string
+	key      []byte
+}
+
+func NewMemoryKeyProvider() KeyProvider {
+	return &memoryKeyProvider{
+		stream2Keys: make(map[string][]memoryKey),
+	}
+}
+
+func (p *memoryKeyProvider) GenKey(streamName string) ([]byte, string, error) {
+	b := make([]byte, aes.BlockSize+8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	key := b[:aes.BlockSize]
+	fileName := fmt.Sprintf("%s.key", hex.EncodeToString(b[aes.BlockSize:]))
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	keys := append(p.stream2Keys[streamName], memoryKey{fileName: fileName, key: key})
+	if len(keys) > memoryKeyProviderMaxKeyNum {
+		keys = keys[len(keys)-memoryKeyProviderMaxKeyNum:]
+	}
+	p.stream2Keys[streamName] = keys
+	return key, fileName, nil
+}
+
+func (p *memoryKeyProvider) GetKey(streamName string, fileName string) ([]byte, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, k := range p.stream2Keys[streamName] {
+		if k.fileName == fileName {
+			return k.key, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type keyInfo struct {
+	method string
+	uri    string
+	key    []byte
+	block  cipher.Block
+}
+
+// @return 加密方式，不加密时返回空字符串
+func (m *Muxer) encryptMethod() string {
+	if !m.config.Enable {
+		return ""
+	}
+	switch m.config.EncryptMethod {
+	case EncryptMethodAES128:
+		return EncryptMethodAES128
+	case EncryptMethodSampleAES:
+		// fmp4的SAMPLE-AES需要cbcs，暂不支持
+		if m.fmp4Mode() {
+			return ""
+		}
+		return EncryptMethodSampleAES
+	}
+	return ""
+}
+
+// 开启新的切片时调用，必要时轮换密钥
+//
+// 注意，开启了加密但是从来没有生成过密钥时返回错误，此时不能开启切片，避免发布未加密的切片
+//
+// @return 当前切片使用的密钥，不加密时返回nil
+func (m *Muxer) updateKey() (*keyInfo, error) {
+	method := m.encryptMethod()
+	if method == "" {
+		return nil, nil
+	}
+	rotate := m.config.KeyRotateFragmentNum > 0 && m.keyFragNum >= m.config.KeyRotateFragmentNum
+	if m.key == nil || rotate {
+		key, uri, err := getKeyProvider().GenKey(m.streamName)
+		var block cipher.Block
+		if err == nil {
+			block, err = aes.NewCipher(key)
+		}
+		if err != nil {
+			m.Log().Error("[%s] gen key error. err=%+v", m.UniqueKey, err)
+			if m.key == nil {
+				return nil, ErrKeyUnavailable
+			}
+			// 继续使用之前的密钥
+		} else {
+			m.key = &keyInfo{
+				method: method,
+				uri:    uri,
+				key:    key,
+				block:  block,
+			}
+			m.keyFragNum = 0
+		}
+	}
+	m.keyFragNum++
+	return m.key, nil
+}
+
+// 开启了加密时，每个切片前写入`#EXT-X-KEY`
+func (m *Muxer) writeKeyTag(buf *bytes.Buffer, frag *fragmentInfo) {
+	if frag.key == nil {
+		return
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=0x%s\n", frag.key.method, frag.key.uri, hex.EncodeToString(genIV(frag.id))))
+}
+
+func (m *Muxer) sampleAESFragment() bool {
+	frag := m.getCurrFrag()
+	return frag.key != nil && frag.key.method == EncryptMethodSampleAES
+}
+
+// SAMPLE-AES时，加密后的TS流写入切片，CC与回调给上层的TS流分开计数
+func (m *Muxer) writeSampleAESFrame(frame *mpegts.Frame) {
+	frag := m.getCurrFrag()
+
+	encFrame := *frame
+	iv := genIV(frag.id)
+	if frame.Sid == mpegts.StreamIDAudio {
+		encFrame.Raw = sampleAESEncryptAudio(frag.key.block, iv, frame.Raw)
+		encFrame.CC = m.audioCC
+	} else {
+		encFrame.Raw = sampleAESEncryptVideo(frag.key.block, iv, frame.Raw)
+		encFrame.CC = m.videoCC
+	}
+	mpegts.PackTSPacket(&encFrame, func(packet []byte) {
+		m.writeFragmentPacket(packet)
+	})
+	if frame.Sid == mpegts.StreamIDAudio {
+		m.audioCC = encFrame.CC
+	} else {
+		m.videoCC = encFrame.CC
+	}
+}
+
+// 开启新的TS切片时调用，设置切片的PAT、PMT以及加密方式
+func (m *Muxer) setupFragmentEncrypt(frag *fragmentInfo) {
+	m.fragment.header = nil
+	m.fragment.enc = nil
+	if frag.key == nil {
+		return
+	}
+	switch frag.key.method {
+	case EncryptMethodAES128:
+		m.fragment.enc = newAES128Encrypter(frag.key.block, genIV(frag.id))
+	case EncryptMethodSampleAES:
+		m.fragment.header = mpegts.GenSampleAESFragmentHeader(m.asc)
+	}
+}
+
+// AES-128时，对一次性生成的完整数据加密，也即LL-HLS的part（独立的资源，使用与所属切片相同的IV），以及fmp4切片（init.mp4不加密）
+func (m *Muxer) encryptSegment(frag *fragmentInfo, b []byte) []byte {
+	if frag.key == nil || frag.key.method != EncryptMethodAES128 {
+		return b
+	}
+	return encryptAES128(frag.key.block, genIV(frag.id), b)
+}
+
+// IV为切片的序号，128位大端
+func genIV(id int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	bele.BEPutUint64(iv[8:], uint64(id))
+	return iv
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// AES-128-CBC流式加密，数据分多次写入，结束时做PKCS7填充
+type aes128Encrypter struct {
+	mode    cipher.BlockMode
+	pending []byte
+}
+
+func newAES128Encrypter(block cipher.Block, iv []byte) *aes128Encrypter {
+	return &aes128Encrypter{
+		mode: cipher.NewCBCEncrypter(block, iv),
+	}
+}
+
+// @return 已经凑满16字节的部分加密后的数据，剩余数据等待下次写入
+func (e *aes128Encrypter) update(b []byte) []byte {
+	e.pending = append(e.pending, b...)
+	n := len(e.pending) / aes.BlockSize * aes.BlockSize
+	out := make([]byte, n)
+	e.mode.CryptBlocks(out, e.pending[:n])
+	e.pending = append(e.pending[:0], e.pending[n:]...)
+	return out
+}
+
+func (e *aes128Encrypter) final() []byte {
+	pad := aes.BlockSize - len(e.pending)%aes.BlockSize
+	for i := 0; i < pad; i++ {
+		e.pending = append(e.pending, uint8(pad))
+	}
+	out := make([]byte, len(e.pending))
+	e.mode.CryptBlocks(out, e.pending)
+	e.pending = nil
+	return out
+}
+
+func encryptAES128(block cipher.Block, iv []byte, b []byte) []byte {
+	e := newAES128Encrypter(block, iv)
+	out := e.update(b)
+	return append(out, e.final()...)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// 视频slice的nalu（长度超过48字节），去除防竞争字节后，前32字节不加密，之后每16字节加密，跟随144字节不加密，最后不足16字节的部分不加密
+// 加密后重新插入防竞争字节，每个nalu使用相同的IV重新开始CBC
+//
+// @return 新申请的内存块
+func sampleAESEncryptVideo(block cipher.Block, iv []byte, annexb []byte) []byte {
+	out := make([]byte, 0, len(annexb)+64)
+	err := avc.IterateNALUAnnexB(annexb, func(nal []byte) {
+		out = append(out, avc.NALUStartCode4...)
+		t := avc.ParseNALUType(nal[0])
+		if (t != avc.NALUTypeSlice && t != avc.NALUTypeIDRSlice) || len(nal) <= sampleAESVideoLeader+aes.BlockSize {
+			out = append(out, nal...)
+			return
+		}
+		rbsp := removeEmulationPrevention(nal)
+		mode := cipher.NewCBCEncrypter(block, iv)
+		for i := sampleAESVideoLeader; i+aes.BlockSize <= len(rbsp); i += aes.BlockSize + sampleAESVideoSkip {
+			mode.CryptBlocks(rbsp[i:i+aes.BlockSize], rbsp[i:i+aes.BlockSize])
+		}
+		out = append(out, addEmulationPrevention(rbsp)...)
+	})
+	if err != nil {
+		return append([]byte(nil), annexb...)
+	}
+	return out
+}
+
+// 每个ADTS帧，头部以及raw frame开头16字节不加密，之后凑满16字节的部分加密，剩余不足16字节的部分不加密
+//
+// @return 新申请的内存块
+func sampleAESEncryptAudio(block cipher.Block, iv []byte, adts []byte) []byte {
+	out := append([]byte(nil), adts...)
+	for pos := 0; pos < len(out); {
+		h, err := aac.ParseADTSHeader(out[pos:])
+		if err != nil || pos+h.FrameLength > len(out) {
+			break
+		}
+		frame := out[pos+h.HeaderLength : pos+h.FrameLength]
+		if len(frame) > sampleAESAudioLeader {
+			n := (len(frame) - sampleAESAudioLeader) / aes.BlockSize * aes.BlockSize
+			if n > 0 {
+				enc := frame[sampleAESAudioLeader : sampleAESAudioLeader+n]
+				cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, enc)
+			}
+		}
+		pos += h.FrameLength
+	}
+	return out
+}
+
+// 去除nalu中的防竞争字节，也即0x000003中的0x03
+//
+// @return 新申请的内存块
+func removeEmulationPrevention(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, v := range nal {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// 连续两个0x00后跟随0x00到0x03时，插入0x03
+func addEmulationPrevention(rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+16)
+	zeros := 0
+	for _, v := range rbsp {
+		if zeros >= 2 && v <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// m3u8请求带有参数时（比如鉴权的token），将参数追加到相对路径的密钥URI上，使得密钥请求也能通过鉴权
+// LL-HLS的`_HLS_`参数不追加
+//
+// @return 没有需要追加的参数时，返回content本身
+func appendKeyURIQuery(content []byte, query url.Values) []byte {
+	if !bytes.Contains(content, []byte("#EXT-X-KEY:")) {
+		return content
+	}
+	params := make(url.Values)
+	for k, v := range query {
+		if !strings.HasPrefix(k, "_HLS_") {
+			params[k] = v
+		}
+	}
+	if len(params) == 0 {
+		return content
+	}
+	q := params.Encode()
+
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXT-X-KEY:") {
+			continue
+		}
+		begin := strings.Index(line, `URI="`)
+		if begin == -1 {
+			continue
+		}
+		begin += len(`URI="`)
+		end := strings.IndexByte(line[begin:], '"')
+		if end == -1 {
+			continue
+		}
+		uri := line[begin : begin+end]
+		if strings.Contains(uri, "://") {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(uri, "?") {
+			sep = "&"
+		}
+		lines[i] = line[:begin] + uri + sep + q + line[begin+end:]
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
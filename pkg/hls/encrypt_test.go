@@ -0,0 +1,263 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+type encryptTestServerObserver struct {
+	token string
+}
+
+func (o *encryptTestServerObserver) OnHLSPlayAuth(info AuthInfo) bool {
+	query, _ := url.ParseQuery(info.URLParam)
+	return query.Get("token") == o.token
+}
+
+func (o *encryptTestServerObserver) OnNewHLSSubSession(session *SubSession) bool {
+	return true
+}
+
+func (o *encryptTestServerObserver) OnDelHLSSubSession(session *SubSession) {
+}
+
+type encryptTestMuxerObserver struct {
+	buf []byte
+}
+
+func (o *encryptTestMuxerObserver) OnTSPackets(rawFrame []byte, boundary bool) {
+	o.buf = append(o.buf, rawFrame...)
+}
+
+// 前failNum次生成密钥失败
+type encryptTestKeyProvider struct {
+	KeyProvider
+	failNum int
+}
+
+func (p *encryptTestKeyProvider) GenKey(streamName string) ([]byte, string, error) {
+	if p.failNum > 0 {
+		p.failNum--
+		return nil, "", ErrKeyUnavailable
+	}
+	return p.KeyProvider.GenKey(streamName)
+}
+
+// 每40毫秒一帧视频，每秒一个关键帧，视频帧带有较大的slice，用于测试SAMPLE-AES
+func feedEncryptTestMuxer(m *Muxer, n int) {
+	feedFMP4Muxer(m, base.RTMPTypeIDVideo, 0, fmp4TestAVCSeqHeader)
+	feedFMP4Muxer(m, base.RTMPTypeIDAudio, 0, fmp4TestAACSeqHeader)
+	for i := 0; i < n; i++ {
+		frameType := base.RTMPAVCInterFrame
+		if i%25 == 0 {
+			frameType = base.RTMPAVCKeyFrame
+		}
+		nalu := make([]byte, 300)
+		for j := range nalu {
+			nalu[j] = byte(j)
+		}
+		nalu[0] = 0x65
+		payload := []byte{frameType, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x2c}
+		feedFMP4Muxer(m, base.RTMPTypeIDVideo, uint32(i*40), append(payload, nalu...))
+		feedFMP4Muxer(m, base.RTMPTypeIDAudio, uint32(i*40+20), append([]byte{0xaf, 0x01}, bytes.Repeat([]byte{0x21}, 100)...))
+	}
+}
+
+func TestAES128Encrypter(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, 16)
+	block, err := aes.NewCipher(key)
+	assert.Equal(t, nil, err)
+	iv := genIV(5)
+	assert.Equal(t, uint8(5), iv[15])
+
+	plain := bytes.Repeat([]byte("0123456789"), 37)
+	e := newAES128Encrypter(block, iv)
+	var out []byte
+	for i := 0; i < len(plain); i += 7 {
+		end := i + 7
+		if end > len(plain) {
+			end = len(plain)
+		}
+		out = append(out, e.update(plain[i:end])...)
+	}
+	out = append(out, e.final()...)
+	assert.Equal(t, encryptAES128(block, iv, plain), out)
+	assert.Equal(t, plain, decryptAES128(block, iv, out))
+}
+
+func TestEmulationPrevention(t *testing.T) {
+	rbsp := []byte{0x65, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x03, 0x04}
+	nal := addEmulationPrevention(rbsp)
+	assert.Equal(t, []byte{0x65, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x03, 0x04}, nal)
+	assert.Equal(t, rbsp, removeEmulationPrevention(nal))
+}
+
+func TestMuxerEncryptAES128(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsenc")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:               true,
+		OutPath:              dir + "/",
+		FragmentDurationMS:   1000,
+		FragmentNum:          3,
+		EncryptMethod:        EncryptMethodAES128,
+		KeyRotateFragmentNum: 2,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 110)
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, 3, strings.Count(playlist, "#EXT-X-KEY:METHOD=AES-128,"))
+	// 每2个切片轮换一次密钥
+	uris := regexp.MustCompile(`URI="([0-9a-f]+\.key)"`).FindAllStringSubmatch(playlist, -1)
+	assert.Equal(t, 3, len(uris))
+	assert.Equal(t, true, uris[0][1] != uris[2][1])
+	assert.Equal(t, true, uris[0][1] == uris[1][1] || uris[1][1] == uris[2][1])
+
+	// 使用密钥以及IV解密后为完整的TS切片
+	frag := m.getFrag(0)
+	key, err := getKeyProvider().GetKey("test", frag.key.uri)
+	assert.Equal(t, nil, err)
+	block, err := aes.NewCipher(key)
+	assert.Equal(t, nil, err)
+	seg, err := ioutil.ReadFile(m.outPath + frag.filename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(seg)%aes.BlockSize)
+	plain := decryptAES128(block, genIV(frag.id), seg)
+	assert.Equal(t, 0, len(plain)%188)
+	assert.Equal(t, mpegts.FixedFragmentHeader, plain[:len(mpegts.FixedFragmentHeader)])
+
+	record, err := ioutil.ReadFile(m.recordPlayListFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(record), "#EXT-X-KEY:METHOD=AES-128,URI=\""+frag.key.uri))
+
+	// 密钥请求与m3u8请求使用相同的鉴权
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	s.SetObserver(&encryptTestServerObserver{token: "abc"})
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil))
+	assert.Equal(t, 403, resp.Code)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8?token=abc", nil))
+	assert.Equal(t, 200, resp.Code)
+	uri := regexp.MustCompile(`URI="([^"]+)"`).FindStringSubmatch(resp.Body.String())[1]
+	assert.Equal(t, true, strings.HasPrefix(uri, frag.key.uri+"?"))
+	assert.Equal(t, true, strings.Contains(uri, "token=abc"))
+
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/"+frag.key.uri, nil))
+	assert.Equal(t, 403, resp.Code)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/"+uri, nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, key, resp.Body.Bytes())
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/0000.key?token=abc", nil))
+	assert.Equal(t, 404, resp.Code)
+}
+
+func TestMuxerEncryptSampleAES(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsenc")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+		EncryptMethod:      EncryptMethodSampleAES,
+	}
+	observer := &encryptTestMuxerObserver{}
+	m := NewMuxer("test", config, observer, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 60)
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, strings.Count(string(content), "#EXT-X-KEY:METHOD=SAMPLE-AES,"))
+
+	frag := m.getFrag(0)
+	seg, err := ioutil.ReadFile(m.outPath + frag.filename)
+	assert.Equal(t, nil, err)
+	header := mpegts.GenSampleAESFragmentHeader(fmp4TestAACSeqHeader[2:])
+	assert.Equal(t, header, seg[:len(header)])
+	assert.Equal(t, 0, len(seg)%188)
+
+	// 切片中slice开头32字节之后的16字节被加密，回调给上层的TS流未加密
+	var leader, block []byte
+	for j := 1; j < 48; j++ {
+		if j < 32 {
+			leader = append(leader, byte(j))
+		} else {
+			block = append(block, byte(j))
+		}
+	}
+	assert.Equal(t, true, bytes.Contains(seg, leader))
+	assert.Equal(t, false, bytes.Contains(seg, block))
+	assert.Equal(t, true, bytes.Contains(observer.buf, block))
+}
+
+func decryptAES128(block cipher.Block, iv []byte, b []byte) []byte {
+	out := make([]byte, len(b))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, b)
+	return out[:len(out)-int(out[len(out)-1])]
+}
+
+func TestMuxerEncryptGenKeyFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsenc")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	backup := getKeyProvider()
+	defer SetKeyProvider(backup)
+
+	for _, segmentType := range []string{SegmentTypeTS, SegmentTypeFMP4} {
+		SetKeyProvider(&encryptTestKeyProvider{KeyProvider: NewMemoryKeyProvider(), failNum: 2})
+		config := &MuxerConfig{
+			Enable:             true,
+			OutPath:            dir + "/" + segmentType + "/",
+			FragmentDurationMS: 1000,
+			FragmentNum:        5,
+			SegmentType:        segmentType,
+			EncryptMethod:      EncryptMethodAES128,
+		}
+		m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+		m.Start()
+		// 前两个关键帧生成密钥失败，不开启切片，从第三个关键帧开始生成加密的切片
+		feedEncryptTestMuxer(m, 110)
+
+		content, err := ioutil.ReadFile(m.playlistFilename)
+		assert.Equal(t, nil, err)
+		playlist := string(content)
+		assert.Equal(t, false, strings.Contains(playlist, "METHOD=NONE"))
+		assert.Equal(t, 2, strings.Count(playlist, "#EXTINF:"))
+		assert.Equal(t, 2, strings.Count(playlist, "#EXT-X-KEY:METHOD=AES-128,"))
+	}
+}
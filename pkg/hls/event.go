@@ -0,0 +1,81 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"time"
+
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 切片以及m3u8的生成事件，只在Enable为true，也即生成HLS文件时回调
+
+const (
+	MakeTSEventOpen  = "open"
+	MakeTSEventClose = "close"
+
+	MakeM3U8TypeLive   = "live"
+	MakeM3U8TypeRecord = "record"
+)
+
+// 注意，在Muxer的协程中同步回调，不要阻塞
+type MuxerEventObserver interface {
+	// 切片开始写入以及写入完成时回调，open时切片文件可能还不存在，close之后切片文件可以被读取
+	//
+	OnHLSMakeTS(info base.HLSMakeTSInfo)
+
+	// 直播m3u8以及录制m3u8写入完成时回调，LL-HLS中part更新时不回调
+	//
+	OnHLSMakeM3U8(info base.HLSMakeM3U8Info)
+}
+
+// 需要在Start之前调用
+func (m *Muxer) SetEventObserver(observer MuxerEventObserver) {
+	m.eventObserver = observer
+}
+
+func (m *Muxer) onMakeTS(event string, frag *fragmentInfo) {
+	if m.eventObserver == nil || !m.config.Enable {
+		return
+	}
+	info := base.HLSMakeTSInfo{
+		Event:          event,
+		AppName:        m.appName,
+		StreamName:     m.streamName,
+		TSFile:         getTSFilenameWithPath(m.outPath, frag.filename),
+		LiveM3U8File:   m.playlistFilename,
+		RecordM3U8File: m.recordPlayListFilename,
+		ID:             frag.id,
+		Discont:        frag.discont,
+		Time:           frag.programDateTime.UnixNano() / 1e6,
+	}
+	if event == MakeTSEventClose {
+		info.Duration = frag.duration
+		info.Offset = frag.offset
+		info.Length = frag.length
+	}
+	m.eventObserver.OnHLSMakeTS(info)
+}
+
+// @param lastID 为-1时表示m3u8中没有切片
+func (m *Muxer) onMakeM3U8(typ string, filename string, mediaSequence int, lastID int, isLast bool) {
+	if m.eventObserver == nil {
+		return
+	}
+	m.eventObserver.OnHLSMakeM3U8(base.HLSMakeM3U8Info{
+		AppName:       m.appName,
+		StreamName:    m.streamName,
+		Type:          typ,
+		M3U8File:      filename,
+		MediaSequence: mediaSequence,
+		LastID:        lastID,
+		IsLast:        isLast,
+		Time:          time.Now().UnixNano() / 1e6,
+	})
+}
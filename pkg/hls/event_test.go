@@ -0,0 +1,110 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+type eventTestObserver struct {
+	t     *testing.T
+	tss   []base.HLSMakeTSInfo
+	m3u8s []base.HLSMakeM3U8Info
+}
+
+func (o *eventTestObserver) OnHLSMakeTS(info base.HLSMakeTSInfo) {
+	if info.Event == MakeTSEventClose {
+		// close之后切片文件可以被读取
+		_, err := os.Stat(info.TSFile)
+		assert.Equal(o.t, nil, err)
+	}
+	o.tss = append(o.tss, info)
+}
+
+func (o *eventTestObserver) OnHLSMakeM3U8(info base.HLSMakeM3U8Info) {
+	o.m3u8s = append(o.m3u8s, info)
+}
+
+func TestMuxerEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsevent")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+	}
+	o := &eventTestObserver{t: t}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.SetAppName("live")
+	m.SetEventObserver(o)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*3+1)
+	m.Dispose()
+
+	// 每个切片依次open、close
+	assert.Equal(t, 8, len(o.tss))
+	for i, info := range o.tss {
+		id := i / 2
+		assert.Equal(t, "live", info.AppName)
+		assert.Equal(t, "test", info.StreamName)
+		assert.Equal(t, id, info.ID)
+		assert.Equal(t, id == 0, info.Discont)
+		assert.Equal(t, m.playlistFilename, info.LiveM3U8File)
+		assert.Equal(t, m.recordPlayListFilename, info.RecordM3U8File)
+		if i%2 == 0 {
+			assert.Equal(t, MakeTSEventOpen, info.Event)
+			assert.Equal(t, float64(0), info.Duration)
+		} else {
+			assert.Equal(t, MakeTSEventClose, info.Event)
+			assert.Equal(t, o.tss[i-1].TSFile, info.TSFile)
+			assert.Equal(t, o.tss[i-1].Time, info.Time)
+		}
+	}
+	assert.Equal(t, 1.0, o.tss[3].Duration)
+	assert.Equal(t, int64(1000), o.tss[4].Time-o.tss[2].Time)
+
+	// 每个切片完成后，依次更新直播m3u8以及录制m3u8
+	assert.Equal(t, 8, len(o.m3u8s))
+	for i, info := range o.m3u8s {
+		id := i / 2
+		assert.Equal(t, id, info.LastID)
+		if i%2 == 0 {
+			assert.Equal(t, MakeM3U8TypeLive, info.Type)
+			assert.Equal(t, m.playlistFilename, info.M3U8File)
+			assert.Equal(t, i == 6, info.IsLast)
+		} else {
+			assert.Equal(t, MakeM3U8TypeRecord, info.Type)
+			assert.Equal(t, m.recordPlayListFilename, info.M3U8File)
+			assert.Equal(t, 0, info.MediaSequence)
+			assert.Equal(t, true, info.IsLast)
+		}
+	}
+	assert.Equal(t, 0, o.m3u8s[2].MediaSequence)
+	assert.Equal(t, 1, o.m3u8s[4].MediaSequence)
+	assert.Equal(t, 2, o.m3u8s[6].MediaSequence)
+
+	// LL-HLS中part更新时不回调m3u8事件
+	config.LowLatency = true
+	o = &eventTestObserver{t: t}
+	m = NewMuxer("ll", config, nil, log.DefaultBeeLogger)
+	m.SetEventObserver(o)
+	m.Start()
+	feedLowLatencyMuxer(t, m, 0, 63)
+	assert.Equal(t, 5, len(o.tss))
+	assert.Equal(t, 4, len(o.m3u8s))
+}
@@ -15,7 +15,12 @@ import (
 )
 
 type Fragment struct {
-	fp *os.File
+	fp  *os.File
+	buf []byte // 内存模式时，数据写入buf，不创建文件
+
+	header []byte           // 切片开头的PAT以及PMT，为nil时使用mpegts.FixedFragmentHeader
+	enc    *aes128Encrypter // AES-128加密时不为nil
+	size   int64            // 打开后写入的字节数，包含加密的填充
 }
 
 func (f *Fragment) OpenFile(filename string) (err error) {
@@ -23,15 +28,73 @@ func (f *Fragment) OpenFile(filename string) (err error) {
 	if err != nil {
 		return
 	}
-	err = f.WriteFile(mpegts.FixedFragmentHeader)
+	f.size = 0
+	err = f.WriteFile(f.fragmentHeader())
 	return
 }
 
-func (f *Fragment) WriteFile(b []byte) (err error) {
-	_, err = f.fp.Write(b)
+// byte range模式，多个切片追加写入同一个文件
+func (f *Fragment) OpenFileAppend(filename string) (err error) {
+	f.fp, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return
+	}
+	f.size = 0
+	err = f.WriteFile(f.fragmentHeader())
 	return
 }
 
+// 内存模式，与OpenFile对应，CloseFile后通过Bytes获取数据
+func (f *Fragment) OpenBuffer() error {
+	f.fp = nil
+	f.buf = nil
+	f.size = 0
+	return f.WriteFile(f.fragmentHeader())
+}
+
+func (f *Fragment) WriteFile(b []byte) (err error) {
+	if f.enc != nil {
+		b = f.enc.update(b)
+	}
+	return f.write(b)
+}
+
 func (f *Fragment) CloseFile() error {
+	if f.enc != nil {
+		if err := f.write(f.enc.final()); err != nil {
+			return err
+		}
+		f.enc = nil
+	}
+	if f.fp == nil {
+		return nil
+	}
 	return f.fp.Close()
 }
+
+// @return 打开后写入的字节数
+func (f *Fragment) Size() int64 {
+	return f.size
+}
+
+// @return 内存模式时的数据，调用方可以持有
+func (f *Fragment) Bytes() []byte {
+	return f.buf
+}
+
+func (f *Fragment) fragmentHeader() []byte {
+	if f.header == nil {
+		return mpegts.FixedFragmentHeader
+	}
+	return f.header
+}
+
+func (f *Fragment) write(b []byte) (err error) {
+	f.size += int64(len(b))
+	if f.fp == nil {
+		f.buf = append(f.buf, b...)
+		return
+	}
+	_, err = f.fp.Write(b)
+	return
+}
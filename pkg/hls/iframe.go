@@ -0,0 +1,191 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+// I帧m3u8，也即`#EXT-X-I-FRAMES-ONLY`，用于快进以及拖动时的缩略图
+//
+// 切片时记录每个视频关键帧在TS切片中的位置，I帧m3u8中的每一项是切片中的一段byte range，不单独生成文件
+// - 每个切片开头的PAT以及PMT，通过`#EXT-X-MAP`指定
+// - 同时生成master.m3u8，引用直播m3u8以及I帧m3u8
+// - 录制索引中也记录关键帧的位置，点播时通过RecordCatalog生成
+//
+// 只支持不加密的TS切片
+
+type iframeInfo struct {
+	Offset int64   `json:"offset"` // 在切片文件中的位置，byte range时为在共用文件中的位置
+	Length int64   `json:"length"`
+	Time   float64 `json:"time"` // 相对切片开始的时间，单位秒
+}
+
+// 生成I帧m3u8所需的切片信息，直播以及点播共用
+type iframeSegment struct {
+	uri             string
+	discont         bool
+	programDateTime time.Time // 为零值时不写入`#EXT-X-PROGRAM-DATE-TIME`
+	offset          int64     // 切片在文件中的位置，也即PAT的位置
+	headerLength    int64     // 切片开头的PAT以及PMT的长度
+	size            int64
+	duration        float64
+	iframes         []iframeInfo
+}
+
+func (m *Muxer) iframePlaylist() bool {
+	return m.config.Enable && m.config.IFramePlaylist && !m.fmp4Mode() && m.encryptMethod() == ""
+}
+
+// 视频关键帧写入切片后调用
+//
+// @param start 写入关键帧之前切片的长度
+func (m *Muxer) appendIFrame(frame *mpegts.Frame, start int64) {
+	frag := m.getCurrFrag()
+	var t float64
+	if frame.DTS > m.fragTS {
+		t = float64(frame.DTS-m.fragTS) / 90000
+	}
+	frag.iframes = append(frag.iframes, iframeInfo{
+		Offset: frag.offset + start,
+		Length: m.fragment.Size() - start,
+		Time:   t,
+	})
+}
+
+func (m *Muxer) writeIFramePlaylist(isLast bool) {
+	if !m.iframePlaylist() {
+		return
+	}
+
+	var segs []iframeSegment
+	mediaSequence := m.iframeSeq
+	for _, frag := range m.playlistFrags() {
+		if len(frag.iframes) == 0 {
+			continue
+		}
+		if len(segs) == 0 {
+			mediaSequence = frag.iframeSeq
+		}
+		seg := iframeSegment{
+			uri:          m.fragmentURI(frag),
+			discont:      frag.discont,
+			offset:       frag.offset,
+			headerLength: frag.headerLength,
+			size:         frag.size,
+			duration:     frag.duration,
+			iframes:      frag.iframes,
+		}
+		if m.config.ProgramDateTime {
+			seg.programDateTime = frag.programDateTime
+		}
+		segs = append(segs, seg)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:5\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", iframeTargetDuration(segs)))
+	m.writePlaylistTypeTag(&buf, isLast)
+	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence))
+	buf.WriteString("#EXT-X-I-FRAMES-ONLY\n\n")
+	writeIFrameSegments(&buf, segs)
+	if isLast {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+	if err := m.writeFile(buf.Bytes(), m.iframePlaylistFilename); err != nil {
+		m.Log().Error("[%s] write iframe m3u8 file error. err=%+v", m.UniqueKey, err)
+		return
+	}
+
+	bandwidth, iframeBandwidth := calcBandwidth(segs)
+	master := genMasterPlaylist(bandwidth, filepath.Base(m.playlistFilename), iframeBandwidth, filepath.Base(m.iframePlaylistFilename))
+	if err := m.writeFile(master, m.masterPlaylistFilename); err != nil {
+		m.Log().Error("[%s] write master m3u8 file error. err=%+v", m.UniqueKey, err)
+	}
+}
+
+func writeIFrameSegments(buf *bytes.Buffer, segs []iframeSegment) {
+	for _, seg := range segs {
+		if seg.discont {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@%d\"\n", seg.uri, seg.headerLength, seg.offset))
+		if !seg.programDateTime.IsZero() {
+			buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.programDateTime.Format(programDateTimeLayout)))
+		}
+		for k, iframe := range seg.iframes {
+			buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", iframeDuration(seg, k)))
+			buf.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", iframe.Length, iframe.Offset))
+			buf.WriteString(seg.uri)
+			buf.WriteString("\n")
+		}
+	}
+}
+
+// @return I帧的时长，也即到下一个I帧的时间，最后一个I帧到切片结束
+func iframeDuration(seg iframeSegment, k int) float64 {
+	end := seg.duration
+	if k+1 < len(seg.iframes) {
+		end = seg.iframes[k+1].Time
+	}
+	if end < seg.iframes[k].Time {
+		return 0
+	}
+	return end - seg.iframes[k].Time
+}
+
+func iframeTargetDuration(segs []iframeSegment) int {
+	var maxDuration float64
+	for _, seg := range segs {
+		for k := range seg.iframes {
+			maxDuration = math.Max(maxDuration, iframeDuration(seg, k))
+		}
+	}
+	return int(math.Ceil(maxDuration))
+}
+
+// @return bandwidth       切片的峰值码率，单位bit/s
+// @return iframeBandwidth I帧的峰值码率，单位bit/s
+func calcBandwidth(segs []iframeSegment) (bandwidth int, iframeBandwidth int) {
+	for _, seg := range segs {
+		if seg.duration > 0 {
+			bandwidth = maxInt(bandwidth, int(float64(seg.size*8)/seg.duration))
+		}
+		for k, iframe := range seg.iframes {
+			if d := iframeDuration(seg, k); d > 0 {
+				iframeBandwidth = maxInt(iframeBandwidth, int(float64(iframe.Length*8)/d))
+			}
+		}
+	}
+	return
+}
+
+func genMasterPlaylist(bandwidth int, playlistURI string, iframeBandwidth int, iframePlaylistURI string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bandwidth))
+	buf.WriteString(playlistURI)
+	buf.WriteString("\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,URI=\"%s\"\n", iframeBandwidth, iframePlaylistURI))
+	return buf.Bytes()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
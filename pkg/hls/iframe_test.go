@@ -0,0 +1,152 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+// 检查I帧m3u8中的每个byte range都指向切片中的视频关键帧
+//
+// @return I帧的数量
+func checkIFramePlaylist(t *testing.T, outPath string, content string) int {
+	lines := strings.Split(content, "\n")
+	var n int
+	for i, line := range lines {
+		var length, offset int
+		if strings.HasPrefix(line, "#EXT-X-MAP:") {
+			var filename string
+			_, err := fmt.Sscanf(strings.Replace(line, `"`, " ", -1), "#EXT-X-MAP:URI= %s ,BYTERANGE= %d@%d", &filename, &length, &offset)
+			assert.Equal(t, nil, err)
+			b, err := ioutil.ReadFile(outPath + filename)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, mpegts.FixedFragmentHeader, b[offset:offset+length])
+			continue
+		}
+		if !strings.HasPrefix(line, "#EXT-X-BYTERANGE:") {
+			continue
+		}
+		n++
+		_, err := fmt.Sscanf(line, "#EXT-X-BYTERANGE:%d@%d", &length, &offset)
+		assert.Equal(t, nil, err)
+		b, err := ioutil.ReadFile(outPath + lines[i+1])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 0, length%188)
+		iframe := b[offset : offset+length]
+		assert.Equal(t, byte(0x47), iframe[0])
+		assert.Equal(t, true, bytes.Contains(iframe[:188], []byte{0x00, 0x00, 0x01, 0xe0}))
+		// 关键帧的NALU，见feedEncryptTestMuxer
+		assert.Equal(t, true, bytes.Contains(iframe, []byte{0x00, 0x00, 0x01, 0x65, 0x01, 0x02}))
+	}
+	return n
+}
+
+func TestMuxerIFramePlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsiframe")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// 每秒一个关键帧，每个切片2个关键帧
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 2000,
+		FragmentNum:        2,
+		IFramePlaylist:     true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*8+1)
+
+	content, err := ioutil.ReadFile(m.iframePlaylistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-VERSION:5\n"))
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-I-FRAMES-ONLY\n"))
+	assert.Equal(t, true, strings.Contains(playlist, "#EXTINF:1.000,\n"))
+	// 4个切片，前2个切片已经移出直播窗口
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:4\n"))
+	assert.Equal(t, 4, checkIFramePlaylist(t, m.outPath, playlist))
+	assert.Equal(t, 2, strings.Count(playlist, "#EXT-X-MAP:"))
+
+	master, err := ioutil.ReadFile(m.masterPlaylistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(master), "#EXT-X-STREAM-INF:BANDWIDTH="))
+	assert.Equal(t, true, strings.Contains(string(master), "\nplaylist.m3u8\n"))
+	assert.Equal(t, true, strings.Contains(string(master), `,URI="iframe.m3u8"`))
+	m.Dispose()
+
+	// 录制的点播I帧m3u8
+	c := NewRecordCatalog(config.OutPath)
+	start := time.Unix(0, 0)
+	end := time.Now().Add(time.Hour)
+	content, err = c.GenIFramePlaylist("test", start, end, "")
+	assert.Equal(t, nil, err)
+	playlist = string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:VOD\n"))
+	assert.Equal(t, true, strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n"))
+	assert.Equal(t, 5, strings.Count(playlist, "#EXT-X-PROGRAM-DATE-TIME:"))
+	assert.Equal(t, 0, strings.Count(playlist, "#EXT-X-DISCONTINUITY"))
+	assert.Equal(t, 9, checkIFramePlaylist(t, config.OutPath, playlist))
+
+	content, err = c.GenMasterPlaylist("test", start, end, "playlist?a=1", "playlist?a=1&type=iframe")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(content), "\nplaylist?a=1\n"))
+	assert.Equal(t, true, strings.Contains(string(content), `,URI="playlist?a=1&type=iframe"`))
+}
+
+func TestMuxerIFramePlaylistByteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsiframe")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+		ByteRange:          true,
+		IFramePlaylist:     true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*4+1)
+
+	content, err := ioutil.ReadFile(m.iframePlaylistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, 3, checkIFramePlaylist(t, m.outPath, playlist))
+	// 每个切片的PAT以及PMT在共用文件中的位置
+	for i := 0; i < m.nfrags; i++ {
+		frag := m.getFrag(i)
+		assert.Equal(t, true, strings.Contains(playlist, fmt.Sprintf(`BYTERANGE="%d@%d"`, len(mpegts.FixedFragmentHeader), frag.offset)))
+	}
+	m.Dispose()
+
+	// 加密时不生成
+	config.EncryptMethod = EncryptMethodAES128
+	m = NewMuxer("encrypt", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*2+1)
+	m.Dispose()
+	_, err = os.Stat(m.iframePlaylistFilename)
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = NewRecordCatalog(config.OutPath).GenIFramePlaylist("encrypt", time.Unix(0, 0), time.Now().Add(time.Hour), "/hls/")
+	assert.Equal(t, ErrRecordNotFound, err)
+}
@@ -0,0 +1,394 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 录制的清理
+//
+// Janitor定时扫描OutPath下所有流的录制索引，以切片文件为单位清理：
+// - 超过保留时长的切片
+// - 所有录制的总大小超过配额时，从最旧的切片开始删除
+// 删除切片后，同时更新录制索引以及record.m3u8，并通过JanitorObserver通知上层
+//
+// 磁盘剩余空间低于阈值时暂停录制（见recordPaused），恢复到阈值以上后继续录制
+//
+// 注意，最近一个检查周期内有修改的文件不会被删除，比如byte range时正在写入的文件
+
+const (
+	PurgeReasonMaxAge = "max_age"
+	PurgeReasonQuota  = "quota"
+
+	defaultJanitorCheckIntervalSec = 60
+
+	// 恢复录制时，要求剩余空间高于阈值的该比例，避免在阈值附近反复暂停、恢复
+	recordResumeFreeRatio = 1.1
+)
+
+type JanitorConfig struct {
+	Enable           bool           `json:"enable"`
+	CheckIntervalSec int            `json:"check_interval_sec"` // 检查间隔，如果为0，则使用默认值60秒
+	MaxAgeSec        int            `json:"max_age_sec"`        // 录制的保留时长，0表示不限制
+	AppMaxAgeSec     map[string]int `json:"app_max_age_sec"`    // 按app设置录制的保留时长，覆盖MaxAgeSec
+	MaxDiskUsageMB   int64          `json:"max_disk_usage_mb"`  // 所有录制的总大小上限，0表示不限制
+	MinFreeDiskMB    int64          `json:"min_free_disk_mb"`   // 磁盘剩余空间低于该值时暂停录制，0表示不检查
+}
+
+type JanitorObserver interface {
+	// 每次检查中，每个流每种原因回调一次
+	//
+	OnHLSPurge(info base.HLSPurgeInfo)
+}
+
+type Janitor struct {
+	outPath  string
+	config   JanitorConfig
+	observer JanitorObserver
+
+	exitChan    chan struct{}
+	disposeOnce sync.Once
+	log         log.Logger
+}
+
+// 录制中的一个文件，以及属于该文件的所有切片
+type recordFile struct {
+	appName    string
+	streamName string
+	filename   string
+	parts      []string // LL-HLS的part文件
+	start      int64
+	end        int64
+	size       int64 // 包含part文件
+	modTime    time.Time
+	exist      bool
+}
+
+// @param outPath 与MuxerConfig.OutPath相同
+// @param observer 可以为nil
+func NewJanitor(outPath string, config JanitorConfig, observer JanitorObserver, logger log.Logger) *Janitor {
+	j := &Janitor{
+		outPath:  outPath,
+		config:   config,
+		observer: observer,
+		exitChan: make(chan struct{}),
+		log:      logger,
+	}
+	j.Log().Info("lifecycle new hls janitor. janitor=%p, outPath=%s", j, outPath)
+	return j
+}
+
+func (j *Janitor) Log() log.Logger {
+	if j.log == nil {
+		j.log = log.DefaultBeeLogger
+	}
+	j.log.WithPrefix("pkg.hls.janitor")
+	return j.log
+}
+
+func (j *Janitor) RunLoop() {
+	t := time.NewTicker(j.checkInterval())
+	defer t.Stop()
+
+	j.check(time.Now())
+	for {
+		select {
+		case <-j.exitChan:
+			return
+		case now := <-t.C:
+			j.check(now)
+		}
+	}
+}
+
+func (j *Janitor) Dispose() {
+	j.disposeOnce.Do(func() {
+		j.Log().Info("lifecycle dispose hls janitor.")
+		close(j.exitChan)
+	})
+}
+
+func (j *Janitor) check(now time.Time) {
+	j.checkDiskFree()
+
+	files := j.scan()
+	infos := j.purge(files, now)
+	if j.observer != nil {
+		for _, info := range infos {
+			j.observer.OnHLSPurge(info)
+		}
+	}
+}
+
+func (j *Janitor) checkDiskFree() {
+	if j.config.MinFreeDiskMB <= 0 {
+		return
+	}
+	free, err := diskFreeBytes(j.outPath)
+	if err != nil {
+		return
+	}
+	minFree := uint64(j.config.MinFreeDiskMB) * 1024 * 1024
+	if !IsRecordPaused() && free < minFree {
+		j.Log().Warn("disk free space too low, pause hls record. free=%dMB, min=%dMB", free/1024/1024, j.config.MinFreeDiskMB)
+		setRecordPaused(true)
+	} else if IsRecordPaused() && float64(free) >= float64(minFree)*recordResumeFreeRatio {
+		j.Log().Info("disk free space recovered, resume hls record. free=%dMB, min=%dMB", free/1024/1024, j.config.MinFreeDiskMB)
+		setRecordPaused(false)
+	}
+}
+
+// @return 所有流的录制文件
+func (j *Janitor) scan() []*recordFile {
+	streamNames, err := NewRecordCatalog(j.outPath).ListStreams()
+	if err != nil {
+		return nil
+	}
+	var files []*recordFile
+	for _, streamName := range streamNames {
+		files = append(files, j.scanStream(streamName)...)
+	}
+	return files
+}
+
+func (j *Janitor) scanStream(streamName string) []*recordFile {
+	streamOutPath := getMuxerOutPath(j.outPath, streamName)
+	segs, err := readRecordIndex(getRecordIndexFilename(streamOutPath))
+	if err != nil {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(streamOutPath)
+	if err != nil {
+		return nil
+	}
+
+	name2File := make(map[string]*recordFile)
+	var files []*recordFile
+	for _, seg := range segs {
+		f, ok := name2File[seg.Filename]
+		if !ok {
+			f = &recordFile{
+				appName:    seg.App,
+				streamName: streamName,
+				filename:   seg.Filename,
+				start:      seg.Start,
+			}
+			name2File[seg.Filename] = f
+			files = append(files, f)
+		}
+		if seg.End > f.end {
+			f.end = seg.End
+		}
+	}
+	for _, fi := range fis {
+		if f, ok := name2File[fi.Name()]; ok {
+			f.exist = true
+			f.size += fi.Size()
+			if fi.ModTime().After(f.modTime) {
+				f.modTime = fi.ModTime()
+			}
+			continue
+		}
+		// LL-HLS的part文件，比如1607342284-5.0.ts属于1607342284-5.ts
+		if isPartFilename(fi.Name()) {
+			ext := filepath.Ext(fi.Name())
+			stem := strings.TrimSuffix(fi.Name(), ext)
+			parent := strings.TrimSuffix(stem, filepath.Ext(stem)) + ext
+			if f, ok := name2File[parent]; ok {
+				f.parts = append(f.parts, fi.Name())
+				f.size += fi.Size()
+			}
+		}
+	}
+	return files
+}
+
+// 删除过期以及超出配额的文件，并更新录制索引
+//
+// @return 需要通知上层的清理信息
+func (j *Janitor) purge(files []*recordFile, now time.Time) []base.HLSPurgeInfo {
+	protectTime := now.Add(-j.checkInterval())
+	nowMS := now.UnixNano() / 1e6
+
+	file2Reason := make(map[*recordFile]string)
+	var remain []*recordFile
+	var totalSize int64
+	for _, f := range files {
+		if !f.exist {
+			// 文件已经不存在，比如被手动删除了，只从录制索引中删除，不通知
+			file2Reason[f] = ""
+			continue
+		}
+		maxAgeSec := j.maxAgeSec(f.appName)
+		if maxAgeSec > 0 && nowMS-f.end > int64(maxAgeSec)*1000 && f.modTime.Before(protectTime) {
+			file2Reason[f] = PurgeReasonMaxAge
+			continue
+		}
+		remain = append(remain, f)
+		totalSize += f.size
+	}
+
+	if j.config.MaxDiskUsageMB > 0 {
+		quota := j.config.MaxDiskUsageMB * 1024 * 1024
+		sort.SliceStable(remain, func(i, k int) bool {
+			return remain[i].end < remain[k].end
+		})
+		for _, f := range remain {
+			if totalSize <= quota {
+				break
+			}
+			if !f.modTime.Before(protectTime) {
+				continue
+			}
+			file2Reason[f] = PurgeReasonQuota
+			totalSize -= f.size
+		}
+		if totalSize > quota {
+			j.Log().Warn("hls record disk usage still over quota. usage=%dMB, quota=%dMB", totalSize/1024/1024, j.config.MaxDiskUsageMB)
+		}
+	}
+
+	if len(file2Reason) == 0 {
+		return nil
+	}
+
+	// 按流删除文件以及更新录制索引，通知信息按流以及原因聚合
+	stream2Removed := make(map[string]map[string]bool)
+	key2Info := make(map[string]*base.HLSPurgeInfo)
+	var keys []string
+	for _, f := range files {
+		reason, ok := file2Reason[f]
+		if !ok {
+			continue
+		}
+		streamOutPath := getMuxerOutPath(j.outPath, f.streamName)
+		if f.exist {
+			if err := os.Remove(getTSFilenameWithPath(streamOutPath, f.filename)); err != nil && !os.IsNotExist(err) {
+				j.Log().Warn("remove hls record file error. file=%s, err=%+v", f.filename, err)
+				continue
+			}
+			for _, part := range f.parts {
+				_ = os.Remove(getTSFilenameWithPath(streamOutPath, part))
+			}
+		}
+		if stream2Removed[f.streamName] == nil {
+			stream2Removed[f.streamName] = make(map[string]bool)
+		}
+		stream2Removed[f.streamName][f.filename] = true
+
+		if reason == "" {
+			continue
+		}
+		key := f.streamName + "/" + reason
+		info, ok := key2Info[key]
+		if !ok {
+			info = &base.HLSPurgeInfo{
+				AppName:    f.appName,
+				StreamName: f.streamName,
+				Reason:     reason,
+				Start:      f.start,
+				End:        f.end,
+			}
+			key2Info[key] = info
+			keys = append(keys, key)
+		}
+		info.Files = append(info.Files, f.filename)
+		info.Bytes += f.size
+		if f.start < info.Start {
+			info.Start = f.start
+		}
+		if f.end > info.End {
+			info.End = f.end
+		}
+	}
+
+	for streamName, removed := range stream2Removed {
+		if err := pruneRecordIndex(getMuxerOutPath(j.outPath, streamName), removed); err != nil {
+			j.Log().Error("prune hls record index error. streamName=%s, err=%+v", streamName, err)
+		}
+	}
+
+	var infos []base.HLSPurgeInfo
+	for _, key := range keys {
+		info := key2Info[key]
+		j.Log().Info("purge hls record. streamName=%s, reason=%s, files=%d, bytes=%d", info.StreamName, info.Reason, len(info.Files), info.Bytes)
+		infos = append(infos, *info)
+	}
+	return infos
+}
+
+func (j *Janitor) maxAgeSec(appName string) int {
+	if v, ok := j.config.AppMaxAgeSec[appName]; ok {
+		return v
+	}
+	return j.config.MaxAgeSec
+}
+
+func (j *Janitor) checkInterval() time.Duration {
+	if j.config.CheckIntervalSec <= 0 {
+		return defaultJanitorCheckIntervalSec * time.Second
+	}
+	return time.Duration(j.config.CheckIntervalSec) * time.Second
+}
+
+// 从录制索引中删除已经被删除的文件中的切片，并重新生成record.m3u8
+// 注意，重新读取录制索引，因为扫描之后Muxer可能追加了新的切片
+//
+// @param removed 被删除的文件名
+func pruneRecordIndex(streamOutPath string, removed map[string]bool) error {
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
+
+	indexFilename := getRecordIndexFilename(streamOutPath)
+	segs, err := readRecordIndex(indexFilename)
+	if err != nil {
+		return err
+	}
+	var kept []recordSegment
+	var buf bytes.Buffer
+	for _, seg := range segs {
+		if removed[seg.Filename] {
+			continue
+		}
+		b, err := json.Marshal(seg)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+		kept = append(kept, seg)
+	}
+
+	playlistFilename := getRecordM3U8Filename(streamOutPath, "")
+	if len(kept) == 0 {
+		_ = os.Remove(playlistFilename)
+		_ = os.Remove(playlistFilename + ".bak")
+		return os.Remove(indexFilename)
+	}
+
+	if err := writeM3U8File(buf.Bytes(), indexFilename, indexFilename+".bak"); err != nil {
+		return err
+	}
+	content := genRecordPlaylist(kept, "", func(filename string) string {
+		return filename
+	})
+	return writeM3U8File(content, playlistFilename, playlistFilename+".bak")
+}
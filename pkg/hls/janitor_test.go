@@ -0,0 +1,195 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+type janitorTestObserver struct {
+	infos []base.HLSPurgeInfo
+}
+
+func (o *janitorTestObserver) OnHLSPurge(info base.HLSPurgeInfo) {
+	o.infos = append(o.infos, info)
+}
+
+func countFiles(t *testing.T, dir string, suffix string) int {
+	fis, err := ioutil.ReadDir(dir)
+	assert.Equal(t, nil, err)
+	var n int
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), suffix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestJanitorMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsjanitor")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.SetAppName("live")
+	m.Start()
+	feedEncryptTestMuxer(m, 25*5+1)
+	m.Dispose()
+
+	segs, err := readRecordIndex(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, len(segs))
+	assert.Equal(t, "live", segs[0].App)
+
+	// app的保留时长覆盖全局配置
+	o := &janitorTestObserver{}
+	j := NewJanitor(config.OutPath, JanitorConfig{MaxAgeSec: 1, AppMaxAgeSec: map[string]int{"live": 3600}}, o, log.DefaultBeeLogger)
+	j.check(time.Now())
+	assert.Equal(t, 0, len(o.infos))
+	assert.Equal(t, 6, countFiles(t, m.outPath, ".ts"))
+
+	// 前3个切片过期
+	j.check(time.Unix(0, (segs[2].End+3600*1000+1)*1e6))
+	assert.Equal(t, 1, len(o.infos))
+	info := o.infos[0]
+	assert.Equal(t, "live", info.AppName)
+	assert.Equal(t, "test", info.StreamName)
+	assert.Equal(t, PurgeReasonMaxAge, info.Reason)
+	assert.Equal(t, []string{segs[0].Filename, segs[1].Filename, segs[2].Filename}, info.Files)
+	assert.Equal(t, segs[0].Start, info.Start)
+	assert.Equal(t, segs[2].End, info.End)
+	assert.Equal(t, true, info.Bytes > 0)
+	assert.Equal(t, 3, countFiles(t, m.outPath, ".ts"))
+
+	// 录制索引以及record.m3u8中只剩下未过期的切片
+	kept, err := readRecordIndex(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, segs[3:], kept)
+	record, err := ioutil.ReadFile(m.recordPlayListFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, strings.Count(string(record), "#EXTINF:"))
+	assert.Equal(t, false, strings.Contains(string(record), segs[2].Filename))
+	assert.Equal(t, true, strings.HasSuffix(string(record), "#EXT-X-ENDLIST\n"))
+
+	// 手动删除的文件只从录制索引中删除，不通知
+	assert.Equal(t, nil, os.Remove(m.outPath+segs[3].Filename))
+	j.check(time.Now())
+	assert.Equal(t, 1, len(o.infos))
+	kept, err = readRecordIndex(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(kept))
+
+	// 全部过期后删除录制索引
+	j.check(time.Unix(0, (segs[5].End+3600*1000+1)*1e6))
+	assert.Equal(t, 2, len(o.infos))
+	_, err = os.Stat(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(m.recordPlayListFilename)
+	assert.Equal(t, true, os.IsNotExist(err))
+	streamNames, err := NewRecordCatalog(config.OutPath).ListStreams()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(streamNames))
+}
+
+func TestJanitorQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsjanitor")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// 两路流，每路2个400KB的切片，总大小1.6MB
+	content := make([]byte, 400*1024)
+	startMS := time.Now().Add(-time.Hour).UnixNano() / 1e6
+	for i, streamName := range []string{"a", "b"} {
+		outPath := getMuxerOutPath(dir+"/", streamName)
+		assert.Equal(t, nil, os.MkdirAll(outPath, 0777))
+		var index []byte
+		for k := 0; k < 2; k++ {
+			seg := recordSegment{ID: k, Filename: streamName + string(rune('0'+k)) + ".ts", Duration: 1}
+			seg.Start = startMS + int64(k*2+i)*1000
+			seg.End = seg.Start + 1000
+			assert.Equal(t, nil, ioutil.WriteFile(outPath+seg.Filename, content, 0666))
+			b, _ := json.Marshal(seg)
+			index = append(index, append(b, '\n')...)
+		}
+		// LL-HLS的part文件随切片一起删除
+		assert.Equal(t, nil, ioutil.WriteFile(outPath+streamName+"0.0.ts", content[:1024], 0666))
+		assert.Equal(t, nil, ioutil.WriteFile(getRecordIndexFilename(outPath), index, 0666))
+	}
+
+	// 从最旧的切片开始删除，直到不超过配额
+	o := &janitorTestObserver{}
+	j := NewJanitor(dir+"/", JanitorConfig{MaxDiskUsageMB: 1}, o, log.DefaultBeeLogger)
+	j.check(time.Now().Add(time.Hour))
+	assert.Equal(t, 2, len(o.infos))
+	for _, info := range o.infos {
+		assert.Equal(t, PurgeReasonQuota, info.Reason)
+		assert.Equal(t, []string{info.StreamName + "0.ts"}, info.Files)
+		assert.Equal(t, int64(400*1024+1024), info.Bytes)
+	}
+	assert.Equal(t, 1, countFiles(t, dir+"/a/", ".ts"))
+	assert.Equal(t, 1, countFiles(t, dir+"/b/", ".ts"))
+
+	// 切片已经过期，但是最近一个检查周期内有修改，不删除
+	o.infos = nil
+	j = NewJanitor(dir+"/", JanitorConfig{MaxAgeSec: 1}, o, log.DefaultBeeLogger)
+	j.check(time.Now())
+	assert.Equal(t, 0, len(o.infos))
+}
+
+func TestJanitorRecordPause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsjanitor")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	defer setRecordPaused(false)
+
+	// 磁盘剩余空间不足时暂停录制
+	j := NewJanitor(dir+"/", JanitorConfig{MinFreeDiskMB: 1 << 40}, nil, log.DefaultBeeLogger)
+	j.check(time.Now())
+	assert.Equal(t, true, IsRecordPaused())
+
+	// 暂停录制时只保留直播窗口中的切片
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*10+1)
+	assert.Equal(t, 2*config.FragmentNum+1, countFiles(t, m.outPath, ".ts"))
+	_, err = os.Stat(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(m.recordPlayListFilename)
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	j.config.MinFreeDiskMB = 1
+	j.check(time.Now())
+	assert.Equal(t, false, IsRecordPaused())
+	feedEncryptTestMuxer(m, 25*3+1)
+	segs, err := readRecordIndex(getRecordIndexFilename(m.outPath))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, len(segs) > 0)
+}
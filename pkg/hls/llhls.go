@@ -0,0 +1,309 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LL-HLS（Low-Latency HLS）
+// https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis
+//
+// #EXT-X-SERVER-CONTROL  // 服务端能力，支持阻塞请求，以及delta update
+// #EXT-X-PART-INF        // part的目标时长
+// #EXT-X-PART            // 已完成的part
+// #EXT-X-PRELOAD-HINT    // 正在生成的part，播放器可以提前请求，服务端阻塞直到该part生成
+// #EXT-X-SKIP            // delta update时，替代被省略的fragment
+//
+// 请求m3u8时的参数
+// _HLS_msn=<M>           // 阻塞直到m3u8中包含序号为M的fragment
+// _HLS_part=<N>          // 和_HLS_msn一起使用，阻塞直到m3u8中包含序号为M的fragment的第N个part
+// _HLS_skip=YES|v2       // 返回delta update的m3u8
+
+var (
+	ErrLLHLSBadRequest = errors.New("lal.hls: bad blocking request")
+	ErrLLHLSTimeout    = errors.New("lal.hls: blocking request timeout")
+)
+
+const (
+	defaultPartDurationMS = 200
+
+	// m3u8中列出part的已完成fragment数量（不包含正在生成的fragment）
+	partFragmentNum = 3
+
+	// `PART-HOLD-BACK`为part时长的倍数，标准要求至少为3
+	partHoldBackNum = 3
+
+	// `CAN-SKIP-UNTIL`为`#EXT-X-TARGETDURATION`的倍数，标准要求至少为6
+	canSkipUntilNum = 6
+
+	// 阻塞请求的最长等待时间为`#EXT-X-TARGETDURATION`的倍数
+	blockingReloadTimeoutNum = 3
+
+	// 请求还没有生成的part时，最长等待时间
+	partWaitTimeoutMS = 3000
+)
+
+type partInfo struct {
+	duration    float64
+	filename    string
+	independent bool
+}
+
+func writeParts(buf *bytes.Buffer, parts []partInfo) {
+	for _, part := range parts {
+		buf.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.duration, part.filename))
+		if part.independent {
+			buf.WriteString(",INDEPENDENT=YES")
+		}
+		buf.WriteString("\n")
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// Muxer更新m3u8后，唤醒Server中等待的阻塞请求
+//
+// key为流的输出目录，Muxer和Server使用相同的OutPath时，key相同
+// 只有请求确实需要阻塞时才注册等待，请求结束后释放，没有请求等待时删除，避免不存在的流名称导致map一直增长
+type playlistNotifier struct {
+	m              sync.Mutex
+	key2Waiter     map[string]*playlistWaiter
+	lowLatencyKeys map[string]struct{} // 开启了LL-HLS，并且正在运行的Muxer
+}
+
+type playlistWaiter struct {
+	ch       chan struct{}
+	refCount int
+}
+
+var notifier = playlistNotifier{
+	key2Waiter:     make(map[string]*playlistWaiter),
+	lowLatencyKeys: make(map[string]struct{}),
+}
+
+func notifyPlaylistUpdate(key string) {
+	notifier.m.Lock()
+	defer notifier.m.Unlock()
+	if w, ok := notifier.key2Waiter[key]; ok {
+		close(w.ch)
+		delete(notifier.key2Waiter, key)
+	}
+}
+
+// 注意，需要在读取m3u8之前获取，避免错过读取和等待之间的更新
+//
+// @return ch      下一次m3u8更新时，该channel被关闭
+// @return release 不再等待时必须调用，包括超时以及请求被取消
+func waitPlaylistUpdate(key string) (ch <-chan struct{}, release func()) {
+	notifier.m.Lock()
+	defer notifier.m.Unlock()
+	w, ok := notifier.key2Waiter[key]
+	if !ok {
+		w = &playlistWaiter{ch: make(chan struct{})}
+		notifier.key2Waiter[key] = w
+	}
+	w.refCount++
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			notifier.m.Lock()
+			defer notifier.m.Unlock()
+			w.refCount--
+			// 已经被notifyPlaylistUpdate删除时，map中可能是新的waiter
+			if w.refCount == 0 && notifier.key2Waiter[key] == w {
+				delete(notifier.key2Waiter, key)
+			}
+		})
+	}
+}
+
+// Muxer开启LL-HLS时，在Start以及Dispose中调用，Server只对开启了LL-HLS的流处理阻塞请求
+func setLowLatencyStream(key string, enable bool) {
+	notifier.m.Lock()
+	defer notifier.m.Unlock()
+	if enable {
+		notifier.lowLatencyKeys[key] = struct{}{}
+	} else {
+		delete(notifier.lowLatencyKeys, key)
+	}
+}
+
+func isLowLatencyStream(key string) bool {
+	notifier.m.Lock()
+	defer notifier.m.Unlock()
+	_, ok := notifier.lowLatencyKeys[key]
+	return ok
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type blockingRequest struct {
+	msn  int64
+	part int // -1表示没有_HLS_part
+	skip bool
+}
+
+// @return hasMSN 是否为阻塞请求
+func parseBlockingRequest(query url.Values) (br blockingRequest, hasMSN bool, err error) {
+	br.part = -1
+	if v := query.Get("_HLS_skip"); v == "YES" || v == "v2" {
+		br.skip = true
+	}
+
+	msn, part := query.Get("_HLS_msn"), query.Get("_HLS_part")
+	if msn == "" {
+		if part != "" {
+			return br, false, ErrLLHLSBadRequest
+		}
+		return br, false, nil
+	}
+	if br.msn, err = strconv.ParseInt(msn, 10, 64); err != nil || br.msn < 0 {
+		return br, false, ErrLLHLSBadRequest
+	}
+	if part != "" {
+		if br.part, err = strconv.Atoi(part); err != nil || br.part < 0 {
+			return br, false, ErrLLHLSBadRequest
+		}
+	}
+	return br, true, nil
+}
+
+// m3u8当前的生成进度
+type playlistPosition struct {
+	targetDuration float64
+	nextMSN        int64 // 正在生成的fragment的序号，也即已完成的最后一个fragment的序号+1
+	partNum        int   // 正在生成的fragment中，已完成的part数量
+	endList        bool
+}
+
+func parsePlaylistPosition(content []byte) (pos playlistPosition) {
+	var segNum int64
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			pos.targetDuration, _ = strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			pos.nextMSN, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			pos.partNum++
+		case line == "#EXT-X-ENDLIST":
+			pos.endList = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segNum++
+			pos.partNum = 0
+		}
+	}
+	pos.nextMSN += segNum
+	return
+}
+
+// @return 阻塞请求是否已经可以返回
+func (pos playlistPosition) contains(br blockingRequest) bool {
+	if pos.endList || br.msn < pos.nextMSN {
+		return true
+	}
+	return br.part != -1 && br.msn == pos.nextMSN && br.part < pos.partNum
+}
+
+// 生成delta update的m3u8，将距离结尾超过`CAN-SKIP-UNTIL`的fragment替换为`#EXT-X-SKIP`
+//
+// @return 如果不支持或者不需要省略，返回原内容
+func skipPlaylistSegments(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+
+	type segment struct {
+		begin    int // 所在行的下标
+		end      int
+		duration float64
+		discont  bool
+	}
+	var (
+		skipUntil float64
+		header    = -1 // 第一个fragment开始的行的下标
+		segs      []segment
+		curr      = segment{begin: -1}
+		total     float64
+	)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:") {
+			for _, attr := range strings.Split(strings.TrimPrefix(line, "#EXT-X-SERVER-CONTROL:"), ",") {
+				if strings.HasPrefix(attr, "CAN-SKIP-UNTIL=") {
+					skipUntil, _ = strconv.ParseFloat(strings.TrimPrefix(attr, "CAN-SKIP-UNTIL="), 64)
+				}
+			}
+			continue
+		}
+
+		isSegmentTag := strings.HasPrefix(line, "#EXTINF:") || strings.HasPrefix(line, "#EXT-X-PART:") || line == "#EXT-X-DISCONTINUITY" || strings.HasPrefix(line, "#EXT-X-KEY:") || strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")
+		if isSegmentTag && curr.begin == -1 {
+			curr.begin = i
+			if header == -1 {
+				header = i
+			}
+		}
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if j := strings.IndexByte(v, ','); j != -1 {
+				v = v[:j]
+			}
+			curr.duration, _ = strconv.ParseFloat(v, 64)
+		case line == "#EXT-X-DISCONTINUITY":
+			curr.discont = true
+		case line != "" && !strings.HasPrefix(line, "#") && curr.begin != -1:
+			curr.end = i + 1
+			segs = append(segs, curr)
+			total += curr.duration
+			curr = segment{begin: -1}
+		}
+	}
+	if skipUntil <= 0 || header == -1 {
+		return content
+	}
+
+	// 从头开始省略，开始位置距离结尾超过skipUntil的fragment
+	// 注意，没有写`#EXT-X-DISCONTINUITY-SEQUENCE`，所以不能省略带有`#EXT-X-DISCONTINUITY`的fragment
+	var (
+		skipped int
+		start   float64
+	)
+	for _, seg := range segs {
+		if seg.discont || total-start <= skipUntil {
+			break
+		}
+		start += seg.duration
+		skipped++
+	}
+	if skipped == 0 {
+		return content
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines[:header] {
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			// `#EXT-X-SKIP`要求版本号至少为9
+			line = "#EXT-X-VERSION:9"
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped))
+	buf.WriteString(strings.Join(lines[segs[skipped-1].end:], "\n"))
+	return buf.Bytes()
+}
@@ -0,0 +1,171 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+// 模拟每40毫秒一帧视频，每秒一个关键帧
+func feedLowLatencyMuxer(t *testing.T, m *Muxer, from, to int) {
+	for i := from; i < to; i++ {
+		ts := uint64(i * 40 * 90)
+		key := i%25 == 0
+		assert.Equal(t, nil, m.updateFragment(ts, key))
+		m.updatePart(ts, key)
+	}
+}
+
+func TestMuxerLowLatency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llhls")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+		LowLatency:         true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedLowLatencyMuxer(t, m, 0, 63)
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	pos := parsePlaylistPosition(content)
+	assert.Equal(t, int64(2), pos.nextMSN)
+	assert.Equal(t, 2, pos.partNum)
+	assert.Equal(t, true, strings.Contains(string(content), "#EXT-X-PART-INF:PART-TARGET=0.200\n"))
+	assert.Equal(t, true, strings.Contains(string(content), "INDEPENDENT=YES"))
+	frag := m.getCurrFrag()
+	assert.Equal(t, true, strings.Contains(string(content), `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="`+getPartFilename(frag.filename, 2)+`"`))
+	_, err = os.Stat(m.outPath + getPartFilename(frag.filename, 1))
+	assert.Equal(t, nil, err)
+
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+
+	// 已经存在的part，不阻塞
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8?_HLS_msn=2&_HLS_part=1", nil))
+	assert.Equal(t, 200, resp.Code)
+
+	// 超过最后一个fragment的序号+2
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8?_HLS_msn=4", nil))
+	assert.Equal(t, 400, resp.Code)
+
+	// 阻塞直到下一个part生成
+	done := make(chan *httptest.ResponseRecorder, 2)
+	go func() {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8?_HLS_msn=2&_HLS_part=2", nil))
+		done <- resp
+	}()
+	go func() {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/"+getPartFilename(frag.filename, 2), nil))
+		done <- resp
+	}()
+	select {
+	case <-done:
+		t.Fatal("blocking request returned before part ready")
+	case <-time.After(100 * time.Millisecond):
+	}
+	feedLowLatencyMuxer(t, m, 63, 66)
+	for i := 0; i < 2; i++ {
+		resp = <-done
+		assert.Equal(t, 200, resp.Code)
+	}
+
+	m.Dispose()
+	content, err = ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.HasSuffix(string(content), "#EXT-X-ENDLIST\n"))
+	assert.Equal(t, false, strings.Contains(string(content), "#EXT-X-PRELOAD-HINT"))
+	assert.Equal(t, false, isLowLatencyStream(m.outPath))
+}
+
+// 只有确实阻塞的请求才注册等待，请求结束后释放
+func TestPlaylistNotifier(t *testing.T) {
+	s := NewServer("", "/tmp/lal_hls_notifier_test/", log.DefaultBeeLogger)
+	for _, path := range []string{
+		"/hls/notexist/playlist.m3u8?_HLS_msn=1&_HLS_part=0",
+		"/hls/notexist/playlist.m3u8",
+		"/hls/notexist/notexist-1.0.ts",
+	} {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 404, resp.Code)
+	}
+	assert.Equal(t, 0, len(notifier.key2Waiter))
+
+	// 超时以及请求被取消时释放
+	ch1, release1 := waitPlaylistUpdate("key")
+	ch2, release2 := waitPlaylistUpdate("key")
+	assert.Equal(t, ch1, ch2)
+	release1()
+	release1()
+	assert.Equal(t, 1, len(notifier.key2Waiter))
+	release2()
+	assert.Equal(t, 0, len(notifier.key2Waiter))
+
+	// 更新后释放旧的等待，不影响新的等待
+	ch1, release1 = waitPlaylistUpdate("key")
+	notifyPlaylistUpdate("key")
+	<-ch1
+	_, release2 = waitPlaylistUpdate("key")
+	release1()
+	assert.Equal(t, 1, len(notifier.key2Waiter))
+	release2()
+	assert.Equal(t, 0, len(notifier.key2Waiter))
+}
+
+func TestParseBlockingRequest(t *testing.T) {
+	s := NewServer("", "", log.DefaultBeeLogger)
+	for _, query := range []string{"_HLS_part=1", "_HLS_msn=a", "_HLS_msn=1&_HLS_part=-1"} {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8?"+query, nil))
+		assert.Equal(t, 400, resp.Code)
+	}
+}
+
+func TestSkipPlaylistSegments(t *testing.T) {
+	golden := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:1\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.600,CAN-SKIP-UNTIL=6.000\n" +
+		"#EXT-X-PART-INF:PART-TARGET=0.200\n#EXT-X-MEDIA-SEQUENCE:0\n\n"
+	for i := 0; i < 10; i++ {
+		golden += "#EXTINF:1.000,\n" + string(rune('a'+i)) + ".ts\n"
+	}
+	golden += "#EXT-X-PART:DURATION=0.200,URI=\"k.0.ts\",INDEPENDENT=YES\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"k.1.ts\"\n"
+
+	content := string(skipPlaylistSegments([]byte(golden)))
+	assert.Equal(t, true, strings.Contains(content, "#EXT-X-VERSION:9\n"))
+	assert.Equal(t, true, strings.Contains(content, "#EXT-X-SKIP:SKIPPED-SEGMENTS=4\n#EXTINF:1.000,\ne.ts\n"))
+	assert.Equal(t, false, strings.Contains(content, "d.ts"))
+	assert.Equal(t, true, strings.HasSuffix(content, "URI=\"k.1.ts\"\n"))
+
+	// 带有不连续标志的fragment不能省略
+	discont := strings.Replace(golden, "#EXTINF:1.000,\nc.ts", "#EXT-X-DISCONTINUITY\n#EXTINF:1.000,\nc.ts", 1)
+	content = string(skipPlaylistSegments([]byte(discont)))
+	assert.Equal(t, true, strings.Contains(content, "#EXT-X-SKIP:SKIPPED-SEGMENTS=2\n#EXT-X-DISCONTINUITY\n"))
+
+	// 没有开启LL-HLS
+	plain := strings.Replace(golden, "#EXT-X-SERVER-CONTROL", "#EXT-X-FOO", 1)
+	assert.Equal(t, plain, string(skipPlaylistSegments([]byte(plain))))
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // @param content     需写入文件的内容
@@ -87,3 +88,108 @@ func CalcM3U8Duration(content []byte) (durationSec float64, err error) {
 	}
 	return
 }
+
+type PlaylistSegment struct {
+	URI           string
+	Duration      float64 // 单位秒
+	Sequence      int64   // 由`#EXT-X-MEDIA-SEQUENCE`以及在列表中的位置计算得出
+	Discontinuity bool    // 该TS之前存在`#EXT-X-DISCONTINUITY`
+}
+
+type PlaylistVariant struct {
+	URI       string
+	Bandwidth int
+}
+
+// 如果是master playlist，则Variants不为空，其他字段无效
+type Playlist struct {
+	TargetDuration float64 // 单位秒
+	MediaSequence  int64
+	EndList        bool
+	Segments       []PlaylistSegment
+	Variants       []PlaylistVariant
+}
+
+// 解析m3u8文件内容，只解析拉流需要的字段
+//
+// @param content m3u8文件内容
+func ParseM3U8(content []byte) (playlist Playlist, err error) {
+	lines := strings.Split(string(content), "\n")
+
+	var (
+		gotHeader     bool
+		duration      float64
+		discontinuity bool
+		bandwidth     int
+		isVariant     bool
+		index         int64
+	)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !gotHeader {
+			if line != "#EXTM3U" {
+				return playlist, ErrHLS
+			}
+			gotHeader = true
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if playlist.TargetDuration, err = strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			if playlist.MediaSequence, err = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64); err != nil {
+				return
+			}
+		case line == "#EXT-X-ENDLIST":
+			playlist.EndList = true
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.IndexByte(v, ','); i != -1 {
+				v = v[:i]
+			}
+			if duration, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			isVariant = true
+			bandwidth = 0
+			for _, attr := range strings.Split(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"), ",") {
+				if strings.HasPrefix(attr, "BANDWIDTH=") {
+					bandwidth, _ = strconv.Atoi(strings.TrimPrefix(attr, "BANDWIDTH="))
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+			// 其他tag以及注释，忽略
+		default:
+			if isVariant {
+				playlist.Variants = append(playlist.Variants, PlaylistVariant{
+					URI:       line,
+					Bandwidth: bandwidth,
+				})
+				isVariant = false
+				continue
+			}
+			playlist.Segments = append(playlist.Segments, PlaylistSegment{
+				URI:           line,
+				Duration:      duration,
+				Sequence:      playlist.MediaSequence + index,
+				Discontinuity: discontinuity,
+			})
+			index++
+			duration = 0
+			discontinuity = false
+		}
+	}
+	if !gotHeader {
+		return playlist, ErrHLS
+	}
+	return playlist, nil
+}
@@ -48,3 +48,39 @@ func TestCalcM3U8Duration(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, float64(39.2), duration)
 }
+
+func TestParseM3U8(t *testing.T) {
+	golden := []byte(`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:5
+#EXT-X-MEDIA-SEQUENCE:10
+
+#EXTINF:4.000,
+10.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:3.333,
+11.ts
+#EXT-X-ENDLIST
+`)
+	p, err := ParseM3U8(golden)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(5), p.TargetDuration)
+	assert.Equal(t, int64(10), p.MediaSequence)
+	assert.Equal(t, true, p.EndList)
+	assert.Equal(t, 2, len(p.Segments))
+	assert.Equal(t, PlaylistSegment{URI: "10.ts", Duration: 4, Sequence: 10}, p.Segments[0])
+	assert.Equal(t, PlaylistSegment{URI: "11.ts", Duration: 3.333, Sequence: 11, Discontinuity: true}, p.Segments[1])
+
+	master := []byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720
+high/index.m3u8
+`)
+	p, err = ParseM3U8(master)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []PlaylistVariant{{URI: "low/index.m3u8", Bandwidth: 800000}, {URI: "high/index.m3u8", Bandwidth: 2000000}}, p.Variants)
+
+	_, err = ParseM3U8([]byte("hello"))
+	assert.Equal(t, ErrHLS, err)
+}
@@ -0,0 +1,131 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// 内存模式（MuxerConfig.InMemory），m3u8以及切片不写磁盘，保存在内存中，由Server直接读取
+//
+// key为流的输出目录，和notifier相同，Muxer和Server使用相同的OutPath时，key相同
+// 切片随Muxer中fragment环形队列的覆盖而淘汰，所以每路流最多保存`2 * FragmentNum + 1`个切片
+
+var ErrMemoryFileNotFound = errors.New("lal.hls: memory file not found")
+
+type memoryStream struct {
+	m             sync.RWMutex
+	filename2Data map[string][]byte
+}
+
+type memoryStore struct {
+	m          sync.Mutex
+	key2Stream map[string]*memoryStream
+}
+
+var memStore = memoryStore{
+	key2Stream: make(map[string]*memoryStream),
+}
+
+// 创建新的内存流，如果已经存在，则替换为空的内存流
+func newMemoryStream(key string) *memoryStream {
+	ms := &memoryStream{
+		filename2Data: make(map[string][]byte),
+	}
+	memStore.m.Lock()
+	defer memStore.m.Unlock()
+	memStore.key2Stream[key] = ms
+	return ms
+}
+
+// @return 不存在时返回nil
+func getMemoryStream(key string) *memoryStream {
+	memStore.m.Lock()
+	defer memStore.m.Unlock()
+	return memStore.key2Stream[key]
+}
+
+// 流结束后，由上层决定何时释放内存
+//
+// @param outPath 流的输出目录，也即Muxer.OutPath()的返回值
+func RemoveMemoryStream(outPath string) {
+	memStore.m.Lock()
+	defer memStore.m.Unlock()
+	delete(memStore.key2Stream, outPath)
+}
+
+// @param content 调用结束后，内部持有该内存块，调用方不能再修改
+func (ms *memoryStream) write(filename string, content []byte) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+	ms.filename2Data[filename] = content
+}
+
+// 内存中的切片写入后不再修改，直接在原内存块上读取，不拷贝
+func (ms *memoryStream) open(filename string) (fileReader, int64, error) {
+	content, err := ms.read(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	return memoryFileReader{bytes.NewReader(content)}, int64(len(content)), nil
+}
+
+type memoryFileReader struct {
+	*bytes.Reader
+}
+
+func (memoryFileReader) Close() error {
+	return nil
+}
+
+func (ms *memoryStream) read(filename string) ([]byte, error) {
+	ms.m.RLock()
+	defer ms.m.RUnlock()
+	content, ok := ms.filename2Data[filename]
+	if !ok {
+		return nil, ErrMemoryFileNotFound
+	}
+	return content, nil
+}
+
+func (ms *memoryStream) remove(filename string) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+	delete(ms.filename2Data, filename)
+}
+
+// 写入m3u8或者切片，内存模式时写入memoryStream，否则先写临时文件再改名
+//
+// @param content 内存模式时，内部持有该内存块
+func (m *Muxer) writeFile(content []byte, filenameWithPath string) error {
+	if m.mem != nil {
+		m.mem.write(filepath.Base(filenameWithPath), content)
+		return nil
+	}
+	return writeM3U8File(content, filenameWithPath, filenameWithPath+".bak")
+}
+
+// fragment环形队列中的位置即将被覆盖，内存模式时，淘汰该位置原来的切片以及part
+// 非内存模式时，删除暂停录制期间没有录制的切片
+func (m *Muxer) evictFrag(frag *fragmentInfo) {
+	if m.mem == nil {
+		m.removeUnrecordedFrag(frag)
+		return
+	}
+	if frag.filename == "" {
+		return
+	}
+	m.mem.remove(frag.filename)
+	for _, part := range frag.parts {
+		m.mem.remove(part.filename)
+	}
+}
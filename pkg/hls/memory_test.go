@@ -0,0 +1,83 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+func TestMuxerInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsmem")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+		InMemory:           true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+
+	// 每40毫秒一帧视频，每秒一个关键帧，生成7个切片
+	var first string
+	for i := 0; i <= 25*7; i++ {
+		assert.Equal(t, nil, m.updateFragment(uint64(i*40*90), i%25 == 0))
+		if i == 0 {
+			first = m.getCurrFrag().filename
+		}
+	}
+
+	// 不写磁盘
+	_, err = os.Stat(m.outPath)
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// 环形队列大小为2*2+1，打开第8个切片时，最早的3个切片已经被淘汰，剩余4个已完成的切片以及playlist.m3u8
+	ms := getMemoryStream(m.outPath)
+	assert.Equal(t, 4+1, len(ms.filename2Data))
+	_, err = ms.read(first)
+	assert.Equal(t, ErrMemoryFileNotFound, err)
+
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "no-cache", resp.Header().Get("Cache-Control"))
+	etag := resp.Header().Get("ETag")
+	assert.Equal(t, true, etag != "")
+
+	req := httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 304, resp.Code)
+
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/"+m.getFrag(m.nfrags-1).filename, nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "max-age=600", resp.Header().Get("Cache-Control"))
+
+	// 内存模式不生成record.m3u8
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/record.m3u8", nil))
+	assert.Equal(t, 404, resp.Code)
+
+	RemoveMemoryStream(m.OutPath())
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil))
+	assert.Equal(t, 404, resp.Code)
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/souliot/siot-av/pkg/mpegts"
@@ -37,24 +38,46 @@ type MuxerConfig struct {
 	OutPath            string `json:"out_path"` // m3u8和ts文件的输出根目录，注意，末尾需已'/'结束
 	FragmentDurationMS int    `json:"fragment_duration_ms"`
 	FragmentNum        int    `json:"fragment_num"`
+
+	LowLatency     bool `json:"low_latency"`      // 开启LL-HLS，切割part，并在m3u8中写入`#EXT-X-PART`等，需要Enable为true
+	PartDurationMS int  `json:"part_duration_ms"` // LL-HLS中part的目标时长，如果为0，则使用默认值200毫秒
+
+	SegmentType string `json:"segment_type"` // 切片格式，"ts"（默认）或者"fmp4"，fmp4时生成init.mp4以及m4s文件，支持HEVC，不支持LowLatency
+
+	InMemory bool `json:"in_memory"` // m3u8和切片保存在内存中，不写磁盘，由Server直接读取，此时不生成record.m3u8
+
+	EncryptMethod        string `json:"encrypt_method"`          // 切片加密方式，""（不加密）、"AES-128"或者"SAMPLE-AES"，fmp4切片只支持AES-128
+	KeyRotateFragmentNum int    `json:"key_rotate_fragment_num"` // 每多少个切片轮换一次密钥，0表示不轮换
+
+	ProgramDateTime bool   `json:"program_date_time"` // 每个切片前写入`#EXT-X-PROGRAM-DATE-TIME`，使用推流端onFI消息中的时钟，推流端没有携带时使用服务端的本地时间
+	PlaylistType    string `json:"playlist_type"`     // m3u8类型，""（默认，滑动窗口的直播）、"EVENT"或者"VOD"，EVENT和VOD保留所有切片，不支持InMemory
+	PlaylistFragNum int    `json:"playlist_frag_num"` // EVENT和VOD时m3u8最多保留的切片数量，超过时丢弃最早的切片，如果为0，则使用默认值7200
+	ByteRange       bool   `json:"byte_range"`        // 所有TS切片写入同一个文件，m3u8中使用`#EXT-X-BYTERANGE`，不支持fmp4、LowLatency以及InMemory
+
+	IFramePlaylist bool `json:"iframe_playlist"` // 生成I帧m3u8（iframe.m3u8）以及master.m3u8，用于快进以及缩略图，只支持不加密的TS切片
+	AlignFragment  bool `json:"align_fragment"`  // 按时间戳对齐切片，在跨越FragmentDurationMS整数倍之后的第一个关键帧切割，切片序号也由时间戳推算，用于ABR
 }
 
 type Muxer struct {
 	UniqueKey string
 
+	appName                   string // 录制索引中记录，用于按app清理录制
 	streamName                string // const after init
 	outPath                   string // const after init
 	playlistFilename          string // const after init
 	playlistFilenameBak       string // const after init
 	recordPlayListFilename    string // const after init
 	recordPlayListFilenameBak string // const after init
+	iframePlaylistFilename    string // const after init
+	masterPlaylistFilename    string // const after init
 
-	config   *MuxerConfig
-	observer MuxerObserver
+	config        *MuxerConfig
+	observer      MuxerObserver
+	eventObserver MuxerEventObserver
 
 	fragment Fragment
 	opened   bool
-	videoCC  uint8
+	videoCC  uint8 // SAMPLE-AES时，写入切片的加密TS流的CC
 	audioCC  uint8
 
 	fragTS                uint64         // 新建立fragment时的时间戳，毫秒 * 90
@@ -63,6 +86,35 @@ type Muxer struct {
 	frags                 []fragmentInfo // TS文件的环形队列，记录TS的信息，比如写M3U8文件时要用 2 * winfrags + 1
 	recordMaxFragDuration float64
 
+	// LL-HLS
+	partOpened      bool
+	partBuf         []byte  // 当前part的数据，part结束时一次性写入文件
+	partTS          uint64  // 当前part的起始时间戳，毫秒 * 90
+	partIndependent bool    // 当前part是否包含视频关键帧
+
+	// fmp4
+	fmp4      fmp4Context
+	tsStarted bool // fmp4切片时，TS流是否已经开始回调给上层
+
+	mem *memoryStream // 内存模式时不为nil
+
+	// 加密
+	key        *keyInfo // 当前使用的密钥
+	keyFragNum int      // 当前密钥已经用于多少个切片
+	asc        []byte   // AAC AudioSpecificConfig，SAMPLE-AES时写入PMT
+
+	// m3u8的可选特性
+	wallClockBase     time.Time      // wallClockBaseTS对应的时间，推流端的时钟或者服务端的本地时间
+	wallClockBaseTS   uint64         // 毫秒 * 90
+	publisherClock    time.Time      // 推流端在onFI中携带的时钟，为零值表示没有收到，或者时间戳不连续后失效
+	publisherClockTS  uint64         // 毫秒 * 90
+	publisherClockNew bool           // 当前切片开始之后是否收到过onFI
+	historyFrags      []fragmentInfo // EVENT以及VOD时，所有已经完成的切片
+	byteRangeFilename string         // byte range时，所有切片写入的文件
+	byteRangeOffset   int64          // byte range时，下一个切片在文件中的位置
+	iframeSeq         int            // 下一个关键帧在I帧m3u8中的序号
+	fragIDOffset      int            // AlignFragment时，第一个切片的序号
+
 	streamer *Streamer
 	log      log.Logger
 }
@@ -73,6 +125,19 @@ type fragmentInfo struct {
 	duration float64 // 当前fragment中数据的时长，单位秒
 	discont  bool    // #EXT-X-DISCONTINUITY
 	filename string
+	parts    []partInfo // LL-HLS中该fragment的part
+	key      *keyInfo   // 加密时使用的密钥，为nil表示不加密
+
+	programDateTime time.Time   // 切片开始时对应的时间，见updateProgramDateTime
+	recorded        bool        // 是否已经写入录制索引
+	upload          *uploadTask // 上传到对象存储的任务，为nil表示不上传
+	offset          int64       // byte range时，切片在文件中的位置
+	length          int64       // byte range时，切片的长度，为0表示不是byte range
+	size            int64       // 切片的字节数
+
+	iframes      []iframeInfo // 切片中视频关键帧的位置，开启IFramePlaylist时记录
+	iframeSeq    int          // 切片中第一个关键帧在I帧m3u8中的序号
+	headerLength int64        // 切片开头的PAT以及PMT的长度
 }
 
 // @param observer 可以为nil，如果不为nil，TS流将回调给上层
@@ -92,6 +157,8 @@ func NewMuxer(streamName string, config *MuxerConfig, observer MuxerObserver, lo
 		playlistFilenameBak:       playlistFilenameBak,
 		recordPlayListFilename:    recordPlaylistFilename,
 		recordPlayListFilenameBak: recordPlaylistFilenameBak,
+		iframePlaylistFilename:    getIFrameM3U8Filename(op),
+		masterPlaylistFilename:    getMasterM3U8Filename(op),
 		config:                    config,
 		observer:                  observer,
 		frags:                     frags,
@@ -112,26 +179,67 @@ func (m *Muxer) Log() log.Logger {
 	return m.log
 }
 
+// 需要在Start之前调用
+func (m *Muxer) SetAppName(appName string) {
+	m.appName = appName
+}
+
 func (m *Muxer) Start() {
 	m.Log().Info("[%s] start hls muxer.", m.UniqueKey)
+	if m.config.EncryptMethod != "" && m.encryptMethod() == "" {
+		m.Log().Warn("[%s] encrypt method not supported. method=%s, segmentType=%s", m.UniqueKey, m.config.EncryptMethod, m.config.SegmentType)
+	}
+	if m.config.PlaylistType != "" && m.playlistType() == "" {
+		m.Log().Warn("[%s] playlist type not supported. type=%s, inMemory=%t", m.UniqueKey, m.config.PlaylistType, m.config.InMemory)
+	}
+	if GetUploader() != nil && (m.lowLatency() || m.byteRange()) {
+		m.Log().Warn("[%s] upload not supported. lowLatency=%t, byteRange=%t", m.UniqueKey, m.lowLatency(), m.byteRange())
+	}
+	if m.config.ByteRange && !m.byteRange() {
+		m.Log().Warn("[%s] byte range not supported. segmentType=%s, lowLatency=%t, inMemory=%t", m.UniqueKey, m.config.SegmentType, m.config.LowLatency, m.config.InMemory)
+	}
 	m.ensureDir()
+	if m.lowLatency() {
+		setLowLatencyStream(m.outPath, true)
+	}
 }
 
 func (m *Muxer) Dispose() {
 	m.Log().Info("[%s] lifecycle dispose hls muxer.", m.UniqueKey)
 	m.streamer.FlushAudio()
+	if m.fmp4Mode() {
+		m.closeFMP4Segment(m.fmp4.lastTS, true)
+		return
+	}
 	if err := m.closeFragment(true); err != nil {
 		m.Log().Error("[%s] close fragment error. err=%+v", m.UniqueKey, err)
 	}
+	if m.lowLatency() {
+		setLowLatencyStream(m.outPath, false)
+	}
 }
 
 // @param msg 函数调用结束后，内部不持有msg中的内存块
 //
 func (m *Muxer) FeedRTMPMessage(msg base.RTMPMsg) {
+	if msg.IsAACSeqHeader() && len(msg.Payload) > 2 {
+		m.asc = append([]byte(nil), msg.Payload[2:]...)
+	}
+	if msg.Header.MsgTypeID == base.RTMPTypeIDMetadata {
+		m.feedPublisherClock(msg)
+	}
+	if m.fmp4Mode() {
+		m.feedFMP4(msg)
+	}
 	m.streamer.FeedRTMPMessage(msg)
 }
 
 func (m *Muxer) OnFrame(streamer *Streamer, frame *mpegts.Frame) {
+	if m.fmp4Mode() {
+		m.onTSFrame(streamer, frame)
+		return
+	}
+
 	var boundary bool
 	var packets []byte
 
@@ -147,6 +255,7 @@ func (m *Muxer) OnFrame(streamer *Streamer, frame *mpegts.Frame) {
 			m.Log().Warn("[%s] OnFrame A not opened.", m.UniqueKey)
 			return
 		}
+		m.updatePart(frame.PTS, !streamer.VideoSeqHeaderCached())
 
 	} else {
 		// 收到视频，可能触发建立fragment的条件是：
@@ -165,24 +274,42 @@ func (m *Muxer) OnFrame(streamer *Streamer, frame *mpegts.Frame) {
 			m.Log().Warn("[%s] OnFrame V not opened.", m.UniqueKey)
 			return
 		}
+		m.updatePart(frame.DTS, frame.Key)
 	}
 
+	// SAMPLE-AES时，切片写入加密后的TS流，回调给上层的依然是未加密的TS流
+	sampleAES := m.config.Enable && m.sampleAESFragment()
+	iframe := m.iframePlaylist() && frame.Sid != mpegts.StreamIDAudio && frame.Key
+	iframeStart := m.fragment.Size()
+	if sampleAES {
+		m.writeSampleAESFrame(frame)
+	}
 	mpegts.PackTSPacket(frame, func(packet []byte) {
-		if m.config.Enable {
-			if err := m.fragment.WriteFile(packet); err != nil {
-				m.Log().Error("[%s] fragment write error. err=%+v", m.UniqueKey, err)
-				return
-			}
+		if m.config.Enable && !sampleAES {
+			m.writeFragmentPacket(packet)
 		}
 		if m.observer != nil {
 			packets = append(packets, packet...)
 		}
 	})
+	if iframe {
+		m.appendIFrame(frame, iframeStart)
+	}
 	if m.observer != nil {
 		m.observer.OnTSPackets(packets, boundary)
 	}
 }
 
+func (m *Muxer) writeFragmentPacket(packet []byte) {
+	if err := m.fragment.WriteFile(packet); err != nil {
+		m.Log().Error("[%s] fragment write error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	if m.partOpened {
+		m.partBuf = append(m.partBuf, packet...)
+	}
+}
+
 func (m *Muxer) OutPath() string {
 	return m.outPath
 }
@@ -229,7 +356,11 @@ func (m *Muxer) updateFragment(ts uint64, boundary bool) error {
 		discont = false
 
 		// 已经有TS切片，切片时长没有达到设置的阈值，则不开启新的切片
-		if f.duration < float64(m.config.FragmentDurationMS)/1000 {
+		if m.config.AlignFragment {
+			if !alignedBoundary(m.fragTS, ts, uint64(m.config.FragmentDurationMS)*90) {
+				return nil
+			}
+		} else if f.duration < float64(m.config.FragmentDurationMS)/1000 {
 			return nil
 		}
 	}
@@ -254,28 +385,59 @@ func (m *Muxer) openFragment(ts uint64, discont bool) error {
 		return ErrHLS
 	}
 
+	key, err := m.updateKey()
+	if err != nil {
+		return err
+	}
+
+	m.alignFragmentID(ts)
 	id := m.getFragmentID()
 
+	frag := m.getCurrFrag()
+	m.evictFrag(frag)
+	frag.id = id
+	frag.key = key
+	frag.offset, frag.length = 0, 0
+	frag.upload = nil
+	frag.size, frag.iframes, frag.iframeSeq = 0, nil, m.iframeSeq
+	m.setupFragmentEncrypt(frag)
+	m.updateProgramDateTime(frag, ts, discont)
+
 	filename := getTSFilename(m.streamName, id, int(time.Now().Unix()))
 	filenameWithPath := getTSFilenameWithPath(m.outPath, filename)
-	if m.config.Enable {
-		if err := m.fragment.OpenFile(filenameWithPath); err != nil {
+	if m.byteRange() {
+		if filename, err = m.openByteRangeFragment(frag); err != nil {
+			return err
+		}
+	} else if m.config.Enable {
+		if m.mem != nil {
+			err = m.fragment.OpenBuffer()
+		} else {
+			err = m.fragment.OpenFile(filenameWithPath)
+		}
+		if err != nil {
 			return err
 		}
 	}
 	m.opened = true
+	frag.headerLength = m.fragment.Size()
 
-	frag := m.getCurrFrag()
 	frag.discont = discont
-	frag.id = id
 	frag.filename = filename
 	frag.duration = 0
+	frag.parts = nil
 
 	m.fragTS = ts
+	m.onMakeTS(MakeTSEventOpen, frag)
 
 	// nrm said: start fragment with audio to make iPhone happy
 	m.streamer.FlushAudio()
 
+	// 更新m3u8中的`#EXT-X-PRELOAD-HINT`
+	if m.lowLatency() {
+		m.writePlaylist(false)
+	}
+
 	return nil
 }
 
@@ -289,22 +451,43 @@ func (m *Muxer) closeFragment(isLast bool) error {
 		if err := m.fragment.CloseFile(); err != nil {
 			return err
 		}
+		m.getCurrFrag().size = m.fragment.Size()
+		m.iframeSeq += len(m.getCurrFrag().iframes)
+		if m.mem != nil {
+			m.mem.write(m.getCurrFrag().filename, m.fragment.Bytes())
+		}
+		m.uploadFragment(m.getCurrFrag())
+		if m.byteRange() {
+			m.closeByteRangeFragment(m.getCurrFrag())
+		}
+	}
+	if m.lowLatency() {
+		m.closePart(m.fragTS + uint64(m.getCurrFrag().duration*90000))
 	}
+	m.onMakeTS(MakeTSEventClose, m.getCurrFrag())
+	m.appendHistoryFrag()
 
 	m.opened = false
 	//更新序号，为下个分片准备好
 	m.incrFrag()
 
 	m.writePlaylist(isLast)
+	m.writeIFramePlaylist(isLast)
 	m.writeRecordPlaylist(isLast)
 
 	return nil
 }
 
 func (m *Muxer) writeRecordPlaylist(isLast bool) {
-	if !m.config.Enable {
+	// 内存模式不需要持久化，不生成record.m3u8
+	if !m.config.Enable || m.mem != nil {
 		return
 	}
+	if IsRecordPaused() {
+		return
+	}
+	recordMutex.Lock()
+	defer recordMutex.Unlock()
 
 	//frag := m.getCurrFrag()
 	currFrag := m.getFrag(m.nfrags - 1)
@@ -312,7 +495,11 @@ func (m *Muxer) writeRecordPlaylist(isLast bool) {
 		m.recordMaxFragDuration = currFrag.duration + 0.5
 	}
 
-	fragLines := fmt.Sprintf("#EXTINF:%.3f,\n%s\n", currFrag.duration, currFrag.filename)
+	var fragBuf bytes.Buffer
+	m.writeKeyTag(&fragBuf, currFrag)
+	m.writeProgramDateTime(&fragBuf, currFrag)
+	m.writeFragmentURI(&fragBuf, currFrag)
+	fragLines := fragBuf.String()
 
 	content, err := ioutil.ReadFile(m.recordPlayListFilename)
 	if err == nil {
@@ -335,7 +522,14 @@ func (m *Muxer) writeRecordPlaylist(isLast bool) {
 		// m3u8文件不存在
 		var buf bytes.Buffer
 		buf.WriteString("#EXTM3U\n")
-		buf.WriteString("#EXT-X-VERSION:3\n")
+		if m.fmp4Mode() {
+			buf.WriteString("#EXT-X-VERSION:7\n")
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", fmp4InitFilename))
+		} else if m.byteRange() {
+			buf.WriteString("#EXT-X-VERSION:4\n")
+		} else {
+			buf.WriteString("#EXT-X-VERSION:3\n")
+		}
 		buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(m.recordMaxFragDuration)))
 		buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n\n", 0))
 
@@ -351,7 +545,11 @@ func (m *Muxer) writeRecordPlaylist(isLast bool) {
 
 	if err := writeM3U8File(content, m.recordPlayListFilename, m.recordPlayListFilenameBak); err != nil {
 		m.Log().Error("[%s] write record m3u8 file error. err=%+v", m.UniqueKey, err)
+	} else {
+		m.upload(filepath.Base(m.recordPlayListFilename), content, "")
+		m.onMakeM3U8(MakeM3U8TypeRecord, m.recordPlayListFilename, 0, currFrag.id, true)
 	}
+	m.appendRecordIndex(currFrag)
 }
 
 func (m *Muxer) writePlaylist(isLast bool) {
@@ -359,10 +557,11 @@ func (m *Muxer) writePlaylist(isLast bool) {
 		return
 	}
 
+	frags := m.playlistFrags()
+
 	// 找出时长最长的fragment
 	maxFrag := float64(m.config.FragmentDurationMS) / 1000
-	for i := 0; i < m.nfrags; i++ {
-		frag := m.getFrag(i)
+	for _, frag := range frags {
 		if frag.duration > maxFrag {
 			maxFrag = frag.duration + 0.5
 		}
@@ -371,34 +570,151 @@ func (m *Muxer) writePlaylist(isLast bool) {
 	// TODO chef 优化这块buffer的构造
 	var buf bytes.Buffer
 	buf.WriteString("#EXTM3U\n")
-	buf.WriteString("#EXT-X-VERSION:3\n")
-	buf.WriteString("#EXT-X-ALLOW-CACHE:NO\n")
-	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(maxFrag)))
-	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n\n", m.frag))
-
-	for i := 0; i < m.nfrags; i++ {
-		frag := m.getFrag(i)
+	if m.lowLatency() {
+		partTarget := float64(m.partDurationMS()) / 1000
+		buf.WriteString("#EXT-X-VERSION:6\n")
+		buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(maxFrag)))
+		buf.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f,CAN-SKIP-UNTIL=%.3f\n",
+			partTarget*partHoldBackNum, float64(int(maxFrag)*canSkipUntilNum)))
+		buf.WriteString(fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget))
+	} else if m.fmp4Mode() {
+		buf.WriteString("#EXT-X-VERSION:7\n")
+		buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(maxFrag)))
+		buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", fmp4InitFilename))
+	} else {
+		if m.byteRange() {
+			buf.WriteString("#EXT-X-VERSION:4\n")
+		} else {
+			buf.WriteString("#EXT-X-VERSION:3\n")
+		}
+		buf.WriteString("#EXT-X-ALLOW-CACHE:NO\n")
+		buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(maxFrag)))
+	}
+	m.writePlaylistTypeTag(&buf, isLast)
+	mediaSequence := m.frag + m.fragIDOffset
+	if len(frags) != 0 {
+		mediaSequence = frags[0].id
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n\n", mediaSequence))
 
+	for i, frag := range frags {
 		if frag.discont {
 			buf.WriteString("#EXT-X-DISCONTINUITY\n")
 		}
+		m.writeKeyTag(&buf, frag)
+		m.writeProgramDateTime(&buf, frag)
 
-		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n%s\n", frag.duration, frag.filename))
+		// 只有最近的几个fragment需要列出part
+		if m.lowLatency() && i >= len(frags)-partFragmentNum {
+			writeParts(&buf, frag.parts)
+		}
+
+		m.writeFragmentURI(&buf, frag)
+	}
+
+	// 正在生成的fragment，只列出已经完成的part，以及正在生成的part
+	if m.lowLatency() && m.opened {
+		frag := m.getCurrFrag()
+		if frag.discont {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		m.writeKeyTag(&buf, frag)
+		m.writeProgramDateTime(&buf, frag)
+		writeParts(&buf, frag.parts)
+		buf.WriteString(fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", getPartFilename(frag.filename, len(frag.parts))))
 	}
 
 	if isLast {
 		buf.WriteString("#EXT-X-ENDLIST\n")
 	}
 
-	if err := writeM3U8File(buf.Bytes(), m.playlistFilename, m.playlistFilenameBak); err != nil {
+	if err := m.writeFile(buf.Bytes(), m.playlistFilename); err != nil {
 		m.Log().Error("[%s] write live m3u8 file error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	m.upload(filepath.Base(m.playlistFilename), buf.Bytes(), "")
+	notifyPlaylistUpdate(m.outPath)
+	if !m.opened {
+		lastID := -1
+		if len(frags) != 0 {
+			lastID = frags[len(frags)-1].id
+		}
+		m.onMakeM3U8(MakeM3U8TypeLive, m.playlistFilename, mediaSequence, lastID, isLast)
+	}
+}
+
+func (m *Muxer) lowLatency() bool {
+	return m.config.Enable && m.config.LowLatency && !m.fmp4Mode()
+}
+
+func (m *Muxer) partDurationMS() int {
+	if m.config.PartDurationMS <= 0 {
+		return defaultPartDurationMS
 	}
+	return m.config.PartDurationMS
+}
+
+// 决定是否结束当前part并开启新的part，注意，fragment切割由updateFragment决定，这里只在fragment内部切割part
+//
+// @param ts          当前帧的时间戳，毫秒 * 90
+// @param independent 当前帧是否可以独立解码
+//
+func (m *Muxer) updatePart(ts uint64, independent bool) {
+	if !m.lowLatency() {
+		return
+	}
+
+	if m.partOpened && ts > m.partTS && ts-m.partTS >= uint64(m.partDurationMS()*90) {
+		m.closePart(ts)
+		m.writePlaylist(false)
+	}
+	if !m.partOpened {
+		m.partOpened = true
+		m.partTS = ts
+		m.partIndependent = false
+		// 注意，内存模式时part的数据由memoryStream持有，所以这里不复用内存块
+		m.partBuf = append([]byte(nil), m.fragment.fragmentHeader()...)
+	}
+	if independent {
+		m.partIndependent = true
+	}
+}
+
+// @param endTS 当前part的结束时间戳，毫秒 * 90
+//
+func (m *Muxer) closePart(endTS uint64) {
+	if !m.partOpened {
+		return
+	}
+	m.partOpened = false
+
+	frag := m.getCurrFrag()
+	var duration float64
+	if endTS > m.partTS {
+		duration = float64(endTS-m.partTS) / 90000
+	}
+	filename := getPartFilename(frag.filename, len(frag.parts))
+	filenameWithPath := getTSFilenameWithPath(m.outPath, filename)
+	// 先写临时文件再改名，避免读到不完整的part
+	if err := m.writeFile(m.encryptSegment(frag, m.partBuf), filenameWithPath); err != nil {
+		m.Log().Error("[%s] write part file error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	frag.parts = append(frag.parts, partInfo{
+		duration:    duration,
+		filename:    filename,
+		independent: m.partIndependent,
+	})
 }
 
 func (m *Muxer) ensureDir() {
 	if !m.config.Enable {
 		return
 	}
+	if m.config.InMemory {
+		m.mem = newMemoryStream(m.outPath)
+		return
+	}
 	err := os.MkdirAll(m.outPath, 0777)
 	if err != nil {
 		m.Log().Error(err)
@@ -406,7 +722,7 @@ func (m *Muxer) ensureDir() {
 }
 
 func (m *Muxer) getFragmentID() int {
-	return m.frag + m.nfrags
+	return m.frag + m.nfrags + m.fragIDOffset
 }
 
 func (m *Muxer) getFrag(n int) *fragmentInfo {
@@ -0,0 +1,383 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/avc"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/fmp4"
+	"github.com/souliot/siot-av/pkg/hevc"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+// fmp4切片，直接使用rtmp message生成，不经过Streamer
+//
+// 与TS切片的区别：
+// - 视频支持HEVC
+// - 生成init.mp4，m3u8中使用`#EXT-X-MAP`引用
+// - Streamer依然工作，TS流只用于回调给MuxerObserver
+
+const (
+	SegmentTypeTS   = "ts"
+	SegmentTypeFMP4 = "fmp4"
+
+	// AAC每帧的采样数
+	aacSamplesPerFrame = 1024
+
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+)
+
+type fmp4Context struct {
+	videoPT     base.AVPacketPT
+	videoConfig []byte
+	width       int
+	height      int
+	audioConfig []byte
+
+	videoTrack  *fmp4.Track
+	audioTrack  *fmp4.Track
+	initWritten bool
+	sequence    uint32
+
+	segStartTS uint32 // 当前切片的起始时间戳，单位毫秒
+	lastTS     uint32 // 最后一帧的时间戳，单位毫秒
+	videos     []fmp4Frame
+	audios     []fmp4Frame
+}
+
+type fmp4Frame struct {
+	ts   uint32 // dts，单位毫秒
+	cts  uint32 // pts - dts，单位毫秒
+	key  bool
+	data []byte
+}
+
+func (m *Muxer) fmp4Mode() bool {
+	return m.config.Enable && m.config.SegmentType == SegmentTypeFMP4
+}
+
+func (m *Muxer) feedFMP4(msg base.RTMPMsg) {
+	switch msg.Header.MsgTypeID {
+	case base.RTMPTypeIDAudio:
+		m.feedFMP4Audio(msg)
+	case base.RTMPTypeIDVideo:
+		m.feedFMP4Video(msg)
+	}
+}
+
+func (m *Muxer) feedFMP4Video(msg base.RTMPMsg) {
+	if len(msg.Payload) < 5 {
+		return
+	}
+	var pt base.AVPacketPT
+	switch msg.Payload[0] & 0xF {
+	case base.RTMPCodecIDAVC:
+		pt = base.AVPacketPTAVC
+	case base.RTMPCodecIDHEVC:
+		pt = base.AVPacketPTHEVC
+	default:
+		return
+	}
+	ctx := &m.fmp4
+	key := msg.Payload[0]>>4 == base.RTMPFrameTypeKey
+
+	if key && msg.Payload[1] == base.RTMPAVCPacketTypeSeqHeader {
+		config := msg.Payload[5:]
+		if ctx.videoConfig != nil {
+			if ctx.initWritten && !bytes.Equal(config, ctx.videoConfig) {
+				// 切片已经引用了init.mp4，不再更新
+				m.Log().Warn("[%s] video seq header changed after init segment written, ignore.", m.UniqueKey)
+			}
+			if ctx.initWritten {
+				return
+			}
+		}
+		ctx.videoPT = pt
+		ctx.videoConfig = append([]byte(nil), config...)
+		ctx.width, ctx.height = parseVideoSize(pt, msg.Payload)
+		return
+	}
+	if ctx.videoConfig == nil || pt != ctx.videoPT {
+		return
+	}
+
+	ts := msg.Header.TimestampAbs
+	if !m.opened {
+		if !key {
+			return
+		}
+		if err := m.openFMP4Segment(ts); err != nil {
+			m.Log().Error("[%s] open segment error. err=%+v", m.UniqueKey, err)
+			return
+		}
+	} else if key && m.reachFMP4SegmentDuration(ts) {
+		m.closeFMP4Segment(ts, false)
+		if err := m.openFMP4Segment(ts); err != nil {
+			m.Log().Error("[%s] open segment error. err=%+v", m.UniqueKey, err)
+			return
+		}
+	}
+	ctx.videos = append(ctx.videos, fmp4Frame{
+		ts:   ts,
+		cts:  bele.BEUint24(msg.Payload[2:]),
+		key:  key,
+		data: append([]byte(nil), msg.Payload[5:]...),
+	})
+	ctx.lastTS = ts
+}
+
+func (m *Muxer) feedFMP4Audio(msg base.RTMPMsg) {
+	if len(msg.Payload) < 3 || msg.Payload[0]>>4 != base.RTMPSoundFormatAAC {
+		return
+	}
+	ctx := &m.fmp4
+
+	if msg.Payload[1] == base.RTMPAACPacketTypeSeqHeader {
+		if !ctx.initWritten {
+			ctx.audioConfig = append([]byte(nil), msg.Payload[2:]...)
+		}
+		return
+	}
+	if ctx.audioConfig == nil {
+		return
+	}
+
+	ts := msg.Header.TimestampAbs
+	if ctx.videoConfig == nil {
+		// 只有音频
+		if !m.opened || m.reachFMP4SegmentDuration(ts) {
+			m.closeFMP4Segment(ts, false)
+			if err := m.openFMP4Segment(ts); err != nil {
+				m.Log().Error("[%s] open segment error. err=%+v", m.UniqueKey, err)
+				return
+			}
+		}
+	} else if !m.opened {
+		// 有视频时，从视频关键帧开始切片
+		return
+	}
+	ctx.audios = append(ctx.audios, fmp4Frame{
+		ts:   ts,
+		data: append([]byte(nil), msg.Payload[2:]...),
+	})
+	if ts > ctx.lastTS {
+		ctx.lastTS = ts
+	}
+}
+
+func (m *Muxer) openFMP4Segment(ts uint32) error {
+	key, err := m.updateKey()
+	if err != nil {
+		return err
+	}
+
+	m.alignFragmentID(uint64(ts) * 90)
+	id := m.getFragmentID()
+	frag := m.getCurrFrag()
+	m.evictFrag(frag)
+	// 第一个切片写入`#EXT-X-DISCONTINUITY`，与TS切片保持一致
+	frag.discont = !m.fmp4.initWritten
+	frag.id = id
+	frag.key = key
+	frag.offset, frag.length = 0, 0
+	frag.upload = nil
+	frag.size, frag.iframes = 0, nil
+	m.updateProgramDateTime(frag, uint64(ts)*90, frag.discont)
+	frag.filename = getFMP4SegmentFilename(id, int(time.Now().Unix()))
+	frag.duration = 0
+	frag.parts = nil
+
+	m.opened = true
+	m.fmp4.segStartTS = ts
+	m.onMakeTS(MakeTSEventOpen, frag)
+	return nil
+}
+
+// @param ts 单位毫秒
+func (m *Muxer) reachFMP4SegmentDuration(ts uint32) bool {
+	startTS := m.fmp4.segStartTS
+	if m.config.AlignFragment {
+		return alignedBoundary(uint64(startTS), uint64(ts), uint64(m.config.FragmentDurationMS))
+	}
+	return ts >= startTS && ts-startTS >= uint32(m.config.FragmentDurationMS)
+}
+
+// @param endTS 当前切片的结束时间戳，也即下一个切片的起始时间戳，单位毫秒
+//
+func (m *Muxer) closeFMP4Segment(endTS uint32, isLast bool) {
+	if !m.opened {
+		return
+	}
+	m.opened = false
+	ctx := &m.fmp4
+
+	if !ctx.initWritten {
+		if err := m.writeFMP4Init(); err != nil {
+			m.Log().Error("[%s] write init segment error. err=%+v", m.UniqueKey, err)
+			ctx.videos, ctx.audios = nil, nil
+			return
+		}
+	}
+
+	var fragments []fmp4.TrackFragment
+	if ctx.videoTrack != nil && len(ctx.videos) != 0 {
+		fragments = append(fragments, genVideoTrackFragment(ctx.videoTrack, ctx.videos, endTS))
+	}
+	if ctx.audioTrack != nil && len(ctx.audios) != 0 {
+		fragments = append(fragments, genAudioTrackFragment(ctx.audioTrack, ctx.audios))
+	}
+	ctx.videos, ctx.audios = nil, nil
+	if len(fragments) == 0 {
+		return
+	}
+
+	ctx.sequence++
+	content := fmp4.GenMediaSegment(ctx.sequence, fragments)
+
+	frag := m.getCurrFrag()
+	if endTS > ctx.segStartTS {
+		frag.duration = float64(endTS-ctx.segStartTS) / 1000
+	}
+	filenameWithPath := getTSFilenameWithPath(m.outPath, frag.filename)
+	content = m.encryptSegment(frag, content)
+	if err := m.writeFile(content, filenameWithPath); err != nil {
+		m.Log().Error("[%s] write fmp4 segment error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	frag.upload = m.upload(frag.filename, content, "")
+	frag.size = int64(len(content))
+	m.onMakeTS(MakeTSEventClose, frag)
+	m.appendHistoryFrag()
+
+	m.incrFrag()
+	m.writePlaylist(isLast)
+	m.writeRecordPlaylist(isLast)
+}
+
+func (m *Muxer) writeFMP4Init() error {
+	ctx := &m.fmp4
+	var tracks []*fmp4.Track
+	if ctx.videoConfig != nil {
+		track, err := fmp4.NewVideoTrack(fmp4VideoTrackID, ctx.videoPT, ctx.videoConfig, ctx.width, ctx.height)
+		if err != nil {
+			return err
+		}
+		ctx.videoTrack = track
+		tracks = append(tracks, track)
+	}
+	if ctx.audioConfig != nil {
+		track, err := fmp4.NewAudioTrack(fmp4AudioTrackID, ctx.audioConfig)
+		if err != nil {
+			return err
+		}
+		ctx.audioTrack = track
+		tracks = append(tracks, track)
+	}
+
+	filenameWithPath := getTSFilenameWithPath(m.outPath, fmp4InitFilename)
+	content := fmp4.GenInitSegment(tracks)
+	if err := m.writeFile(content, filenameWithPath); err != nil {
+		return err
+	}
+	m.upload(fmp4InitFilename, content, "")
+	ctx.initWritten = true
+	return nil
+}
+
+// TS切片时，由Muxer.OnFrame处理，fmp4切片时，只将TS流回调给上层
+func (m *Muxer) onTSFrame(streamer *Streamer, frame *mpegts.Frame) {
+	if m.observer == nil {
+		return
+	}
+
+	// 与OnFrame中boundary的判断方式相同
+	var boundary bool
+	if frame.Sid == mpegts.StreamIDAudio {
+		boundary = !streamer.VideoSeqHeaderCached()
+	} else {
+		boundary = frame.Key && (!streamer.AudioSeqHeaderCached() || !m.tsStarted || !streamer.AudioCacheEmpty())
+	}
+	if boundary {
+		m.tsStarted = true
+	}
+	if !m.tsStarted {
+		return
+	}
+
+	var packets []byte
+	mpegts.PackTSPacket(frame, func(packet []byte) {
+		packets = append(packets, packet...)
+	})
+	m.observer.OnTSPackets(packets, boundary)
+}
+
+func genVideoTrackFragment(track *fmp4.Track, frames []fmp4Frame, endTS uint32) fmp4.TrackFragment {
+	f := fmp4.TrackFragment{
+		Track:          track,
+		BaseDecodeTime: uint64(frames[0].ts) * 90,
+	}
+	var duration uint32
+	for i, frame := range frames {
+		next := endTS
+		if i+1 < len(frames) {
+			next = frames[i+1].ts
+		}
+		// 最后一帧没有结束时间时，沿用上一帧的时长
+		if next > frame.ts {
+			duration = (next - frame.ts) * 90
+		}
+		f.Samples = append(f.Samples, fmp4.Sample{
+			Duration:  duration,
+			CTSOffset: int32(frame.cts * 90),
+			Key:       frame.key,
+			Data:      frame.data,
+		})
+	}
+	return f
+}
+
+func genAudioTrackFragment(track *fmp4.Track, frames []fmp4Frame) fmp4.TrackFragment {
+	f := fmp4.TrackFragment{
+		Track:          track,
+		BaseDecodeTime: uint64(frames[0].ts) * uint64(track.Timescale) / 1000,
+	}
+	for _, frame := range frames {
+		f.Samples = append(f.Samples, fmp4.Sample{
+			Duration: aacSamplesPerFrame,
+			Data:     frame.data,
+		})
+	}
+	return f
+}
+
+// 解析视频宽高，失败时返回0，不影响切片
+func parseVideoSize(pt base.AVPacketPT, seqHeader []byte) (width, height int) {
+	if pt == base.AVPacketPTAVC {
+		sps, _, err := avc.ParseSPSPPSFromSeqHeader(seqHeader)
+		if err != nil {
+			return
+		}
+		var ctx avc.Context
+		_ = avc.ParseSPS(sps, &ctx)
+		return int(ctx.Width), int(ctx.Height)
+	}
+
+	_, sps, _, err := hevc.ParseVPSSPSPPSFromSeqHeader(seqHeader)
+	if err != nil {
+		return
+	}
+	var ctx hevc.Context
+	_ = hevc.ParseSPS(sps, &ctx)
+	return int(ctx.PicWidthInLumaSamples), int(ctx.PicHeightInLumaSamples)
+}
@@ -0,0 +1,122 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+var (
+	fmp4TestAVCSeqHeader = []byte{
+		0x17, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x1a,
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00,
+		0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+		0x01, 0x00, 0x06, 0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0,
+	}
+	fmp4TestAACSeqHeader = []byte{0xaf, 0x00, 0x12, 0x10}
+)
+
+type fmp4TestObserver struct {
+	n int
+}
+
+func (o *fmp4TestObserver) OnTSPackets(rawFrame []byte, boundary bool) {
+	o.n++
+}
+
+func feedFMP4Muxer(m *Muxer, typeID uint8, ts uint32, payload []byte) {
+	m.FeedRTMPMessage(base.RTMPMsg{
+		Header: base.RTMPHeader{
+			MsgTypeID:    typeID,
+			MsgLen:       uint32(len(payload)),
+			TimestampAbs: ts,
+		},
+		Payload: payload,
+	})
+}
+
+func TestMuxerFMP4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fmp4")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+		SegmentType:        SegmentTypeFMP4,
+	}
+	observer := &fmp4TestObserver{}
+	m := NewMuxer("test", config, observer, log.DefaultBeeLogger)
+	m.Start()
+
+	feedFMP4Muxer(m, base.RTMPTypeIDVideo, 0, fmp4TestAVCSeqHeader)
+	feedFMP4Muxer(m, base.RTMPTypeIDAudio, 0, fmp4TestAACSeqHeader)
+	// 每40毫秒一帧视频，每秒一个关键帧，每23毫秒一帧音频
+	for i := 0; i < 60; i++ {
+		frameType := base.RTMPAVCInterFrame
+		if i%25 == 0 {
+			frameType = base.RTMPAVCKeyFrame
+		}
+		nalu := []byte{0x00, 0x00, 0x00, 0x02, 0x65, byte(i)}
+		feedFMP4Muxer(m, base.RTMPTypeIDVideo, uint32(i*40), append([]byte{frameType, 0x01, 0x00, 0x00, 0x00}, nalu...))
+		feedFMP4Muxer(m, base.RTMPTypeIDAudio, uint32(i*40+20), []byte{0xaf, 0x01, 0x21, 0x00})
+	}
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(content), "#EXT-X-VERSION:7\n"))
+	assert.Equal(t, true, strings.Contains(string(content), `#EXT-X-MAP:URI="init.mp4"`))
+	assert.Equal(t, 2, strings.Count(string(content), ".m4s\n"))
+	assert.Equal(t, true, strings.Contains(string(content), "#EXTINF:1.000,\n"))
+
+	initSeg, err := ioutil.ReadFile(m.outPath + fmp4InitFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ftyp", string(initSeg[4:8]))
+	assert.Equal(t, "avc1", m.fmp4.videoTrack.Codec()[:4])
+	assert.Equal(t, 1280, m.fmp4.width)
+	assert.Equal(t, 720, m.fmp4.height)
+
+	frag := m.getFrag(0)
+	seg, err := ioutil.ReadFile(m.outPath + frag.filename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "styp", string(seg[4:8]))
+
+	// TS流依然回调给上层
+	assert.Equal(t, true, observer.n > 0)
+
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/"+frag.filename, nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "video/iso.segment", resp.Header().Get("Content-Type"))
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/init.mp4", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "video/mp4", resp.Header().Get("Content-Type"))
+
+	m.Dispose()
+	content, err = ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, strings.Count(string(content), ".m4s\n"))
+	assert.Equal(t, true, strings.HasSuffix(string(content), "#EXT-X-ENDLIST\n"))
+	record, err := ioutil.ReadFile(m.recordPlayListFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(record), `#EXT-X-MAP:URI="init.mp4"`))
+}
@@ -10,7 +10,9 @@ package hls
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
@@ -62,6 +64,27 @@ func readFileContent(rootOutPath string, ri requestInfo) ([]byte, error) {
 	return ioutil.ReadFile(filename)
 }
 
+// 切片不一次性读入内存，byte range模式下所有切片在同一个文件中，文件会一直增长，按请求的范围读取
+type fileReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// @return size 文件的大小
+func openFileContent(rootOutPath string, ri requestInfo) (r fileReader, size int64, err error) {
+	filename := fmt.Sprintf("%s%s/%s", rootOutPath, ri.streamName, ri.fileName)
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, 0, err
+	}
+	return fp, fi.Size(), nil
+}
+
 func getMuxerOutPath(rootOutPath string, streamName string) string {
 	return fmt.Sprintf("%s%s/", rootOutPath, streamName)
 }
@@ -74,6 +97,20 @@ func getRecordM3U8Filename(outpath string, streamName string) string {
 	return fmt.Sprintf("%s%s.m3u8", outpath, "record")
 }
 
+// I帧m3u8以及引用它的master m3u8，见iframe.go
+func getIFrameM3U8Filename(outpath string) string {
+	return fmt.Sprintf("%s%s.m3u8", outpath, "iframe")
+}
+
+func getMasterM3U8Filename(outpath string) string {
+	return fmt.Sprintf("%s%s.m3u8", outpath, "master")
+}
+
+// 录制索引，见record.go
+func getRecordIndexFilename(outpath string) string {
+	return fmt.Sprintf("%s%s", outpath, "record.idx")
+}
+
 func getTSFilenameWithPath(outpath string, filename string) string {
 	return fmt.Sprintf("%s%s", outpath, filename)
 }
@@ -81,3 +118,24 @@ func getTSFilenameWithPath(outpath string, filename string) string {
 func getTSFilename(streamName string, id int, timestamp int) string {
 	return fmt.Sprintf("%d-%d.ts", timestamp, id)
 }
+
+// byte range模式，所有切片写入同一个文件
+func getByteRangeFilename(timestamp int) string {
+	return fmt.Sprintf("%d.ts", timestamp)
+}
+
+// LL-HLS中的part文件名，比如fragment文件名为1607342284-5.ts，则第0个part的文件名为1607342284-5.0.ts
+func getPartFilename(fragFilename string, index int) string {
+	return fmt.Sprintf("%s.%d.ts", strings.TrimSuffix(fragFilename, ".ts"), index)
+}
+
+// fmp4切片的初始化段，每路流一个
+const fmp4InitFilename = "init.mp4"
+
+func getFMP4SegmentFilename(id int, timestamp int) string {
+	return fmt.Sprintf("%d-%d.m4s", timestamp, id)
+}
+
+func isPartFilename(filename string) bool {
+	return strings.Count(filename, ".") == 2
+}
@@ -0,0 +1,234 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/rtmp"
+)
+
+// m3u8的可选特性
+//
+// ProgramDateTime 每个切片前写入`#EXT-X-PROGRAM-DATE-TIME`
+//                 使用推流端的时钟，也即推流端（比如FMLE、Wirecast）定时发送的onFI消息中的系统日期`sd`以及系统时间`st`，与该消息的时间戳对应
+//                 推流端没有发送onFI时，以第一个切片（以及时间戳跳跃导致的不连续切片）开始时服务端的本地时间为基准
+//                 之后的切片都按推流端的时间戳增量推算，不受本地定时器影响
+// PlaylistType    EVENT时，m3u8保留从开始到现在的所有切片，流结束时追加`#EXT-X-ENDLIST`
+//                 VOD时，流结束前与EVENT相同，流结束时改写为VOD
+//                 每个切片完成时都会重写整个m3u8，所以保留的切片数量有上限，见MuxerConfig.PlaylistFragNum
+// ByteRange       所有TS切片依次追加写入同一个文件，m3u8中使用`#EXT-X-BYTERANGE`描述切片在文件中的位置，避免长时间录制时生成大量小文件
+
+const (
+	PlaylistTypeEvent = "EVENT"
+	PlaylistTypeVOD   = "VOD"
+
+	programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+	defaultPlaylistFragNum = 7200
+
+	// onFI可能比切片的第一帧稍晚到达，时间戳在该范围内时依然认为推流端时钟有效
+	publisherClockToleranceMS = 1000
+)
+
+// @return 不支持或者没有配置时返回空字符串，也即滑动窗口的直播m3u8
+func (m *Muxer) playlistType() string {
+	// 内存模式的切片随环形队列淘汰，无法保留所有切片
+	if m.config.InMemory {
+		return ""
+	}
+	switch m.config.PlaylistType {
+	case PlaylistTypeEvent, PlaylistTypeVOD:
+		return m.config.PlaylistType
+	}
+	return ""
+}
+
+func (m *Muxer) byteRange() bool {
+	// LL-HLS的part文件名由切片文件名生成，fmp4需要单独的init.mp4，内存模式按文件名保存切片，都不支持
+	return m.config.ByteRange && !m.config.InMemory && !m.config.LowLatency && !m.fmp4Mode()
+}
+
+// 开启新的切片时调用，记录切片开始时对应的时间
+// 基准优先使用推流端的时钟，见feedPublisherClock，没有时使用第一个切片（或者不连续切片）开始时服务端的本地时间，之后按时间戳增量推算
+// 注意，没有开启ProgramDateTime时也会记录，录制索引需要使用
+//
+// @param ts      切片的起始时间戳，毫秒 * 90
+// @param discont 切片是否不连续，不连续时重新映射
+func (m *Muxer) updateProgramDateTime(frag *fragmentInfo, ts uint64, discont bool) {
+	if !m.publisherClock.IsZero() {
+		// 时间戳不连续之后，之前收到的推流端时钟不再对应，等待新的onFI，在此之前使用服务端的本地时间
+		if ts+publisherClockToleranceMS*90 < m.publisherClockTS || (discont && !m.publisherClockNew) {
+			m.publisherClock = time.Time{}
+			m.wallClockBase = time.Time{}
+		} else {
+			m.wallClockBase = m.publisherClock
+			m.wallClockBaseTS = m.publisherClockTS
+		}
+	}
+	m.publisherClockNew = false
+
+	if m.publisherClock.IsZero() && (discont || m.wallClockBase.IsZero() || ts < m.wallClockBaseTS) {
+		m.wallClockBase = time.Now()
+		m.wallClockBaseTS = ts
+	}
+	// onFI可能比切片的第一帧稍晚，时间戳差值可能为负数
+	frag.programDateTime = m.wallClockBase.Add(time.Duration(int64(ts)-int64(m.wallClockBaseTS)) / 90 * time.Millisecond)
+}
+
+// 解析推流端发送的onFI，记录推流端的时钟以及对应的时间戳
+//
+// onFI的格式为`onFI`加上一个对象，比如`{sd: "18-10-2026", st: "09:53:31.117"}`
+// sd为日期，格式为dd-mm-yyyy（也兼容两位的年份），st为时间，格式为hh:mm:ss.sss
+// 注意，onFI不携带时区，按照服务端的时区解析
+func (m *Muxer) feedPublisherClock(msg base.RTMPMsg) {
+	t, ok := parseOnFI(msg.Payload)
+	if !ok {
+		return
+	}
+	m.publisherClock = t
+	m.publisherClockTS = uint64(msg.Header.TimestampAbs) * 90
+	m.publisherClockNew = true
+}
+
+func parseOnFI(payload []byte) (time.Time, bool) {
+	name, l, err := rtmp.AMF0.ReadString(payload)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if name == "@setDataFrame" {
+		var l2 int
+		if name, l2, err = rtmp.AMF0.ReadString(payload[l:]); err != nil {
+			return time.Time{}, false
+		}
+		l += l2
+	}
+	if name != "onFI" {
+		return time.Time{}, false
+	}
+	opa, _, err := rtmp.AMF0.ReadObjectOrArray(payload[l:])
+	if err != nil {
+		return time.Time{}, false
+	}
+	sd, err := opa.FindString("sd")
+	if err != nil {
+		return time.Time{}, false
+	}
+	st, err := opa.FindString("st")
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"02-01-2006 15:04:05.999", "02-01-06 15:04:05.999"} {
+		if t, err := time.ParseInLocation(layout, sd+" "+st, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 切片关闭后调用，EVENT以及VOD时保留切片的信息
+// 超过PlaylistFragNum时丢弃最早的切片，避免长时间推流时内存以及每次重写m3u8的开销无限增长
+func (m *Muxer) appendHistoryFrag() {
+	if m.playlistType() == "" {
+		return
+	}
+	m.historyFrags = append(m.historyFrags, *m.getCurrFrag())
+
+	maxNum := m.config.PlaylistFragNum
+	if maxNum <= 0 {
+		maxNum = defaultPlaylistFragNum
+	}
+	if len(m.historyFrags) > maxNum {
+		// 注意，不拷贝，之后append扩容时释放前面的内存
+		m.historyFrags = m.historyFrags[len(m.historyFrags)-maxNum:]
+	}
+}
+
+// @return 写入m3u8的已经完成的切片
+func (m *Muxer) playlistFrags() []*fragmentInfo {
+	var frags []*fragmentInfo
+	if m.playlistType() != "" {
+		for i := range m.historyFrags {
+			frags = append(frags, &m.historyFrags[i])
+		}
+		return frags
+	}
+	for i := 0; i < m.nfrags; i++ {
+		frags = append(frags, m.getFrag(i))
+	}
+	return frags
+}
+
+func (m *Muxer) writePlaylistTypeTag(buf *bytes.Buffer, isLast bool) {
+	t := m.playlistType()
+	if t == "" {
+		return
+	}
+	// VOD的m3u8不允许改变，所以流结束前以EVENT输出
+	if t == PlaylistTypeVOD && !isLast {
+		t = PlaylistTypeEvent
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-PLAYLIST-TYPE:%s\n", t))
+	// 每个切片都从关键帧开始
+	buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+}
+
+func (m *Muxer) writeProgramDateTime(buf *bytes.Buffer, frag *fragmentInfo) {
+	if !m.config.ProgramDateTime || frag.programDateTime.IsZero() {
+		return
+	}
+	buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", frag.programDateTime.Format(programDateTimeLayout)))
+}
+
+// 写入切片的`#EXTINF`，byte range时还有`#EXT-X-BYTERANGE`，以及切片的URI
+func (m *Muxer) writeFragmentURI(buf *bytes.Buffer, frag *fragmentInfo) {
+	buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", frag.duration))
+	if frag.length > 0 {
+		buf.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", frag.length, frag.offset))
+	}
+	buf.WriteString(m.fragmentURI(frag))
+	buf.WriteString("\n")
+}
+
+// byte range时打开切片，追加写入到同一个文件
+//
+// @return 切片的文件名
+func (m *Muxer) openByteRangeFragment(frag *fragmentInfo) (string, error) {
+	if m.byteRangeFilename == "" {
+		m.byteRangeFilename = getByteRangeFilename(int(time.Now().Unix()))
+		// 同一秒内重新推流时，文件名相同，继续追加
+		m.byteRangeOffset = fileSize(getTSFilenameWithPath(m.outPath, m.byteRangeFilename))
+	}
+	frag.offset = m.byteRangeOffset
+	frag.length = 0
+	if !m.config.Enable {
+		return m.byteRangeFilename, nil
+	}
+	return m.byteRangeFilename, m.fragment.OpenFileAppend(getTSFilenameWithPath(m.outPath, m.byteRangeFilename))
+}
+
+// byte range时切片关闭后调用，记录切片的长度
+func (m *Muxer) closeByteRangeFragment(frag *fragmentInfo) {
+	frag.length = m.fragment.Size()
+	m.byteRangeOffset += frag.length
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func fileSize(filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
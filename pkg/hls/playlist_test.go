@@ -0,0 +1,216 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+	"github.com/souliot/siot-av/pkg/rtmp"
+)
+
+func TestMuxerPlaylistType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsplaylist")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+		ProgramDateTime:    true,
+		PlaylistType:       PlaylistTypeVOD,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	begin := time.Now()
+	feedEncryptTestMuxer(m, 25*5+1)
+
+	// 流结束前以EVENT输出，保留所有切片
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-INDEPENDENT-SEGMENTS\n"))
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:0\n"))
+	assert.Equal(t, 5, strings.Count(playlist, "#EXTINF:"))
+
+	// 切片的时间按照时间戳推算，间隔为1秒
+	matches := regexp.MustCompile(`#EXT-X-PROGRAM-DATE-TIME:(.+)\n`).FindAllStringSubmatch(playlist, -1)
+	assert.Equal(t, 5, len(matches))
+	var times []time.Time
+	for _, match := range matches {
+		pdt, err := time.Parse(programDateTimeLayout, match[1])
+		assert.Equal(t, nil, err)
+		times = append(times, pdt)
+	}
+	assert.Equal(t, true, times[0].Sub(begin) > -time.Second && times[0].Sub(begin) < time.Second)
+	assert.Equal(t, 4*time.Second, times[4].Sub(times[0]))
+
+	m.Dispose()
+	content, err = ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	playlist = string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:VOD\n"))
+	assert.Equal(t, 6, strings.Count(playlist, "#EXTINF:"))
+	assert.Equal(t, true, strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n"))
+
+	record, err := ioutil.ReadFile(m.recordPlayListFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, strings.Count(string(record), "#EXT-X-PROGRAM-DATE-TIME:"))
+}
+
+func TestMuxerPlaylistFragNum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsplaylist")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        2,
+		PlaylistType:       PlaylistTypeEvent,
+		PlaylistFragNum:    3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*6+1)
+
+	// 超过上限时丢弃最早的切片
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3\n"))
+	assert.Equal(t, 3, strings.Count(playlist, "#EXTINF:"))
+	assert.Equal(t, 3, len(m.historyFrags))
+	m.Dispose()
+}
+
+func TestMuxerByteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsbyterange")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+		ByteRange:          true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*4+1)
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-VERSION:4\n"))
+
+	// 所有切片写入同一个文件，位置连续
+	matches := regexp.MustCompile(`#EXT-X-BYTERANGE:(\d+)@(\d+)\n(.+)\n`).FindAllStringSubmatch(playlist, -1)
+	assert.Equal(t, 3, len(matches))
+	filename := matches[0][3]
+	var next int
+	for i, match := range matches {
+		assert.Equal(t, filename, match[3])
+		length, _ := strconv.Atoi(match[1])
+		offset, _ := strconv.Atoi(match[2])
+		if i != 0 {
+			assert.Equal(t, next, offset)
+		}
+		next = offset + length
+	}
+	files, err := ioutil.ReadDir(m.outPath)
+	assert.Equal(t, nil, err)
+	var tsNum int
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".ts") {
+			tsNum++
+		}
+	}
+	assert.Equal(t, 1, tsNum)
+
+	// 按照byte range请求，每个切片都以PAT和PMT开始
+	length, _ := strconv.Atoi(matches[1][1])
+	offset, _ := strconv.Atoi(matches[1][2])
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	req := httptest.NewRequest("GET", "/hls/test/"+filename, nil)
+	req.Header.Set("Range", "bytes="+strconv.Itoa(offset)+"-"+strconv.Itoa(offset+length-1))
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 206, resp.Code)
+	assert.Equal(t, length, resp.Body.Len())
+	assert.Equal(t, mpegts.FixedFragmentHeader, resp.Body.Bytes()[:len(mpegts.FixedFragmentHeader)])
+
+	req = httptest.NewRequest("GET", "/hls/test/"+filename, nil)
+	req.Header.Set("Range", "bytes=100000000-")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 416, resp.Code)
+}
+
+// 推流端发送onFI时，`#EXT-X-PROGRAM-DATE-TIME`使用推流端的时钟
+func TestMuxerPublisherClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlspdt")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        10,
+		ProgramDateTime:    true,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+
+	var buf bytes.Buffer
+	_ = rtmp.AMF0.WriteString(&buf, "onFI")
+	_ = rtmp.AMF0.WriteObject(&buf, rtmp.ObjectPairArray{
+		{Key: "sd", Value: "16-01-2013"},
+		{Key: "st", Value: "09:53:31.117"},
+	})
+	m.FeedRTMPMessage(base.RTMPMsg{
+		Header:  base.RTMPHeader{MsgTypeID: base.RTMPTypeIDMetadata, MsgLen: uint32(buf.Len())},
+		Payload: buf.Bytes(),
+	})
+	feedEncryptTestMuxer(m, 25*3+1)
+
+	content, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	matches := regexp.MustCompile(`#EXT-X-PROGRAM-DATE-TIME:(.+)\n`).FindAllStringSubmatch(string(content), -1)
+	assert.Equal(t, 3, len(matches))
+	begin := time.Date(2013, 1, 16, 9, 53, 31, 117*1e6, time.Local)
+	for i, match := range matches {
+		pdt, err := time.Parse(programDateTimeLayout, match[1])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, pdt.Equal(begin.Add(time.Duration(i)*time.Second)))
+	}
+
+	// 不是onFI的metadata，以及格式错误的onFI，忽略
+	_, ok := parseOnFI([]byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'})
+	assert.Equal(t, false, ok)
+	_, ok = parseOnFI(buf.Bytes()[:10])
+	assert.Equal(t, false, ok)
+	m.Dispose()
+}
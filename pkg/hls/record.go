@@ -0,0 +1,384 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 录制索引
+//
+// 每个切片完成时，在流的输出目录下的record.idx中追加一行JSON，记录切片的文件名，以及切片开始、结束时对应的本地时间
+// RecordCatalog读取录制索引，查询流可用的录制时间段，以及生成任意时间段的点播m3u8
+//
+// 注意，流结束后如果删除了输出目录（HLSConfig.CleanupFlag），录制也随之删除
+//
+// 录制的清理见janitor.go
+
+var ErrRecordNotFound = errors.New("lal.hls: record not found")
+
+// Muxer与Janitor都会修改record.m3u8以及record.idx，使用该锁保护
+var recordMutex sync.Mutex
+
+// 磁盘剩余空间不足时，由Janitor暂停录制，此时切片不写入record.m3u8以及录制索引，并且在环形队列中被覆盖时删除，也即只保留直播窗口
+var recordPaused int32
+
+func setRecordPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&recordPaused, v)
+}
+
+func IsRecordPaused() bool {
+	return atomic.LoadInt32(&recordPaused) == 1
+}
+
+// 相邻切片的间隔不超过该值时，认为是连续的录制，单位毫秒
+const recordRangeMaxGapMS = 1000
+
+type recordSegment struct {
+	App       string  `json:"app,omitempty"`
+	ID        int     `json:"id"`
+	Filename  string  `json:"filename"`
+	Start     int64   `json:"start"` // Unix毫秒
+	End       int64   `json:"end"`
+	Duration  float64 `json:"duration"` // 单位秒
+	Discont   bool    `json:"discont,omitempty"`
+	Map       string  `json:"map,omitempty"`    // fmp4的初始化段
+	Offset    int64   `json:"offset,omitempty"` // byte range时，切片在文件中的位置
+	Length    int64   `json:"length,omitempty"`
+	KeyMethod string  `json:"key_method,omitempty"`
+	KeyURI    string  `json:"key_uri,omitempty"`
+
+	// 开启IFramePlaylist时记录，用于生成点播的I帧m3u8
+	Size         int64        `json:"size,omitempty"`
+	HeaderLength int64        `json:"header_length,omitempty"`
+	IFrames      []iframeInfo `json:"iframes,omitempty"`
+}
+
+// 切片完成时调用，追加到录制索引
+func (m *Muxer) appendRecordIndex(frag *fragmentInfo) {
+	seg := recordSegment{
+		App:      m.appName,
+		ID:       frag.id,
+		Filename: frag.filename,
+		Start:    frag.programDateTime.UnixNano() / 1e6,
+		Duration: frag.duration,
+		Discont:  frag.discont,
+		Offset:   frag.offset,
+		Length:   frag.length,
+	}
+	seg.End = seg.Start + int64(frag.duration*1000)
+	if m.fmp4Mode() {
+		seg.Map = fmp4InitFilename
+	}
+	if frag.key != nil {
+		seg.KeyMethod = frag.key.method
+		seg.KeyURI = frag.key.uri
+	}
+	if len(frag.iframes) != 0 {
+		seg.Size = frag.size
+		seg.HeaderLength = frag.headerLength
+		seg.IFrames = frag.iframes
+	}
+	b, err := json.Marshal(seg)
+	if err != nil {
+		return
+	}
+
+	fp, err := os.OpenFile(getRecordIndexFilename(m.outPath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		m.Log().Error("[%s] open record index error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	defer fp.Close()
+	if _, err = fp.Write(append(b, '\n')); err != nil {
+		m.Log().Error("[%s] write record index error. err=%+v", m.UniqueKey, err)
+		return
+	}
+	frag.recorded = true
+}
+
+// 切片在环形队列中被覆盖时调用，删除没有被录制的切片文件，见recordPaused
+func (m *Muxer) removeUnrecordedFrag(frag *fragmentInfo) {
+	// byte range时多个切片在同一个文件中，无法单独删除
+	if !m.config.Enable || frag.filename == "" || frag.recorded || frag.length > 0 {
+		frag.recorded = false
+		return
+	}
+	_ = os.Remove(getTSFilenameWithPath(m.outPath, frag.filename))
+	for _, part := range frag.parts {
+		_ = os.Remove(getTSFilenameWithPath(m.outPath, part.filename))
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type RecordCatalog struct {
+	outPath string
+}
+
+// @param outPath 与MuxerConfig.OutPath相同
+func NewRecordCatalog(outPath string) *RecordCatalog {
+	return &RecordCatalog{
+		outPath: outPath,
+	}
+}
+
+// @return 有录制索引的所有流的名称
+func (c *RecordCatalog) ListStreams() ([]string, error) {
+	fis, err := ioutil.ReadDir(c.outPath)
+	if err != nil {
+		return nil, err
+	}
+	var streamNames []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(getRecordIndexFilename(getMuxerOutPath(c.outPath, fi.Name()))); err == nil {
+			streamNames = append(streamNames, fi.Name())
+		}
+	}
+	return streamNames, nil
+}
+
+// @return 流的录制中所有连续的时间段，按时间排序
+func (c *RecordCatalog) ListRanges(streamName string) ([]base.RecordRange, error) {
+	segs, err := c.readIndex(streamName)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []base.RecordRange
+	for _, seg := range segs {
+		n := len(ranges)
+		if n != 0 && seg.Start-ranges[n-1].End <= recordRangeMaxGapMS {
+			if seg.End > ranges[n-1].End {
+				ranges[n-1].End = seg.End
+			}
+			continue
+		}
+		ranges = append(ranges, base.RecordRange{Start: seg.Start, End: seg.End})
+	}
+	for i := range ranges {
+		ranges[i].Duration = float64(ranges[i].End-ranges[i].Start) / 1000
+	}
+	return ranges, nil
+}
+
+// 生成点播m3u8，包含与[start, end)有重叠的所有切片
+//
+// @param uriPrefix 切片URI的前缀，比如`/hls/`或者`http://127.0.0.1:8081/hls/`，切片URI为`<uriPrefix><streamName>/<filename>`
+func (c *RecordCatalog) GenPlaylist(streamName string, start time.Time, end time.Time, uriPrefix string) ([]byte, error) {
+	segs, err := c.selectSegments(streamName, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return genRecordPlaylist(segs, PlaylistTypeVOD, recordURI(streamName, uriPrefix)), nil
+}
+
+// 生成点播的I帧m3u8，包含与[start, end)有重叠、并且记录了关键帧位置的所有切片，参数含义与GenPlaylist相同
+func (c *RecordCatalog) GenIFramePlaylist(streamName string, start time.Time, end time.Time, uriPrefix string) ([]byte, error) {
+	segs, err := c.selectIFrameSegments(streamName, start, end, uriPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:5\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", iframeTargetDuration(segs)))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-PLAYLIST-TYPE:%s\n", PlaylistTypeVOD))
+	buf.WriteString("#EXT-X-I-FRAMES-ONLY\n\n")
+	writeIFrameSegments(&buf, segs)
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes(), nil
+}
+
+// 生成点播的master m3u8，引用点播m3u8以及I帧m3u8
+//
+// @param playlistURI       GenPlaylist生成的m3u8的URI
+// @param iframePlaylistURI GenIFramePlaylist生成的m3u8的URI
+func (c *RecordCatalog) GenMasterPlaylist(streamName string, start time.Time, end time.Time, playlistURI string, iframePlaylistURI string) ([]byte, error) {
+	segs, err := c.selectIFrameSegments(streamName, start, end, "")
+	if err != nil {
+		return nil, err
+	}
+	bandwidth, iframeBandwidth := calcBandwidth(segs)
+	return genMasterPlaylist(bandwidth, playlistURI, iframeBandwidth, iframePlaylistURI), nil
+}
+
+// @return 与[start, end)有重叠的所有切片
+func (c *RecordCatalog) selectSegments(streamName string, start time.Time, end time.Time) ([]recordSegment, error) {
+	segs, err := c.readIndex(streamName)
+	if err != nil {
+		return nil, err
+	}
+	startMS := start.UnixNano() / 1e6
+	endMS := end.UnixNano() / 1e6
+	var selected []recordSegment
+	for _, seg := range segs {
+		if seg.End > startMS && seg.Start < endMS {
+			selected = append(selected, seg)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return selected, nil
+}
+
+func (c *RecordCatalog) selectIFrameSegments(streamName string, start time.Time, end time.Time, uriPrefix string) ([]iframeSegment, error) {
+	segs, err := c.selectSegments(streamName, start, end)
+	if err != nil {
+		return nil, err
+	}
+	uri := recordURI(streamName, uriPrefix)
+	var iframeSegs []iframeSegment
+	var prev *recordSegment
+	for i := range segs {
+		seg := &segs[i]
+		// 加密以及fmp4的切片不记录关键帧位置
+		if len(seg.IFrames) == 0 {
+			continue
+		}
+		iframeSegs = append(iframeSegs, iframeSegment{
+			uri:             uri(seg.Filename),
+			discont:         prev != nil && (seg.Discont || seg.Start-prev.End > recordRangeMaxGapMS),
+			programDateTime: time.Unix(0, seg.Start*1e6),
+			offset:          seg.Offset,
+			headerLength:    seg.HeaderLength,
+			size:            seg.Size,
+			duration:        seg.Duration,
+			iframes:         seg.IFrames,
+		})
+		prev = seg
+	}
+	if len(iframeSegs) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return iframeSegs, nil
+}
+
+// @return 录制中的切片、初始化段以及密钥的URI
+func recordURI(streamName string, uriPrefix string) func(filename string) string {
+	return func(filename string) string {
+		if strings.Contains(filename, "://") || strings.HasPrefix(filename, "/") {
+			return filename
+		}
+		return fmt.Sprintf("%s%s/%s", uriPrefix, streamName, filename)
+	}
+}
+
+func (c *RecordCatalog) readIndex(streamName string) ([]recordSegment, error) {
+	// 流名称来自于请求参数，不允许访问输出目录之外的文件
+	if streamName == "" || streamName == "." || streamName == ".." || strings.ContainsAny(streamName, `/\`) {
+		return nil, ErrRecordNotFound
+	}
+	return readRecordIndex(getRecordIndexFilename(getMuxerOutPath(c.outPath, streamName)))
+}
+
+// @return 按开始时间排序的所有切片
+func readRecordIndex(filename string) ([]recordSegment, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, ErrRecordNotFound
+	}
+	defer fp.Close()
+
+	var segs []recordSegment
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var seg recordSegment
+		// 进程异常退出时，最后一行可能不完整，忽略
+		if err := json.Unmarshal(scanner.Bytes(), &seg); err != nil || seg.Filename == "" {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// 重新推流时本地时间可能回退，所以按时间重新排序
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].Start < segs[j].Start
+	})
+	return segs, nil
+}
+
+// @param playlistType 为空时不写入`#EXT-X-PLAYLIST-TYPE`，比如Janitor重新生成的record.m3u8，之后Muxer还会继续追加切片
+// @param uri          切片、初始化段以及密钥的URI
+func genRecordPlaylist(segs []recordSegment, playlistType string, uri func(filename string) string) []byte {
+	version := 3
+	maxDuration := 0.0
+	for _, seg := range segs {
+		if seg.Map != "" {
+			version = 7
+		} else if seg.Length > 0 && version < 4 {
+			version = 4
+		}
+		maxDuration = math.Max(maxDuration, seg.Duration)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", version))
+	buf.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(maxDuration))))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	if playlistType != "" {
+		buf.WriteString(fmt.Sprintf("#EXT-X-PLAYLIST-TYPE:%s\n", playlistType))
+		buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	buf.WriteString("\n")
+
+	var prev *recordSegment
+	for i := range segs {
+		seg := &segs[i]
+		// 时间不连续（比如中间断流了），或者初始化段变化时，需要重新初始化解码器
+		if prev != nil && (seg.Discont || seg.Start-prev.End > recordRangeMaxGapMS || seg.Map != prev.Map) {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.Map != "" && (prev == nil || seg.Map != prev.Map) {
+			buf.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", uri(seg.Map)))
+		}
+		if seg.KeyMethod != "" {
+			buf.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=0x%s\n", seg.KeyMethod, uri(seg.KeyURI), hex.EncodeToString(genIV(seg.ID))))
+		} else if prev != nil && prev.KeyMethod != "" {
+			buf.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		}
+		buf.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", time.Unix(0, seg.Start*1e6).Format(programDateTimeLayout)))
+		buf.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", seg.Duration))
+		if seg.Length > 0 {
+			buf.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", seg.Length, seg.Offset))
+		}
+		buf.WriteString(uri(seg.Filename))
+		buf.WriteString("\n")
+		prev = seg
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,100 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+func TestRecordCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsrecord")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 25*5+1)
+	m.Dispose()
+
+	c := NewRecordCatalog(config.OutPath)
+	streamNames, err := c.ListStreams()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"test"}, streamNames)
+
+	// 所有切片的本地时间连续，为一个时间段
+	segs, err := c.readIndex("test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, len(segs))
+	for i := 1; i < len(segs); i++ {
+		assert.Equal(t, segs[i-1].End, segs[i].Start)
+	}
+	ranges, err := c.ListRanges("test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(ranges))
+	assert.Equal(t, segs[0].Start, ranges[0].Start)
+	assert.Equal(t, segs[5].End, ranges[0].End)
+
+	// 模拟一小时后重新推流，追加一个不连续的时间段，以及一行不完整的记录
+	fp, err := os.OpenFile(getRecordIndexFilename(m.outPath), os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Equal(t, nil, err)
+	later := segs[5].End + 3600*1000
+	for i := 0; i < 2; i++ {
+		b, _ := json.Marshal(recordSegment{ID: i, Filename: "later.ts", Start: later + int64(i)*1000, End: later + int64(i+1)*1000, Duration: 1, Discont: i == 0})
+		_, _ = fp.Write(append(b, '\n'))
+	}
+	_, _ = fp.Write([]byte(`{"id":2,"filen`))
+	_ = fp.Close()
+	ranges, err = c.ListRanges("test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(ranges))
+	assert.Equal(t, later, ranges[1].Start)
+	assert.Equal(t, float64(2), ranges[1].Duration)
+
+	// 只包含与查询时间段有重叠的切片
+	start := time.Unix(0, (segs[1].Start+500)*1e6)
+	end := time.Unix(0, (segs[3].Start+500)*1e6)
+	content, err := c.GenPlaylist("test", start, end, "/hls/")
+	assert.Equal(t, nil, err)
+	playlist := string(content)
+	assert.Equal(t, true, strings.Contains(playlist, "#EXT-X-PLAYLIST-TYPE:VOD\n"))
+	assert.Equal(t, 3, strings.Count(playlist, "#EXTINF:"))
+	assert.Equal(t, 3, strings.Count(playlist, "#EXT-X-PROGRAM-DATE-TIME:"))
+	assert.Equal(t, true, strings.Contains(playlist, "/hls/test/"+segs[1].Filename+"\n"))
+	assert.Equal(t, false, strings.Contains(playlist, segs[0].Filename))
+	assert.Equal(t, true, strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n"))
+
+	// 跨越两个时间段时，中间插入不连续标志
+	content, err = c.GenPlaylist("test", time.Unix(0, segs[5].Start*1e6), time.Unix(0, (later+500)*1e6), "http://127.0.0.1:8081/hls/")
+	assert.Equal(t, nil, err)
+	playlist = string(content)
+	assert.Equal(t, 2, strings.Count(playlist, "#EXTINF:"))
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"))
+	assert.Equal(t, true, strings.Contains(playlist, "http://127.0.0.1:8081/hls/test/later.ts\n"))
+
+	_, err = c.GenPlaylist("test", time.Unix(0, 0), time.Unix(1, 0), "/hls/")
+	assert.Equal(t, ErrRecordNotFound, err)
+	_, err = c.ListRanges("../test")
+	assert.Equal(t, ErrRecordNotFound, err)
+	_, err = c.ListRanges("notexist")
+	assert.Equal(t, ErrRecordNotFound, err)
+}
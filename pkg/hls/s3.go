@@ -0,0 +1,216 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3兼容的对象存储，只实现了上传需要的PutObject，使用AWS Signature Version 4签名，path-style的地址，也即`<Endpoint>/<Bucket>/<Key>`
+//
+// 参考 https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+
+const (
+	defaultS3Region    = "us-east-1"
+	defaultS3TimeoutMS = 10000
+
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3AmzDateLayout = "20060102T150405Z"
+	s3DateLayout    = "20060102"
+)
+
+type S3Config struct {
+	Enable     bool   `json:"enable"`
+	Endpoint   string `json:"endpoint"` // 比如`http://127.0.0.1:9000`
+	Region     string `json:"region"`   // 如果为空，则使用默认值us-east-1
+	Bucket     string `json:"bucket"`
+	AccessKey  string `json:"access_key"`
+	SecretKey  string `json:"secret_key"`
+	PathPrefix string `json:"path_prefix"` // 对象名的前缀，对象名为`<PathPrefix><streamName>/<filename>`
+
+	// 如果不为空，直播m3u8中已经上传成功的切片，URI使用`<CDNURLPrefix><streamName>/<filename>`，也即由CDN或者对象存储直接提供切片
+	CDNURLPrefix string `json:"cdn_url_prefix"`
+
+	TimeoutMS       int `json:"timeout_ms"`        // 单次上传的超时时间，如果为0，则使用默认值10秒
+	MaxRetry        int `json:"max_retry"`         // 上传失败后的重试次数
+	RetryIntervalMS int `json:"retry_interval_ms"` // 重试间隔，如果为0，则使用默认值1秒
+	QueueSize       int `json:"queue_size"`        // 上传队列的长度，队列满时丢弃，如果为0，则使用默认值1024
+	WorkerNum       int `json:"worker_num"`        // 并发上传的数量，同一路流的文件按顺序上传，如果为0，则使用默认值4
+}
+
+type S3Client struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3Client(config S3Config) *S3Client {
+	timeoutMS := config.TimeoutMS
+	if timeoutMS <= 0 {
+		timeoutMS = defaultS3TimeoutMS
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	return &S3Client{
+		config: config,
+		client: &http.Client{
+			Timeout: time.Duration(timeoutMS) * time.Millisecond,
+		},
+	}
+}
+
+func (c *S3Client) ObjectKey(streamName string, filename string) string {
+	return fmt.Sprintf("%s%s/%s", c.config.PathPrefix, streamName, filename)
+}
+
+func (c *S3Client) PutObject(key string, content []byte, contentType string) error {
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(c.config.Endpoint, "/"), c.config.Bucket, s3EncodeKey(key))
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(content)
+	signS3Request(req, c.config.AccessKey, c.config.SecretKey, c.config.Region, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("lal.hls: s3 put object failed. status=%d, body=%s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// 设置`x-amz-date`、`x-amz-content-sha256`以及`Authorization`，对Host以及请求中已有的所有header签名
+//
+// @param payloadHash 请求body的sha256，hex格式
+func signS3Request(req *http.Request, accessKey string, secretKey string, region string, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("x-amz-date", t.Format(s3AmzDateLayout))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders, signature := s3Signature(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, req.URL.Host, req.Header, secretKey, region, payloadHash, t)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, s3Scope(t, region), signedHeaders, signature))
+}
+
+// @param header 需要签名的header，不包含Host，其中的`Authorization`会被忽略
+//
+// @return signedHeaders 参与签名的header名称，`;`分隔
+// @return signature     签名，hex格式
+func s3Signature(method string, escapedPath string, rawQuery string, host string, header http.Header, secretKey string, region string, payloadHash string, t time.Time) (signedHeaders string, signature string) {
+	t = t.UTC()
+
+	name2Value := map[string]string{"host": host}
+	for k, vs := range header {
+		k = strings.ToLower(k)
+		if k == "authorization" {
+			continue
+		}
+		var values []string
+		for _, v := range vs {
+			values = append(values, strings.TrimSpace(v))
+		}
+		name2Value[k] = strings.Join(values, ",")
+	}
+	var names []string
+	for k := range name2Value {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + name2Value[k] + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	if escapedPath == "" {
+		escapedPath = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		s3CanonicalQuery(rawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3AmzDateLayout),
+		s3Scope(t, region),
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+secretKey), t.Format(s3DateLayout))
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature = hex.EncodeToString(s3HMAC(key, stringToSign))
+	return
+}
+
+func s3Scope(t time.Time, region string) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", t.Format(s3DateLayout), region)
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3CanonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kvs []string
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if !strings.Contains(kv, "=") {
+			kv += "="
+		}
+		kvs = append(kvs, kv)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, "&")
+}
+
+// 对象名中除了A-Z、a-z、0-9、'-'、'.'、'_'、'~'以及'/'，其他字符都需要编码
+func s3EncodeKey(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+	return buf.String()
+}
@@ -9,27 +9,77 @@
 package hls
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/souliot/siot-av/pkg/base"
 	"github.com/souliot/naza/pkg/log"
 )
 
+const (
+	// 切片的Cache-Control max-age
+	segmentMaxAgeSec = 600
+
+	subSessionCheckIntervalMS = 1000
+)
+
+type AuthInfo struct {
+	StreamName string
+	FileName   string
+	URLParam   string // 请求中的参数，比如鉴权的token，不包含'?'
+	RemoteAddr string
+}
+
+type ServerObserver interface {
+	// 收到m3u8以及密钥请求时回调，返回false时拒绝请求，返回403
+	// 注意，m3u8中相对路径的密钥URI会追加m3u8请求的参数，所以密钥请求与m3u8请求带有相同的参数
+	//
+	OnHLSPlayAuth(info AuthInfo) bool
+
+	// 新的播放者首次请求m3u8时回调，返回false时拒绝请求，返回403
+	// 注意，只有设置了ServerObserver时，才会识别以及统计播放者
+	//
+	OnNewHLSSubSession(session *SubSession) bool
+
+	// 播放者超时没有请求m3u8时回调
+	//
+	OnDelHLSSubSession(session *SubSession)
+}
+
 type Server struct {
-	addr    string
-	outPath string
-	ln      net.Listener
-	httpSrv *http.Server
-	log     log.Logger
+	addr     string
+	outPath  string
+	ln       net.Listener
+	httpSrv  *http.Server
+	observer ServerObserver
+	log      log.Logger
+
+	abrProvider ABRProvider
+
+	subSessionConfig SubSessionConfig
+	sessionMutex     sync.Mutex
+	key2Session      map[string]*SubSession // key为`streamName/sid`
+	key2Kicked       map[string]*SubSession // 被踢掉的播放者，超时前拒绝其请求
+	exitChan         chan struct{}
+	disposeOnce      sync.Once
 }
 
 func NewServer(addr string, outPath string, logger log.Logger) *Server {
 	logger.WithPrefix("pkg.hls.muxer")
 	return &Server{
-		addr:    addr,
-		outPath: outPath,
-		log:     logger,
+		addr:        addr,
+		outPath:     outPath,
+		log:         logger,
+		key2Session: make(map[string]*SubSession),
+		key2Kicked:  make(map[string]*SubSession),
+		exitChan:    make(chan struct{}),
 	}
 }
 
@@ -41,20 +91,54 @@ func (s *Server) Log() log.Logger {
 	return s.log
 }
 
+// 需要在Listen之前调用
+func (s *Server) SetObserver(observer ServerObserver) {
+	s.observer = observer
+}
+
+// 需要在Listen之前调用
+func (s *Server) SetABRProvider(provider ABRProvider) {
+	s.abrProvider = provider
+}
+
+// 需要在Listen之前调用
+func (s *Server) SetSubSessionConfig(config SubSessionConfig) {
+	s.subSessionConfig = config
+}
+
+// 需要在Listen之前调用，设置后不再监听addr
+func (s *Server) SetListener(ln net.Listener) {
+	s.ln = ln
+}
+
+// 只作为http.Handler挂载到外部的http.Server时，不需要调用Listen，但依然需要调用RunLoop
 func (s *Server) Listen() (err error) {
-	if s.ln, err = net.Listen("tcp", s.addr); err != nil {
-		return
+	if s.ln == nil {
+		if s.ln, err = net.Listen("tcp", s.addr); err != nil {
+			return
+		}
 	}
 	s.httpSrv = &http.Server{Addr: s.addr, Handler: s}
-	s.Log().Info("start hls server listen. addr=%s", s.addr)
+	s.Log().Info("start hls server listen. addr=%s", s.ln.Addr().String())
 	return
 }
 
 func (s *Server) RunLoop() error {
+	go s.runSubSessionCheckLoop()
+	if s.httpSrv == nil {
+		<-s.exitChan
+		return nil
+	}
 	return s.httpSrv.Serve(s.ln)
 }
 
 func (s *Server) Dispose() {
+	s.disposeOnce.Do(func() {
+		close(s.exitChan)
+	})
+	if s.httpSrv == nil {
+		return
+	}
 	if err := s.httpSrv.Close(); err != nil {
 		s.Log().Error(err)
 	}
@@ -64,18 +148,82 @@ func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	// TODO chef:
 	// - check appname in URI path
 
-	ri := parseRequestInfo(req.RequestURI)
+	// 注意，LL-HLS的请求带有参数，所以这里使用不带参数的path
+	ri := parseRequestInfo(req.URL.Path)
 
-	if ri.fileName == "" || ri.streamName == "" || (ri.fileType != "m3u8" && ri.fileType != "ts") {
+	if ri.fileName == "" || ri.streamName == "" || (ri.fileType != "m3u8" && ri.fileType != "ts" && ri.fileType != "mp4" && ri.fileType != "m4s" && ri.fileType != "key") {
 		s.Log().Warn("%+v", ri)
 		resp.WriteHeader(404)
 		return
 	}
 
-	content, err := readFileContent(s.outPath, ri)
+	if (ri.fileType == "m3u8" || ri.fileType == "key") && s.observer != nil {
+		info := AuthInfo{
+			StreamName: ri.streamName,
+			FileName:   ri.fileName,
+			URLParam:   req.URL.RawQuery,
+			RemoteAddr: req.RemoteAddr,
+		}
+		if !s.observer.OnHLSPlayAuth(info) {
+			s.Log().Warn("hls play auth failed. info=%+v", info)
+			resp.WriteHeader(403)
+			return
+		}
+	}
+
+	// ABR的master m3u8只引用各码率的m3u8，不对应某个流，不创建播放者
+	if content, ok := s.readABRPlaylist(ri); ok {
+		content = appendPlaylistURIQuery(content, filterQuery(req.URL.Query()))
+		resp.Header().Add("Content-Type", "application/x-mpegurl")
+		resp.Header().Add("Server", base.LALHLSM3U8Server)
+		resp.Header().Add("Cache-Control", "no-cache")
+		resp.Header().Add("Access-Control-Allow-Origin", "*")
+		_, _ = resp.Write(content)
+		return
+	}
+
+	session, isNew, ok := s.getSubSession(resp, req, ri)
+	if !ok {
+		return
+	}
+
+	// m3u8以及密钥读取到内存中，切片按需读取
+	var content []byte
+	var fr fileReader
+	var size int64
+	var err error
+	switch ri.fileType {
+	case "m3u8":
+		content, err = s.readPlaylist(req.Context(), ri, req.URL.Query())
+		if err == nil {
+			content = appendPlaylistURIQuery(content, playlistURIQuery(req.URL.Query(), session))
+		}
+	case "ts":
+		fr, size, err = s.readFragment(req.Context(), ri)
+	case "mp4", "m4s":
+		fr, size, err = s.openFile(ri)
+	case "key":
+		content, err = getKeyProvider().GetKey(ri.streamName, ri.fileName)
+	}
+	if fr != nil {
+		defer fr.Close()
+	} else {
+		size = int64(len(content))
+	}
 	if err != nil {
 		s.Log().Warn("%+v", err)
-		resp.WriteHeader(404)
+		// 首次请求就失败的播放者，比如流不存在，不再保留
+		if isNew {
+			s.delSubSession(session)
+		}
+		switch err {
+		case ErrLLHLSBadRequest:
+			resp.WriteHeader(400)
+		case ErrLLHLSTimeout:
+			resp.WriteHeader(503)
+		default:
+			resp.WriteHeader(404)
+		}
 		return
 	}
 
@@ -86,14 +234,339 @@ func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	case "ts":
 		resp.Header().Add("Content-Type", "video/mp2t")
 		resp.Header().Add("Server", base.LALHLSTSServer)
+	case "mp4":
+		resp.Header().Add("Content-Type", "video/mp4")
+		resp.Header().Add("Server", base.LALHLSTSServer)
+	case "m4s":
+		resp.Header().Add("Content-Type", "video/iso.segment")
+		resp.Header().Add("Server", base.LALHLSTSServer)
+	case "key":
+		resp.Header().Add("Content-Type", "application/octet-stream")
+		resp.Header().Add("Server", base.LALHLSTSServer)
+	}
+	// m3u8会更新，切片生成后不再改变，可以缓存，密钥需要鉴权，不缓存
+	etag := genETag(ri, content, size)
+	resp.Header().Add("ETag", etag)
+	if ri.fileType == "m3u8" || ri.fileType == "key" {
+		resp.Header().Add("Cache-Control", "no-cache")
+	} else {
+		resp.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", segmentMaxAgeSec))
 	}
-	resp.Header().Add("Cache-Control", "no-cache")
 	resp.Header().Add("Access-Control-Allow-Origin", "*")
 
+	// 切片由http.ServeContent处理If-None-Match以及Range，byte range模式下播放器按照`#EXT-X-BYTERANGE`请求切片的一部分
+	if fr != nil {
+		cw := &countingResponseWriter{ResponseWriter: resp}
+		http.ServeContent(cw, req, "", time.Time{}, fr)
+		if session != nil {
+			session.addWroteBytes(cw.n)
+		}
+		return
+	}
+
+	if req.Header.Get("If-None-Match") == etag {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
 	_, _ = resp.Write(content)
+	if session != nil {
+		session.addWroteBytes(len(content))
+	}
 	return
 }
 
+// 统计写入的body大小，用于播放者的流量统计
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += n
+	return n, err
+}
+
+// 识别请求所属的播放者，m3u8请求时，不存在则创建
+//
+// @return session 没有设置ServerObserver，或者非m3u8请求找不到播放者时为nil
+// @return isNew   是否为本次请求新创建的播放者
+// @return ok      为false时，已经回复了请求（重定向或者拒绝）
+//
+func (s *Server) getSubSession(resp http.ResponseWriter, req *http.Request, ri requestInfo) (session *SubSession, isNew bool, ok bool) {
+	if s.observer == nil {
+		return nil, false, true
+	}
+
+	sid := req.URL.Query().Get(SubSessionIDParam)
+	if sid == "" {
+		if ri.fileType == "m3u8" && s.subSessionConfig.Redirect {
+			query := req.URL.Query()
+			query.Set(SubSessionIDParam, genRandomSubSessionID())
+			u := *req.URL
+			u.RawQuery = query.Encode()
+			http.Redirect(resp, req, u.RequestURI(), http.StatusFound)
+			return nil, false, false
+		}
+		sid = genSubSessionIDByClient(ri.streamName, req.RemoteAddr, req.UserAgent())
+	}
+	key := ri.streamName + "/" + sid
+
+	s.sessionMutex.Lock()
+	if _, ok := s.key2Kicked[key]; ok {
+		s.sessionMutex.Unlock()
+		resp.WriteHeader(403)
+		return nil, false, false
+	}
+	session = s.key2Session[key]
+	if session != nil && session.isDisposed() {
+		s.sessionMutex.Unlock()
+		s.kickSubSession(key, session)
+		resp.WriteHeader(403)
+		return nil, false, false
+	}
+	if session != nil || ri.fileType != "m3u8" {
+		s.sessionMutex.Unlock()
+		if session != nil && ri.fileType == "m3u8" {
+			session.onPlaylist(time.Now())
+		}
+		return session, false, true
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	rawURL := fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.RequestURI())
+	session = NewSubSession(sid, s.subSessionConfig.AppName, ri.streamName, rawURL, filterQuery(req.URL.Query()).Encode(), req.RemoteAddr, s.log)
+	s.key2Session[key] = session
+	s.sessionMutex.Unlock()
+
+	if !s.observer.OnNewHLSSubSession(session) {
+		s.sessionMutex.Lock()
+		delete(s.key2Session, key)
+		s.sessionMutex.Unlock()
+		resp.WriteHeader(403)
+		return nil, false, false
+	}
+	return session, true, true
+}
+
+func (s *Server) delSubSession(session *SubSession) {
+	s.sessionMutex.Lock()
+	key := session.streamName + "/" + session.sid
+	if s.key2Session[key] != session {
+		s.sessionMutex.Unlock()
+		return
+	}
+	delete(s.key2Session, key)
+	s.sessionMutex.Unlock()
+
+	session.Log().Info("[%s] lifecycle dispose hls SubSession.", session.UniqueKey)
+	s.observer.OnDelHLSSubSession(session)
+}
+
+// 被踢掉的播放者从key2Session中移到key2Kicked
+func (s *Server) kickSubSession(key string, session *SubSession) {
+	s.sessionMutex.Lock()
+	if s.key2Session[key] != session {
+		s.sessionMutex.Unlock()
+		return
+	}
+	delete(s.key2Session, key)
+	s.key2Kicked[key] = session
+	s.sessionMutex.Unlock()
+
+	session.Log().Info("[%s] lifecycle dispose hls SubSession, kicked.", session.UniqueKey)
+	s.observer.OnDelHLSSubSession(session)
+}
+
+func (s *Server) runSubSessionCheckLoop() {
+	t := time.NewTicker(subSessionCheckIntervalMS * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.exitChan:
+			return
+		case now := <-t.C:
+			s.checkSubSessionTimeout(now)
+		}
+	}
+}
+
+func (s *Server) checkSubSessionTimeout(now time.Time) {
+	timeoutMS := s.subSessionConfig.TimeoutMS
+	if timeoutMS <= 0 {
+		timeoutMS = defaultSubSessionTimeoutMS
+	}
+
+	var expired []*SubSession
+	kicked := make(map[string]*SubSession)
+	s.sessionMutex.Lock()
+	for k, session := range s.key2Session {
+		if session.isDisposed() {
+			kicked[k] = session
+		} else if !session.IsAlive(now, time.Duration(timeoutMS)*time.Millisecond) {
+			expired = append(expired, session)
+			delete(s.key2Session, k)
+		}
+	}
+	for k, session := range s.key2Kicked {
+		if !session.IsAlive(now, time.Duration(timeoutMS)*time.Millisecond) {
+			delete(s.key2Kicked, k)
+		}
+	}
+	s.sessionMutex.Unlock()
+
+	// 回调时不持有锁
+	for _, session := range expired {
+		session.Log().Info("[%s] lifecycle dispose hls SubSession, timeout.", session.UniqueKey)
+		s.observer.OnDelHLSSubSession(session)
+	}
+	for k, session := range kicked {
+		s.kickSubSession(k, session)
+	}
+}
+
+// 内存模式的流从内存中读取，否则从磁盘读取
+func (s *Server) readFile(ri requestInfo) ([]byte, error) {
+	if ms := getMemoryStream(getMuxerOutPath(s.outPath, ri.streamName)); ms != nil {
+		return ms.read(ri.fileName)
+	}
+	return readFileContent(s.outPath, ri)
+}
+
+// 内存模式的流从内存中读取，否则从磁盘读取
+func (s *Server) openFile(ri requestInfo) (fileReader, int64, error) {
+	if ms := getMemoryStream(getMuxerOutPath(s.outPath, ri.streamName)); ms != nil {
+		return ms.open(ri.fileName)
+	}
+	return openFileContent(s.outPath, ri)
+}
+
+// m3u8使用内容计算，切片的文件名唯一且内容不再改变，使用文件名和大小计算，避免每次请求都计算大块数据的hash
+// 注意，byte range模式下切片所在的文件一直在增长，大小变化时ETag也随之变化
+//
+// @param content 切片时不使用
+// @param size    内容的大小
+func genETag(ri requestInfo, content []byte, size int64) string {
+	h := fnv.New64a()
+	if ri.fileType == "m3u8" {
+		_, _ = h.Write(content)
+	} else {
+		_, _ = h.Write([]byte(ri.streamName + "/" + ri.fileName))
+	}
+	return fmt.Sprintf("\"%x-%x\"", size, h.Sum64())
+}
+
+// 带有`_HLS_msn`参数，并且流开启了LL-HLS时，阻塞直到m3u8中包含请求的fragment或part
+// 配置了WaitPlaylistTimeoutMS时，m3u8还不存在的请求也会阻塞，等待第一个m3u8生成
+func (s *Server) readPlaylist(ctx context.Context, ri requestInfo, query url.Values) ([]byte, error) {
+	br, hasMSN, err := parseBlockingRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	key := getMuxerOutPath(s.outPath, ri.streamName)
+	// 没有开启LL-HLS的流，忽略阻塞请求的参数
+	hasMSN = hasMSN && isLowLatencyStream(key)
+	mayBlock := hasMSN || s.subSessionConfig.WaitPlaylistTimeoutMS > 0
+
+	var content []byte
+	var deadline <-chan time.Time
+	var waitDeadline <-chan time.Time
+	for {
+		var updateChan <-chan struct{}
+		release := func() {}
+		if mayBlock {
+			updateChan, release = waitPlaylistUpdate(key)
+		}
+		if content, err = s.readFile(ri); err != nil {
+			// m3u8还不存在，比如正在回源，等待第一个m3u8生成
+			if s.subSessionConfig.WaitPlaylistTimeoutMS <= 0 {
+				release()
+				return nil, err
+			}
+			if waitDeadline == nil {
+				timer := time.NewTimer(time.Duration(s.subSessionConfig.WaitPlaylistTimeoutMS) * time.Millisecond)
+				defer timer.Stop()
+				waitDeadline = timer.C
+			}
+			if !waitUpdate(ctx, updateChan, waitDeadline, release) {
+				return nil, err
+			}
+			continue
+		}
+		if !hasMSN {
+			release()
+			break
+		}
+
+		pos := parsePlaylistPosition(content)
+		if pos.contains(br) {
+			release()
+			break
+		}
+		// 标准要求，请求的序号超过最后一个fragment的序号+2时，返回400
+		if br.msn > pos.nextMSN+1 {
+			release()
+			return nil, ErrLLHLSBadRequest
+		}
+		if deadline == nil {
+			timer := time.NewTimer(time.Duration(pos.targetDuration*blockingReloadTimeoutNum*1000) * time.Millisecond)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		if !waitUpdate(ctx, updateChan, deadline, release) {
+			return nil, ErrLLHLSTimeout
+		}
+	}
+
+	if br.skip {
+		content = skipPlaylistSegments(content)
+	}
+	return content, nil
+}
+
+// 请求`#EXT-X-PRELOAD-HINT`中的part时，该part可能还没有生成，阻塞直到生成
+func (s *Server) readFragment(ctx context.Context, ri requestInfo) (fileReader, int64, error) {
+	key := getMuxerOutPath(s.outPath, ri.streamName)
+	if !isPartFilename(ri.fileName) || !isLowLatencyStream(key) {
+		return s.openFile(ri)
+	}
+
+	var deadline <-chan time.Time
+	for {
+		updateChan, release := waitPlaylistUpdate(key)
+		fr, size, err := s.openFile(ri)
+		if err == nil {
+			release()
+			return fr, size, nil
+		}
+		if deadline == nil {
+			timer := time.NewTimer(partWaitTimeoutMS * time.Millisecond)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		if !waitUpdate(ctx, updateChan, deadline, release) {
+			return nil, 0, err
+		}
+	}
+}
+
+// 等待m3u8更新，返回前调用release
+//
+// @return 返回false表示超时或者请求被取消
+func waitUpdate(ctx context.Context, updateChan <-chan struct{}, deadline <-chan time.Time, release func()) bool {
+	defer release()
+	select {
+	case <-updateChan:
+		return true
+	case <-deadline:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // m3u8文件用这个也行
 //resp.Header().Add("Content-Type", "application/vnd.apple.mpegurl")
 
@@ -102,3 +575,68 @@ func (s *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 //resp.Header().Add("Access-Control-Allow-Methods", "*")
 //resp.Header().Add("Access-Control-Allow-Headers", "Content-Type,Access-Token")
 //resp.Header().Add("Access-Control-Allow-Expose-Headers", "*")
+
+// 去除LL-HLS的`_HLS_`参数以及会话ID
+func filterQuery(query url.Values) url.Values {
+	params := make(url.Values)
+	for k, v := range query {
+		if !strings.HasPrefix(k, "_HLS_") && k != SubSessionIDParam {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// m3u8中的URI需要追加的参数，也即m3u8请求的参数（比如鉴权的token），以及播放者的会话ID
+func playlistURIQuery(query url.Values, session *SubSession) url.Values {
+	params := filterQuery(query)
+	if session != nil {
+		params.Set(SubSessionIDParam, session.sid)
+	}
+	return params
+}
+
+// 将参数追加到m3u8中相对路径的URI上，包括切片、part、密钥以及init.mp4，使得这些请求也能通过鉴权，并且能够识别播放者
+// 密钥URI由appendKeyURIQuery处理
+//
+// @return 没有需要追加的参数时，返回content本身
+func appendPlaylistURIQuery(content []byte, query url.Values) []byte {
+	if len(query) == 0 {
+		return content
+	}
+	q := query.Encode()
+	appendQuery := func(uri string) string {
+		if strings.Contains(uri, "://") {
+			return uri
+		}
+		if strings.Contains(uri, "?") {
+			return uri + "&" + q
+		}
+		return uri + "?" + q
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			lines[i] = appendQuery(line)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-KEY:") {
+			continue
+		}
+		begin := strings.Index(line, `URI="`)
+		if begin == -1 {
+			continue
+		}
+		begin += len(`URI="`)
+		end := strings.IndexByte(line[begin:], '"')
+		if end == -1 {
+			continue
+		}
+		lines[i] = line[:begin] + appendQuery(line[begin:begin+end]) + line[begin+end:]
+	}
+	return appendKeyURIQuery([]byte(strings.Join(lines, "\n")), query)
+}
@@ -0,0 +1,195 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// HLS的播放者
+//
+// HTTP请求本身是无状态的，通过请求参数中的会话ID`hls_sid`识别同一个播放者，m3u8中的切片、part、密钥等URI都会追加该参数
+// m3u8请求不带会话ID时：
+// - SubSessionConfig.Redirect为true，302重定向到带有随机会话ID的地址
+// - 否则，使用IP+User-Agent生成会话ID
+//
+// 播放者超过SubSessionConfig.TimeoutMS没有请求m3u8时，认为播放结束
+// 调用Dispose踢掉播放者后，在SubSessionConfig.TimeoutMS内，该播放者的请求都返回403
+
+const (
+	SubSessionIDParam = "hls_sid"
+
+	defaultSubSessionTimeoutMS = 30000
+	defaultSubSessionAppName   = "live"
+)
+
+type SubSessionConfig struct {
+	TimeoutMS int  `json:"timeout_ms"` // 超过该时间没有请求m3u8，则播放者超时，如果为0，则使用默认值30秒
+	Redirect  bool `json:"redirect"`   // m3u8请求不带会话ID时，是否302重定向到带有随机会话ID的地址
+
+	// m3u8不存在时（比如流还没有推上来，或者正在回源），请求等待第一个m3u8生成的最长时间，0表示不等待，直接返回404
+	// 注意，设置了ServerObserver时，请求m3u8的播放者会触发回源
+	WaitPlaylistTimeoutMS int `json:"wait_playlist_timeout_ms"`
+
+	// HLS的URL中不包含appName，播放者所属group以及回源使用该appName，为空时使用"live"
+	AppName string `json:"app_name"`
+}
+
+type SubSession struct {
+	UniqueKey string
+
+	sid        string // const after init
+	appName    string // const after init
+	streamName string // const after init
+	url        string // const after init
+	rawQuery   string // const after init 首次请求m3u8的参数，不包含会话ID
+	remoteAddr string // const after init
+
+	mutex             sync.Mutex
+	disposed          bool
+	lastPlaylistTime  time.Time
+	wroteBytesSum     uint64
+	prevWroteBytesSum uint64
+	stat              base.StatSession
+	log               log.Logger
+}
+
+func NewSubSession(sid string, appName string, streamName string, url string, rawQuery string, remoteAddr string, logger log.Logger) *SubSession {
+	if appName == "" {
+		appName = defaultSubSessionAppName
+	}
+	uk := base.GenUniqueKey(base.UKPHLSSubSession)
+	s := &SubSession{
+		UniqueKey:        uk,
+		sid:              sid,
+		appName:          appName,
+		streamName:       streamName,
+		url:              url,
+		rawQuery:         rawQuery,
+		remoteAddr:       remoteAddr,
+		lastPlaylistTime: time.Now(),
+		stat: base.StatSession{
+			Protocol:   base.ProtocolHLS,
+			SessionID:  uk,
+			StartTime:  time.Now().Format("2006-01-02 15:04:05.999"),
+			RemoteAddr: remoteAddr,
+		},
+		log: logger,
+	}
+	s.Log().Info("[%s] lifecycle new hls SubSession. session=%p, remote addr=%s, sid=%s", uk, s, remoteAddr, sid)
+	return s
+}
+
+func (session *SubSession) Log() log.Logger {
+	if session.log == nil {
+		session.log = log.DefaultBeeLogger
+	}
+	session.log.WithPrefix("pkg.hls.sub_session")
+	return session.log
+}
+
+// 踢掉播放者，hls.Server之后拒绝该播放者的请求，并回调ServerObserver.OnDelHLSSubSession
+func (session *SubSession) Dispose() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.disposed = true
+	// 从踢掉的时间开始计算拒绝请求的时长
+	session.lastPlaylistTime = time.Now()
+}
+
+func (session *SubSession) UpdateStat(interval uint32) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	wDiff := session.wroteBytesSum - session.prevWroteBytesSum
+	session.stat.WriteBitrate = int(wDiff * 8 / 1024 / uint64(interval))
+	session.stat.Bitrate = session.stat.WriteBitrate
+	session.prevWroteBytesSum = session.wroteBytesSum
+}
+
+func (session *SubSession) GetStat() base.StatSession {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.stat.WroteBytesSum = session.wroteBytesSum
+	return session.stat
+}
+
+// @return 最近一次请求m3u8的时间是否在超时时间内
+func (session *SubSession) IsAlive(now time.Time, timeout time.Duration) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return now.Sub(session.lastPlaylistTime) < timeout
+}
+
+func (session *SubSession) URL() string {
+	return session.url
+}
+
+func (session *SubSession) AppName() string {
+	return session.appName
+}
+
+func (session *SubSession) StreamName() string {
+	return session.streamName
+}
+
+func (session *SubSession) RawQuery() string {
+	return session.rawQuery
+}
+
+func (session *SubSession) RemoteAddr() string {
+	return session.remoteAddr
+}
+
+func (session *SubSession) isDisposed() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.disposed
+}
+
+func (session *SubSession) onPlaylist(now time.Time) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.lastPlaylistTime = now
+}
+
+func (session *SubSession) addWroteBytes(n int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.wroteBytesSum += uint64(n)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func genRandomSubSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// 不同的流使用不同的会话ID
+func genSubSessionIDByClient(streamName string, remoteAddr string, userAgent string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(streamName + "|" + ip + "|" + userAgent))
+	return fmt.Sprintf("%x", h.Sum64())
+}
@@ -0,0 +1,220 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+type subSessionTestObserver struct {
+	newSessions []*SubSession
+	delSessions []*SubSession
+}
+
+func (o *subSessionTestObserver) OnHLSPlayAuth(info AuthInfo) bool {
+	return true
+}
+
+func (o *subSessionTestObserver) OnNewHLSSubSession(session *SubSession) bool {
+	o.newSessions = append(o.newSessions, session)
+	return true
+}
+
+func (o *subSessionTestObserver) OnDelHLSSubSession(session *SubSession) {
+	o.delSessions = append(o.delSessions, session)
+}
+
+func TestServerSubSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlssub")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 60)
+
+	o := &subSessionTestObserver{}
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	s.SetObserver(o)
+	s.SetSubSessionConfig(SubSessionConfig{TimeoutMS: 5000})
+
+	get := func(uri string, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", "test")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// 没有会话ID时，使用IP+User-Agent识别，同一个播放者多次请求m3u8只创建一个会话
+	resp := get("/hls/test/playlist.m3u8?token=abc", "10.0.0.1:1000")
+	assert.Equal(t, 200, resp.Code)
+	resp = get("/hls/test/playlist.m3u8?token=abc", "10.0.0.1:1001")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 1, len(o.newSessions))
+	session := o.newSessions[0]
+	assert.Equal(t, "test", session.StreamName())
+	assert.Equal(t, "live", session.AppName())
+	assert.Equal(t, "token=abc", session.RawQuery())
+	assert.Equal(t, true, strings.HasPrefix(session.URL(), "http://example.com/hls/test/playlist.m3u8"))
+
+	// m3u8中的切片URI带有会话ID，切片请求计入播放者的流量
+	var segURI string
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		if strings.HasSuffix(line, "hls_sid="+session.sid+"&token=abc") && !strings.HasPrefix(line, "#") {
+			segURI = line
+			break
+		}
+	}
+	assert.Equal(t, true, segURI != "")
+	playlistBytes := session.GetStat().WroteBytesSum
+	resp = get("/hls/test/"+segURI, "10.0.0.2:1000")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, playlistBytes+uint64(resp.Body.Len()), session.GetStat().WroteBytesSum)
+	session.UpdateStat(1)
+	assert.Equal(t, true, session.GetStat().Bitrate > 0)
+
+	// 其他播放者
+	resp = get("/hls/test/playlist.m3u8", "10.0.0.3:1000")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 2, len(o.newSessions))
+
+	// 超时
+	s.checkSubSessionTimeout(time.Now().Add(time.Second))
+	assert.Equal(t, 0, len(o.delSessions))
+	s.checkSubSessionTimeout(time.Now().Add(6 * time.Second))
+	assert.Equal(t, 2, len(o.delSessions))
+	assert.Equal(t, 0, len(s.key2Session))
+
+	// 重定向到带有随机会话ID的地址
+	s.SetSubSessionConfig(SubSessionConfig{Redirect: true})
+	resp = get("/hls/test/playlist.m3u8?token=abc", "10.0.0.1:1000")
+	assert.Equal(t, 302, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "abc", location.Query().Get("token"))
+	sid := location.Query().Get(SubSessionIDParam)
+	assert.Equal(t, true, sid != "")
+	resp = get(location.String(), "10.0.0.1:1000")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, 3, len(o.newSessions))
+	assert.Equal(t, sid, o.newSessions[2].sid)
+}
+
+// 踢掉的播放者，超时前的请求都返回403
+func TestServerKickSubSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlskick")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 60)
+
+	o := &subSessionTestObserver{}
+	s := NewServer("", config.OutPath, log.DefaultBeeLogger)
+	s.SetObserver(o)
+	s.SetSubSessionConfig(SubSessionConfig{TimeoutMS: 5000})
+	get := func(uri string) int {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", uri, nil))
+		return resp.Code
+	}
+
+	assert.Equal(t, 200, get("/hls/test/playlist.m3u8"))
+	assert.Equal(t, 1, len(o.newSessions))
+	o.newSessions[0].Dispose()
+	assert.Equal(t, 403, get("/hls/test/playlist.m3u8"))
+	assert.Equal(t, 1, len(o.delSessions))
+	assert.Equal(t, 403, get("/hls/test/playlist.m3u8"))
+	assert.Equal(t, 1, len(o.newSessions))
+	assert.Equal(t, 1, len(o.delSessions))
+
+	// 播放者不再请求时，由定时检查回调删除
+	assert.Equal(t, 200, get("/hls/test/playlist.m3u8?hls_sid=abc"))
+	assert.Equal(t, 2, len(o.newSessions))
+	o.newSessions[1].Dispose()
+	s.checkSubSessionTimeout(time.Now())
+	assert.Equal(t, 2, len(o.delSessions))
+	assert.Equal(t, 403, get("/hls/test/playlist.m3u8?hls_sid=abc"))
+
+	// 超时之后可以重新播放
+	s.checkSubSessionTimeout(time.Now().Add(6 * time.Second))
+	assert.Equal(t, 0, len(s.key2Kicked))
+	assert.Equal(t, 200, get("/hls/test/playlist.m3u8?hls_sid=abc"))
+	assert.Equal(t, 3, len(o.newSessions))
+	m.Dispose()
+}
+
+func TestServerWaitPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlswait")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	o := &subSessionTestObserver{}
+	s := NewServer("", dir+"/", log.DefaultBeeLogger)
+	s.SetObserver(o)
+	s.SetSubSessionConfig(SubSessionConfig{WaitPlaylistTimeoutMS: 5000})
+
+	// 流还不存在，请求等待第一个m3u8生成
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil))
+		done <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	feedEncryptTestMuxer(m, 30)
+
+	resp := <-done
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, true, strings.Contains(resp.Body.String(), "#EXTINF:"))
+	assert.Equal(t, 1, len(o.newSessions))
+	assert.Equal(t, 0, len(o.delSessions))
+
+	// 超时后返回404，并且不保留该播放者
+	s.SetSubSessionConfig(SubSessionConfig{WaitPlaylistTimeoutMS: 100})
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/notexist/playlist.m3u8", nil))
+	assert.Equal(t, 404, resp.Code)
+	assert.Equal(t, 2, len(o.newSessions))
+	assert.Equal(t, 1, len(o.delSessions))
+	assert.Equal(t, "notexist", o.delSessions[0].StreamName())
+}
@@ -0,0 +1,325 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 上传到对象存储
+//
+// 切片完成、m3u8更新时，Muxer把文件放入Uploader的上传队列，由Uploader异步上传，不阻塞Muxer
+// - 上传的是Muxer写文件时的内容，或者切片关闭之后的文件，所以不会与Muxer写m3u8时的改名冲突
+// - 同一路流的文件由同一个协程按顺序上传，所以切片总是先于引用它的m3u8上传
+// - 不上传LL-HLS的part、byte range的切片以及密钥
+//
+// 注意，对象存储中的文件不会被Janitor清理，可以使用对象存储自身的生命周期规则
+
+const (
+	UploadFailReasonQueueFull = "queue_full"
+	UploadFailReasonError     = "error"
+
+	defaultUploadQueueSize       = 1024
+	defaultUploadWorkerNum       = 4
+	defaultUploadRetryIntervalMS = 1000
+)
+
+type UploaderObserver interface {
+	// 队列满被丢弃，或者重试后依然失败时回调
+	//
+	OnHLSUploadFail(info base.HLSUploadFailInfo)
+}
+
+var (
+	uploaderMutex sync.Mutex
+	uploader      *Uploader
+)
+
+// 设置后，所有Muxer都会上传文件，设置为nil时不上传
+func SetUploader(u *Uploader) {
+	uploaderMutex.Lock()
+	defer uploaderMutex.Unlock()
+	uploader = u
+}
+
+func GetUploader() *Uploader {
+	uploaderMutex.Lock()
+	defer uploaderMutex.Unlock()
+	return uploader
+}
+
+type uploadTask struct {
+	streamName  string
+	filename    string
+	key         string
+	content     []byte // 如果为nil，则上传时读取localPath
+	localPath   string
+	contentType string
+	done        int32 // 上传成功后为1
+}
+
+func (t *uploadTask) uploaded() bool {
+	return atomic.LoadInt32(&t.done) == 1
+}
+
+type Uploader struct {
+	config   S3Config
+	client   *S3Client
+	observer UploaderObserver
+
+	queues      []chan *uploadTask // 按流名称分配
+	exitChan    chan struct{}
+	disposeOnce sync.Once
+	wg          sync.WaitGroup
+
+	mutex       sync.Mutex
+	stream2Stat map[string]*base.StatHLSUpload
+	log         log.Logger
+}
+
+// @param observer 可以为nil
+func NewUploader(config S3Config, observer UploaderObserver, logger log.Logger) *Uploader {
+	workerNum := config.WorkerNum
+	if workerNum <= 0 {
+		workerNum = defaultUploadWorkerNum
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultUploadQueueSize
+	}
+	u := &Uploader{
+		config:      config,
+		client:      NewS3Client(config),
+		observer:    observer,
+		exitChan:    make(chan struct{}),
+		stream2Stat: make(map[string]*base.StatHLSUpload),
+		log:         logger,
+	}
+	for i := 0; i < workerNum; i++ {
+		u.queues = append(u.queues, make(chan *uploadTask, (queueSize+workerNum-1)/workerNum))
+	}
+	u.Log().Info("lifecycle new hls uploader. uploader=%p, endpoint=%s, bucket=%s", u, config.Endpoint, config.Bucket)
+	return u
+}
+
+func (u *Uploader) Log() log.Logger {
+	if u.log == nil {
+		u.log = log.DefaultBeeLogger
+	}
+	u.log.WithPrefix("pkg.hls.uploader")
+	return u.log
+}
+
+// 阻塞直到Dispose
+func (u *Uploader) RunLoop() {
+	for _, q := range u.queues {
+		u.wg.Add(1)
+		go u.runWorker(q)
+	}
+	u.wg.Wait()
+}
+
+// 注意，队列中还没有上传的文件会被丢弃
+func (u *Uploader) Dispose() {
+	u.disposeOnce.Do(func() {
+		u.Log().Info("lifecycle dispose hls uploader.")
+		close(u.exitChan)
+	})
+}
+
+func (u *Uploader) GetStat(streamName string) base.StatHLSUpload {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if stat, ok := u.stream2Stat[streamName]; ok {
+		return *stat
+	}
+	return base.StatHLSUpload{}
+}
+
+// 如果不为空，直播m3u8中已经上传成功的切片使用该URI
+func (u *Uploader) cdnURL(streamName string, filename string) string {
+	if u.config.CDNURLPrefix == "" {
+		return ""
+	}
+	return u.config.CDNURLPrefix + streamName + "/" + filename
+}
+
+// 放入上传队列，不阻塞
+//
+// @param content 如果为nil，则上传时读取localPath，注意，调用方之后不能再修改content
+func (u *Uploader) push(streamName string, filename string, content []byte, localPath string) *uploadTask {
+	t := &uploadTask{
+		streamName:  streamName,
+		filename:    filename,
+		key:         u.client.ObjectKey(streamName, filename),
+		content:     content,
+		localPath:   localPath,
+		contentType: uploadContentType(filename),
+	}
+	select {
+	case u.queue(streamName) <- t:
+	default:
+		u.Log().Warn("hls upload queue full, drop. streamName=%s, filename=%s", streamName, filename)
+		u.updateStat(streamName, func(stat *base.StatHLSUpload) {
+			stat.DropNum++
+			stat.LastError = UploadFailReasonQueueFull
+		})
+		u.onFail(t, UploadFailReasonQueueFull, "")
+	}
+	return t
+}
+
+func (u *Uploader) queue(streamName string) chan *uploadTask {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(streamName))
+	return u.queues[h.Sum32()%uint32(len(u.queues))]
+}
+
+func (u *Uploader) runWorker(q chan *uploadTask) {
+	defer u.wg.Done()
+	for {
+		select {
+		case <-u.exitChan:
+			return
+		case t := <-q:
+			u.upload(t)
+		}
+	}
+}
+
+func (u *Uploader) upload(t *uploadTask) {
+	content := t.content
+	if content == nil {
+		var err error
+		if content, err = ioutil.ReadFile(t.localPath); err != nil {
+			// 比如暂停录制时，切片已经被删除
+			u.fail(t, err)
+			return
+		}
+	}
+
+	var err error
+	for i := 0; i <= u.config.MaxRetry; i++ {
+		if i != 0 {
+			u.updateStat(t.streamName, func(stat *base.StatHLSUpload) {
+				stat.RetryNum++
+			})
+			select {
+			case <-u.exitChan:
+				return
+			case <-time.After(u.retryInterval()):
+			}
+		}
+		if err = u.client.PutObject(t.key, content, t.contentType); err == nil {
+			atomic.StoreInt32(&t.done, 1)
+			u.updateStat(t.streamName, func(stat *base.StatHLSUpload) {
+				stat.SuccNum++
+				stat.UploadBytesSum += uint64(len(content))
+			})
+			return
+		}
+		u.Log().Warn("hls upload error. key=%s, retry=%d, err=%+v", t.key, i, err)
+	}
+	u.fail(t, err)
+}
+
+func (u *Uploader) fail(t *uploadTask, err error) {
+	u.Log().Error("hls upload failed. key=%s, err=%+v", t.key, err)
+	u.updateStat(t.streamName, func(stat *base.StatHLSUpload) {
+		stat.FailNum++
+		stat.LastError = err.Error()
+	})
+	u.onFail(t, UploadFailReasonError, err.Error())
+}
+
+func (u *Uploader) onFail(t *uploadTask, reason string, errMsg string) {
+	if u.observer == nil {
+		return
+	}
+	u.observer.OnHLSUploadFail(base.HLSUploadFailInfo{
+		StreamName: t.streamName,
+		Filename:   t.filename,
+		ObjectKey:  t.key,
+		Reason:     reason,
+		Error:      errMsg,
+	})
+}
+
+func (u *Uploader) updateStat(streamName string, fn func(stat *base.StatHLSUpload)) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	stat, ok := u.stream2Stat[streamName]
+	if !ok {
+		stat = &base.StatHLSUpload{}
+		u.stream2Stat[streamName] = stat
+	}
+	fn(stat)
+}
+
+func (u *Uploader) retryInterval() time.Duration {
+	if u.config.RetryIntervalMS <= 0 {
+		return defaultUploadRetryIntervalMS * time.Millisecond
+	}
+	return time.Duration(u.config.RetryIntervalMS) * time.Millisecond
+}
+
+func uploadContentType(filename string) string {
+	switch filepath.Ext(filename) {
+	case ".m3u8":
+		return "application/x-mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".mp4":
+		return "video/mp4"
+	case ".m4s":
+		return "video/iso.segment"
+	}
+	return "application/octet-stream"
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// @param content 如果为nil，则上传时读取localPath
+//
+// @return 没有开启上传时返回nil
+func (m *Muxer) upload(filename string, content []byte, localPath string) *uploadTask {
+	u := GetUploader()
+	if u == nil || !m.config.Enable || m.lowLatency() || m.byteRange() {
+		return nil
+	}
+	return u.push(m.streamName, filename, content, localPath)
+}
+
+// 切片关闭后调用
+func (m *Muxer) uploadFragment(frag *fragmentInfo) {
+	if m.mem != nil {
+		frag.upload = m.upload(frag.filename, m.fragment.Bytes(), "")
+		return
+	}
+	frag.upload = m.upload(frag.filename, nil, getTSFilenameWithPath(m.outPath, frag.filename))
+}
+
+// @return 切片在m3u8中的URI，已经上传成功并且配置了CDN地址时，使用CDN地址
+func (m *Muxer) fragmentURI(frag *fragmentInfo) string {
+	u := GetUploader()
+	if u != nil && frag.upload != nil && frag.upload.uploaded() {
+		if url := u.cdnURL(m.streamName, frag.filename); url != "" {
+			return url
+		}
+	}
+	return frag.filename
+}
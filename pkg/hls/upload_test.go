@@ -0,0 +1,227 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package hls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 模拟S3，校验签名，对象保存在内存中
+type uploadTestS3 struct {
+	t         *testing.T
+	secretKey string
+
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	failPath string // 以该前缀开头的对象总是上传失败
+}
+
+func (s *uploadTestS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	assert.Equal(s.t, payloadHash, r.Header.Get("x-amz-content-sha256"))
+
+	// Authorization: AWS4-HMAC-SHA256 Credential=<ak>/<scope>, SignedHeaders=<names>, Signature=<signature>
+	auth := r.Header.Get("Authorization")
+	var signedHeaders, signature string
+	for _, item := range strings.Split(strings.TrimPrefix(auth, s3Algorithm+" "), ", ") {
+		kv := strings.SplitN(item, "=", 2)
+		switch kv[0] {
+		case "SignedHeaders":
+			signedHeaders = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+	header := make(http.Header)
+	for _, k := range strings.Split(signedHeaders, ";") {
+		if k != "host" {
+			header[k] = r.Header.Values(k)
+		}
+	}
+	at, err := time.Parse(s3AmzDateLayout, r.Header.Get("x-amz-date"))
+	assert.Equal(s.t, nil, err)
+	expectedSignedHeaders, expectedSignature := s3Signature(r.Method, r.URL.EscapedPath(), r.URL.RawQuery, r.Host, header, s.secretKey, defaultS3Region, payloadHash, at)
+	if expectedSignedHeaders != signedHeaders || expectedSignature != signature {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failPath != "" && strings.HasPrefix(r.URL.Path, s.failPath) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.objects[r.URL.Path] = body
+}
+
+func (s *uploadTestS3) get(path string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.objects[path]
+	return b, ok
+}
+
+type uploadTestObserver struct {
+	mutex sync.Mutex
+	infos []base.HLSUploadFailInfo
+}
+
+func (o *uploadTestObserver) OnHLSUploadFail(info base.HLSUploadFailInfo) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.infos = append(o.infos, info)
+}
+
+func (o *uploadTestObserver) count() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.infos)
+}
+
+// 等待上传队列中的任务完成
+func waitUploadDone(u *Uploader, streamName string, total uint64) base.StatHLSUpload {
+	for i := 0; i < 200; i++ {
+		stat := u.GetStat(streamName)
+		if stat.SuccNum+stat.FailNum+stat.DropNum >= total {
+			return stat
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return u.GetStat(streamName)
+}
+
+// 使用AWS文档中的示例，参考 https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func TestS3Signature(t *testing.T) {
+	at, _ := time.Parse(s3AmzDateLayout, "20130524T000000Z")
+	header := make(http.Header)
+	header.Set("Range", "bytes=0-9")
+	header.Set("x-amz-content-sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	header.Set("x-amz-date", "20130524T000000Z")
+	signedHeaders, signature := s3Signature(http.MethodGet, "/test.txt", "", "examplebucket.s3.amazonaws.com", header,
+		"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "us-east-1", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", at)
+	assert.Equal(t, "host;range;x-amz-content-sha256;x-amz-date", signedHeaders)
+	assert.Equal(t, "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41", signature)
+
+	assert.Equal(t, "live/a%20b/1.ts", s3EncodeKey("live/a b/1.ts"))
+	assert.Equal(t, "a=&b=2&c=1", s3CanonicalQuery("c=1&b=2&a"))
+}
+
+func TestUploader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hlsupload")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	s3 := &uploadTestS3{t: t, secretKey: "secret", objects: make(map[string][]byte)}
+	ts := httptest.NewServer(s3)
+	defer ts.Close()
+
+	o := &uploadTestObserver{}
+	u := NewUploader(S3Config{
+		Enable:          true,
+		Endpoint:        ts.URL,
+		Bucket:          "bucket",
+		AccessKey:       "access",
+		SecretKey:       "secret",
+		PathPrefix:      "hls/",
+		CDNURLPrefix:    "http://cdn.example.com/hls/",
+		MaxRetry:        1,
+		RetryIntervalMS: 10,
+	}, o, log.DefaultBeeLogger)
+	go u.RunLoop()
+	defer u.Dispose()
+	SetUploader(u)
+	defer SetUploader(nil)
+
+	config := &MuxerConfig{
+		Enable:             true,
+		OutPath:            dir + "/",
+		FragmentDurationMS: 1000,
+		FragmentNum:        3,
+	}
+	m := NewMuxer("test", config, nil, log.DefaultBeeLogger)
+	m.Start()
+	// 关闭3个切片，每个切片关闭时上传切片、直播m3u8以及录制m3u8
+	feedEncryptTestMuxer(m, 25*3+1)
+	stat := waitUploadDone(u, "test", 9)
+	assert.Equal(t, uint64(9), stat.SuccNum)
+	assert.Equal(t, uint64(0), stat.FailNum)
+	assert.Equal(t, true, stat.UploadBytesSum > 0)
+
+	// 上传的内容与本地文件相同
+	for i := 0; i < m.nfrags; i++ {
+		frag := m.getFrag(i)
+		assert.Equal(t, true, frag.upload.uploaded())
+		local, err := ioutil.ReadFile(m.outPath + frag.filename)
+		assert.Equal(t, nil, err)
+		remote, ok := s3.get("/bucket/hls/test/" + frag.filename)
+		assert.Equal(t, true, ok)
+		assert.Equal(t, local, remote)
+	}
+	local, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	remote, ok := s3.get("/bucket/hls/test/" + filepath.Base(m.playlistFilename))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, local, remote)
+	_, ok = s3.get("/bucket/hls/test/" + filepath.Base(m.recordPlayListFilename))
+	assert.Equal(t, true, ok)
+
+	// 已经上传成功的切片，直播m3u8中使用CDN地址
+	lastFilename := m.getFrag(m.nfrags - 1).filename
+	m.Dispose()
+	playlist, err := ioutil.ReadFile(m.playlistFilename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(playlist), "http://cdn.example.com/hls/test/"+lastFilename+"\n"))
+
+	// 重试后依然失败
+	s3.mutex.Lock()
+	s3.failPath = "/bucket/hls/fail/"
+	s3.mutex.Unlock()
+	u.push("fail", "1.ts", []byte("1"), "")
+	stat = waitUploadDone(u, "fail", 1)
+	assert.Equal(t, uint64(1), stat.FailNum)
+	assert.Equal(t, uint64(1), stat.RetryNum)
+	assert.Equal(t, 1, o.count())
+	assert.Equal(t, UploadFailReasonError, o.infos[0].Reason)
+	assert.Equal(t, "hls/fail/1.ts", o.infos[0].ObjectKey)
+}
+
+func TestUploaderQueueFull(t *testing.T) {
+	o := &uploadTestObserver{}
+	u := NewUploader(S3Config{Enable: true, QueueSize: 1, WorkerNum: 1}, o, log.DefaultBeeLogger)
+
+	// 没有调用RunLoop，队列不会被消费
+	t1 := u.push("test", "1.ts", []byte("1"), "")
+	t2 := u.push("test", "2.ts", []byte("2"), "")
+	assert.Equal(t, false, t1.uploaded())
+	assert.Equal(t, false, t2.uploaded())
+	stat := u.GetStat("test")
+	assert.Equal(t, uint64(1), stat.DropNum)
+	assert.Equal(t, UploadFailReasonQueueFull, stat.LastError)
+	assert.Equal(t, 1, o.count())
+	assert.Equal(t, "2.ts", o.infos[0].Filename)
+	assert.Equal(t, UploadFailReasonQueueFull, o.infos[0].Reason)
+	u.Dispose()
+}
@@ -11,9 +11,11 @@ package httpflv
 import (
 	"crypto/tls"
 	"net"
+	"net/http"
 	"sync"
 
 	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
 )
 
 type ServerObserver interface {
@@ -22,6 +24,12 @@ type ServerObserver interface {
 	OnNewHTTPFLVSubSession(session *SubSession) bool
 
 	OnDelHTTPFLVSubSession(session *SubSession)
+
+	// 通知上层有新的http推流（POST或PUT）
+	// 返回值： true则允许推流，false则回复403并关闭连接
+	OnNewHTTPFLVPubSession(session *PubSession) bool
+
+	OnDelHTTPFLVPubSession(session *PubSession)
 }
 
 type ServerConfig struct {
@@ -41,7 +49,9 @@ type Server struct {
 	log      log.Logger
 }
 
-// TODO chef: 监听太难看了，考虑直接传入Listener对象，或直接路由进来，使得不同server可以共用端口
+// 除了根据ServerConfig自己监听，还可以：
+// - 通过SetListener以及SetHTTPSListener传入Listener对象
+// - 作为http.Handler挂载到外部的http.Server上，使得不同server可以共用端口
 
 func NewServer(observer ServerObserver, config ServerConfig, logger log.Logger) *Server {
 	logger.WithPrefix("pkg.httpflv.server")
@@ -60,15 +70,25 @@ func (s *Server) Log() log.Logger {
 	return s.log
 }
 
+// 需要在Listen之前调用，设置后不再监听ServerConfig中的SubListenAddr
+func (server *Server) SetListener(ln net.Listener) {
+	server.ln = ln
+}
+
+// 需要在Listen之前调用，设置后不再监听ServerConfig中的HTTPSAddr，注意，ln需要已经处理好TLS
+func (server *Server) SetHTTPSListener(ln net.Listener) {
+	server.httpsLn = ln
+}
+
 func (server *Server) Listen() (err error) {
-	if server.config.Enable {
+	if server.ln == nil && server.config.Enable {
 		if server.ln, err = net.Listen("tcp", server.config.SubListenAddr); err != nil {
 			return
 		}
 		server.Log().Info("start httpflv server listen. addr=%s", server.config.SubListenAddr)
 	}
 
-	if server.config.EnableHTTPS {
+	if server.httpsLn == nil && server.config.EnableHTTPS {
 		var cert tls.Certificate
 		cert, err = tls.LoadX509KeyPair(server.config.HTTPSCertFile, server.config.HTTPSKeyFile)
 		if err != nil {
@@ -135,9 +155,32 @@ func (server *Server) Dispose() {
 	}
 }
 
+// 挂载到外部的http.Server时使用，接管连接后与自己监听时的处理相同
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := base.HijackHTTPConn(w, req)
+	if err != nil {
+		server.Log().Error("hijack httpflv connection error. err=%+v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	server.handleConnect(conn, scheme)
+}
+
 func (server *Server) handleConnect(conn net.Conn, scheme string) {
 	server.Log().Info("accept a httpflv connection. remoteAddr=%s", conn.RemoteAddr().String())
-	session := NewSubSession(conn, scheme, server.log)
+
+	// 根据method区分推流和拉流
+	pc := base.NewPeekConn(conn)
+	if b, err := pc.Peek(5); err == nil && base.IsHTTPPublishRequest(b) {
+		server.handlePub(pc, scheme)
+		return
+	}
+
+	session := NewSubSession(pc, scheme, server.log)
 	if err := session.ReadRequest(); err != nil {
 		server.Log().Error("[%s] read httpflv SubSession request error. err=%v", session.UniqueKey, err)
 		return
@@ -152,3 +195,23 @@ func (server *Server) handleConnect(conn net.Conn, scheme string) {
 	server.Log().Debug("[%s] httpflv sub session loop done. err=%v", session.UniqueKey, err)
 	server.observer.OnDelHTTPFLVSubSession(session)
 }
+
+func (server *Server) handlePub(conn net.Conn, scheme string) {
+	session := NewPubSession(conn, scheme, server.log)
+	if err := session.ReadRequest(); err != nil {
+		server.Log().Error("[%s] read httpflv PubSession request error. err=%v", session.UniqueKey, err)
+		return
+	}
+	server.Log().Debug("[%s] < read http request. method=%s, url=%s", session.UniqueKey, session.method, session.URL())
+
+	if !server.observer.OnNewHTTPFLVPubSession(session) {
+		session.WriteHTTPResponse(http.StatusForbidden)
+		session.Dispose()
+		return
+	}
+
+	err := session.RunLoop()
+	server.Log().Debug("[%s] httpflv pub session loop done. err=%v", session.UniqueKey, err)
+	session.Dispose()
+	server.observer.OnDelHTTPFLVPubSession(session)
+}
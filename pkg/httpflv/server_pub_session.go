@@ -0,0 +1,211 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpflv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/naza/pkg/nazahttp"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+type PubSessionObserver interface {
+	// @param tag 回调结束后，内部不再使用tag中的内存块
+	OnReadFLVTag(tag Tag)
+}
+
+// 通过http POST或PUT推送flv流，比如`ffmpeg -re -i in.flv -c copy -f flv -method POST http://host/live/test.flv`
+type PubSession struct {
+	UniqueKey string
+
+	scheme string
+
+	method           string
+	pathWithRawQuery string
+	headers          map[string][]string
+	urlCtx           base.URLContext
+
+	observer PubSessionObserver
+
+	conn         connection.Connection
+	prevConnStat connection.Stat
+	staleStat    *connection.Stat
+	stat         base.StatSession
+	log          log.Logger
+}
+
+func NewPubSession(conn net.Conn, scheme string, logger log.Logger) *PubSession {
+	uk := base.GenUniqueKey(base.UKPFLVPubSession)
+	s := &PubSession{
+		UniqueKey: uk,
+		scheme:    scheme,
+		conn: connection.New(conn, func(option *connection.Option) {
+			option.ReadBufSize = readBufSize
+		}),
+		stat: base.StatSession{
+			Protocol:   base.ProtocolHTTPFLV,
+			SessionID:  uk,
+			StartTime:  time.Now().Format("2006-01-02 15:04:05.999"),
+			RemoteAddr: conn.RemoteAddr().String(),
+		},
+		log: logger,
+	}
+	s.log.WithPrefix("pkg.httpflv.pub_session")
+	s.log.Info("[%s] lifecycle new httpflv PubSession. session=%p, remote addr=%s", uk, s, conn.RemoteAddr().String())
+	return s
+}
+
+func (s *PubSession) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.httpflv.pub_session")
+	return s.log
+}
+
+// 读取http请求头，超过pubSessionReadHeaderTimeoutMS没有读取完时返回错误
+func (session *PubSession) ReadRequest() (err error) {
+	defer func() {
+		if err != nil {
+			session.Dispose()
+		}
+	}()
+
+	if err = session.conn.SetReadDeadline(time.Now().Add(time.Duration(pubSessionReadHeaderTimeoutMS) * time.Millisecond)); err != nil {
+		return
+	}
+	var requestLine string
+	if requestLine, session.headers, err = nazahttp.ReadHTTPHeader(session.conn); err != nil {
+		return
+	}
+	if err = session.conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	if session.method, session.pathWithRawQuery, _, err = nazahttp.ParseHTTPRequestLine(requestLine); err != nil {
+		return
+	}
+
+	rawURL := fmt.Sprintf("%s://%s%s", session.scheme, base.GetHTTPHeader(session.headers, "Host"), session.pathWithRawQuery)
+	session.urlCtx, err = base.ParseHTTPFLVURL(rawURL, session.scheme == "https")
+	return
+}
+
+// 设置回调监听对象后，才开始读取数据，需要在RunLoop之前调用
+func (session *PubSession) SetObserver(observer PubSessionObserver) {
+	session.observer = observer
+}
+
+// 读取body中的flv流，直到body结束或出错
+//
+// @return body正常结束时返回nil
+func (session *PubSession) RunLoop() error {
+	// 超过pubSessionReadAVTimeoutMS没有读取到数据时返回错误
+	session.conn.ModReadTimeoutMS(pubSessionReadAVTimeoutMS)
+
+	if strings.EqualFold(base.GetHTTPHeader(session.headers, "Expect"), "100-continue") {
+		if _, err := session.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")); err != nil {
+			return err
+		}
+	}
+
+	r := base.NewHTTPBodyReader(session.conn, session.headers)
+
+	flvHeader := make([]byte, flvHeaderSize)
+	if _, err := io.ReadFull(r, flvHeader); err != nil {
+		return err
+	}
+	if flvHeader[0] != 'F' || flvHeader[1] != 'L' || flvHeader[2] != 'V' {
+		session.WriteHTTPResponse(http.StatusBadRequest)
+		return ErrHTTPFLV
+	}
+
+	for {
+		tag, err := readTag(r)
+		if err != nil {
+			if err == io.EOF {
+				session.Log().Info("[%s] httpflv PubSession body done.", session.UniqueKey)
+				session.WriteHTTPResponse(http.StatusOK)
+				return nil
+			}
+			return err
+		}
+		if session.observer != nil {
+			session.observer.OnReadFLVTag(tag)
+		}
+	}
+}
+
+// 回复推流请求，比如拒绝推流时回复403，推流正常结束时回复200
+func (session *PubSession) WriteHTTPResponse(statusCode int) {
+	session.Log().Debug("[%s] > W http response. status=%d", session.UniqueKey, statusCode)
+	_, _ = session.conn.Write(base.PackHTTPPubResponse(statusCode, base.LALHTTPFLVSubSessionServer))
+}
+
+func (session *PubSession) Dispose() {
+	session.Log().Info("[%s] lifecycle dispose httpflv PubSession.", session.UniqueKey)
+	_ = session.conn.Close()
+}
+
+func (session *PubSession) URL() string {
+	return session.urlCtx.URL
+}
+
+func (session *PubSession) AppName() string {
+	return session.urlCtx.PathWithoutLastItem
+}
+
+func (session *PubSession) StreamName() string {
+	return strings.TrimSuffix(session.urlCtx.LastItemOfPath, ".flv")
+}
+
+func (session *PubSession) RawQuery() string {
+	return session.urlCtx.RawQuery
+}
+
+func (session *PubSession) RemoteAddr() string {
+	return session.conn.RemoteAddr().String()
+}
+
+func (session *PubSession) GetStat() base.StatSession {
+	currStat := session.conn.GetStat()
+	session.stat.ReadBytesSum = currStat.ReadBytesSum
+	session.stat.WroteBytesSum = currStat.WroteBytesSum
+	return session.stat
+}
+
+func (session *PubSession) UpdateStat(interval uint32) {
+	currStat := session.conn.GetStat()
+	rDiff := currStat.ReadBytesSum - session.prevConnStat.ReadBytesSum
+	session.stat.ReadBitrate = int(rDiff * 8 / 1024 / uint64(interval))
+	wDiff := currStat.WroteBytesSum - session.prevConnStat.WroteBytesSum
+	session.stat.WriteBitrate = int(wDiff * 8 / 1024 / uint64(interval))
+	session.stat.Bitrate = session.stat.ReadBitrate
+	session.prevConnStat = currStat
+}
+
+func (session *PubSession) IsAlive() (readAlive, writeAlive bool) {
+	currStat := session.conn.GetStat()
+	if session.staleStat == nil {
+		session.staleStat = new(connection.Stat)
+		*session.staleStat = currStat
+		return true, true
+	}
+
+	readAlive = !(currStat.ReadBytesSum-session.staleStat.ReadBytesSum == 0)
+	writeAlive = !(currStat.WroteBytesSum-session.staleStat.WroteBytesSum == 0)
+	*session.staleStat = currStat
+	return
+}
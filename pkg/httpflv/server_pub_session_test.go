@@ -0,0 +1,143 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpflv
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+type testPubObserver struct {
+	reject bool
+	tags   []Tag
+	delCh  chan *PubSession
+}
+
+func (o *testPubObserver) OnNewHTTPFLVSubSession(session *SubSession) bool {
+	return false
+}
+
+func (o *testPubObserver) OnDelHTTPFLVSubSession(session *SubSession) {
+}
+
+func (o *testPubObserver) OnNewHTTPFLVPubSession(session *PubSession) bool {
+	if o.reject {
+		return false
+	}
+	session.SetObserver(o)
+	return true
+}
+
+func (o *testPubObserver) OnDelHTTPFLVPubSession(session *PubSession) {
+	o.delCh <- session
+}
+
+func (o *testPubObserver) OnReadFLVTag(tag Tag) {
+	o.tags = append(o.tags, tag)
+}
+
+func TestPubSession(t *testing.T) {
+	o := &testPubObserver{delCh: make(chan *PubSession, 1)}
+	server := NewServer(o, ServerConfig{Enable: true, SubListenAddr: "127.0.0.1:0"}, log.DefaultBeeLogger)
+	err := server.Listen()
+	assert.Equal(t, nil, err)
+	go server.RunLoop()
+	defer server.Dispose()
+
+	var body []byte
+	body = append(body, FLVHeader...)
+	body = append(body, PackHTTPFLVTag(TagTypeVideo, 0, []byte{AVCKeyFrame, AVCPacketTypeSeqHeader, 0, 0, 0})...)
+	body = append(body, PackHTTPFLVTag(TagTypeAudio, 23, []byte{0xaf, AACPacketTypeRaw, 1, 2})...)
+
+	url := "http://" + server.ln.Addr().String() + "/live/test.flv"
+	// 使用io.MultiReader隐藏长度，使得请求使用chunked编码
+	resp, err := http.Post(url, "video/x-flv", io.MultiReader(bytes.NewReader(body)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	session := <-o.delCh
+	assert.Equal(t, "live", session.AppName())
+	assert.Equal(t, "test", session.StreamName())
+	assert.Equal(t, 2, len(o.tags))
+	assert.Equal(t, TagTypeVideo, o.tags[0].Header.Type)
+	assert.Equal(t, uint32(23), o.tags[1].Header.Timestamp)
+	assert.Equal(t, []byte{0xaf, AACPacketTypeRaw, 1, 2}, o.tags[1].Payload())
+
+	// 拒绝推流
+	o.reject = true
+	resp, err = http.Post(url, "video/x-flv", bytes.NewReader(body))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+// 作为http.Handler挂载到外部的http.Server上
+func TestPubSessionServeHTTP(t *testing.T) {
+	o := &testPubObserver{delCh: make(chan *PubSession, 1)}
+	server := NewServer(o, ServerConfig{}, log.DefaultBeeLogger)
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	var body []byte
+	body = append(body, FLVHeader...)
+	body = append(body, PackHTTPFLVTag(TagTypeVideo, 0, []byte{AVCKeyFrame, AVCPacketTypeSeqHeader, 0, 0, 0})...)
+
+	resp, err := http.Post(srv.URL+"/live/test.flv", "video/x-flv", io.MultiReader(bytes.NewReader(body)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	session := <-o.delCh
+	assert.Equal(t, "live", session.AppName())
+	assert.Equal(t, "test", session.StreamName())
+	assert.Equal(t, 1, len(o.tags))
+}
+
+// 读取请求头以及body的超时
+func TestPubSessionReadTimeout(t *testing.T) {
+	backupHeader, backupAV := pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS
+	defer func() {
+		pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS = backupHeader, backupAV
+	}()
+	pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS = 50, 50
+
+	// 请求头没有发送完
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = c2.Write([]byte("POST /live/test.flv HTTP/1.1\r\n"))
+	}()
+	b := time.Now()
+	err := NewPubSession(c1, "http", log.DefaultBeeLogger).ReadRequest()
+	assert.IsNotNil(t, err)
+	assert.Equal(t, true, time.Since(b) < time.Second)
+
+	// 请求头发送完后，body中没有数据
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = c2.Write([]byte("POST /live/test.flv HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	}()
+	session := NewPubSession(c1, "http", log.DefaultBeeLogger)
+	err = session.ReadRequest()
+	assert.Equal(t, nil, err)
+	b = time.Now()
+	err = session.RunLoop()
+	assert.IsNotNil(t, err)
+	assert.Equal(t, true, time.Since(b) < time.Second)
+}
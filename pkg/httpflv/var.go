@@ -11,5 +11,7 @@ package httpflv
 var readBufSize = 256 //16384 // ClientPullSession 和 SubSession 读取数据时
 var wChanSize = 1024  // SubSession 发送数据时 channel 的大小
 var subSessionWriteTimeoutMS = 10000
+var pubSessionReadHeaderTimeoutMS = 10000 // PubSession读取http请求头的超时
+var pubSessionReadAVTimeoutMS = 10000     // PubSession读取body中音视频数据的超时
 
 var FLVHeader = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
@@ -10,8 +10,10 @@ package httpts
 
 import (
 	"net"
+	"net/http"
 
 	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
 )
 
 type ServerObserver interface {
@@ -20,6 +22,12 @@ type ServerObserver interface {
 	OnNewHTTPTSSubSession(session *SubSession) bool
 
 	OnDelHTTPTSSubSession(session *SubSession)
+
+	// 通知上层有新的http推流（POST或PUT）
+	// 返回值： true则允许推流，false则回复403并关闭连接
+	OnNewHTTPTSPubSession(session *PubSession) bool
+
+	OnDelHTTPTSPubSession(session *PubSession)
 }
 
 type Server struct {
@@ -44,7 +52,16 @@ func (s *Server) Log() log.Logger {
 	s.log.WithPrefix("pkg.httpts.sub_session")
 	return s.log
 }
+
+// 需要在Listen之前调用，设置后不再监听addr
+func (server *Server) SetListener(ln net.Listener) {
+	server.ln = ln
+}
+
 func (server *Server) Listen() (err error) {
+	if server.ln != nil {
+		return
+	}
 	if server.ln, err = net.Listen("tcp", server.addr); err != nil {
 		return
 	}
@@ -71,9 +88,28 @@ func (server *Server) Dispose() {
 	}
 }
 
+// 挂载到外部的http.Server时使用，接管连接后与自己监听时的处理相同
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := base.HijackHTTPConn(w, req)
+	if err != nil {
+		server.Log().Error("hijack httpts connection error. err=%+v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	server.handleConnect(conn)
+}
+
 func (server *Server) handleConnect(conn net.Conn) {
 	server.Log().Info("accept a httpts connection. remoteAddr=%s", conn.RemoteAddr().String())
-	session := NewSubSession(conn, "http", server.log)
+
+	// 根据method区分推流和拉流
+	pc := base.NewPeekConn(conn)
+	if b, err := pc.Peek(5); err == nil && base.IsHTTPPublishRequest(b) {
+		server.handlePub(pc)
+		return
+	}
+
+	session := NewSubSession(pc, "http", server.log)
 	if err := session.ReadRequest(); err != nil {
 		server.Log().Error("[%s] read httpts SubSession request error. err=%v", session.UniqueKey, err)
 		return
@@ -88,3 +124,23 @@ func (server *Server) handleConnect(conn net.Conn) {
 	server.Log().Debug("[%s] httpts sub session loop done. err=%v", session.UniqueKey, err)
 	server.observer.OnDelHTTPTSSubSession(session)
 }
+
+func (server *Server) handlePub(conn net.Conn) {
+	session := NewPubSession(conn, "http", server.log)
+	if err := session.ReadRequest(); err != nil {
+		server.Log().Error("[%s] read httpts PubSession request error. err=%v", session.UniqueKey, err)
+		return
+	}
+	server.Log().Debug("[%s] < read http request. method=%s, url=%s", session.UniqueKey, session.method, session.URL())
+
+	if !server.observer.OnNewHTTPTSPubSession(session) {
+		session.WriteHTTPResponse(http.StatusForbidden)
+		session.Dispose()
+		return
+	}
+
+	err := session.RunLoop()
+	server.Log().Debug("[%s] httpts pub session loop done. err=%v", session.UniqueKey, err)
+	session.Dispose()
+	server.observer.OnDelHTTPTSPubSession(session)
+}
@@ -0,0 +1,227 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/naza/pkg/nazahttp"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/remux"
+)
+
+// 与rtsp.BaseInSessionObserver中的音视频回调保持一致，方便上层复用
+type PubSessionObserver interface {
+	// @param asc: AAC AudioSpecificConfig，注意，如果不存在音频，则为nil
+	// @param vps, sps, pps 如果都为nil，则没有视频，如果sps, pps不为nil，则vps不为nil是H265，vps为nil是H264
+	OnAVConfig(asc, vps, sps, pps []byte)
+
+	// @param pkt: 视频为AVCC格式（4字节长度前缀），不包含vps、sps、pps、aud
+	//             音频为AAC raw frame，不包含ADTS头
+	//             Timestamp为DTS，单位毫秒
+	OnAVPacket(pkt base.AVPacket)
+}
+
+// 通过http POST或PUT推送TS流，比如`ffmpeg -re -i in.ts -c copy -f mpegts -method POST http://host/live/test.ts`
+type PubSession struct {
+	UniqueKey string
+
+	scheme string
+
+	method           string
+	pathWithRawQuery string
+	headers          map[string][]string
+	urlCtx           base.URLContext
+
+	observer PubSessionObserver
+	remuxer  *remux.TS2AVPacket
+
+	conn         connection.Connection
+	prevConnStat connection.Stat
+	staleStat    *connection.Stat
+	stat         base.StatSession
+	log          log.Logger
+}
+
+func NewPubSession(conn net.Conn, scheme string, logger log.Logger) *PubSession {
+	uk := base.GenUniqueKey(base.UKPTSPubSession)
+	s := &PubSession{
+		UniqueKey: uk,
+		scheme:    scheme,
+		conn: connection.New(conn, func(option *connection.Option) {
+			option.ReadBufSize = readBufSize
+		}),
+		stat: base.StatSession{
+			Protocol:   base.ProtocolHTTPTS,
+			SessionID:  uk,
+			StartTime:  time.Now().Format("2006-01-02 15:04:05.999"),
+			RemoteAddr: conn.RemoteAddr().String(),
+		},
+		log: logger,
+	}
+	s.remuxer = remux.NewTS2AVPacket(uk, 0, s.onAVConfig, s.onAVPacket, logger)
+	s.log.WithPrefix("pkg.httpts.pub_session")
+	s.log.Info("[%s] lifecycle new httpts PubSession. session=%p, remote addr=%s", uk, s, conn.RemoteAddr().String())
+	return s
+}
+
+func (s *PubSession) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.httpts.pub_session")
+	return s.log
+}
+
+// 读取http请求头，超过pubSessionReadHeaderTimeoutMS没有读取完时返回错误
+func (session *PubSession) ReadRequest() (err error) {
+	defer func() {
+		if err != nil {
+			session.Dispose()
+		}
+	}()
+
+	if err = session.conn.SetReadDeadline(time.Now().Add(time.Duration(pubSessionReadHeaderTimeoutMS) * time.Millisecond)); err != nil {
+		return
+	}
+	var requestLine string
+	if requestLine, session.headers, err = nazahttp.ReadHTTPHeader(session.conn); err != nil {
+		return
+	}
+	if err = session.conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	if session.method, session.pathWithRawQuery, _, err = nazahttp.ParseHTTPRequestLine(requestLine); err != nil {
+		return
+	}
+
+	rawURL := fmt.Sprintf("%s://%s%s", session.scheme, base.GetHTTPHeader(session.headers, "Host"), session.pathWithRawQuery)
+	session.urlCtx, err = base.ParseHTTPTSURL(rawURL, session.scheme == "https")
+	return
+}
+
+// 设置回调监听对象后，才开始读取数据，需要在RunLoop之前调用
+func (session *PubSession) SetObserver(observer PubSessionObserver) {
+	session.observer = observer
+}
+
+// 读取body中的TS流，直到body结束或出错
+//
+// @return body正常结束时返回nil
+func (session *PubSession) RunLoop() error {
+	// 超过pubSessionReadAVTimeoutMS没有读取到数据时返回错误
+	session.conn.ModReadTimeoutMS(pubSessionReadAVTimeoutMS)
+
+	if strings.EqualFold(base.GetHTTPHeader(session.headers, "Expect"), "100-continue") {
+		if _, err := session.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")); err != nil {
+			return err
+		}
+	}
+
+	r := base.NewHTTPBodyReader(session.conn, session.headers)
+	buf := make([]byte, 7*188)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			session.remuxer.Feed(buf[:n])
+		}
+		if err != nil {
+			if err == io.EOF {
+				session.remuxer.Flush()
+				session.Log().Info("[%s] httpts PubSession body done.", session.UniqueKey)
+				session.WriteHTTPResponse(http.StatusOK)
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// 回复推流请求，比如拒绝推流时回复403，推流正常结束时回复200
+func (session *PubSession) WriteHTTPResponse(statusCode int) {
+	session.Log().Debug("[%s] > W http response. status=%d", session.UniqueKey, statusCode)
+	_, _ = session.conn.Write(base.PackHTTPPubResponse(statusCode, base.LALHTTPTSSubSessionServer))
+}
+
+func (session *PubSession) Dispose() {
+	session.Log().Info("[%s] lifecycle dispose httpts PubSession.", session.UniqueKey)
+	_ = session.conn.Close()
+}
+
+func (session *PubSession) URL() string {
+	return session.urlCtx.URL
+}
+
+func (session *PubSession) AppName() string {
+	return session.urlCtx.PathWithoutLastItem
+}
+
+func (session *PubSession) StreamName() string {
+	return strings.TrimSuffix(session.urlCtx.LastItemOfPath, ".ts")
+}
+
+func (session *PubSession) RawQuery() string {
+	return session.urlCtx.RawQuery
+}
+
+func (session *PubSession) RemoteAddr() string {
+	return session.conn.RemoteAddr().String()
+}
+
+func (session *PubSession) GetStat() base.StatSession {
+	currStat := session.conn.GetStat()
+	session.stat.ReadBytesSum = currStat.ReadBytesSum
+	session.stat.WroteBytesSum = currStat.WroteBytesSum
+	return session.stat
+}
+
+func (session *PubSession) UpdateStat(interval uint32) {
+	currStat := session.conn.GetStat()
+	rDiff := currStat.ReadBytesSum - session.prevConnStat.ReadBytesSum
+	session.stat.ReadBitrate = int(rDiff * 8 / 1024 / uint64(interval))
+	wDiff := currStat.WroteBytesSum - session.prevConnStat.WroteBytesSum
+	session.stat.WriteBitrate = int(wDiff * 8 / 1024 / uint64(interval))
+	session.stat.Bitrate = session.stat.ReadBitrate
+	session.prevConnStat = currStat
+}
+
+func (session *PubSession) IsAlive() (readAlive, writeAlive bool) {
+	currStat := session.conn.GetStat()
+	if session.staleStat == nil {
+		session.staleStat = new(connection.Stat)
+		*session.staleStat = currStat
+		return true, true
+	}
+
+	readAlive = !(currStat.ReadBytesSum-session.staleStat.ReadBytesSum == 0)
+	writeAlive = !(currStat.WroteBytesSum-session.staleStat.WroteBytesSum == 0)
+	*session.staleStat = currStat
+	return
+}
+
+// callback by remux.TS2AVPacket
+func (session *PubSession) onAVConfig(asc, vps, sps, pps []byte) {
+	if session.observer != nil {
+		session.observer.OnAVConfig(asc, vps, sps, pps)
+	}
+}
+
+// callback by remux.TS2AVPacket
+func (session *PubSession) onAVPacket(pkt base.AVPacket) {
+	if session.observer != nil {
+		session.observer.OnAVPacket(pkt)
+	}
+}
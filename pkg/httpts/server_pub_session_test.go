@@ -0,0 +1,132 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package httpts
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+type testPubObserver struct {
+	sps   []byte
+	pkts  []base.AVPacket
+	delCh chan *PubSession
+}
+
+func (o *testPubObserver) OnNewHTTPTSSubSession(session *SubSession) bool {
+	return false
+}
+
+func (o *testPubObserver) OnDelHTTPTSSubSession(session *SubSession) {
+}
+
+func (o *testPubObserver) OnNewHTTPTSPubSession(session *PubSession) bool {
+	session.SetObserver(o)
+	return true
+}
+
+func (o *testPubObserver) OnDelHTTPTSPubSession(session *PubSession) {
+	o.delCh <- session
+}
+
+func (o *testPubObserver) OnAVConfig(asc, vps, sps, pps []byte) {
+	o.sps = sps
+}
+
+func (o *testPubObserver) OnAVPacket(pkt base.AVPacket) {
+	o.pkts = append(o.pkts, pkt)
+}
+
+func TestPubSession(t *testing.T) {
+	o := &testPubObserver{delCh: make(chan *PubSession, 1)}
+	server := NewServer(o, "127.0.0.1:0", log.DefaultBeeLogger)
+	err := server.Listen()
+	assert.Equal(t, nil, err)
+	go server.RunLoop()
+	defer server.Dispose()
+
+	sps := []byte{0x67, 0x64, 0x00, 0x1f}
+	var body []byte
+	body = append(body, mpegts.FixedFragmentHeader...)
+	var cc uint8
+	for i, key := range []bool{true, false} {
+		raw := []byte{0, 0, 0, 1, 0x41, 0x9a}
+		if key {
+			raw = append([]byte{0, 0, 0, 1}, sps...)
+			raw = append(raw, 0, 0, 0, 1, 0x68, 0xee, 0, 0, 0, 1, 0x65, 0x88)
+		}
+		ts := uint64(90000 + i*3600)
+		frame := &mpegts.Frame{PTS: ts, DTS: ts, CC: cc, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Key: key, Raw: raw}
+		mpegts.PackTSPacket(frame, func(packet []byte) {
+			body = append(body, packet...)
+		})
+		cc = frame.CC
+	}
+	// FixedFragmentHeader中的PMT包含音频，需要收到音频后才回调音视频参数
+	adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, 1, 2, 3, 4}
+	mpegts.PackTSPacket(&mpegts.Frame{PTS: 90000, DTS: 90000, Pid: mpegts.PidAudio, Sid: mpegts.StreamIDAudio, Raw: adts}, func(packet []byte) {
+		body = append(body, packet...)
+	})
+
+	url := "http://" + server.ln.Addr().String() + "/live/test.ts"
+	resp, err := http.Post(url, "video/mp2t", bytes.NewReader(body))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	session := <-o.delCh
+	assert.Equal(t, "test", session.StreamName())
+	assert.Equal(t, sps, o.sps)
+	assert.Equal(t, 3, len(o.pkts))
+	assert.Equal(t, base.AVPacketPTAVC, o.pkts[0].PayloadType)
+	assert.Equal(t, uint32(40), o.pkts[1].Timestamp)
+	assert.Equal(t, base.AVPacketPTAAC, o.pkts[2].PayloadType)
+}
+
+// 读取请求头以及body的超时
+func TestPubSessionReadTimeout(t *testing.T) {
+	backupHeader, backupAV := pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS
+	defer func() {
+		pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS = backupHeader, backupAV
+	}()
+	pubSessionReadHeaderTimeoutMS, pubSessionReadAVTimeoutMS = 50, 50
+
+	// 请求头没有发送完
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = c2.Write([]byte("POST /live/test.ts HTTP/1.1\r\n"))
+	}()
+	b := time.Now()
+	err := NewPubSession(c1, "http", log.DefaultBeeLogger).ReadRequest()
+	assert.IsNotNil(t, err)
+	assert.Equal(t, true, time.Since(b) < time.Second)
+
+	// 请求头发送完后，body中没有数据
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = c2.Write([]byte("POST /live/test.ts HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	}()
+	session := NewPubSession(c1, "http", log.DefaultBeeLogger)
+	err = session.ReadRequest()
+	assert.Equal(t, nil, err)
+	b = time.Now()
+	err = session.RunLoop()
+	assert.IsNotNil(t, err)
+	assert.Equal(t, true, time.Since(b) < time.Second)
+}
@@ -31,7 +31,7 @@ type SubSession struct {
 	scheme string
 
 	pathWithRawQuery string
-	headers          map[string]string
+	headers          map[string][]string
 	urlCtx           base.URLContext
 
 	conn         connection.Connection
@@ -11,3 +11,5 @@ package httpts
 var readBufSize = 256 //16384 // SubSession读取数据时
 var wChanSize = 1024  // SubSession发送数据时channel的大小
 var subSessionWriteTimeoutMS = 10000
+var pubSessionReadHeaderTimeoutMS = 10000 // PubSession读取http请求头的超时
+var pubSessionReadAVTimeoutMS = 10000     // PubSession读取body中音视频数据的超时
@@ -0,0 +1,118 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/hls"
+)
+
+// ABRProvider of hls.Server
+//
+// 只返回HLS正在切片的码率，码率、分辨率以及编码格式取自各group的StatGroup
+func (sm *ServerManager) GetABRRenditions(name string) []hls.Rendition {
+	abr := config.HLSConfig.ABR
+	if !abr.Enable {
+		return nil
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	var sgs []base.StatGroup
+	for _, ladder := range abr.Ladders {
+		if ladder.Name != name {
+			continue
+		}
+		for _, streamName := range ladder.StreamNames {
+			if g, exist := sm.groupMap[streamName]; exist && g.IsHLSMuxerAlive() {
+				sgs = append(sgs, g.GetStat())
+			}
+		}
+		return statGroups2Renditions(sgs)
+	}
+
+	if abr.Separator == "" {
+		return nil
+	}
+	for streamName, g := range sm.groupMap {
+		if n, ok := parseABRName(streamName, abr.Separator); ok && n == name && g.IsHLSMuxerAlive() {
+			sgs = append(sgs, g.GetStat())
+		}
+	}
+	sort.Slice(sgs, func(i, j int) bool {
+		if bi, bj := abrBitrate(sgs[i]), abrBitrate(sgs[j]); bi != bj {
+			return bi > bj
+		}
+		return sgs[i].StreamName < sgs[j].StreamName
+	})
+	return statGroups2Renditions(sgs)
+}
+
+// 命名约定，比如`stream_1080`、`stream_720p`，最后一个分隔符之后为数字（可以以'p'结尾）
+//
+// @return name 组合后的名称，比如`stream`
+// @return ok   不符合命名约定时为false
+func parseABRName(streamName string, separator string) (name string, ok bool) {
+	i := strings.LastIndex(streamName, separator)
+	if i <= 0 {
+		return "", false
+	}
+	suffix := strings.TrimSuffix(streamName[i+len(separator):], "p")
+	if suffix == "" {
+		return "", false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return streamName[:i], true
+}
+
+// RFC 8216中`BANDWIDTH`为峰值码率，这里使用推流码率各统计周期的最大值，还没有最大值时使用当前码率
+//
+// @return 单位kbit/s
+func abrBitrate(sg base.StatGroup) int {
+	if sg.PubBitratePeak < sg.StatPub.Bitrate {
+		return sg.StatPub.Bitrate
+	}
+	return sg.PubBitratePeak
+}
+
+// 还没有统计出码率的group不写入，因为`BANDWIDTH`是必需的
+//
+// 注意，统计的码率单位为kbit/s，并且按1024换算（见各session的UpdateStat），`BANDWIDTH`单位为bit/s
+func statGroups2Renditions(sgs []base.StatGroup) []hls.Rendition {
+	var renditions []hls.Rendition
+	for _, sg := range sgs {
+		kbps := abrBitrate(sg)
+		if kbps <= 0 {
+			continue
+		}
+		var codecs []string
+		if sg.VideoCodecRFC6381 != "" {
+			codecs = append(codecs, sg.VideoCodecRFC6381)
+		}
+		if sg.AudioCodecRFC6381 != "" {
+			codecs = append(codecs, sg.AudioCodecRFC6381)
+		}
+		renditions = append(renditions, hls.Rendition{
+			StreamName: sg.StreamName,
+			Bandwidth:  kbps * 1024,
+			Width:      sg.VideoWidth,
+			Height:     sg.VideoHeight,
+			Codecs:     strings.Join(codecs, ","),
+		})
+	}
+	return renditions
+}
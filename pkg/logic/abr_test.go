@@ -0,0 +1,54 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/hls"
+)
+
+func TestParseABRName(t *testing.T) {
+	golden := map[string]string{
+		"stream_1080":  "stream",
+		"stream_720p":  "stream",
+		"a_b_480":      "a_b",
+		"stream":       "",
+		"stream_":      "",
+		"stream_p":     "",
+		"stream_hd":    "",
+		"_1080":        "",
+		"stream_1080x": "",
+	}
+	for streamName, expected := range golden {
+		name, ok := parseABRName(streamName, "_")
+		assert.Equal(t, expected != "", ok, streamName)
+		assert.Equal(t, expected, name, streamName)
+	}
+}
+
+func TestStatGroups2Renditions(t *testing.T) {
+	sgs := []base.StatGroup{
+		{StreamName: "s_1080", VideoWidth: 1920, VideoHeight: 1080, VideoCodecRFC6381: "avc1.640028", AudioCodecRFC6381: "mp4a.40.2"},
+		{StreamName: "s_720"},
+		{StreamName: "s_480"},
+	}
+	sgs[0].StatPub.Bitrate = 4000
+	// 使用码率的最大值
+	sgs[1].StatPub.Bitrate = 1500
+	sgs[1].PubBitratePeak = 2000
+	renditions := statGroups2Renditions(sgs)
+	// 还没有统计出码率的group不写入
+	assert.Equal(t, []hls.Rendition{
+		{StreamName: "s_1080", Bandwidth: 4000 * 1024, Width: 1920, Height: 1080, Codecs: "avc1.640028,mp4a.40.2"},
+		{StreamName: "s_720", Bandwidth: 2000 * 1024},
+	}, renditions)
+}
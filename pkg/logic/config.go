@@ -14,8 +14,11 @@ import (
 
 	"github.com/souliot/naza/pkg/log"
 	"github.com/souliot/siot-av/pkg/httpflv"
+	"github.com/souliot/siot-av/pkg/rtmp"
+	"github.com/souliot/siot-av/pkg/udpts"
 
 	"github.com/souliot/naza/pkg/nazajson"
+	"github.com/souliot/siot-av/pkg/dash"
 	"github.com/souliot/siot-av/pkg/hls"
 )
 
@@ -25,36 +28,91 @@ type Config struct {
 	RTMPConfig      RTMPConfig      `json:"rtmp"`
 	HTTPFLVConfig   HTTPFLVConfig   `json:"httpflv"`
 	HLSConfig       HLSConfig       `json:"hls"`
+	DASHConfig      DASHConfig      `json:"dash"`
 	HTTPTSConfig    HTTPTSConfig    `json:"httpts"`
 	RTSPConfig      RTSPConfig      `json:"rtsp"`
 	RelayPushConfig RelayPushConfig `json:"relay_push"`
 	RelayPullConfig RelayPullConfig `json:"relay_pull"`
+	DVRConfig       DVRConfig       `json:"dvr"`
+	UDPTSConfig     UDPTSConfig     `json:"udp_ts"`
 
 	HTTPAPIConfig    HTTPAPIConfig    `json:"http_api"`
+	HTTPServerConfig HTTPServerConfig `json:"http_server"`
 	ServerID         string           `json:"server_id"`
 	HTTPNotifyConfig HTTPNotifyConfig `json:"http_notify"`
 	PProfConfig      PProfConfig      `json:"pprof"`
 }
 
 type RTMPConfig struct {
-	Enable bool   `json:"enable"`
-	Addr   string `json:"addr"`
-	GOPNum int    `json:"gop_num"`
+	rtmp.ServerConfig
+	GOPNum int `json:"gop_num"`
+	// 同一个流已经存在输入流时，新的rtmp推流的处理策略，取值见PubConflictPolicyXXX，为空时使用PubConflictPolicyReject
+	PubConflictPolicy string `json:"pub_conflict_policy"`
+	// key为app名，value为重定向地址，客户端connect的app命中时，回复NetConnection.Connect.Rejected并携带ex.redirect
+	ConnectRedirect map[string]string `json:"connect_redirect"`
 }
 
+const (
+	PubConflictPolicyReject = "reject" // 拒绝新的推流，回复NetStream.Publish.BadName
+	PubConflictPolicyKick   = "kick"   // 踢掉旧的推流，使用新的推流
+	PubConflictPolicyKeep   = "keep"   // 保留旧的推流，新的推流作为备用，旧的推流断开后切换到备用推流
+)
+
 type HTTPFLVConfig struct {
 	httpflv.ServerConfig
 	GOPNum int `json:"gop_num"`
+	// 是否允许通过http POST或PUT推送flv流
+	PubEnable bool `json:"pub_enable"`
 }
 
 type HTTPTSConfig struct {
 	Enable        bool   `json:"enable"`
 	SubListenAddr string `json:"sub_listen_addr"`
+	// 是否允许通过http POST或PUT推送TS流
+	PubEnable bool `json:"pub_enable"`
 }
 
 type HLSConfig struct {
 	SubListenAddr string `json:"sub_listen_addr"`
 	hls.MuxerConfig
+	CleanupFlag bool                 `json:"cleanup_flag"`
+	SubSession  hls.SubSessionConfig `json:"sub_session"` // 播放者的识别以及超时
+	Auth        HLSAuthConfig        `json:"auth"`        // m3u8以及密钥请求的鉴权，默认不开启
+
+	// 录制回放接口`/api/record/playlist`生成的m3u8中，切片URI的前缀，比如`http://127.0.0.1:8081/hls/`
+	// 为空时，开启了http_server则使用hls的路径前缀，否则使用请求的主机名以及sub_listen_addr的端口，比如`http://<host>:8081/hls/`
+	RecordURLPrefix string `json:"record_url_prefix"`
+
+	Janitor hls.JanitorConfig `json:"janitor"` // 录制的保留时长、磁盘配额以及低磁盘空间保护，不支持InMemory
+	S3      hls.S3Config      `json:"s3"`      // 切片、m3u8以及录制上传到S3兼容的对象存储，不支持LL-HLS以及byte range
+	ABR     ABRConfig         `json:"abr"`     // 多码率，播放`/hls/<name>/master.m3u8`，各码率的切片需要开启align_fragment
+}
+
+// 播放m3u8以及密钥时，URL参数需要携带`token=md5(Secret + StreamName)`，md5为32位小写十六进制
+// 注意，ABR的master m3u8使用组合后的名称计算token，各码率的m3u8沿用master m3u8的参数，所以也接受组合后名称的token
+type HLSAuthConfig struct {
+	Enable bool   `json:"enable"`
+	Secret string `json:"secret"`
+}
+
+// 码率组合的方式有两种：
+// - 在Ladders中显式配置
+// - 命名约定，比如`stream_1080`、`stream_720`，最后一个Separator之后为数字（可以以'p'结尾）的流，组合为`stream`，按码率从高到低排列
+type ABRConfig struct {
+	Enable    bool        `json:"enable"`
+	Separator string      `json:"separator"` // 命名约定的分隔符，为空时不使用命名约定
+	Ladders   []ABRLadder `json:"ladders"`
+}
+
+type ABRLadder struct {
+	Name        string   `json:"name"`         // master m3u8的名称
+	StreamNames []string `json:"stream_names"` // 各码率的流名称，第一个为播放器默认选择的码率
+}
+
+// 窗口以及清理的含义与HLSConfig相同
+type DASHConfig struct {
+	SubListenAddr string `json:"sub_listen_addr"`
+	dash.MuxerConfig
 	CleanupFlag bool `json:"cleanup_flag"`
 }
 
@@ -64,7 +122,8 @@ type RTSPConfig struct {
 }
 
 type RelayPushConfig struct {
-	Enable   bool     `json:"enable"`
+	Enable bool `json:"enable"`
+	// 元素为host:port时使用rtmp转推，也可以带上scheme，比如rtmps://host:port，此时使用rtmps转推
 	AddrList []string `json:"addr_list"`
 }
 
@@ -73,11 +132,46 @@ type RelayPullConfig struct {
 	Addr   string `json:"addr"`
 }
 
+// 时移播放，rtmp和httpflv订阅者可以在url参数中携带starttime，比如`?starttime=-60s`
+type DVRConfig struct {
+	Enable    bool `json:"enable"`
+	WindowSec int  `json:"window_sec"` // 时移窗口的时长
+	// 每个流在内存中缓存的最大大小，为0则不限制
+	// 超过后，如果配置了SpillDir，将较早的gop写入磁盘，否则直接丢弃较早的gop
+	MaxMemoryMB int    `json:"max_memory_mb"`
+	SpillDir    string `json:"spill_dir"`
+}
+
+// 接收UDP承载的MPEG-TS流作为输入流，每一项对应一个监听地址以及一路流
+// PushList中每一项将对应流的TS流通过UDP发送给目标地址，也可以通过HTTP API动态添加
+type UDPTSConfig struct {
+	Enable     bool                 `json:"enable"`
+	StreamList []udpts.ServerConfig `json:"stream_list"`
+	PushList   []udpts.PushConfig   `json:"push_list"`
+}
+
 type HTTPAPIConfig struct {
 	Enable bool   `json:"enable"`
 	Addr   string `json:"addr"`
 }
 
+// 开启后，httpflv、httpts、hls以及http api共用这里的监听端口，各自的监听地址不再生效，是否开启依然由各自的enable决定
+type HTTPServerConfig struct {
+	Enable        bool   `json:"enable"`
+	ListenAddr    string `json:"listen_addr"` // 为空并且不开启https时不监听，只通过HTTPHandler挂载到外部的http.Server上
+	EnableHTTPS   bool   `json:"enable_https"`
+	HTTPSAddr     string `json:"https_addr"`
+	HTTPSCertFile string `json:"https_cert_file"`
+	HTTPSKeyFile  string `json:"https_key_file"`
+
+	// URL路径的前缀，为空时使用默认值，httpflv以及httpts为`/`（按后缀`.flv`以及`.ts`区分），hls为`/hls/`，http api为`/api/`
+	// 前缀不同时，比如`/media/hls/`，分发前替换为默认值，所以hls的record_url_prefix需要使用配置的前缀
+	HTTPFLVPrefix string `json:"httpflv_prefix"`
+	HTTPTSPrefix  string `json:"httpts_prefix"`
+	HLSPrefix     string `json:"hls_prefix"`
+	HTTPAPIPrefix string `json:"http_api_prefix"`
+}
+
 type HTTPNotifyConfig struct {
 	Enable            bool   `json:"enable"`
 	UpdateIntervalSec int    `json:"update_interval_sec"`
@@ -88,6 +182,10 @@ type HTTPNotifyConfig struct {
 	OnSubStart        string `json:"on_sub_start"`
 	OnSubStop         string `json:"on_sub_stop"`
 	OnRTMPConnect     string `json:"on_rtmp_connect"`
+	OnHLSPurge        string `json:"on_hls_purge"`
+	OnHLSUploadFail   string `json:"on_hls_upload_fail"`
+	OnHLSMakeTS       string `json:"on_hls_make_ts"`
+	OnHLSMakeM3U8     string `json:"on_hls_make_m3u8"`
 }
 
 type PProfConfig struct {
@@ -115,10 +213,13 @@ func LoadConf(confFile string) (*Config, error) {
 		"rtmp",
 		"httpflv",
 		"hls",
+		"dash",
 		"httpts",
 		"rtsp",
 		"relay_push",
 		"relay_pull",
+		"dvr",
+		"udp_ts",
 		"http_api",
 		"http_notify",
 		"pprof",
@@ -129,5 +230,14 @@ func LoadConf(confFile string) (*Config, error) {
 			log.DefaultBeeLogger.Warn("missing config item %s", kf)
 		}
 	}
+
+	switch config.RTMPConfig.PubConflictPolicy {
+	case PubConflictPolicyReject, PubConflictPolicyKick, PubConflictPolicyKeep:
+	case "":
+		config.RTMPConfig.PubConflictPolicy = PubConflictPolicyReject
+	default:
+		log.DefaultBeeLogger.Warn("invalid config item rtmp.pub_conflict_policy %s, use %s", config.RTMPConfig.PubConflictPolicy, PubConflictPolicyReject)
+		config.RTMPConfig.PubConflictPolicy = PubConflictPolicyReject
+	}
 	return &config, nil
 }
@@ -0,0 +1,38 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+)
+
+func TestLoadConfPubConflictPolicy(t *testing.T) {
+	golden := map[string]string{
+		`{"rtmp": {"pub_conflict_policy": "kick"}}`: PubConflictPolicyKick,
+		`{"rtmp": {"pub_conflict_policy": "keep"}}`: PubConflictPolicyKeep,
+		`{"rtmp": {"pub_conflict_policy": "foo"}}`:  PubConflictPolicyReject,
+		`{"rtmp": {}}`: PubConflictPolicyReject,
+	}
+	for content, policy := range golden {
+		f, err := ioutil.TempFile("", "lalconf")
+		assert.Equal(t, nil, err)
+		_, err = f.WriteString(content)
+		assert.Equal(t, nil, err)
+		f.Close()
+
+		c, err := LoadConf(f.Name())
+		os.Remove(f.Name())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, policy, c.RTMPConfig.PubConflictPolicy)
+	}
+}
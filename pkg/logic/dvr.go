@@ -0,0 +1,525 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+// 时移播放
+//
+// DVRBuffer 按时间窗口缓存最近的音视频数据，以gop为单位管理
+// 订阅者在url参数中携带starttime，比如`?starttime=-60s`，从距离该时间点最近的关键帧开始，按正常速率播放
+
+// 时移订阅者追上最新数据后，检查是否有新数据的间隔
+var dvrReadIntervalMS = 20
+
+// 时间戳跳变超过该值时，时移订阅者重新对齐时间戳与系统时间
+var dvrTimestampJumpThresholdMS uint32 = 10000
+
+// 输入流中断后，新的输入流的第一个gop与已有数据之间的时间戳间隔
+var dvrDiscontinuityGapMS uint32 = 40
+
+type DVRBuffer struct {
+	uniqueKey string
+	windowMS  uint32
+	maxMemory int
+	spillDir  string
+
+	mutex          sync.Mutex
+	metadata       *base.RTMPMsg
+	videoSeqHeader *base.RTMPMsg
+	aacSeqHeader   *base.RTMPMsg
+	gops           []*dvrGOP
+	firstSeq       uint64 // gops[0]的序号
+	memSize        int    // 所有在内存中的gop的大小
+	// 输入流中断后，等待新的输入流的关键帧，并将新的输入流的时间戳接在已有数据之后
+	isDiscontinuous bool
+	tsOffset        uint32
+	log             log.Logger
+}
+
+type dvrGOP struct {
+	seq     uint64
+	startTS uint32
+	endTS   uint32
+	// gop开始时生效的metadata和seq header
+	metadata       *base.RTMPMsg
+	videoSeqHeader *base.RTMPMsg
+	aacSeqHeader   *base.RTMPMsg
+
+	msgs      []base.RTMPMsg // 写入磁盘后为nil
+	size      int
+	spillFile string
+}
+
+// 时移订阅者的读取位置
+type DVRCursor struct {
+	seq uint64
+	idx int
+
+	// 已经发送给订阅者的metadata和seq header，发生变化时需要重新发送
+	metadata       *base.RTMPMsg
+	videoSeqHeader *base.RTMPMsg
+	aacSeqHeader   *base.RTMPMsg
+}
+
+func NewDVRBuffer(uniqueKey string, dvrConfig DVRConfig, logger log.Logger) *DVRBuffer {
+	logger.WithPrefix("pkg.logic.dvr")
+	if dvrConfig.SpillDir != "" {
+		if err := os.MkdirAll(dvrConfig.SpillDir, 0777); err != nil {
+			logger.Error("[%s] mkdir dvr spill dir failed. dir=%s, err=%+v", uniqueKey, dvrConfig.SpillDir, err)
+		}
+	}
+	return &DVRBuffer{
+		uniqueKey: uniqueKey,
+		windowMS:  uint32(dvrConfig.WindowSec * 1000),
+		maxMemory: dvrConfig.MaxMemoryMB * 1024 * 1024,
+		spillDir:  dvrConfig.SpillDir,
+		log:       logger,
+	}
+}
+
+func (d *DVRBuffer) Log() log.Logger {
+	if d.log == nil {
+		d.log = log.DefaultBeeLogger
+	}
+	d.log.WithPrefix("pkg.logic.dvr")
+	return d.log
+}
+
+// @param msg 函数调用结束后，内部不持有msg.Payload内存块
+func (d *DVRBuffer) Feed(msg base.RTMPMsg) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch {
+	case msg.Header.MsgTypeID == base.RTMPTypeIDMetadata:
+		m := msg.Clone()
+		d.metadata = &m
+		return
+	case msg.IsVideoKeySeqHeader():
+		m := msg.Clone()
+		d.videoSeqHeader = &m
+		return
+	case msg.IsAACSeqHeader():
+		m := msg.Clone()
+		d.aacSeqHeader = &m
+		return
+	}
+
+	if d.isDiscontinuous {
+		if !msg.IsVideoKeyNALU() {
+			return
+		}
+		d.isDiscontinuous = false
+		d.tsOffset = 0
+		if len(d.gops) != 0 {
+			d.tsOffset = d.gops[len(d.gops)-1].endTS + dvrDiscontinuityGapMS - msg.Header.TimestampAbs
+		}
+	}
+	msg.Header.TimestampAbs += d.tsOffset
+
+	if msg.IsVideoKeyNALU() {
+		d.gops = append(d.gops, &dvrGOP{
+			seq:            d.firstSeq + uint64(len(d.gops)),
+			startTS:        msg.Header.TimestampAbs,
+			metadata:       d.metadata,
+			videoSeqHeader: d.videoSeqHeader,
+			aacSeqHeader:   d.aacSeqHeader,
+		})
+	}
+	if len(d.gops) == 0 {
+		return
+	}
+
+	gop := d.gops[len(d.gops)-1]
+	gop.msgs = append(gop.msgs, msg.Clone())
+	gop.size += len(msg.Payload)
+	gop.endTS = msg.Header.TimestampAbs
+	d.memSize += len(msg.Payload)
+
+	d.evict()
+	d.spill()
+}
+
+// 定位到距离当前最新数据<offset>之前最近的关键帧
+//
+// @param offset 负数，比如-60s表示60秒之前
+func (d *DVRBuffer) Seek(offset time.Duration) DVRCursor {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.gops) == 0 {
+		return DVRCursor{seq: d.firstSeq}
+	}
+
+	lastTS := d.gops[len(d.gops)-1].endTS
+	offsetMS := uint32(-offset / time.Millisecond)
+	var target uint32
+	if lastTS > offsetMS {
+		target = lastTS - offsetMS
+	}
+
+	best := d.gops[0]
+	for _, gop := range d.gops[1:] {
+		if absDiff(gop.startTS, target) < absDiff(best.startTS, target) {
+			best = gop
+		}
+	}
+	return DVRCursor{seq: best.seq}
+}
+
+// 读取游标之后的数据，并移动游标
+// 如果游标指向的数据已经移出时间窗口，则从窗口内最早的gop开始读取
+//
+// 注意，写入磁盘的gop在释放锁之后读取，避免读磁盘阻塞Feed
+//
+// @return 返回的msg内存块不会被修改，调用方可以一直持有；返回nil表示暂时没有新数据
+func (d *DVRBuffer) Read(cursor *DVRCursor) []base.RTMPMsg {
+	for {
+		gop, msgs, spillFile, isLast := d.locate(cursor)
+		if gop == nil {
+			return nil
+		}
+
+		if msgs == nil {
+			var err error
+			if msgs, err = loadDVRSpillFile(spillFile); err != nil {
+				// 释放锁之后gop可能已经移出时间窗口，磁盘文件被删除
+				d.Log().Error("[%s] load dvr gop failed. seq=%d, err=%+v", d.uniqueKey, gop.seq, err)
+				if isLast {
+					return nil
+				}
+				cursor.seq++
+				cursor.idx = 0
+				continue
+			}
+		}
+		if cursor.idx >= len(msgs) {
+			if !isLast {
+				// 当前gop已经读完，并且已经有新的gop
+				cursor.seq++
+				cursor.idx = 0
+				continue
+			}
+			return nil
+		}
+
+		var out []base.RTMPMsg
+		if cursor.idx == 0 {
+			for _, item := range []struct {
+				curr *base.RTMPMsg
+				sent **base.RTMPMsg
+			}{
+				{gop.metadata, &cursor.metadata},
+				{gop.videoSeqHeader, &cursor.videoSeqHeader},
+				{gop.aacSeqHeader, &cursor.aacSeqHeader},
+			} {
+				if item.curr != nil && item.curr != *item.sent {
+					m := *item.curr
+					m.Header.TimestampAbs = gop.startTS
+					out = append(out, m)
+					*item.sent = item.curr
+				}
+			}
+		}
+		out = append(out, msgs[cursor.idx:]...)
+
+		if !isLast {
+			cursor.seq++
+			cursor.idx = 0
+		} else {
+			cursor.idx = len(msgs)
+		}
+		return out
+	}
+}
+
+// 在锁内定位游标指向的gop，并拷贝gop中会被Feed修改的字段
+//
+// @return gop       为nil表示暂时没有新数据
+// @return msgs      gop在内存中时有效，Feed只会在末尾追加，不会修改已有的元素
+// @return spillFile gop已经写入磁盘时有效
+// @return isLast    是否为最新的gop
+func (d *DVRBuffer) locate(cursor *DVRCursor) (gop *dvrGOP, msgs []base.RTMPMsg, spillFile string, isLast bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if cursor.seq < d.firstSeq {
+		d.Log().Warn("[%s] dvr cursor out of window. seq=%d, first=%d", d.uniqueKey, cursor.seq, d.firstSeq)
+		cursor.seq = d.firstSeq
+		cursor.idx = 0
+	}
+	pos := int(cursor.seq - d.firstSeq)
+	if pos >= len(d.gops) {
+		return nil, nil, "", false
+	}
+	gop = d.gops[pos]
+	return gop, gop.msgs, gop.spillFile, pos == len(d.gops)-1
+}
+
+// 输入流中断时调用，保留已有数据，新的输入流从关键帧开始缓存，时间戳接在已有数据之后
+// 新的输入流会重新发送metadata和seq header，所以清空之前的
+func (d *DVRBuffer) Discontinue() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.isDiscontinuous = true
+	d.metadata = nil
+	d.videoSeqHeader = nil
+	d.aacSeqHeader = nil
+}
+
+func (d *DVRBuffer) Clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, gop := range d.gops {
+		gop.removeSpillFile()
+	}
+	d.firstSeq += uint64(len(d.gops))
+	d.gops = nil
+	d.memSize = 0
+	d.metadata = nil
+	d.videoSeqHeader = nil
+	d.aacSeqHeader = nil
+	d.isDiscontinuous = false
+	d.tsOffset = 0
+}
+
+// 删除移出时间窗口的gop，至少保留最新的gop
+func (d *DVRBuffer) evict() {
+	last := d.gops[len(d.gops)-1]
+	for len(d.gops) > 1 {
+		// 去掉最早的gop后，剩余数据依然能覆盖时间窗口时才删除
+		if last.endTS < d.gops[1].startTS || last.endTS-d.gops[1].startTS < d.windowMS {
+			break
+		}
+		d.dropFirst()
+	}
+
+	// 没有配置磁盘目录时，超过内存限制直接丢弃最早的gop
+	if d.maxMemory > 0 && d.spillDir == "" {
+		for len(d.gops) > 1 && d.memSize > d.maxMemory {
+			d.dropFirst()
+		}
+	}
+}
+
+func (d *DVRBuffer) dropFirst() {
+	gop := d.gops[0]
+	if gop.msgs != nil {
+		d.memSize -= gop.size
+	}
+	gop.removeSpillFile()
+	d.gops = d.gops[1:]
+	d.firstSeq++
+}
+
+// 超过内存限制时，将较早的gop写入磁盘，正在写入的最新gop始终保留在内存中
+func (d *DVRBuffer) spill() {
+	if d.maxMemory <= 0 || d.spillDir == "" {
+		return
+	}
+	for i := 0; i < len(d.gops)-1 && d.memSize > d.maxMemory; i++ {
+		gop := d.gops[i]
+		if gop.msgs == nil {
+			continue
+		}
+		filename := filepath.Join(d.spillDir, fmt.Sprintf("%s-%d.dvr", d.uniqueKey, gop.seq))
+		if err := gop.spill(filename); err != nil {
+			d.Log().Error("[%s] spill dvr gop failed. file=%s, err=%+v", d.uniqueKey, filename, err)
+			return
+		}
+		d.memSize -= gop.size
+	}
+}
+
+// 磁盘文件格式，每个msg依次为：
+// type id(1) | timestamp(4) | msg stream id(4) | payload len(4) | payload
+func (gop *dvrGOP) spill(filename string) error {
+	var buf bytes.Buffer
+	for _, msg := range gop.msgs {
+		_ = buf.WriteByte(msg.Header.MsgTypeID)
+		_ = bele.WriteBE(&buf, msg.Header.TimestampAbs)
+		_ = bele.WriteBE(&buf, uint32(msg.Header.MsgStreamID))
+		_ = bele.WriteBE(&buf, uint32(len(msg.Payload)))
+		_, _ = buf.Write(msg.Payload)
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	gop.spillFile = filename
+	gop.msgs = nil
+	return nil
+}
+
+func loadDVRSpillFile(filename string) ([]base.RTMPMsg, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []base.RTMPMsg
+	for len(b) > 0 {
+		if len(b) < 13 {
+			return nil, ErrLogic
+		}
+		var msg base.RTMPMsg
+		msg.Header.MsgTypeID = b[0]
+		msg.Header.TimestampAbs = bele.BEUint32(b[1:])
+		msg.Header.MsgStreamID = int(bele.BEUint32(b[5:]))
+		l := int(bele.BEUint32(b[9:]))
+		b = b[13:]
+		if len(b) < l {
+			return nil, ErrLogic
+		}
+		msg.Header.MsgLen = uint32(l)
+		msg.Payload = b[:l]
+		b = b[l:]
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (gop *dvrGOP) removeSpillFile() {
+	if gop.spillFile != "" {
+		_ = os.Remove(gop.spillFile)
+		gop.spillFile = ""
+	}
+}
+
+// 时移订阅者，在独立的协程中从DVRBuffer读取数据，按正常速率发送
+type dvrSubscriber struct {
+	uniqueKey string
+	dvr       *DVRBuffer
+	cursor    DVRCursor
+	write     func(msg base.RTMPMsg) error
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+func newDVRSubscriber(uniqueKey string, dvr *DVRBuffer, offset time.Duration, write func(msg base.RTMPMsg) error) *dvrSubscriber {
+	return &dvrSubscriber{
+		uniqueKey: uniqueKey,
+		dvr:       dvr,
+		cursor:    dvr.Seek(offset),
+		write:     write,
+		stopChan:  make(chan struct{}),
+	}
+}
+
+func (s *dvrSubscriber) RunLoop() {
+	var (
+		isStarted bool
+		baseTime  time.Time
+		baseTS    uint32
+	)
+
+	for {
+		msgs := s.dvr.Read(&s.cursor)
+		if len(msgs) == 0 {
+			if !s.wait(time.Duration(dvrReadIntervalMS) * time.Millisecond) {
+				return
+			}
+			continue
+		}
+
+		for _, msg := range msgs {
+			ts := msg.Header.TimestampAbs
+			// 时间戳回退或者跳变时，重新对齐
+			elapsedMS := uint32(time.Since(baseTime) / time.Millisecond)
+			if !isStarted || ts < baseTS || ts-baseTS > elapsedMS+dvrTimestampJumpThresholdMS {
+				isStarted = true
+				baseTime = time.Now()
+				baseTS = ts
+			}
+
+			due := baseTime.Add(time.Duration(ts-baseTS) * time.Millisecond)
+			if !s.wait(time.Until(due)) {
+				return
+			}
+			if err := s.write(msg); err != nil {
+				log.DefaultBeeLogger.Warn("[%s] dvr subscriber write failed. err=%+v", s.uniqueKey, err)
+				return
+			}
+		}
+	}
+}
+
+func (s *dvrSubscriber) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+}
+
+// @return 返回false表示已经停止
+func (s *dvrSubscriber) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-s.stopChan:
+			return false
+		default:
+			return true
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.stopChan:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// 解析url参数中的starttime，支持`-60s`、`-1m30s`以及单位为秒的`-60`
+//
+// @return 不存在、格式错误或者不是负数时返回0，表示从最新的数据开始播放
+func parseStartTime(rawQuery string) time.Duration {
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return 0
+	}
+	v := q.Get("starttime")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+		d = time.Duration(sec) * time.Second
+	}
+	if d >= 0 {
+		return 0
+	}
+	return d
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
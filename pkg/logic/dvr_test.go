@@ -0,0 +1,177 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+func makeDVRTestMsg(ts uint32, isKey bool) base.RTMPMsg {
+	payload := []byte{0x27, 1, 0, 0, 0, uint8(ts / 1000)}
+	if isKey {
+		payload[0] = 0x17
+	}
+	return base.RTMPMsg{
+		Header:  base.RTMPHeader{MsgLen: uint32(len(payload)), MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: ts},
+		Payload: payload,
+	}
+}
+
+// 每秒一个gop，每个gop两个msg
+func feedDVRTestGOPs(d *DVRBuffer, from, to int) {
+	for i := from; i < to; i++ {
+		d.Feed(makeDVRTestMsg(uint32(i*1000), true))
+		d.Feed(makeDVRTestMsg(uint32(i*1000+500), false))
+	}
+}
+
+func TestDVRBuffer(t *testing.T) {
+	d := NewDVRBuffer("test", DVRConfig{Enable: true, WindowSec: 10}, log.DefaultBeeLogger)
+
+	vsh := base.RTMPMsg{
+		Header:  base.RTMPHeader{MsgTypeID: base.RTMPTypeIDVideo},
+		Payload: []byte{0x17, 0, 0, 0, 0},
+	}
+	d.Feed(vsh)
+	feedDVRTestGOPs(d, 0, 30)
+
+	// 只保留时间窗口内的gop
+	assert.Equal(t, 11, len(d.gops))
+	assert.Equal(t, uint32(19000), d.gops[0].startTS)
+
+	// 从5秒前最近的关键帧开始，第一次读取时先发送seq header
+	cursor := d.Seek(-5 * time.Second)
+	msgs := d.Read(&cursor)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, true, msgs[0].IsVideoKeySeqHeader())
+	assert.Equal(t, uint32(24000), msgs[0].Header.TimestampAbs)
+	assert.Equal(t, uint32(24000), msgs[1].Header.TimestampAbs)
+	assert.Equal(t, uint32(24500), msgs[2].Header.TimestampAbs)
+	msgs = d.Read(&cursor)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, uint32(25000), msgs[0].Header.TimestampAbs)
+
+	// 追上最新数据
+	for i := 0; i < 4; i++ {
+		msgs = d.Read(&cursor)
+	}
+	assert.Equal(t, uint32(29500), msgs[1].Header.TimestampAbs)
+	assert.Equal(t, 0, len(d.Read(&cursor)))
+	feedDVRTestGOPs(d, 30, 31)
+	msgs = d.Read(&cursor)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, uint32(30000), msgs[0].Header.TimestampAbs)
+
+	// 超过窗口的偏移从最早的gop开始，读取位置移出窗口后也从最早的gop开始
+	cursor = d.Seek(-time.Hour)
+	feedDVRTestGOPs(d, 31, 40)
+	msgs = d.Read(&cursor)
+	assert.Equal(t, uint32(29000), msgs[1].Header.TimestampAbs)
+
+	d.Clear()
+	assert.Equal(t, 0, len(d.Read(&cursor)))
+}
+
+func TestDVRBuffer_Spill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dvr")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// 内存限制为0时不写磁盘，这里使用一个很小的限制，除了最新的gop都会写入磁盘
+	d := NewDVRBuffer("test", DVRConfig{Enable: true, WindowSec: 10, SpillDir: dir}, log.DefaultBeeLogger)
+	d.maxMemory = 1
+	feedDVRTestGOPs(d, 0, 5)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 4, len(files))
+	assert.Equal(t, true, d.gops[0].msgs == nil)
+
+	cursor := d.Seek(-time.Hour)
+	msgs := d.Read(&cursor)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, makeDVRTestMsg(0, true), msgs[0])
+	assert.Equal(t, makeDVRTestMsg(500, false), msgs[1])
+
+	// 磁盘文件在释放锁之后读取，读取前文件可能已经被删除，此时跳过该gop
+	assert.Equal(t, nil, os.Remove(d.gops[1].spillFile))
+	msgs = d.Read(&cursor)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, makeDVRTestMsg(2000, true), msgs[0])
+
+	d.Clear()
+	files, _ = ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files))
+}
+
+// 推流重连后保留已有数据，新的推流从关键帧开始缓存，时间戳接在已有数据之后
+func TestDVRBuffer_Discontinue(t *testing.T) {
+	d := NewDVRBuffer("test", DVRConfig{Enable: true, WindowSec: 10}, log.DefaultBeeLogger)
+	feedDVRTestGOPs(d, 0, 3)
+	d.Discontinue()
+
+	d.Feed(makeDVRTestMsg(100, false))
+	feedDVRTestGOPs(d, 0, 2)
+	assert.Equal(t, 5, len(d.gops))
+	assert.Equal(t, uint32(2500), d.gops[2].endTS)
+	assert.Equal(t, uint32(2540), d.gops[3].startTS)
+	assert.Equal(t, uint32(3540), d.gops[4].startTS)
+	assert.Equal(t, 2, len(d.gops[2].msgs))
+
+	cursor := d.Seek(-time.Hour)
+	var tsList []uint32
+	for {
+		msgs := d.Read(&cursor)
+		if len(msgs) == 0 {
+			break
+		}
+		for _, msg := range msgs {
+			tsList = append(tsList, msg.Header.TimestampAbs)
+		}
+	}
+	assert.Equal(t, []uint32{0, 500, 1000, 1500, 2000, 2500, 2540, 3040, 3540, 4040}, tsList)
+}
+
+func TestDVRSubscriber(t *testing.T) {
+	d := NewDVRBuffer("test", DVRConfig{Enable: true, WindowSec: 10}, log.DefaultBeeLogger)
+	d.Feed(makeDVRTestMsg(0, true))
+	d.Feed(makeDVRTestMsg(100, false))
+
+	ch := make(chan base.RTMPMsg, 8)
+	sub := newDVRSubscriber("test", d, -time.Minute, func(msg base.RTMPMsg) error {
+		ch <- msg
+		return nil
+	})
+	go sub.RunLoop()
+
+	// 按时间戳间隔发送
+	b := time.Now()
+	assert.Equal(t, uint32(0), (<-ch).Header.TimestampAbs)
+	assert.Equal(t, uint32(100), (<-ch).Header.TimestampAbs)
+	assert.Equal(t, true, time.Since(b) >= 90*time.Millisecond)
+
+	d.Feed(makeDVRTestMsg(200, false))
+	assert.Equal(t, uint32(200), (<-ch).Header.TimestampAbs)
+	sub.Stop()
+}
+
+func TestParseStartTime(t *testing.T) {
+	assert.Equal(t, -60*time.Second, parseStartTime("starttime=-60s"))
+	assert.Equal(t, -90*time.Second, parseStartTime("a=1&starttime=-1m30s"))
+	assert.Equal(t, -60*time.Second, parseStartTime("starttime=-60"))
+	assert.Equal(t, time.Duration(0), parseStartTime("starttime=60s"))
+	assert.Equal(t, time.Duration(0), parseStartTime("starttime=abc"))
+	assert.Equal(t, time.Duration(0), parseStartTime(""))
+}
@@ -26,14 +26,7 @@ var (
 )
 
 func Entry(confFile string) {
-	config = loadConf(confFile)
-	initLog()
-	log.DefaultBeeLogger.Info("bininfo: %s", bininfo.StringifySingleLine())
-	log.DefaultBeeLogger.Info("version: %s", base.LALFullInfo)
-	log.DefaultBeeLogger.Info("github: %s", base.LALGithubSite)
-	log.DefaultBeeLogger.Info("doc: %s", base.LALDocSite)
-
-	sm = NewServerManager(log.DefaultBeeLogger)
+	Init(confFile)
 
 	if config.PProfConfig.Enable {
 		go runWebPProf(config.PProfConfig.Addr)
@@ -45,6 +38,22 @@ func Entry(confFile string) {
 	sm.RunLoop()
 }
 
+// 嵌入到其他Go程序中时使用，加载配置并创建ServerManager，之后由调用方调用RunLoop以及Dispose
+//
+// 开启http_server时，可以在RunLoop之前通过SetHTTPListener传入Listener，或者通过HTTPHandler挂载到已有的http.Server上
+// 需要在进程内接收hls切片事件时，可以在RunLoop之前通过SetHLSEventObserver设置
+func Init(confFile string) *ServerManager {
+	config = loadConf(confFile)
+	initLog()
+	log.DefaultBeeLogger.Info("bininfo: %s", bininfo.StringifySingleLine())
+	log.DefaultBeeLogger.Info("version: %s", base.LALFullInfo)
+	log.DefaultBeeLogger.Info("github: %s", base.LALGithubSite)
+	log.DefaultBeeLogger.Info("doc: %s", base.LALDocSite)
+
+	sm = NewServerManager(log.DefaultBeeLogger)
+	return sm
+}
+
 func Dispose() {
 	sm.Dispose()
 }
@@ -14,6 +14,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/souliot/naza/pkg/log"
 	"github.com/souliot/siot-av/pkg/remux"
@@ -30,7 +31,10 @@ import (
 
 	"github.com/souliot/siot-av/pkg/avc"
 	"github.com/souliot/siot-av/pkg/rtsp"
+	"github.com/souliot/siot-av/pkg/udpts"
 
+	"github.com/souliot/siot-av/pkg/dash"
+	"github.com/souliot/siot-av/pkg/fmp4"
 	"github.com/souliot/siot-av/pkg/hls"
 
 	"github.com/souliot/siot-av/pkg/httpflv"
@@ -48,8 +52,13 @@ type Group struct {
 	//
 	stat base.StatGroup
 	//
-	rtmpPubSession *rtmp.ServerSession
-	rtspPubSession *rtsp.PubSession
+	rtmpPubSession    *rtmp.ServerSession
+	rtspPubSession    *rtsp.PubSession
+	udptsPubSession   *udpts.PubSession
+	httpflvPubSession *httpflv.PubSession
+	httptsPubSession  *httpts.PubSession
+	// 推流冲突策略为keep时，等待切换的备用rtmp推流
+	rtmpPubStandbyList []*rtmpPubStandby
 	//
 	pullEnable bool
 	pullURL    string
@@ -59,14 +68,23 @@ type Group struct {
 	httpflvSubSessionSet map[*httpflv.SubSession]struct{}
 	httptsSubSessionSet  map[*httpts.SubSession]struct{}
 	rtspSubSessionSet    map[*rtsp.SubSession]struct{}
+	hlsSubSessionSet     map[*hls.SubSession]struct{}
 	//
 	url2PushProxy map[string]*pushProxy
+	// key为目标地址
+	addr2UDPTSPushSession map[string]*udpts.PushSession
 	//
 	hlsMuxer *hls.Muxer
+	// dash
+	dashMuxer *dash.Muxer
 	// rtmp pub/pull使用
 	gopCache        *GOPCache
 	httpflvGopCache *GOPCache
-	// rtsp pub使用
+	// 时移播放使用，key为rtmp或httpflv的sub session
+	// 时移订阅者同时也在rtmpSubSessionSet或httpflvSubSessionSet中，用于统计、踢出以及超时检查，但是不参与广播
+	dvr           *DVRBuffer
+	dvrSubscriber map[interface{}]*dvrSubscriber
+	// rtsp pub、udp ts pub使用
 	asc []byte
 	vps []byte
 	sps []byte
@@ -77,8 +95,9 @@ type Group struct {
 }
 
 type pullProxy struct {
-	isPulling   bool
-	pullSession *rtmp.PullSession
+	isPulling      bool
+	pullSession    *rtmp.PullSession
+	hlsPullSession *hls.PullSession
 }
 
 type pushProxy struct {
@@ -86,6 +105,53 @@ type pushProxy struct {
 	pushSession *rtmp.PushSession
 }
 
+// 备用rtmp推流在切换为当前推流之前，只缓存最新的metadata和音视频seq header，其他数据直接丢弃
+// 切换后先补发缓存的数据，保证订阅者能够正常解码
+type rtmpPubStandby struct {
+	group   *Group
+	session *rtmp.ServerSession
+
+	// 以下字段只在session的读协程中访问
+	isActive       bool
+	metadata       *base.RTMPMsg
+	videoSeqHeader *base.RTMPMsg
+	aacSeqHeader   *base.RTMPMsg
+}
+
+// rtmp.PubSessionObserver
+func (s *rtmpPubStandby) OnReadRTMPAVMsg(msg base.RTMPMsg) {
+	if !s.isActive {
+		s.group.mutex.Lock()
+		s.isActive = s.group.rtmpPubSession == s.session
+		s.group.mutex.Unlock()
+
+		if !s.isActive {
+			switch {
+			case msg.Header.MsgTypeID == base.RTMPTypeIDMetadata:
+				m := msg.Clone()
+				s.metadata = &m
+			case msg.IsVideoKeySeqHeader():
+				m := msg.Clone()
+				s.videoSeqHeader = &m
+			case msg.IsAACSeqHeader():
+				m := msg.Clone()
+				s.aacSeqHeader = &m
+			}
+			return
+		}
+
+		for _, m := range []*base.RTMPMsg{s.metadata, s.videoSeqHeader, s.aacSeqHeader} {
+			if m != nil {
+				m.Header.TimestampAbs = msg.Header.TimestampAbs
+				s.group.OnReadRTMPAVMsg(*m)
+			}
+		}
+		s.metadata, s.videoSeqHeader, s.aacSeqHeader = nil, nil, nil
+	}
+
+	s.group.OnReadRTMPAVMsg(msg)
+}
+
 func NewGroup(appName string, streamName string, pullEnable bool, pullURL string, logger log.Logger) *Group {
 	uk := base.GenUniqueKey(base.UKPGroup)
 	logger.WithPrefix("pkg.logic.group")
@@ -94,7 +160,7 @@ func NewGroup(appName string, streamName string, pullEnable bool, pullURL string
 	url2PushProxy := make(map[string]*pushProxy)
 	if config.RelayPushConfig.Enable {
 		for _, addr := range config.RelayPushConfig.AddrList {
-			url := fmt.Sprintf("rtmp://%s/%s/%s", addr, appName, streamName)
+			url := relayPushURL(addr, appName, streamName)
 			url2PushProxy[url] = &pushProxy{
 				isPushing:   false,
 				pushSession: nil,
@@ -102,26 +168,47 @@ func NewGroup(appName string, streamName string, pullEnable bool, pullURL string
 		}
 	}
 
-	return &Group{
+	var dvr *DVRBuffer
+	if config.DVRConfig.Enable {
+		dvr = NewDVRBuffer(uk, config.DVRConfig, logger)
+	}
+
+	group := &Group{
 		UniqueKey:  uk,
 		appName:    appName,
 		streamName: streamName,
 		stat: base.StatGroup{
 			StreamName: streamName,
 		},
-		exitChan:             make(chan struct{}, 1),
-		rtmpSubSessionSet:    make(map[*rtmp.ServerSession]struct{}),
-		httpflvSubSessionSet: make(map[*httpflv.SubSession]struct{}),
-		httptsSubSessionSet:  make(map[*httpts.SubSession]struct{}),
-		rtspSubSessionSet:    make(map[*rtsp.SubSession]struct{}),
-		gopCache:             NewGOPCache("rtmp", uk, config.RTMPConfig.GOPNum, logger),
-		httpflvGopCache:      NewGOPCache("httpflv", uk, config.HTTPFLVConfig.GOPNum, logger),
-		pullProxy:            &pullProxy{},
-		url2PushProxy:        url2PushProxy,
-		pullEnable:           pullEnable,
-		pullURL:              pullURL,
-		log:                  logger,
+		exitChan:              make(chan struct{}, 1),
+		rtmpSubSessionSet:     make(map[*rtmp.ServerSession]struct{}),
+		httpflvSubSessionSet:  make(map[*httpflv.SubSession]struct{}),
+		httptsSubSessionSet:   make(map[*httpts.SubSession]struct{}),
+		hlsSubSessionSet:      make(map[*hls.SubSession]struct{}),
+		rtspSubSessionSet:     make(map[*rtsp.SubSession]struct{}),
+		gopCache:              NewGOPCache("rtmp", uk, config.RTMPConfig.GOPNum, logger),
+		httpflvGopCache:       NewGOPCache("httpflv", uk, config.HTTPFLVConfig.GOPNum, logger),
+		dvr:                   dvr,
+		dvrSubscriber:         make(map[interface{}]*dvrSubscriber),
+		pullProxy:             &pullProxy{},
+		url2PushProxy:         url2PushProxy,
+		pullEnable:            pullEnable,
+		pullURL:               pullURL,
+		addr2UDPTSPushSession: make(map[string]*udpts.PushSession),
+		log:                   logger,
+	}
+
+	if config.UDPTSConfig.Enable {
+		for _, c := range config.UDPTSConfig.PushList {
+			if c.StreamName != streamName {
+				continue
+			}
+			if err := group.addUDPTSPush(c); err != nil {
+				group.Log().Error("[%s] start udp ts push failed. addr=%s, err=%+v", uk, c.Addr, err)
+			}
+		}
 	}
+	return group
 }
 func (s *Group) Log() log.Logger {
 	if s.log == nil {
@@ -165,6 +252,18 @@ func (group *Group) Tick() {
 				group.rtspPubSession = nil
 			}
 		}
+		if group.httpflvPubSession != nil {
+			if readAlive, _ := group.httpflvPubSession.IsAlive(); !readAlive {
+				group.Log().Warn("[%s] session timeout. session=%s", group.UniqueKey, group.httpflvPubSession.UniqueKey)
+				group.httpflvPubSession.Dispose()
+			}
+		}
+		if group.httptsPubSession != nil {
+			if readAlive, _ := group.httptsPubSession.IsAlive(); !readAlive {
+				group.Log().Warn("[%s] session timeout. session=%s", group.UniqueKey, group.httptsPubSession.UniqueKey)
+				group.httptsPubSession.Dispose()
+			}
+		}
 		if group.pullProxy.pullSession != nil {
 			if readAlive, _ := group.pullProxy.pullSession.IsAlive(); !readAlive {
 				group.Log().Warn("[%s] session timeout. session=%s", group.UniqueKey, group.pullProxy.pullSession.UniqueKey())
@@ -172,6 +271,12 @@ func (group *Group) Tick() {
 				group.delRTMPPullSession(group.pullProxy.pullSession)
 			}
 		}
+		if group.pullProxy.hlsPullSession != nil {
+			if readAlive, _ := group.pullProxy.hlsPullSession.IsAlive(); !readAlive {
+				group.Log().Warn("[%s] session timeout. session=%s", group.UniqueKey, group.pullProxy.hlsPullSession.UniqueKey)
+				group.pullProxy.hlsPullSession.Dispose()
+			}
+		}
 		for session := range group.rtmpSubSessionSet {
 			if _, writeAlive := session.IsAlive(); !writeAlive {
 				group.Log().Warn("[%s] session timeout. session=%s", group.UniqueKey, session.UniqueKey)
@@ -210,9 +315,21 @@ func (group *Group) Tick() {
 		if group.rtspPubSession != nil {
 			group.rtspPubSession.UpdateStat(calcSessionStatIntervalSec)
 		}
+		if group.udptsPubSession != nil {
+			group.udptsPubSession.UpdateStat(calcSessionStatIntervalSec)
+		}
+		if group.httpflvPubSession != nil {
+			group.httpflvPubSession.UpdateStat(calcSessionStatIntervalSec)
+		}
+		if group.httptsPubSession != nil {
+			group.httptsPubSession.UpdateStat(calcSessionStatIntervalSec)
+		}
 		if group.pullProxy.pullSession != nil {
 			group.pullProxy.pullSession.UpdateStat(calcSessionStatIntervalSec)
 		}
+		if group.pullProxy.hlsPullSession != nil {
+			group.pullProxy.hlsPullSession.UpdateStat(calcSessionStatIntervalSec)
+		}
 		for session := range group.rtmpSubSessionSet {
 			session.UpdateStat(calcSessionStatIntervalSec)
 		}
@@ -225,10 +342,29 @@ func (group *Group) Tick() {
 		for session := range group.rtspSubSessionSet {
 			session.UpdateStat(calcSessionStatIntervalSec)
 		}
+		for session := range group.hlsSubSessionSet {
+			session.UpdateStat(calcSessionStatIntervalSec)
+		}
+		for _, session := range group.addr2UDPTSPushSession {
+			session.UpdateStat(calcSessionStatIntervalSec)
+		}
+		group.updatePubBitratePeak()
 	}
 	group.tickCount++
 }
 
+// 记录推流码率的最大值，更换推流session时重新统计
+func (group *Group) updatePubBitratePeak() {
+	pub := group.getStatPub()
+	if pub.SessionID != group.stat.StatPub.SessionID {
+		group.stat.PubBitratePeak = 0
+	}
+	group.stat.StatPub = pub
+	if pub.Bitrate > group.stat.PubBitratePeak {
+		group.stat.PubBitratePeak = pub.Bitrate
+	}
+}
+
 // 主动释放所有资源。保证所有资源的生命周期逻辑上都在我们的控制中。降低出bug的几率，降低心智负担。
 // 注意，Dispose后，不应再使用这个对象。
 // 值得一提，如果是从其他协程回调回来的消息，在使用Group中的资源前，要判断资源是否存在以及可用。
@@ -247,16 +383,41 @@ func (group *Group) Dispose() {
 		group.rtmpPubSession.Dispose()
 		group.rtmpPubSession = nil
 	}
+	for _, standby := range group.rtmpPubStandbyList {
+		standby.session.Dispose()
+	}
+	group.rtmpPubStandbyList = nil
 	if group.rtspPubSession != nil {
 		group.rtspPubSession.Dispose()
 		group.rtspPubSession = nil
 	}
+	if group.udptsPubSession != nil {
+		group.udptsPubSession.Dispose()
+		group.udptsPubSession = nil
+	}
+	if group.httpflvPubSession != nil {
+		group.httpflvPubSession.Dispose()
+		group.httpflvPubSession = nil
+	}
+	if group.httptsPubSession != nil {
+		group.httptsPubSession.Dispose()
+		group.httptsPubSession = nil
+	}
 
 	for session := range group.rtmpSubSessionSet {
 		session.Dispose()
 	}
 	group.rtmpSubSessionSet = nil
 
+	// 时移订阅者的session在rtmpSubSessionSet或httpflvSubSessionSet中释放
+	for _, sub := range group.dvrSubscriber {
+		sub.Stop()
+	}
+	group.dvrSubscriber = nil
+	if group.dvr != nil {
+		group.dvr.Clear()
+	}
+
 	for session := range group.httpflvSubSessionSet {
 		session.Dispose()
 	}
@@ -267,6 +428,14 @@ func (group *Group) Dispose() {
 	}
 	group.httptsSubSessionSet = nil
 
+	// hls的播放者没有连接，由hls.Server超时后回调删除
+	group.hlsSubSessionSet = nil
+
+	for _, session := range group.addr2UDPTSPushSession {
+		session.Dispose()
+	}
+	group.addr2UDPTSPushSession = nil
+
 	group.disposeHLSMuxer()
 
 	if config.RelayPushConfig.Enable {
@@ -279,28 +448,56 @@ func (group *Group) Dispose() {
 	}
 }
 
-func (group *Group) AddRTMPPubSession(session *rtmp.ServerSession) bool {
+// 已经存在输入流时，根据配置的推流冲突策略处理
+//
+// @return standby 是否作为备用推流，备用推流在切换为当前推流之前不对外通知
+// @return err     非nil表示拒绝该推流
+func (group *Group) AddRTMPPubSession(session *rtmp.ServerSession) (standby bool, err error) {
 	group.Log().Debug("[%s] [%s] add PubSession into group.", group.UniqueKey, session.UniqueKey)
 
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
 
+	if group.hasInSession() {
+		switch config.RTMPConfig.PubConflictPolicy {
+		case PubConflictPolicyKick:
+			group.kickPubSession(session.UniqueKey)
+		case PubConflictPolicyKeep:
+			if group.rtmpPubSession != nil {
+				group.Log().Info("[%s] add rtmp PubSession as standby. curr=%s, standby=%s", group.UniqueKey, group.rtmpPubSession.UniqueKey, session.UniqueKey)
+				s := &rtmpPubStandby{group: group, session: session}
+				group.rtmpPubStandbyList = append(group.rtmpPubStandbyList, s)
+				session.SetPubSessionObserver(s)
+				return true, nil
+			}
+		case PubConflictPolicyReject, "":
+		default:
+			group.Log().Warn("[%s] unknown pub conflict policy, reject. policy=%s", group.UniqueKey, config.RTMPConfig.PubConflictPolicy)
+		}
+	}
+
+	// 拉流回源的输入流不会被踢掉，此时依然拒绝
 	if group.hasInSession() {
 		group.Log().Error("[%s] in stream already exist. wanna add=%s", group.UniqueKey, session.UniqueKey)
-		return false
+		return false, &rtmp.StatusError{
+			Code:        rtmp.StatusCodePublishBadName,
+			Description: fmt.Sprintf("stream %s already publishing", group.streamName),
+		}
 	}
 
 	group.rtmpPubSession = session
 	group.addIn()
 	session.SetPubSessionObserver(group)
 
-	return true
+	return false, nil
 }
 
-func (group *Group) DelRTMPPubSession(session *rtmp.ServerSession) {
+// @return wasStandby 被删除的是否为还没有切换为当前推流的备用推流
+// @return promoted   删除当前推流后，切换为当前推流的备用推流，没有切换时为nil
+func (group *Group) DelRTMPPubSession(session *rtmp.ServerSession) (wasStandby bool, promoted *rtmp.ServerSession) {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
-	group.delRTMPPubSession(session)
+	return group.delRTMPPubSession(session)
 }
 
 // TODO chef: rtsp package中，增加回调返回值判断，如果是false，将连接关掉
@@ -328,6 +525,78 @@ func (group *Group) DelRTSPPubSession(session *rtsp.PubSession) {
 	group.delRTSPPubSession(session)
 }
 
+func (group *Group) AddUDPTSPubSession(session *udpts.PubSession) bool {
+	group.Log().Debug("[%s] [%s] add udp ts PubSession into group.", group.UniqueKey, session.UniqueKey)
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if group.hasInSession() {
+		group.Log().Error("[%s] in stream already exist. wanna add=%s", group.UniqueKey, session.UniqueKey)
+		return false
+	}
+
+	group.udptsPubSession = session
+	group.addIn()
+	session.SetObserver(&udptsPubObserver{group: group, session: session})
+
+	return true
+}
+
+func (group *Group) DelUDPTSPubSession(session *udpts.PubSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delUDPTSPubSession(session)
+}
+
+func (group *Group) AddHTTPFLVPubSession(session *httpflv.PubSession) bool {
+	group.Log().Debug("[%s] [%s] add httpflv PubSession into group.", group.UniqueKey, session.UniqueKey)
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if group.hasInSession() {
+		group.Log().Error("[%s] in stream already exist. wanna add=%s", group.UniqueKey, session.UniqueKey)
+		return false
+	}
+
+	group.httpflvPubSession = session
+	group.addIn()
+	session.SetObserver(&httpflvPubObserver{group: group, session: session})
+
+	return true
+}
+
+func (group *Group) DelHTTPFLVPubSession(session *httpflv.PubSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delHTTPFLVPubSession(session)
+}
+
+func (group *Group) AddHTTPTSPubSession(session *httpts.PubSession) bool {
+	group.Log().Debug("[%s] [%s] add httpts PubSession into group.", group.UniqueKey, session.UniqueKey)
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if group.hasInSession() {
+		group.Log().Error("[%s] in stream already exist. wanna add=%s", group.UniqueKey, session.UniqueKey)
+		return false
+	}
+
+	group.httptsPubSession = session
+	group.addIn()
+	session.SetObserver(&httptsPubObserver{group: group, session: session})
+
+	return true
+}
+
+func (group *Group) DelHTTPTSPubSession(session *httpts.PubSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delHTTPTSPubSession(session)
+}
+
 func (group *Group) AddRTMPPullSession(session *rtmp.PullSession) bool {
 	group.Log().Debug("[%s] [%s] add PullSession into group.", group.UniqueKey, session.UniqueKey())
 
@@ -350,10 +619,39 @@ func (group *Group) DelRTMPPullSession(session *rtmp.PullSession) {
 	group.delRTMPPullSession(session)
 }
 
+func (group *Group) AddHLSPullSession(session *hls.PullSession) bool {
+	group.Log().Debug("[%s] [%s] add hls PullSession into group.", group.UniqueKey, session.UniqueKey)
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if group.hasInSession() {
+		group.Log().Error("[%s] in stream already exist. wanna add=%s", group.UniqueKey, session.UniqueKey)
+		return false
+	}
+
+	group.pullProxy.hlsPullSession = session
+	group.addIn()
+	return true
+}
+
+func (group *Group) DelHLSPullSession(session *hls.PullSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delHLSPullSession(session)
+}
+
 func (group *Group) AddRTMPSubSession(session *rtmp.ServerSession) {
 	group.Log().Debug("[%s] [%s] add SubSession into group.", group.UniqueKey, session.UniqueKey)
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
+
+	if offset := parseStartTime(session.RawQuery()); offset != 0 && group.dvr != nil {
+		group.addDVRSubscriber(session, session.UniqueKey, offset, func(msg base.RTMPMsg) error {
+			header := remux.MakeDefaultRTMPHeader(msg.Header)
+			return session.AsyncWrite(rtmp.Message2Chunks(msg.Payload, &header))
+		})
+	}
 	group.rtmpSubSessionSet[session] = struct{}{}
 
 	group.pullIfNeeded()
@@ -372,6 +670,13 @@ func (group *Group) AddHTTPFLVSubSession(session *httpflv.SubSession) {
 
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
+
+	if offset := parseStartTime(session.RawQuery()); offset != 0 && group.dvr != nil {
+		group.addDVRSubscriber(session, session.UniqueKey, offset, func(msg base.RTMPMsg) error {
+			session.WriteRawPacket(remux.RTMPMsg2FLVTag(msg).Raw)
+			return nil
+		})
+	}
 	group.httpflvSubSessionSet[session] = struct{}{}
 
 	group.pullIfNeeded()
@@ -404,6 +709,22 @@ func (group *Group) DelHTTPTSSubSession(session *httpts.SubSession) {
 	group.delHTTPTSSubSession(session)
 }
 
+func (group *Group) AddHLSSubSession(session *hls.SubSession) {
+	group.Log().Debug("[%s] [%s] add hls SubSession into group.", group.UniqueKey, session.UniqueKey)
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.hlsSubSessionSet[session] = struct{}{}
+
+	// hls的播放者也触发回源，hls.Server等待回源生成第一个m3u8
+	group.pullIfNeeded()
+}
+
+func (group *Group) DelHLSSubSession(session *hls.SubSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delHLSSubSession(session)
+}
+
 func (group *Group) HandleNewRTSPSubSessionDescribe(session *rtsp.SubSession) (ok bool, sdp []byte) {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
@@ -451,6 +772,34 @@ func (group *Group) DelRTMPPushSession(url string, session *rtmp.PushSession) {
 	}
 }
 
+// 添加UDP TS推送目标，目标地址已经存在时，使用新的配置替换
+func (group *Group) AddUDPTSPush(c udpts.PushConfig) error {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if err := group.addUDPTSPush(c); err != nil {
+		return err
+	}
+	// 输入流已经存在，但是之前没有创建hls.Muxer
+	if group.hasInSession() && group.hlsMuxer == nil {
+		group.startHLSMuxer()
+	}
+	return nil
+}
+
+// @return 目标地址不存在时返回false
+func (group *Group) DelUDPTSPush(addr string) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	session, ok := group.addr2UDPTSPushSession[addr]
+	if !ok {
+		return false
+	}
+	group.Log().Debug("[%s] [%s] del udp ts PushSession from group.", group.UniqueKey, session.UniqueKey)
+	session.Dispose()
+	delete(group.addr2UDPTSPushSession, addr)
+	return true
+}
+
 func (group *Group) IsTotalEmpty() bool {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
@@ -483,6 +832,10 @@ func (group *Group) OnTSPackets(rawFrame []byte, boundary bool) {
 			session.WriteRawPacket(rawFrame)
 		}
 	}
+
+	for _, session := range group.addr2UDPTSPushSession {
+		session.WriteTSPackets(rawFrame, boundary)
+	}
 }
 
 // rtmp.PubSession or rtmp.PullSession
@@ -503,6 +856,67 @@ func (group *Group) OnRTPPacket(pkt rtprtcp.RTPPacket) {
 	}
 }
 
+// udpts.PubSession的回调在udpts.Server的读协程中，不像rtsp.PubSession那样已经在锁保护内，所以在这里加锁
+type udptsPubObserver struct {
+	group   *Group
+	session *udpts.PubSession
+}
+
+func (o *udptsPubObserver) OnAVConfig(asc, vps, sps, pps []byte) {
+	o.group.mutex.Lock()
+	defer o.group.mutex.Unlock()
+	if o.group.udptsPubSession != o.session {
+		return
+	}
+	o.group.OnAVConfig(asc, vps, sps, pps)
+}
+
+func (o *udptsPubObserver) OnAVPacket(pkt base.AVPacket) {
+	o.group.mutex.Lock()
+	defer o.group.mutex.Unlock()
+	if o.group.udptsPubSession != o.session {
+		return
+	}
+	o.group.OnAVPacket(pkt)
+}
+
+type httpflvPubObserver struct {
+	group   *Group
+	session *httpflv.PubSession
+}
+
+func (o *httpflvPubObserver) OnReadFLVTag(tag httpflv.Tag) {
+	o.group.mutex.Lock()
+	defer o.group.mutex.Unlock()
+	if o.group.httpflvPubSession != o.session {
+		return
+	}
+	o.group.broadcastRTMP(remux.FLVTag2RTMPMsg(tag))
+}
+
+type httptsPubObserver struct {
+	group   *Group
+	session *httpts.PubSession
+}
+
+func (o *httptsPubObserver) OnAVConfig(asc, vps, sps, pps []byte) {
+	o.group.mutex.Lock()
+	defer o.group.mutex.Unlock()
+	if o.group.httptsPubSession != o.session {
+		return
+	}
+	o.group.OnAVConfig(asc, vps, sps, pps)
+}
+
+func (o *httptsPubObserver) OnAVPacket(pkt base.AVPacket) {
+	o.group.mutex.Lock()
+	defer o.group.mutex.Unlock()
+	if o.group.httptsPubSession != o.session {
+		return
+	}
+	o.group.OnAVPacket(pkt)
+}
+
 // rtsp.PubSession
 func (group *Group) OnAVConfig(asc, vps, sps, pps []byte) {
 	// 注意，前面已经进锁了，这里依然在锁保护内
@@ -543,7 +957,7 @@ func (group *Group) OnAVPacket(pkt base.AVPacket) {
 
 func (group *Group) StringifyDebugStats() string {
 	group.mutex.Lock()
-	subLen := len(group.rtmpSubSessionSet) + len(group.httpflvSubSessionSet) + len(group.httptsSubSessionSet) + len(group.rtspSubSessionSet)
+	subLen := len(group.rtmpSubSessionSet) + len(group.httpflvSubSessionSet) + len(group.httptsSubSessionSet) + len(group.rtspSubSessionSet) + len(group.hlsSubSessionSet)
 	group.mutex.Unlock()
 	if subLen > 10 {
 		return fmt.Sprintf("[%s] not log out all stats. subLen=%d", group.UniqueKey, subLen)
@@ -556,13 +970,7 @@ func (group *Group) GetStat() base.StatGroup {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
 
-	if group.rtmpPubSession != nil {
-		group.stat.StatPub = base.StatSession2Pub(group.rtmpPubSession.GetStat())
-	} else if group.rtspPubSession != nil {
-		group.stat.StatPub = base.StatSession2Pub(group.rtspPubSession.GetStat())
-	} else {
-		group.stat.StatPub = base.StatPub{}
-	}
+	group.stat.StatPub = group.getStatPub()
 
 	group.stat.StatSubs = nil
 	for s := range group.rtmpSubSessionSet {
@@ -577,14 +985,44 @@ func (group *Group) GetStat() base.StatGroup {
 	for s := range group.rtspSubSessionSet {
 		group.stat.StatSubs = append(group.stat.StatSubs, base.StatSession2Sub(s.GetStat()))
 	}
+	for s := range group.hlsSubSessionSet {
+		group.stat.StatSubs = append(group.stat.StatSubs, base.StatSession2Sub(s.GetStat()))
+	}
+	for _, s := range group.addr2UDPTSPushSession {
+		group.stat.StatSubs = append(group.stat.StatSubs, base.StatSession2Sub(s.GetStat()))
+	}
 
 	if group.pullProxy.pullSession != nil {
 		group.stat.StatPull = base.StatSession2Pull(group.pullProxy.pullSession.GetStat())
 	}
+	if group.pullProxy.hlsPullSession != nil {
+		group.stat.StatPull = base.StatSession2Pull(group.pullProxy.hlsPullSession.GetStat())
+	}
+
+	group.stat.HLSUpload = nil
+	if u := hls.GetUploader(); u != nil && group.hlsMuxer != nil {
+		stat := u.GetStat(group.streamName)
+		group.stat.HLSUpload = &stat
+	}
 
 	return group.stat
 }
 
+func (group *Group) getStatPub() base.StatPub {
+	if group.rtmpPubSession != nil {
+		return base.StatSession2Pub(group.rtmpPubSession.GetStat())
+	} else if group.rtspPubSession != nil {
+		return base.StatSession2Pub(group.rtspPubSession.GetStat())
+	} else if group.udptsPubSession != nil {
+		return base.StatSession2Pub(group.udptsPubSession.GetStat())
+	} else if group.httpflvPubSession != nil {
+		return base.StatSession2Pub(group.httpflvPubSession.GetStat())
+	} else if group.httptsPubSession != nil {
+		return base.StatSession2Pub(group.httptsPubSession.GetStat())
+	}
+	return base.StatPub{}
+}
+
 func (group *Group) StartPull(url string) {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
@@ -600,6 +1038,12 @@ func (group *Group) IsHLSMuxerAlive() bool {
 	return group.hlsMuxer != nil
 }
 
+func (group *Group) IsDASHMuxerAlive() bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	return group.dashMuxer != nil
+}
+
 func (group *Group) KickOutSession(sessionID string) bool {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
@@ -607,15 +1051,36 @@ func (group *Group) KickOutSession(sessionID string) bool {
 	group.Log().Info("[%s] kick out session. session id=%s", group.UniqueKey, sessionID)
 
 	if strings.HasPrefix(sessionID, base.UKPRTMPServerSession) {
-		if group.rtmpPubSession != nil {
+		if group.rtmpPubSession != nil && group.rtmpPubSession.UniqueKey == sessionID {
 			group.rtmpPubSession.Dispose()
 			return true
 		}
+		for s := range group.rtmpSubSessionSet {
+			if s.UniqueKey == sessionID {
+				s.Dispose()
+				return true
+			}
+		}
 	} else if strings.HasPrefix(sessionID, base.UKPRTSPPubSession) {
 		if group.rtspPubSession != nil {
 			group.rtspPubSession.Dispose()
 			return true
 		}
+	} else if strings.HasPrefix(sessionID, base.UKPUDPTSPubSession) {
+		if group.udptsPubSession != nil {
+			group.udptsPubSession.Dispose()
+			return true
+		}
+	} else if strings.HasPrefix(sessionID, base.UKPFLVPubSession) {
+		if group.httpflvPubSession != nil {
+			group.httpflvPubSession.Dispose()
+			return true
+		}
+	} else if strings.HasPrefix(sessionID, base.UKPTSPubSession) {
+		if group.httptsPubSession != nil {
+			group.httptsPubSession.Dispose()
+			return true
+		}
 	} else if strings.HasPrefix(sessionID, base.UKPFLVSubSession) {
 		// TODO chef: 考虑数据结构改成sessionIDzuokey的map
 		for s := range group.httpflvSubSessionSet {
@@ -631,6 +1096,14 @@ func (group *Group) KickOutSession(sessionID string) bool {
 				return true
 			}
 		}
+	} else if strings.HasPrefix(sessionID, base.UKPHLSSubSession) {
+		// hls.Server拒绝该播放者之后的请求，并回调删除
+		for s := range group.hlsSubSessionSet {
+			if s.UniqueKey == sessionID {
+				s.Dispose()
+				return true
+			}
+		}
 	} else if strings.HasPrefix(sessionID, base.UKPRTSPSubSession) {
 		// TODO chef: impl me
 	} else {
@@ -640,16 +1113,57 @@ func (group *Group) KickOutSession(sessionID string) bool {
 	return false
 }
 
-func (group *Group) delRTMPPubSession(session *rtmp.ServerSession) {
+// 踢掉当前的推流输入，拉流回源的输入不处理
+//
+// @param newUniqueKey 新的推流，只用于日志
+func (group *Group) kickPubSession(newUniqueKey string) {
+	if group.rtmpPubSession != nil {
+		group.Log().Warn("[%s] kick rtmp PubSession. old=%s, new=%s", group.UniqueKey, group.rtmpPubSession.UniqueKey, newUniqueKey)
+		old := group.rtmpPubSession
+		old.Dispose()
+		group.delRTMPPubSession(old)
+	} else if group.rtspPubSession != nil {
+		group.Log().Warn("[%s] kick rtsp PubSession. old=%s, new=%s", group.UniqueKey, group.rtspPubSession.UniqueKey, newUniqueKey)
+		group.delRTSPPubSession(group.rtspPubSession)
+	} else if group.udptsPubSession != nil {
+		group.Log().Warn("[%s] kick udp ts PubSession. old=%s, new=%s", group.UniqueKey, group.udptsPubSession.UniqueKey, newUniqueKey)
+		group.delUDPTSPubSession(group.udptsPubSession)
+	} else if group.httpflvPubSession != nil {
+		group.Log().Warn("[%s] kick httpflv PubSession. old=%s, new=%s", group.UniqueKey, group.httpflvPubSession.UniqueKey, newUniqueKey)
+		group.delHTTPFLVPubSession(group.httpflvPubSession)
+	} else if group.httptsPubSession != nil {
+		group.Log().Warn("[%s] kick httpts PubSession. old=%s, new=%s", group.UniqueKey, group.httptsPubSession.UniqueKey, newUniqueKey)
+		group.delHTTPTSPubSession(group.httptsPubSession)
+	}
+}
+
+func (group *Group) delRTMPPubSession(session *rtmp.ServerSession) (wasStandby bool, promoted *rtmp.ServerSession) {
 	group.Log().Debug("[%s] [%s] del rtmp PubSession from group.", group.UniqueKey, session.UniqueKey)
 
 	if session != group.rtmpPubSession {
+		for i, standby := range group.rtmpPubStandbyList {
+			if standby.session == session {
+				group.rtmpPubStandbyList = append(group.rtmpPubStandbyList[:i], group.rtmpPubStandbyList[i+1:]...)
+				return true, nil
+			}
+		}
 		group.Log().Warn("[%s] del rtmp pub session but not match. del session=%s, group session=%p", group.UniqueKey, session.UniqueKey, group.rtmpPubSession)
 		return
 	}
 
 	group.rtmpPubSession = nil
 	group.delIn()
+
+	// 切换到最早加入的备用推流
+	if len(group.rtmpPubStandbyList) != 0 {
+		standby := group.rtmpPubStandbyList[0]
+		group.rtmpPubStandbyList = group.rtmpPubStandbyList[1:]
+		group.Log().Info("[%s] switch to standby rtmp PubSession. session=%s", group.UniqueKey, standby.session.UniqueKey)
+		group.rtmpPubSession = standby.session
+		group.addIn()
+		return false, standby.session
+	}
+	return
 }
 
 func (group *Group) delRTSPPubSession(session *rtsp.PubSession) {
@@ -665,6 +1179,45 @@ func (group *Group) delRTSPPubSession(session *rtsp.PubSession) {
 	group.delIn()
 }
 
+func (group *Group) delUDPTSPubSession(session *udpts.PubSession) {
+	group.Log().Debug("[%s] [%s] del udp ts PubSession from group.", group.UniqueKey, session.UniqueKey)
+
+	if session != group.udptsPubSession {
+		group.Log().Warn("[%s] del udp ts pub session but not match. del session=%s, group session=%p", group.UniqueKey, session.UniqueKey, group.udptsPubSession)
+		return
+	}
+
+	_ = group.udptsPubSession.Dispose()
+	group.udptsPubSession = nil
+	group.delIn()
+}
+
+func (group *Group) delHTTPFLVPubSession(session *httpflv.PubSession) {
+	group.Log().Debug("[%s] [%s] del httpflv PubSession from group.", group.UniqueKey, session.UniqueKey)
+
+	if session != group.httpflvPubSession {
+		group.Log().Warn("[%s] del httpflv pub session but not match. del session=%s, group session=%p", group.UniqueKey, session.UniqueKey, group.httpflvPubSession)
+		return
+	}
+
+	group.httpflvPubSession.Dispose()
+	group.httpflvPubSession = nil
+	group.delIn()
+}
+
+func (group *Group) delHTTPTSPubSession(session *httpts.PubSession) {
+	group.Log().Debug("[%s] [%s] del httpts PubSession from group.", group.UniqueKey, session.UniqueKey)
+
+	if session != group.httptsPubSession {
+		group.Log().Warn("[%s] del httpts pub session but not match. del session=%s, group session=%p", group.UniqueKey, session.UniqueKey, group.httptsPubSession)
+		return
+	}
+
+	group.httptsPubSession.Dispose()
+	group.httptsPubSession = nil
+	group.delIn()
+}
+
 func (group *Group) delRTMPPullSession(session *rtmp.PullSession) {
 	group.Log().Debug("[%s] [%s] del rtmp PullSession from group.", group.UniqueKey, session.UniqueKey())
 
@@ -673,14 +1226,45 @@ func (group *Group) delRTMPPullSession(session *rtmp.PullSession) {
 	group.delIn()
 }
 
+func (group *Group) delHLSPullSession(session *hls.PullSession) {
+	group.Log().Debug("[%s] [%s] del hls PullSession from group.", group.UniqueKey, session.UniqueKey)
+
+	// 拉流失败时，session还没有加入group，也需要重置回源状态
+	group.pullProxy.isPulling = false
+	if session != group.pullProxy.hlsPullSession {
+		return
+	}
+	group.pullProxy.hlsPullSession = nil
+	group.delIn()
+}
+
 func (group *Group) delRTMPSubSession(session *rtmp.ServerSession) {
 	group.Log().Debug("[%s] [%s] del rtmp SubSession from group.", group.UniqueKey, session.UniqueKey)
 	delete(group.rtmpSubSessionSet, session)
+	group.delDVRSubscriber(session)
 }
 
 func (group *Group) delHTTPFLVSubSession(session *httpflv.SubSession) {
 	group.Log().Debug("[%s] [%s] del httpflv SubSession from group.", group.UniqueKey, session.UniqueKey)
 	delete(group.httpflvSubSessionSet, session)
+	group.delDVRSubscriber(session)
+}
+
+// 时移订阅者由独立的协程从DVRBuffer中读取数据发送，broadcastRTMP时跳过
+//
+// @param session rtmp或httpflv的sub session
+func (group *Group) addDVRSubscriber(session interface{}, uniqueKey string, offset time.Duration, write func(msg base.RTMPMsg) error) {
+	group.Log().Info("[%s] [%s] add dvr subscriber. offset=%v", group.UniqueKey, uniqueKey, offset)
+	sub := newDVRSubscriber(uniqueKey, group.dvr, offset, write)
+	group.dvrSubscriber[session] = sub
+	go sub.RunLoop()
+}
+
+func (group *Group) delDVRSubscriber(session interface{}) {
+	if sub, ok := group.dvrSubscriber[session]; ok {
+		sub.Stop()
+		delete(group.dvrSubscriber, session)
+	}
 }
 
 func (group *Group) delHTTPTSSubSession(session *httpts.SubSession) {
@@ -688,6 +1272,11 @@ func (group *Group) delHTTPTSSubSession(session *httpts.SubSession) {
 	delete(group.httptsSubSessionSet, session)
 }
 
+func (group *Group) delHLSSubSession(session *hls.SubSession) {
+	group.Log().Debug("[%s] [%s] del hls SubSession from group.", group.UniqueKey, session.UniqueKey)
+	delete(group.hlsSubSessionSet, session)
+}
+
 // TODO chef: 目前相当于其他类型往rtmp.AVMsg转了，考虑统一往一个通用类型转
 // @param msg 调用结束后，内部不持有msg.Payload内存块
 func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
@@ -699,9 +1288,12 @@ func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
 	//group.Log().Debug("[%s] broadcaseRTMP. header=%+v, %s", group.UniqueKey, msg.Header, hex.Dump(nazastring.SubSliceSafety(msg.Payload, 7)))
 
 	// # 0. hls
-	if config.HLSConfig.Enable && group.hlsMuxer != nil {
+	if group.hlsMuxer != nil {
 		group.hlsMuxer.FeedRTMPMessage(msg)
 	}
+	if group.dashMuxer != nil {
+		group.dashMuxer.FeedRTMPMessage(msg)
+	}
 
 	// # 1. 设置好用于发送的 rtmp 头部信息
 	currHeader := remux.MakeDefaultRTMPHeader(msg.Header)
@@ -715,6 +1307,9 @@ func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
 
 	// # 3. 广播。遍历所有 rtmp sub session，转发数据
 	for session := range group.rtmpSubSessionSet {
+		if _, ok := group.dvrSubscriber[session]; ok {
+			continue
+		}
 		// ## 3.1. 如果是新的 sub session，发送已缓存的信息
 		if session.IsFresh {
 			// TODO chef: 头信息和full gop也可以在SubSession刚加入时发送
@@ -769,12 +1364,16 @@ func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
 				v.pushSession.IsFresh = false
 			}
 
-			_ = v.pushSession.AsyncWrite(lcd.Get())
+			// 转推每路只有一个连接，使用连接自身的chunk header压缩节省带宽
+			_ = v.pushSession.WriteMsg(base.RTMPMsg{Header: currHeader, Payload: msg.Payload})
 		}
 	}
 
 	// # 4. 广播。遍历所有 httpflv sub session，转发数据
 	for session := range group.httpflvSubSessionSet {
+		if _, ok := group.dvrSubscriber[session]; ok {
+			continue
+		}
 		if session.IsFresh {
 			if group.httpflvGopCache.Metadata != nil {
 				session.WriteRawPacket(group.httpflvGopCache.Metadata)
@@ -798,20 +1397,29 @@ func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
 	}
 
 	// # 5. 缓存关键信息，以及gop
-	if config.RTMPConfig.Enable {
+	if config.RTMPConfig.Enable || config.RTMPConfig.EnableRTMPS {
 		group.gopCache.Feed(msg, lcd.Get)
 	}
+	if group.dvr != nil {
+		group.dvr.Feed(msg)
+	}
 	if config.HTTPFLVConfig.Enable {
 		group.httpflvGopCache.Feed(msg, lrm2ft.Get)
 	}
 
 	// # 6. 记录stat
+	group.updateAVStat(msg)
+}
+
+// 从seq header中记录音视频的编码格式以及分辨率
+// 注意，视频编码格式是否已经记录，需要检查VideoCodec而不是AudioCodec，否则先收到音频seq header的流不会记录视频编码格式
+func (group *Group) updateAVStat(msg base.RTMPMsg) {
 	if group.stat.AudioCodec == "" {
 		if msg.IsAACSeqHeader() {
 			group.stat.AudioCodec = base.AudioCodecAAC
 		}
 	}
-	if group.stat.AudioCodec == "" {
+	if group.stat.VideoCodec == "" {
 		if msg.IsAVCKeySeqHeader() {
 			group.stat.VideoCodec = base.VideoCodecAVC
 		}
@@ -843,6 +1451,20 @@ func (group *Group) broadcastRTMP(msg base.RTMPMsg) {
 			}
 		}
 	}
+	if msg.IsAACSeqHeader() {
+		if track, err := fmp4.NewAudioTrack(0, msg.Payload[2:]); err == nil {
+			group.stat.AudioCodecRFC6381 = track.Codec()
+		}
+	}
+	if msg.IsVideoKeySeqHeader() && len(msg.Payload) > 5 {
+		pt := base.AVPacketPTAVC
+		if msg.IsHEVCKeySeqHeader() {
+			pt = base.AVPacketPTHEVC
+		}
+		if track, err := fmp4.NewVideoTrack(0, pt, msg.Payload[5:], 0, 0); err == nil {
+			group.stat.VideoCodecRFC6381 = track.Codec()
+		}
+	}
 }
 
 func (group *Group) stopPullIfNeeded() {
@@ -850,6 +1472,10 @@ func (group *Group) stopPullIfNeeded() {
 		group.Log().Info("[%s] stop pull since no sub session.", group.UniqueKey)
 		group.pullProxy.pullSession.Dispose()
 	}
+	if group.pullProxy.hlsPullSession != nil && !group.hasOutSession() {
+		group.Log().Info("[%s] stop pull since no sub session.", group.UniqueKey)
+		group.pullProxy.hlsPullSession.Dispose()
+	}
 }
 
 func (group *Group) pullIfNeeded() {
@@ -870,10 +1496,17 @@ func (group *Group) pullIfNeeded() {
 
 	group.Log().Info("[%s] start relay pull. url=%s", group.UniqueKey, group.pullURL)
 
+	if isHLSURL(group.pullURL) {
+		go group.runHLSPull(group.pullURL)
+		return
+	}
+
 	go func() {
 		pullSession := rtmp.NewPullSession(func(option *rtmp.PullSessionOption) {
 			option.PullTimeoutMS = relayPullTimeoutMS
 			option.ReadAVTimeoutMS = relayPullReadAVTimeoutMS
+			// 回源时与作为服务端时使用相同的握手校验策略
+			option.StrictHandshake = config.RTMPConfig.StrictHandshake
 		})
 		err := pullSession.Pull(group.pullURL, group.OnReadRTMPAVMsg)
 		if err != nil {
@@ -892,13 +1525,57 @@ func (group *Group) pullIfNeeded() {
 	}()
 }
 
+func (group *Group) runHLSPull(url string) {
+	pullSession := hls.NewPullSession(group.log, func(option *hls.PullSessionOption) {
+		option.FetchTimeoutMS = relayPullTimeoutMS
+	})
+	// 先加入group再开始拉流，避免丢失拉流协程中回调的音视频参数
+	if !group.AddHLSPullSession(pullSession) {
+		group.DelHLSPullSession(pullSession)
+		return
+	}
+	err := pullSession.Pull(url, func(asc, vps, sps, pps []byte) {
+		group.mutex.Lock()
+		defer group.mutex.Unlock()
+		if group.pullProxy.hlsPullSession != pullSession {
+			return
+		}
+		group.OnAVConfig(asc, vps, sps, pps)
+	}, func(pkt base.AVPacket) {
+		group.mutex.Lock()
+		defer group.mutex.Unlock()
+		if group.pullProxy.hlsPullSession != pullSession {
+			return
+		}
+		group.OnAVPacket(pkt)
+	})
+	if err != nil {
+		group.Log().Error("[%s] relay pull fail. err=%v", pullSession.UniqueKey, err)
+		group.DelHLSPullSession(pullSession)
+		return
+	}
+	err = <-pullSession.Wait()
+	group.Log().Info("[%s] relay pull done. err=%v", pullSession.UniqueKey, err)
+	pullSession.Dispose()
+	group.DelHLSPullSession(pullSession)
+}
+
+// 回源地址的路径以.m3u8结尾时，使用HLS回源
+func isHLSURL(url string) bool {
+	if i := strings.IndexByte(url, '?'); i != -1 {
+		url = url[:i]
+	}
+	return strings.HasSuffix(url, ".m3u8")
+}
+
 func (group *Group) pushIfNeeded() {
 	// push转推功能没开
 	if !config.RelayPushConfig.Enable {
 		return
 	}
 	// 没有pub发布者
-	if group.rtmpPubSession == nil && group.rtspPubSession == nil {
+	if group.rtmpPubSession == nil && group.rtspPubSession == nil && group.udptsPubSession == nil &&
+		group.httpflvPubSession == nil && group.httptsPubSession == nil {
 		return
 	}
 
@@ -926,6 +1603,7 @@ func (group *Group) pushIfNeeded() {
 			pushSession := rtmp.NewPushSession(func(option *rtmp.PushSessionOption) {
 				option.PushTimeoutMS = relayPushTimeoutMS
 				option.WriteAVTimeoutMS = relayPushWriteAVTimeoutMS
+				option.StrictHandshake = config.RTMPConfig.StrictHandshake
 			})
 			err := pushSession.Push(u2)
 			if err != nil {
@@ -941,6 +1619,14 @@ func (group *Group) pushIfNeeded() {
 	}
 }
 
+// @param addr 为host:port时使用rtmp，也可以带上scheme，比如rtmps://host:port
+func relayPushURL(addr string, appName string, streamName string) string {
+	if strings.Contains(addr, "://") {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(addr, "/"), appName, streamName)
+	}
+	return fmt.Sprintf("rtmp://%s/%s/%s", addr, appName, streamName)
+}
+
 func (group *Group) hasPushSession() bool {
 	for _, item := range group.url2PushProxy {
 		if item.isPushing || item.pushSession != nil {
@@ -954,34 +1640,55 @@ func (group *Group) isTotalEmpty() bool {
 	return group.rtmpPubSession == nil &&
 		len(group.rtmpSubSessionSet) == 0 &&
 		group.rtspPubSession == nil &&
+		group.udptsPubSession == nil &&
+		group.httpflvPubSession == nil &&
+		group.httptsPubSession == nil &&
 		len(group.httpflvSubSessionSet) == 0 &&
+		len(group.dvrSubscriber) == 0 &&
 		len(group.httptsSubSessionSet) == 0 &&
 		len(group.rtspSubSessionSet) == 0 &&
+		len(group.hlsSubSessionSet) == 0 &&
 		group.hlsMuxer == nil &&
+		group.dashMuxer == nil &&
 		!group.hasPushSession() &&
-		group.pullProxy.pullSession == nil
+		group.pullProxy.pullSession == nil &&
+		group.pullProxy.hlsPullSession == nil
 }
 
 func (group *Group) hasInSession() bool {
 	return group.rtmpPubSession != nil ||
 		group.rtspPubSession != nil ||
-		group.pullProxy.pullSession != nil
+		group.udptsPubSession != nil ||
+		group.httpflvPubSession != nil ||
+		group.httptsPubSession != nil ||
+		group.pullProxy.pullSession != nil ||
+		group.pullProxy.hlsPullSession != nil
 }
 
 func (group *Group) hasOutSession() bool {
 	return len(group.rtmpSubSessionSet) != 0 ||
+		len(group.dvrSubscriber) != 0 ||
 		len(group.httpflvSubSessionSet) != 0 ||
 		len(group.httptsSubSessionSet) != 0 ||
-		len(group.rtspSubSessionSet) != 0
+		len(group.rtspSubSessionSet) != 0 ||
+		len(group.hlsSubSessionSet) != 0
 }
 
 func (group *Group) addIn() {
-	if config.HLSConfig.Enable {
+	// udp ts推送也使用hls.Muxer生成的TS流
+	if config.HLSConfig.Enable || len(group.addr2UDPTSPushSession) != 0 {
 		if group.hlsMuxer != nil {
 			group.Log().Error("[%s] hls muxer exist while addIn. muxer=%+v", group.UniqueKey, group.hlsMuxer)
 		}
-		group.hlsMuxer = hls.NewMuxer(group.streamName, &config.HLSConfig.MuxerConfig, group, group.log)
-		group.hlsMuxer.Start()
+		group.startHLSMuxer()
+	}
+
+	if config.DASHConfig.Enable {
+		if group.dashMuxer != nil {
+			group.Log().Error("[%s] dash muxer exist while addIn. muxer=%+v", group.UniqueKey, group.dashMuxer)
+		}
+		group.dashMuxer = dash.NewMuxer(group.streamName, &config.DASHConfig.MuxerConfig, group.log)
+		group.dashMuxer.Start()
 	}
 
 	if config.RelayPushConfig.Enable {
@@ -990,9 +1697,12 @@ func (group *Group) addIn() {
 }
 
 func (group *Group) delIn() {
-	if config.HLSConfig.Enable && group.hlsMuxer != nil {
+	if group.hlsMuxer != nil {
 		group.disposeHLSMuxer()
 	}
+	if group.dashMuxer != nil {
+		group.disposeDASHMuxer()
+	}
 
 	if config.RelayPushConfig.Enable {
 		for _, v := range group.url2PushProxy {
@@ -1005,14 +1715,39 @@ func (group *Group) delIn() {
 
 	group.gopCache.Clear()
 	group.httpflvGopCache.Clear()
+	// 时移数据保留，推流重连后接着缓存
+	if group.dvr != nil {
+		group.dvr.Discontinue()
+	}
+}
+
+func (group *Group) startHLSMuxer() {
+	group.hlsMuxer = hls.NewMuxer(group.streamName, &config.HLSConfig.MuxerConfig, group, group.log)
+	group.hlsMuxer.SetAppName(group.appName)
+	group.hlsMuxer.SetEventObserver(sm)
+	group.hlsMuxer.Start()
+}
+
+func (group *Group) addUDPTSPush(c udpts.PushConfig) error {
+	if old, ok := group.addr2UDPTSPushSession[c.Addr]; ok {
+		old.Dispose()
+		delete(group.addr2UDPTSPushSession, c.Addr)
+	}
+	session := udpts.NewPushSession(group.appName, group.streamName, c, group.log)
+	if err := session.Start(); err != nil {
+		return err
+	}
+	group.Log().Debug("[%s] [%s] add udp ts PushSession into group.", group.UniqueKey, session.UniqueKey)
+	group.addr2UDPTSPushSession[c.Addr] = session
+	return nil
 }
 
 func (group *Group) disposeHLSMuxer() {
 	if group.hlsMuxer != nil {
 		group.hlsMuxer.Dispose()
 
-		// 添加延时任务，删除HLS文件
-		if config.HLSConfig.Enable && config.HLSConfig.CleanupFlag {
+		// 添加延时任务，删除HLS文件，内存模式时总是释放内存
+		if config.HLSConfig.Enable && (config.HLSConfig.CleanupFlag || config.HLSConfig.InMemory) {
 			defertaskthread.Go(
 				config.HLSConfig.FragmentDurationMS*config.HLSConfig.FragmentNum*2,
 				func(param ...interface{}) {
@@ -1027,6 +1762,12 @@ func (group *Group) disposeHLSMuxer() {
 						}
 					}
 
+					if config.HLSConfig.InMemory {
+						group.Log().Info("cleanup hls memory stream. streamName=%s", streamName)
+						hls.RemoveMemoryStream(outPath)
+						return
+					}
+
 					group.Log().Info("cleanup hls file path. streamName=%s, path=%s", streamName, outPath)
 					if err := os.RemoveAll(outPath); err != nil {
 						group.Log().Warn("cleanup hls file path error. path=%s, err=%+v", outPath, err)
@@ -1042,6 +1783,39 @@ func (group *Group) disposeHLSMuxer() {
 	}
 }
 
+func (group *Group) disposeDASHMuxer() {
+	group.dashMuxer.Dispose()
+
+	// 添加延时任务，删除DASH文件
+	if config.DASHConfig.CleanupFlag {
+		defertaskthread.Go(
+			config.DASHConfig.FragmentDurationMS*config.DASHConfig.FragmentNum*2,
+			func(param ...interface{}) {
+				appName := param[0].(string)
+				streamName := param[1].(string)
+				outPath := param[2].(string)
+
+				if g := sm.getGroup(appName, streamName); g != nil {
+					if g.IsDASHMuxerAlive() {
+						group.Log().Warn("cancel cleanup dash file path since dash muxer still alive. streamName=%s", streamName)
+						return
+					}
+				}
+
+				group.Log().Info("cleanup dash file path. streamName=%s, path=%s", streamName, outPath)
+				if err := os.RemoveAll(outPath); err != nil {
+					group.Log().Warn("cleanup dash file path error. path=%s, err=%+v", outPath, err)
+				}
+			},
+			group.appName,
+			group.streamName,
+			group.dashMuxer.OutPath(),
+		)
+	}
+
+	group.dashMuxer = nil
+}
+
 // TODO chef: 后续看是否有更合适的方法判断
 func (group *Group) isHEVC() bool {
 	return group.vps != nil
@@ -0,0 +1,132 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"net"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/hls"
+	"github.com/souliot/siot-av/pkg/httpflv"
+	"github.com/souliot/siot-av/pkg/rtmp"
+)
+
+func TestGroupRTMPPubStandby(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{}
+	config.RTMPConfig.PubConflictPolicy = PubConflictPolicyKeep
+
+	newSession := func() *rtmp.ServerSession {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		return rtmp.NewServerSession(nil, c1, log.DefaultBeeLogger)
+	}
+	group := NewGroup("live", "test", false, "", log.DefaultBeeLogger)
+	s1, s2, s3 := newSession(), newSession(), newSession()
+
+	standby, err := group.AddRTMPPubSession(s1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, standby)
+	standby, err = group.AddRTMPPubSession(s2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, standby)
+	standby, err = group.AddRTMPPubSession(s3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, standby)
+
+	// 备用推流断开，不影响当前推流
+	wasStandby, promoted := group.DelRTMPPubSession(s3)
+	assert.Equal(t, true, wasStandby)
+	assert.Equal(t, (*rtmp.ServerSession)(nil), promoted)
+
+	// 当前推流断开，切换到备用推流
+	wasStandby, promoted = group.DelRTMPPubSession(s1)
+	assert.Equal(t, false, wasStandby)
+	assert.Equal(t, s2, promoted)
+
+	wasStandby, promoted = group.DelRTMPPubSession(s2)
+	assert.Equal(t, false, wasStandby)
+	assert.Equal(t, (*rtmp.ServerSession)(nil), promoted)
+	assert.Equal(t, false, group.HasInSession())
+}
+
+// kick策略下，rtmp推流可以踢掉其他协议的推流
+func TestGroupRTMPPubKick(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{}
+	config.RTMPConfig.PubConflictPolicy = PubConflictPolicyKick
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	group := NewGroup("live", "test", false, "", log.DefaultBeeLogger)
+	old := httpflv.NewPubSession(c1, "http", log.DefaultBeeLogger)
+	assert.Equal(t, true, group.AddHTTPFLVPubSession(old))
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	session := rtmp.NewServerSession(nil, c3, log.DefaultBeeLogger)
+	standby, err := group.AddRTMPPubSession(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, standby)
+	assert.Equal(t, (*httpflv.PubSession)(nil), group.httpflvPubSession)
+	assert.Equal(t, session, group.rtmpPubSession)
+
+	// 未知的策略按reject处理
+	config.RTMPConfig.PubConflictPolicy = "foo"
+	c5, c6 := net.Pipe()
+	defer c6.Close()
+	_, err = group.AddRTMPPubSession(rtmp.NewServerSession(nil, c5, log.DefaultBeeLogger))
+	assert.IsNotNil(t, err)
+	assert.Equal(t, session, group.rtmpPubSession)
+}
+
+func TestGroupKickOutHLSSubSession(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{}
+
+	group := NewGroup("live", "test", false, "", log.DefaultBeeLogger)
+	session := hls.NewSubSession("sid", "live", "test", "", "", "", log.DefaultBeeLogger)
+	group.AddHLSSubSession(session)
+	assert.Equal(t, false, group.KickOutSession("HLSSUB_notexist"))
+	assert.Equal(t, true, group.KickOutSession(session.UniqueKey))
+}
+
+// 先收到音频seq header的流，也需要记录视频的编码格式
+func TestGroupUpdateAVStat(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{}
+
+	group := NewGroup("live", "test", false, "", log.DefaultBeeLogger)
+	group.updateAVStat(base.RTMPMsg{
+		Header:  base.RTMPHeader{MsgTypeID: base.RTMPTypeIDAudio},
+		Payload: []byte{0xaf, 0x00, 0x12, 0x10},
+	})
+	group.updateAVStat(base.RTMPMsg{
+		Header: base.RTMPHeader{MsgTypeID: base.RTMPTypeIDVideo},
+		Payload: []byte{
+			0x17, 0x00, 0x00, 0x00, 0x00,
+			0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x1a,
+			0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00,
+			0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+			0x01, 0x00, 0x06, 0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0,
+		},
+	})
+	stat := group.GetStat()
+	assert.Equal(t, base.AudioCodecAAC, stat.AudioCodec)
+	assert.Equal(t, base.VideoCodecAVC, stat.VideoCodec)
+	assert.Equal(t, "mp4a.40.2", stat.AudioCodecRFC6381)
+	assert.Equal(t, "avc1.64001f", stat.VideoCodecRFC6381)
+}
@@ -0,0 +1,63 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"net/url"
+
+	"github.com/souliot/naza/pkg/nazamd5"
+	"github.com/souliot/siot-av/pkg/hls"
+)
+
+const hlsAuthTokenParam = "token"
+
+func genHLSAuthToken(secret string, streamName string) string {
+	return nazamd5.MD5([]byte(secret + streamName))
+}
+
+// @return 没有开启鉴权时返回true
+func checkHLSPlayAuth(hlsConfig HLSConfig, info hls.AuthInfo) bool {
+	if !hlsConfig.Auth.Enable {
+		return true
+	}
+	query, err := url.ParseQuery(info.URLParam)
+	if err != nil {
+		return false
+	}
+	token := query.Get(hlsAuthTokenParam)
+	if token == "" {
+		return false
+	}
+	if token == genHLSAuthToken(hlsConfig.Auth.Secret, info.StreamName) {
+		return true
+	}
+	if name, ok := abrNameOf(hlsConfig.ABR, info.StreamName); ok {
+		return token == genHLSAuthToken(hlsConfig.Auth.Secret, name)
+	}
+	return false
+}
+
+// @return name 流所属的ABR组合后的名称
+// @return ok   流不属于任何ABR组合时为false
+func abrNameOf(abr ABRConfig, streamName string) (name string, ok bool) {
+	if !abr.Enable {
+		return "", false
+	}
+	for _, ladder := range abr.Ladders {
+		for _, sn := range ladder.StreamNames {
+			if sn == streamName {
+				return ladder.Name, true
+			}
+		}
+	}
+	if abr.Separator == "" {
+		return "", false
+	}
+	return parseABRName(streamName, abr.Separator)
+}
@@ -0,0 +1,41 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/siot-av/pkg/hls"
+)
+
+func TestCheckHLSPlayAuth(t *testing.T) {
+	var hlsConfig HLSConfig
+	info := hls.AuthInfo{StreamName: "test", FileName: "playlist.m3u8"}
+
+	// 默认不开启
+	assert.Equal(t, true, checkHLSPlayAuth(hlsConfig, info))
+
+	hlsConfig.Auth = HLSAuthConfig{Enable: true, Secret: "abc"}
+	token := genHLSAuthToken("abc", "test")
+	assert.Equal(t, "f7dc2e1937940bb8486274edc88cc3c5", token)
+	assert.Equal(t, false, checkHLSPlayAuth(hlsConfig, info))
+	info.URLParam = "token=" + genHLSAuthToken("abc", "other")
+	assert.Equal(t, false, checkHLSPlayAuth(hlsConfig, info))
+	info.URLParam = "hls_sid=1&token=" + token
+	assert.Equal(t, true, checkHLSPlayAuth(hlsConfig, info))
+
+	// ABR各码率的m3u8沿用master m3u8的token
+	info.StreamName = "test_720"
+	assert.Equal(t, false, checkHLSPlayAuth(hlsConfig, info))
+	hlsConfig.ABR = ABRConfig{Enable: true, Separator: "_"}
+	assert.Equal(t, true, checkHLSPlayAuth(hlsConfig, info))
+	hlsConfig.ABR = ABRConfig{Enable: true, Ladders: []ABRLadder{{Name: "test", StreamNames: []string{"test_720"}}}}
+	assert.Equal(t, true, checkHLSPlayAuth(hlsConfig, info))
+}
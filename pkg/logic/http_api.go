@@ -12,6 +12,8 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/souliot/naza/pkg/nazahttp"
@@ -28,21 +30,46 @@ type HTTPAPIServerObserver interface {
 	OnStatGroup(streamName string) *base.StatGroup
 	OnCtrlStartPull(info base.APICtrlStartPullReq)
 	OnCtrlKickOutSession(info base.APICtrlKickOutSession) base.HTTPResponseBasic
+	OnCtrlStartUDPTSPush(info base.APICtrlStartUDPTSPushReq) base.HTTPResponseBasic
+	OnCtrlStopUDPTSPush(info base.APICtrlStopUDPTSPushReq) base.HTTPResponseBasic
+
+	// @param streamName 为空时返回所有有录制的流
+	//
+	OnRecordList(streamName string) ([]base.RecordStream, error)
+
+	// @param reqHost 请求的Host，record_url_prefix为空时，用于生成切片URI的前缀
+	//
+	OnRecordPlaylist(streamName string, start time.Time, end time.Time, iframe bool, reqHost string) ([]byte, error)
+	OnRecordMasterPlaylist(streamName string, start time.Time, end time.Time, playlistURI string, iframePlaylistURI string) ([]byte, error)
 }
 
 type HTTPAPIServer struct {
 	addr     string
 	observer HTTPAPIServerObserver
 	ln       net.Listener
+	mux      *http.ServeMux
 	log      log.Logger
 }
 
 func NewHTTPAPIServer(addr string, observer HTTPAPIServerObserver, logger log.Logger) *HTTPAPIServer {
 	logger.WithPrefix("pkg.logic.http_api")
-	return &HTTPAPIServer{
+	h := &HTTPAPIServer{
 		addr:     addr,
 		observer: observer,
+		mux:      http.NewServeMux(),
 	}
+	h.mux.HandleFunc("/api/list", h.apiListHandler)
+	h.mux.HandleFunc("/api/stat/lal_info", h.statLALInfoHandler)
+	h.mux.HandleFunc("/api/stat/group", h.statGroupHandler)
+	h.mux.HandleFunc("/api/stat/all_group", h.statAllGroupHandler)
+	h.mux.HandleFunc("/api/ctrl/start_pull", h.ctrlStartPullHandler)
+	h.mux.HandleFunc("/api/ctrl/kick_out_session", h.ctrlKickOutSessionHandler)
+	h.mux.HandleFunc("/api/ctrl/start_udp_ts_push", h.ctrlStartUDPTSPushHandler)
+	h.mux.HandleFunc("/api/ctrl/stop_udp_ts_push", h.ctrlStopUDPTSPushHandler)
+	h.mux.HandleFunc("/api/record/list", h.recordListHandler)
+	h.mux.HandleFunc("/api/record/playlist", h.recordPlaylistHandler)
+	h.mux.HandleFunc("/api/record/master", h.recordMasterHandler)
+	return h
 }
 func (s *HTTPAPIServer) Log() log.Logger {
 	if s.log == nil {
@@ -51,7 +78,15 @@ func (s *HTTPAPIServer) Log() log.Logger {
 	s.log.WithPrefix("pkg.logic.http_api")
 	return s.log
 }
+// 需要在Listen之前调用，设置后不再监听addr
+func (h *HTTPAPIServer) SetListener(ln net.Listener) {
+	h.ln = ln
+}
+
 func (h *HTTPAPIServer) Listen() (err error) {
+	if h.ln != nil {
+		return
+	}
 	if h.ln, err = net.Listen("tcp", h.addr); err != nil {
 		return
 	}
@@ -60,20 +95,16 @@ func (h *HTTPAPIServer) Listen() (err error) {
 }
 
 func (h *HTTPAPIServer) Runloop() error {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/api/list", h.apiListHandler)
-	mux.HandleFunc("/api/stat/lal_info", h.statLALInfoHandler)
-	mux.HandleFunc("/api/stat/group", h.statGroupHandler)
-	mux.HandleFunc("/api/stat/all_group", h.statAllGroupHandler)
-	mux.HandleFunc("/api/ctrl/start_pull", h.ctrlStartPullHandler)
-	mux.HandleFunc("/api/ctrl/kick_out_session", h.ctrlKickOutSessionHandler)
-
 	var srv http.Server
-	srv.Handler = mux
+	srv.Handler = h
 	return srv.Serve(h.ln)
 }
 
+// 挂载到外部的http.Server时使用
+func (h *HTTPAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
 // TODO chef: dispose
 
 func (h *HTTPAPIServer) apiListHandler(w http.ResponseWriter, req *http.Request) {
@@ -90,6 +121,10 @@ func (h *HTTPAPIServer) apiListHandler(w http.ResponseWriter, req *http.Request)
 	<li><a href="/api/stat/group?stream_name=test110">/api/stat/group?stream_name=test110</a></li>
 	<li><a href="/api/stat/all_group">/api/stat/all_group</a></li>
 	<li><a href="/api/stat/lal_info">/api/stat/lal_info</a></li>
+	<li><a href="/api/record/list?stream_name=test110">/api/record/list?stream_name=test110</a></li>
+	<li><a href="/api/record/playlist?stream_name=test110&start=2020-12-01T14:00:00%2B08:00&end=2020-12-01T14:20:00%2B08:00">/api/record/playlist?stream_name=test110&start=2020-12-01T14:00:00+08:00&end=2020-12-01T14:20:00+08:00</a></li>
+	<li><a href="/api/record/playlist?stream_name=test110&start=2020-12-01T14:00:00%2B08:00&end=2020-12-01T14:20:00%2B08:00&type=iframe">/api/record/playlist?stream_name=test110&start=2020-12-01T14:00:00+08:00&end=2020-12-01T14:20:00+08:00&type=iframe</a></li>
+	<li><a href="/api/record/master?stream_name=test110&start=2020-12-01T14:00:00%2B08:00&end=2020-12-01T14:20:00%2B08:00">/api/record/master?stream_name=test110&start=2020-12-01T14:00:00+08:00&end=2020-12-01T14:20:00+08:00</a></li>
 	<li><a href="/api/ctrl/start_pull?protocol=rtmp&addr=127.0.0.1:1935&app_name=live&stream_name=test110&url_param=token=aaa">/api/ctrl/start_pull?protocol=rtmp&addr=127.0.0.1:1935&app_name=live&stream_name=test110&url_param=token=aaa</a></li>
 </ul>
 <br>
@@ -194,6 +229,142 @@ func (h *HTTPAPIServer) ctrlKickOutSessionHandler(w http.ResponseWriter, req *ht
 	return
 }
 
+func (h *HTTPAPIServer) ctrlStartUDPTSPushHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.HTTPResponseBasic
+	var info base.APICtrlStartUDPTSPushReq
+
+	err := nazahttp.UnmarshalRequestJsonBody(req, &info, "stream_name", "addr")
+	if err != nil {
+		h.Log().Warn("http api start udp ts push error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+	h.Log().Info("http api start udp ts push. req info=%+v", info)
+
+	resp := h.observer.OnCtrlStartUDPTSPush(info)
+	feedback(resp, w)
+	return
+}
+
+func (h *HTTPAPIServer) ctrlStopUDPTSPushHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.HTTPResponseBasic
+	var info base.APICtrlStopUDPTSPushReq
+
+	err := nazahttp.UnmarshalRequestJsonBody(req, &info, "stream_name", "addr")
+	if err != nil {
+		h.Log().Warn("http api stop udp ts push error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+	h.Log().Info("http api stop udp ts push. req info=%+v", info)
+
+	resp := h.observer.OnCtrlStopUDPTSPush(info)
+	feedback(resp, w)
+	return
+}
+
+func (h *HTTPAPIServer) recordListHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.APIRecordList
+
+	streams, err := h.observer.OnRecordList(req.URL.Query().Get("stream_name"))
+	if err != nil {
+		v.ErrorCode = base.ErrorCodeRecordNotFound
+		v.Desp = base.DespRecordNotFound
+		feedback(v, w)
+		return
+	}
+
+	v.ErrorCode = base.ErrorCodeSucc
+	v.Desp = base.DespSucc
+	v.Data.Streams = streams
+	feedback(v, w)
+}
+
+// 成功时返回点播m3u8，失败时返回json
+//
+// 参数type为iframe时返回I帧m3u8
+func (h *HTTPAPIServer) recordPlaylistHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.HTTPResponseBasic
+
+	q := req.URL.Query()
+	streamName := q.Get("stream_name")
+	start, end, ok := parseRecordTimeRange(q)
+	if streamName == "" || !ok {
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+
+	content, err := h.observer.OnRecordPlaylist(streamName, start, end, q.Get("type") == "iframe", req.Host)
+	if err != nil {
+		h.Log().Warn("http api record playlist error. streamName=%s, err=%+v", streamName, err)
+		v.ErrorCode = base.ErrorCodeRecordNotFound
+		v.Desp = base.DespRecordNotFound
+		feedback(v, w)
+		return
+	}
+	feedbackPlaylist(content, w)
+}
+
+// 成功时返回master m3u8，引用`/api/record/playlist`生成的点播m3u8以及I帧m3u8，失败时返回json
+func (h *HTTPAPIServer) recordMasterHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.HTTPResponseBasic
+
+	q := req.URL.Query()
+	streamName := q.Get("stream_name")
+	start, end, ok := parseRecordTimeRange(q)
+	if streamName == "" || !ok {
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+
+	// 使用相对路径，保留请求中的其他参数，比如鉴权
+	q.Del("type")
+	playlistURI := "playlist?" + q.Encode()
+	q.Set("type", "iframe")
+	iframePlaylistURI := "playlist?" + q.Encode()
+	content, err := h.observer.OnRecordMasterPlaylist(streamName, start, end, playlistURI, iframePlaylistURI)
+	if err != nil {
+		h.Log().Warn("http api record master playlist error. streamName=%s, err=%+v", streamName, err)
+		v.ErrorCode = base.ErrorCodeRecordNotFound
+		v.Desp = base.DespRecordNotFound
+		feedback(v, w)
+		return
+	}
+	feedbackPlaylist(content, w)
+}
+
+func parseRecordTimeRange(q url.Values) (start time.Time, end time.Time, ok bool) {
+	start, err1 := parseRecordTime(q.Get("start"))
+	end, err2 := parseRecordTime(q.Get("end"))
+	return start, end, err1 == nil && err2 == nil && end.After(start)
+}
+
+// 支持Unix时间戳（秒），RFC3339（比如`2020-12-01T14:00:00+08:00`），以及本地时间`2020-12-01 14:00:00`
+func parseRecordTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+}
+
+func feedbackPlaylist(content []byte, w http.ResponseWriter) {
+	w.Header().Add("Server", base.LALHTTPAPIServer)
+	w.Header().Add("Content-Type", "application/x-mpegurl")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(content)
+}
+
 func feedback(v interface{}, w http.ResponseWriter) {
 	resp, _ := json.Marshal(v)
 	w.Header().Add("Server", base.LALHTTPAPIServer)
@@ -81,6 +81,22 @@ func (h *HTTPNotify) OnRTMPConnect(info base.RTMPConnectInfo) {
 	h.asyncPost(config.HTTPNotifyConfig.OnRTMPConnect, info)
 }
 
+func (h *HTTPNotify) OnHLSPurge(info base.HLSPurgeInfo) {
+	h.asyncPost(config.HTTPNotifyConfig.OnHLSPurge, info)
+}
+
+func (h *HTTPNotify) OnHLSUploadFail(info base.HLSUploadFailInfo) {
+	h.asyncPost(config.HTTPNotifyConfig.OnHLSUploadFail, info)
+}
+
+func (h *HTTPNotify) OnHLSMakeTS(info base.HLSMakeTSInfo) {
+	h.asyncPost(config.HTTPNotifyConfig.OnHLSMakeTS, info)
+}
+
+func (h *HTTPNotify) OnHLSMakeM3U8(info base.HLSMakeM3U8Info) {
+	h.asyncPost(config.HTTPNotifyConfig.OnHLSMakeM3U8, info)
+}
+
 func (h *HTTPNotify) RunLoop() {
 	for {
 		select {
@@ -0,0 +1,194 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/souliot/naza/pkg/log"
+)
+
+// httpflv、httpts、hls以及http api共用一个http监听端口（以及一个https监听端口），按URL路径的前缀分发
+//
+// HTTPServer本身是一个http.Handler，也可以不监听，挂载到外部的http.Server上，见HTTPHandler
+
+const (
+	defaultHTTPFLVPrefix = "/"
+	defaultHTTPTSPrefix  = "/"
+	defaultHLSPrefix     = "/hls/"
+	defaultHTTPAPIPrefix = "/api/"
+)
+
+type httpRoute struct {
+	prefix       string // 配置的前缀
+	nativePrefix string // handler原本处理的前缀，分发前将prefix替换为nativePrefix
+	suffix       string // 为空时不检查后缀
+	handler      http.Handler
+}
+
+func (r httpRoute) match(path string) bool {
+	return strings.HasPrefix(path, r.prefix) && strings.HasSuffix(path, r.suffix)
+}
+
+type HTTPServer struct {
+	config HTTPServerConfig
+
+	mutex  sync.RWMutex
+	routes []httpRoute
+
+	ln       net.Listener
+	httpsLn  net.Listener
+	srv      http.Server
+	httpsSrv http.Server
+	log      log.Logger
+}
+
+func NewHTTPServer(config HTTPServerConfig, logger log.Logger) *HTTPServer {
+	logger.WithPrefix("pkg.logic.http_server")
+	s := &HTTPServer{
+		config: config,
+		log:    logger,
+	}
+	// httpflv以及httpts的session需要Hijack连接，而HTTP/2不支持Hijack
+	s.httpsSrv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	s.srv.Handler = s
+	s.httpsSrv.Handler = s
+	return s
+}
+
+func (s *HTTPServer) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.logic.http_server")
+	return s.log
+}
+
+// @param prefix       配置的前缀，为空时使用nativePrefix
+// @param nativePrefix handler原本处理的前缀
+// @param suffix       为空时不检查后缀，比如httpflv为`.flv`
+func (s *HTTPServer) AddRoute(prefix string, nativePrefix string, suffix string, handler http.Handler) {
+	if prefix == "" {
+		prefix = nativePrefix
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes = append(s.routes, httpRoute{
+		prefix:       prefix,
+		nativePrefix: nativePrefix,
+		suffix:       suffix,
+		handler:      handler,
+	})
+	// 最长前缀优先，比如`/hls/`下的ts切片不会被前缀为`/`的httpts处理
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		return len(s.routes[i].prefix) > len(s.routes[j].prefix)
+	})
+}
+
+// 需要在Listen之前调用，设置后不再监听ListenAddr
+func (s *HTTPServer) SetListener(ln net.Listener) {
+	s.ln = ln
+}
+
+// 需要在Listen之前调用，设置后不再监听HTTPSAddr，注意，ln需要已经处理好TLS
+func (s *HTTPServer) SetHTTPSListener(ln net.Listener) {
+	s.httpsLn = ln
+}
+
+// ListenAddr以及HTTPSAddr都没有配置时，不监听，只作为http.Handler使用
+func (s *HTTPServer) Listen() (err error) {
+	if s.ln == nil && s.config.ListenAddr != "" {
+		if s.ln, err = net.Listen("tcp", s.config.ListenAddr); err != nil {
+			return
+		}
+		s.Log().Info("start http server listen. addr=%s", s.config.ListenAddr)
+	}
+
+	if s.httpsLn == nil && s.config.EnableHTTPS {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(s.config.HTTPSCertFile, s.config.HTTPSKeyFile); err != nil {
+			return
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if s.httpsLn, err = tls.Listen("tcp", s.config.HTTPSAddr, tlsConfig); err != nil {
+			return
+		}
+		s.Log().Info("start https server listen. addr=%s", s.config.HTTPSAddr)
+	}
+	return
+}
+
+func (s *HTTPServer) RunLoop() error {
+	errChan := make(chan error, 2)
+	var n int
+	if s.ln != nil {
+		n++
+		go func() {
+			errChan <- s.srv.Serve(s.ln)
+		}()
+	}
+	if s.httpsLn != nil {
+		n++
+		go func() {
+			errChan <- s.httpsSrv.Serve(s.httpsLn)
+		}()
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-errChan; e != nil && e != http.ErrServerClosed && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *HTTPServer) Dispose() {
+	if err := s.srv.Close(); err != nil {
+		s.Log().Error(err)
+	}
+	if err := s.httpsSrv.Close(); err != nil {
+		s.Log().Error(err)
+	}
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.RLock()
+	var route *httpRoute
+	for i := range s.routes {
+		if s.routes[i].match(req.URL.Path) {
+			r := s.routes[i]
+			route = &r
+			break
+		}
+	}
+	s.mutex.RUnlock()
+
+	if route == nil {
+		s.Log().Warn("no http route. path=%s", req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if route.prefix != route.nativePrefix {
+		r := new(http.Request)
+		*r = *req
+		u := *req.URL
+		u.Path = route.nativePrefix + strings.TrimPrefix(req.URL.Path, route.prefix)
+		u.RawPath = ""
+		r.URL = &u
+		req = r
+	}
+	route.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,69 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+// 回复handler的名称以及收到的路径
+type httpServerTestHandler string
+
+func (h httpServerTestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	_, _ = w.Write([]byte(string(h) + " " + req.URL.RequestURI()))
+}
+
+func TestHTTPServer(t *testing.T) {
+	s := NewHTTPServer(HTTPServerConfig{Enable: true}, log.DefaultBeeLogger)
+	s.AddRoute("", defaultHTTPFLVPrefix, ".flv", httpServerTestHandler("httpflv"))
+	s.AddRoute("", defaultHTTPTSPrefix, ".ts", httpServerTestHandler("httpts"))
+	s.AddRoute("/media/hls/", defaultHLSPrefix, "", httpServerTestHandler("hls"))
+	s.AddRoute("", defaultHTTPAPIPrefix, "", httpServerTestHandler("httpapi"))
+
+	golden := map[string]string{
+		"/live/test.flv?token=1":            "httpflv /live/test.flv?token=1",
+		"/live/test.ts":                     "httpts /live/test.ts",
+		"/media/hls/test/playlist.m3u8?a=1": "hls /hls/test/playlist.m3u8?a=1",
+		"/media/hls/test/test-1.ts":         "hls /hls/test/test-1.ts",
+		"/api/stat/all_group":               "httpapi /api/stat/all_group",
+	}
+	for uri, expected := range golden {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", uri, nil))
+		assert.Equal(t, 200, resp.Code, uri)
+		assert.Equal(t, expected, resp.Body.String(), uri)
+	}
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/live/test.mp4", nil))
+	assert.Equal(t, 404, resp.Code)
+
+	// 使用外部传入的Listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	s.SetListener(ln)
+	assert.Equal(t, nil, s.Listen())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.RunLoop()
+	}()
+	r, err := http.Get("http://" + ln.Addr().String() + "/live/test.flv")
+	assert.Equal(t, nil, err)
+	b, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	assert.Equal(t, "httpflv /live/test.flv", string(b))
+	s.Dispose()
+	assert.Equal(t, nil, <-done)
+}
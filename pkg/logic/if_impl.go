@@ -56,6 +56,10 @@ var _ rtmp.ServerObserver = &ServerManager{}
 var _ rtsp.ServerObserver = &ServerManager{}
 var _ httpflv.ServerObserver = &ServerManager{}
 var _ httpts.ServerObserver = &ServerManager{}
+var _ hls.JanitorObserver = &ServerManager{}
+var _ hls.UploaderObserver = &ServerManager{}
+var _ hls.MuxerEventObserver = &ServerManager{}
+var _ hls.ABRProvider = &ServerManager{}
 
 var _ HTTPAPIServerObserver = &ServerManager{}
 
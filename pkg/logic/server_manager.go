@@ -10,7 +10,10 @@ package logic
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,40 +24,70 @@ import (
 
 	"github.com/souliot/siot-av/pkg/rtsp"
 
+	"github.com/souliot/siot-av/pkg/dash"
 	"github.com/souliot/siot-av/pkg/hls"
 
 	"github.com/souliot/siot-av/pkg/httpflv"
 	"github.com/souliot/siot-av/pkg/rtmp"
+	"github.com/souliot/siot-av/pkg/udpts"
 )
 
 type ServerManager struct {
 	rtmpServer    *rtmp.Server
 	httpflvServer *httpflv.Server
 	hlsServer     *hls.Server
+	recordCatalog *hls.RecordCatalog
+	hlsJanitor    *hls.Janitor
+	hlsUploader   *hls.Uploader
+	dashServer    *dash.Server
 	httptsServer  *httpts.Server
 	rtspServer    *rtsp.Server
+	udptsServers  []*udpts.Server
 	httpAPIServer *HTTPAPIServer
+	httpServer    *HTTPServer // 开启http_server时不为nil
 	exitChan      chan struct{}
 
+	hlsEventObserver hls.MuxerEventObserver // 见SetHLSEventObserver
+
 	mutex    sync.Mutex
 	groupMap map[string]*Group // TODO chef: with appName
-	log      log.Logger
+	// 通过http api添加的UDP TS推送目标，key为streamName，value的key为目标地址
+	// group销毁后依然保留，重新创建group时再次添加
+	streamName2UDPTSPush map[string]map[string]udpts.PushConfig
+	log                  log.Logger
 }
 
 func NewServerManager(logger log.Logger) *ServerManager {
 	m := &ServerManager{
-		groupMap: make(map[string]*Group),
-		exitChan: make(chan struct{}),
-		log:      logger,
+		groupMap:             make(map[string]*Group),
+		streamName2UDPTSPush: make(map[string]map[string]udpts.PushConfig),
+		exitChan:             make(chan struct{}),
+		log:                  logger,
 	}
-	if config.RTMPConfig.Enable {
-		m.rtmpServer = rtmp.NewServer(m, config.RTMPConfig.Addr, logger)
+	if config.RTMPConfig.Enable || config.RTMPConfig.EnableRTMPS {
+		m.rtmpServer = rtmp.NewServer(m, config.RTMPConfig.ServerConfig, logger)
 	}
 	if config.HTTPFLVConfig.Enable || config.HTTPFLVConfig.EnableHTTPS {
 		m.httpflvServer = httpflv.NewServer(m, config.HTTPFLVConfig.ServerConfig, logger)
 	}
 	if config.HLSConfig.Enable {
 		m.hlsServer = hls.NewServer(config.HLSConfig.SubListenAddr, config.HLSConfig.OutPath, logger)
+		m.hlsServer.SetObserver(m)
+		m.hlsServer.SetSubSessionConfig(config.HLSConfig.SubSession)
+		if config.HLSConfig.ABR.Enable {
+			m.hlsServer.SetABRProvider(m)
+		}
+		m.recordCatalog = hls.NewRecordCatalog(config.HLSConfig.OutPath)
+		if config.HLSConfig.Janitor.Enable && !config.HLSConfig.InMemory {
+			m.hlsJanitor = hls.NewJanitor(config.HLSConfig.OutPath, config.HLSConfig.Janitor, m, logger)
+		}
+		if config.HLSConfig.S3.Enable {
+			m.hlsUploader = hls.NewUploader(config.HLSConfig.S3, m, logger)
+			hls.SetUploader(m.hlsUploader)
+		}
+	}
+	if config.DASHConfig.Enable {
+		m.dashServer = dash.NewServer(config.DASHConfig.SubListenAddr, config.DASHConfig.OutPath, logger)
 	}
 	if config.HTTPTSConfig.Enable {
 		m.httptsServer = httpts.NewServer(m, config.HTTPTSConfig.SubListenAddr, logger)
@@ -62,9 +95,30 @@ func NewServerManager(logger log.Logger) *ServerManager {
 	if config.RTSPConfig.Enable {
 		m.rtspServer = rtsp.NewServer(config.RTSPConfig.Addr, m, logger)
 	}
+	if config.UDPTSConfig.Enable {
+		for _, c := range config.UDPTSConfig.StreamList {
+			m.udptsServers = append(m.udptsServers, udpts.NewServer(m, c, logger))
+		}
+	}
 	if config.HTTPAPIConfig.Enable {
 		m.httpAPIServer = NewHTTPAPIServer(config.HTTPAPIConfig.Addr, m, logger)
 	}
+	if config.HTTPServerConfig.Enable {
+		c := config.HTTPServerConfig
+		m.httpServer = NewHTTPServer(c, logger)
+		if m.httpflvServer != nil {
+			m.httpServer.AddRoute(c.HTTPFLVPrefix, defaultHTTPFLVPrefix, ".flv", m.httpflvServer)
+		}
+		if m.httptsServer != nil {
+			m.httpServer.AddRoute(c.HTTPTSPrefix, defaultHTTPTSPrefix, ".ts", m.httptsServer)
+		}
+		if m.hlsServer != nil {
+			m.httpServer.AddRoute(c.HLSPrefix, defaultHLSPrefix, "", m.hlsServer)
+		}
+		if m.httpAPIServer != nil {
+			m.httpServer.AddRoute(c.HTTPAPIPrefix, defaultHTTPAPIPrefix, "", m.httpAPIServer)
+		}
+	}
 	m.log.WithPrefix("pkg.logic.server_manager")
 	return m
 }
@@ -90,7 +144,7 @@ func (sm *ServerManager) RunLoop() {
 		}()
 	}
 
-	if sm.httpflvServer != nil {
+	if sm.httpflvServer != nil && sm.httpServer == nil {
 		if err := sm.httpflvServer.Listen(); err != nil {
 			sm.Log().Error(err)
 			os.Exit(1)
@@ -102,7 +156,7 @@ func (sm *ServerManager) RunLoop() {
 		}()
 	}
 
-	if sm.httptsServer != nil {
+	if sm.httptsServer != nil && sm.httpServer == nil {
 		if err := sm.httptsServer.Listen(); err != nil {
 			sm.Log().Error(err)
 			os.Exit(1)
@@ -115,12 +169,35 @@ func (sm *ServerManager) RunLoop() {
 	}
 
 	if sm.hlsServer != nil {
-		if err := sm.hlsServer.Listen(); err != nil {
+		// 共用http_server时只作为http.Handler使用，不监听
+		if sm.httpServer == nil {
+			if err := sm.hlsServer.Listen(); err != nil {
+				sm.Log().Error(err)
+				os.Exit(1)
+			}
+		}
+		go func() {
+			if err := sm.hlsServer.RunLoop(); err != nil {
+				sm.Log().Error(err)
+			}
+		}()
+	}
+
+	if sm.hlsJanitor != nil {
+		go sm.hlsJanitor.RunLoop()
+	}
+
+	if sm.hlsUploader != nil {
+		go sm.hlsUploader.RunLoop()
+	}
+
+	if sm.dashServer != nil {
+		if err := sm.dashServer.Listen(); err != nil {
 			sm.Log().Error(err)
 			os.Exit(1)
 		}
 		go func() {
-			if err := sm.hlsServer.RunLoop(); err != nil {
+			if err := sm.dashServer.RunLoop(); err != nil {
 				sm.Log().Error(err)
 			}
 		}()
@@ -138,7 +215,19 @@ func (sm *ServerManager) RunLoop() {
 		}()
 	}
 
-	if sm.httpAPIServer != nil {
+	for _, server := range sm.udptsServers {
+		if err := server.Listen(); err != nil {
+			sm.Log().Error(err)
+			os.Exit(1)
+		}
+		go func(server *udpts.Server) {
+			if err := server.RunLoop(); err != nil {
+				sm.Log().Error(err)
+			}
+		}(server)
+	}
+
+	if sm.httpAPIServer != nil && sm.httpServer == nil {
 		if err := sm.httpAPIServer.Listen(); err != nil {
 			sm.Log().Error(err)
 			os.Exit(1)
@@ -150,6 +239,18 @@ func (sm *ServerManager) RunLoop() {
 		}()
 	}
 
+	if sm.httpServer != nil {
+		if err := sm.httpServer.Listen(); err != nil {
+			sm.Log().Error(err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := sm.httpServer.RunLoop(); err != nil {
+				sm.Log().Error(err)
+			}
+		}()
+	}
+
 	uis := uint32(config.HTTPNotifyConfig.UpdateIntervalSec)
 	var updateInfo base.UpdateInfo
 	updateInfo.ServerID = config.ServerID
@@ -203,6 +304,22 @@ func (sm *ServerManager) Dispose() {
 	if sm.hlsServer != nil {
 		sm.hlsServer.Dispose()
 	}
+	if sm.hlsJanitor != nil {
+		sm.hlsJanitor.Dispose()
+	}
+	if sm.hlsUploader != nil {
+		hls.SetUploader(nil)
+		sm.hlsUploader.Dispose()
+	}
+	if sm.dashServer != nil {
+		sm.dashServer.Dispose()
+	}
+	for _, server := range sm.udptsServers {
+		server.Dispose()
+	}
+	if sm.httpServer != nil {
+		sm.httpServer.Dispose()
+	}
 
 	sm.mutex.Lock()
 	for _, group := range sm.groupMap {
@@ -213,6 +330,33 @@ func (sm *ServerManager) Dispose() {
 	sm.exitChan <- struct{}{}
 }
 
+// 需要在RunLoop之前调用，开启http_server时，使用传入的Listener替代listen_addr以及https_addr，为nil时不替代
+func (sm *ServerManager) SetHTTPListener(ln net.Listener, httpsLn net.Listener) {
+	if sm.httpServer == nil {
+		sm.Log().Warn("http_server not enabled, ignore http listener.")
+		return
+	}
+	if ln != nil {
+		sm.httpServer.SetListener(ln)
+	}
+	if httpsLn != nil {
+		sm.httpServer.SetHTTPSListener(httpsLn)
+	}
+}
+
+// 需要在RunLoop之前调用，hls.Muxer的切片以及m3u8事件，除了http notify之外，也回调给observer
+func (sm *ServerManager) SetHLSEventObserver(observer hls.MuxerEventObserver) {
+	sm.hlsEventObserver = observer
+}
+
+// 开启http_server时，返回分发httpflv、httpts、hls以及http api请求的http.Handler，可以挂载到外部的http.Server上，否则返回nil
+func (sm *ServerManager) HTTPHandler() http.Handler {
+	if sm.httpServer == nil {
+		return nil
+	}
+	return sm.httpServer
+}
+
 func (sm *ServerManager) GetGroup(appName string, streamName string) *Group {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
@@ -221,7 +365,7 @@ func (sm *ServerManager) GetGroup(appName string, streamName string) *Group {
 }
 
 // ServerObserver of rtmp.Server
-func (sm *ServerManager) OnRTMPConnect(session *rtmp.ServerSession, opa rtmp.ObjectPairArray) {
+func (sm *ServerManager) OnRTMPConnect(session *rtmp.ServerSession, opa rtmp.ObjectPairArray) error {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
@@ -239,16 +383,34 @@ func (sm *ServerManager) OnRTMPConnect(session *rtmp.ServerSession, opa rtmp.Obj
 		info.TCURL = tcURL
 	}
 	httpNotify.OnRTMPConnect(info)
+
+	if redirect, ok := config.RTMPConfig.ConnectRedirect[info.App]; ok {
+		return &rtmp.StatusError{
+			Code:        rtmp.StatusCodeConnectRejected,
+			Description: "redirect",
+			Redirect:    redirect,
+		}
+	}
+	return nil
 }
 
 // ServerObserver of rtmp.Server
-func (sm *ServerManager) OnNewRTMPPubSession(session *rtmp.ServerSession) bool {
+func (sm *ServerManager) OnNewRTMPPubSession(session *rtmp.ServerSession) error {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 	group := sm.getOrCreateGroup(session.AppName(), session.StreamName())
-	res := group.AddRTMPPubSession(session)
+	standby, err := group.AddRTMPPubSession(session)
+	if err != nil {
+		return err
+	}
+	// 备用推流切换为当前推流时才通知
+	if !standby {
+		sm.notifyRTMPPubStart(group, session)
+	}
+	return nil
+}
 
-	// TODO chef: res值为false时，可以考虑不回调
+func (sm *ServerManager) notifyRTMPPubStart(group *Group, session *rtmp.ServerSession) {
 	// TODO chef: 每次赋值都逐个拼，代码冗余，考虑直接用ISession抽离一下代码
 	var info base.PubStartInfo
 	info.ServerID = config.ServerID
@@ -262,7 +424,6 @@ func (sm *ServerManager) OnNewRTMPPubSession(session *rtmp.ServerSession) bool {
 	info.HasInSession = group.HasInSession()
 	info.HasOutSession = group.HasOutSession()
 	httpNotify.OnPubStart(info)
-	return res
 }
 
 // ServerObserver of rtmp.Server
@@ -274,7 +435,11 @@ func (sm *ServerManager) OnDelRTMPPubSession(session *rtmp.ServerSession) {
 		return
 	}
 
-	group.DelRTMPPubSession(session)
+	wasStandby, promoted := group.DelRTMPPubSession(session)
+	// 没有切换为当前推流的备用推流，没有通知过开始，也不通知结束
+	if wasStandby {
+		return
+	}
 
 	var info base.PubStopInfo
 	info.ServerID = config.ServerID
@@ -288,6 +453,11 @@ func (sm *ServerManager) OnDelRTMPPubSession(session *rtmp.ServerSession) {
 	info.HasInSession = group.HasInSession()
 	info.HasOutSession = group.HasOutSession()
 	httpNotify.OnPubStop(info)
+
+	// 切换到备用推流
+	if promoted != nil {
+		sm.notifyRTMPPubStart(group, promoted)
+	}
 }
 
 // ServerObserver of rtmp.Server
@@ -384,6 +554,59 @@ func (sm *ServerManager) OnDelHTTPFLVSubSession(session *httpflv.SubSession) {
 	httpNotify.OnSubStop(info)
 }
 
+// ServerObserver of httpflv.Server
+func (sm *ServerManager) OnNewHTTPFLVPubSession(session *httpflv.PubSession) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if !config.HTTPFLVConfig.PubEnable {
+		sm.Log().Warn("[%s] httpflv pub not enabled, reject. streamName=%s", session.UniqueKey, session.StreamName())
+		return false
+	}
+	group := sm.getOrCreateGroup(session.AppName(), session.StreamName())
+	if !group.AddHTTPFLVPubSession(session) {
+		return false
+	}
+
+	var info base.PubStartInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHTTPFLV
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStart(info)
+	return true
+}
+
+// ServerObserver of httpflv.Server
+func (sm *ServerManager) OnDelHTTPFLVPubSession(session *httpflv.PubSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getGroup(session.AppName(), session.StreamName())
+	if group == nil {
+		return
+	}
+
+	group.DelHTTPFLVPubSession(session)
+
+	var info base.PubStopInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHTTPFLV
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStop(info)
+}
+
 // ServerObserver of httpts.Server
 func (sm *ServerManager) OnNewHTTPTSSubSession(session *httpts.SubSession) bool {
 	sm.mutex.Lock()
@@ -431,6 +654,59 @@ func (sm *ServerManager) OnDelHTTPTSSubSession(session *httpts.SubSession) {
 	httpNotify.OnSubStop(info)
 }
 
+// ServerObserver of httpts.Server
+func (sm *ServerManager) OnNewHTTPTSPubSession(session *httpts.PubSession) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if !config.HTTPTSConfig.PubEnable {
+		sm.Log().Warn("[%s] httpts pub not enabled, reject. streamName=%s", session.UniqueKey, session.StreamName())
+		return false
+	}
+	group := sm.getOrCreateGroup(session.AppName(), session.StreamName())
+	if !group.AddHTTPTSPubSession(session) {
+		return false
+	}
+
+	var info base.PubStartInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHTTPTS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStart(info)
+	return true
+}
+
+// ServerObserver of httpts.Server
+func (sm *ServerManager) OnDelHTTPTSPubSession(session *httpts.PubSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getGroup(session.AppName(), session.StreamName())
+	if group == nil {
+		return
+	}
+
+	group.DelHTTPTSPubSession(session)
+
+	var info base.PubStopInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHTTPTS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStop(info)
+}
+
 // ServerObserver of rtsp.Server
 func (sm *ServerManager) OnNewRTSPSessionConnect(session *rtsp.ServerCommandSession) {
 	// TODO chef: impl me
@@ -490,6 +766,55 @@ func (sm *ServerManager) OnDelRTSPPubSession(session *rtsp.PubSession) {
 	httpNotify.OnPubStop(info)
 }
 
+// ServerObserver of udpts.Server
+func (sm *ServerManager) OnNewUDPTSPubSession(session *udpts.PubSession) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getOrCreateGroup(session.AppName(), session.StreamName())
+	if !group.AddUDPTSPubSession(session) {
+		return false
+	}
+
+	var info base.PubStartInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolUDPTS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStart(info)
+	return true
+}
+
+// ServerObserver of udpts.Server
+func (sm *ServerManager) OnDelUDPTSPubSession(session *udpts.PubSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getGroup(session.AppName(), session.StreamName())
+	if group == nil {
+		return
+	}
+
+	group.DelUDPTSPubSession(session)
+
+	var info base.PubStopInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolUDPTS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnPubStop(info)
+}
+
 // ServerObserver of rtsp.Server
 func (sm *ServerManager) OnNewRTSPSubSessionDescribe(session *rtsp.SubSession) (ok bool, sdp []byte) {
 	sm.mutex.Lock()
@@ -548,6 +873,87 @@ func (sm *ServerManager) OnDelRTSPSubSession(session *rtsp.SubSession) {
 	httpNotify.OnSubStop(info)
 }
 
+// ServerObserver of hls.Server
+func (sm *ServerManager) OnHLSPlayAuth(info hls.AuthInfo) bool {
+	return checkHLSPlayAuth(config.HLSConfig, info)
+}
+
+// ServerObserver of hls.Server
+func (sm *ServerManager) OnNewHLSSubSession(session *hls.SubSession) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getOrCreateGroup(session.AppName(), session.StreamName())
+	group.AddHLSSubSession(session)
+
+	var info base.SubStartInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHLS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnSubStart(info)
+	return true
+}
+
+// ServerObserver of hls.Server
+func (sm *ServerManager) OnDelHLSSubSession(session *hls.SubSession) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	group := sm.getGroup(session.AppName(), session.StreamName())
+	if group == nil {
+		return
+	}
+
+	group.DelHLSSubSession(session)
+
+	var info base.SubStopInfo
+	info.ServerID = config.ServerID
+	info.Protocol = base.ProtocolHLS
+	info.URL = session.URL()
+	info.AppName = session.AppName()
+	info.StreamName = session.StreamName()
+	info.URLParam = session.RawQuery()
+	info.SessionID = session.UniqueKey
+	info.RemoteAddr = session.RemoteAddr()
+	info.HasInSession = group.HasInSession()
+	info.HasOutSession = group.HasOutSession()
+	httpNotify.OnSubStop(info)
+}
+
+// JanitorObserver of hls.Janitor
+func (sm *ServerManager) OnHLSPurge(info base.HLSPurgeInfo) {
+	info.ServerID = config.ServerID
+	httpNotify.OnHLSPurge(info)
+}
+
+// UploaderObserver of hls.Uploader
+func (sm *ServerManager) OnHLSUploadFail(info base.HLSUploadFailInfo) {
+	info.ServerID = config.ServerID
+	httpNotify.OnHLSUploadFail(info)
+}
+
+// MuxerEventObserver of hls.Muxer
+func (sm *ServerManager) OnHLSMakeTS(info base.HLSMakeTSInfo) {
+	info.ServerID = config.ServerID
+	httpNotify.OnHLSMakeTS(info)
+	if sm.hlsEventObserver != nil {
+		sm.hlsEventObserver.OnHLSMakeTS(info)
+	}
+}
+
+func (sm *ServerManager) OnHLSMakeM3U8(info base.HLSMakeM3U8Info) {
+	info.ServerID = config.ServerID
+	httpNotify.OnHLSMakeM3U8(info)
+	if sm.hlsEventObserver != nil {
+		sm.hlsEventObserver.OnHLSMakeM3U8(info)
+	}
+}
+
 // HTTPAPIServerObserver
 func (sm *ServerManager) OnStatAllGroup() (sgs []base.StatGroup) {
 	return sm.statAllGroup()
@@ -567,6 +973,81 @@ func (sm *ServerManager) OnStatGroup(streamName string) *base.StatGroup {
 	return &ret
 }
 
+// HTTPAPIServerObserver
+func (sm *ServerManager) OnRecordList(streamName string) ([]base.RecordStream, error) {
+	if sm.recordCatalog == nil {
+		return nil, hls.ErrRecordNotFound
+	}
+	var streamNames []string
+	if streamName != "" {
+		streamNames = []string{streamName}
+	} else {
+		var err error
+		if streamNames, err = sm.recordCatalog.ListStreams(); err != nil {
+			return nil, err
+		}
+	}
+
+	var rss []base.RecordStream
+	for _, name := range streamNames {
+		ranges, err := sm.recordCatalog.ListRanges(name)
+		if err != nil {
+			return nil, err
+		}
+		rss = append(rss, base.RecordStream{
+			StreamName: name,
+			Ranges:     ranges,
+		})
+	}
+	return rss, nil
+}
+
+// HTTPAPIServerObserver
+func (sm *ServerManager) OnRecordPlaylist(streamName string, start time.Time, end time.Time, iframe bool, reqHost string) ([]byte, error) {
+	if sm.recordCatalog == nil {
+		return nil, hls.ErrRecordNotFound
+	}
+	uriPrefix := recordURLPrefix(reqHost)
+	if iframe {
+		return sm.recordCatalog.GenIFramePlaylist(streamName, start, end, uriPrefix)
+	}
+	return sm.recordCatalog.GenPlaylist(streamName, start, end, uriPrefix)
+}
+
+// 录制m3u8由http api返回，切片由hls提供，record_url_prefix为空时：
+// - 开启了共用的http监听时，hls与http api使用同一个端口，使用hls的路径前缀
+// - 否则hls与http api的端口不同，使用请求的主机名以及hls的端口，生成绝对地址
+func recordURLPrefix(reqHost string) string {
+	if config.HLSConfig.RecordURLPrefix != "" {
+		return config.HLSConfig.RecordURLPrefix
+	}
+	if config.HTTPServerConfig.Enable {
+		if config.HTTPServerConfig.HLSPrefix != "" {
+			return config.HTTPServerConfig.HLSPrefix
+		}
+		return defaultHLSPrefix
+	}
+
+	_, port, err := net.SplitHostPort(config.HLSConfig.SubListenAddr)
+	if err != nil || reqHost == "" {
+		return defaultHLSPrefix
+	}
+	host := reqHost
+	if h, _, err := net.SplitHostPort(reqHost); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), defaultHLSPrefix)
+}
+
+// HTTPAPIServerObserver
+func (sm *ServerManager) OnRecordMasterPlaylist(streamName string, start time.Time, end time.Time, playlistURI string, iframePlaylistURI string) ([]byte, error) {
+	if sm.recordCatalog == nil {
+		return nil, hls.ErrRecordNotFound
+	}
+	return sm.recordCatalog.GenMasterPlaylist(streamName, start, end, playlistURI, iframePlaylistURI)
+}
+
 // HTTPAPIServerObserver
 func (sm *ServerManager) OnCtrlStartPull(info base.APICtrlStartPullReq) {
 	sm.mutex.Lock()
@@ -577,7 +1058,19 @@ func (sm *ServerManager) OnCtrlStartPull(info base.APICtrlStartPullReq) {
 		return
 	}
 	var url string
-	if info.URLParam != "" {
+	if strings.EqualFold(info.Protocol, "hls") {
+		// addr可以直接是完整的m3u8地址（包括本地文件路径），否则按http://{addr}/{app_name}/{stream_name}.m3u8拼接
+		if strings.Contains(info.Addr, "://") || isHLSURL(info.Addr) {
+			url = info.Addr
+		} else {
+			url = fmt.Sprintf("http://%s/%s/%s.m3u8", info.Addr, info.AppName, info.StreamName)
+		}
+		if info.URLParam != "" && strings.Contains(url, "?") {
+			url += "&" + info.URLParam
+		} else if info.URLParam != "" {
+			url += "?" + info.URLParam
+		}
+	} else if info.URLParam != "" {
 		url = fmt.Sprintf("rtmp://%s/%s/%s?%s", info.Addr, info.AppName, info.StreamName, info.URLParam)
 	} else {
 		url = fmt.Sprintf("rtmp://%s/%s/%s", info.Addr, info.AppName, info.StreamName)
@@ -608,6 +1101,77 @@ func (sm *ServerManager) OnCtrlKickOutSession(info base.APICtrlKickOutSession) b
 	}
 }
 
+// HTTPAPIServerObserver
+func (sm *ServerManager) OnCtrlStartUDPTSPush(info base.APICtrlStartUDPTSPushReq) base.HTTPResponseBasic {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	g := sm.getGroup("fake", info.StreamName)
+	if g == nil {
+		return base.HTTPResponseBasic{
+			ErrorCode: base.ErrorCodeGroupNotFound,
+			Desp:      base.DespGroupNotFound,
+		}
+	}
+	c := udpts.PushConfig{
+		StreamName: info.StreamName,
+		Addr:       info.Addr,
+		TTL:        info.TTL,
+		PCRPacing:  info.PCRPacing,
+	}
+	if err := g.AddUDPTSPush(c); err != nil {
+		sm.Log().Error("start udp ts push failed. streamName=%s, addr=%s, err=%+v", info.StreamName, info.Addr, err)
+		return base.HTTPResponseBasic{
+			ErrorCode: base.ErrorCodeStartFailed,
+			Desp:      base.DespStartFailed,
+		}
+	}
+	if _, ok := sm.streamName2UDPTSPush[info.StreamName]; !ok {
+		sm.streamName2UDPTSPush[info.StreamName] = make(map[string]udpts.PushConfig)
+	}
+	sm.streamName2UDPTSPush[info.StreamName][info.Addr] = c
+	return base.HTTPResponseBasic{
+		ErrorCode: base.ErrorCodeSucc,
+		Desp:      base.DespSucc,
+	}
+}
+
+// HTTPAPIServerObserver
+func (sm *ServerManager) OnCtrlStopUDPTSPush(info base.APICtrlStopUDPTSPushReq) base.HTTPResponseBasic {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	// 同时删除保留的推送目标，group已经销毁时也可以删除
+	_, saved := sm.streamName2UDPTSPush[info.StreamName][info.Addr]
+	if saved {
+		delete(sm.streamName2UDPTSPush[info.StreamName], info.Addr)
+		if len(sm.streamName2UDPTSPush[info.StreamName]) == 0 {
+			delete(sm.streamName2UDPTSPush, info.StreamName)
+		}
+	}
+	g := sm.getGroup("fake", info.StreamName)
+	if g == nil {
+		if saved {
+			return base.HTTPResponseBasic{
+				ErrorCode: base.ErrorCodeSucc,
+				Desp:      base.DespSucc,
+			}
+		}
+		return base.HTTPResponseBasic{
+			ErrorCode: base.ErrorCodeGroupNotFound,
+			Desp:      base.DespGroupNotFound,
+		}
+	}
+	if !g.DelUDPTSPush(info.Addr) && !saved {
+		return base.HTTPResponseBasic{
+			ErrorCode: base.ErrorCodeSessionNotFound,
+			Desp:      base.DespSessionNotFound,
+		}
+	}
+	return base.HTTPResponseBasic{
+		ErrorCode: base.ErrorCodeSucc,
+		Desp:      base.DespSucc,
+	}
+}
+
 func (sm *ServerManager) iterateGroup() {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
@@ -630,6 +1194,11 @@ func (sm *ServerManager) getOrCreateGroup(appName string, streamName string) *Gr
 		pullURL := fmt.Sprintf("rtmp://%s/%s/%s", config.RelayPullConfig.Addr, appName, streamName)
 		group = NewGroup(appName, streamName, config.RelayPullConfig.Enable, pullURL, sm.log)
 		sm.groupMap[streamName] = group
+		for _, c := range sm.streamName2UDPTSPush[streamName] {
+			if err := group.AddUDPTSPush(c); err != nil {
+				sm.Log().Error("start udp ts push failed. streamName=%s, addr=%s, err=%+v", streamName, c.Addr, err)
+			}
+		}
 
 		go group.RunLoop()
 	}
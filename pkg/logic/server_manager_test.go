@@ -0,0 +1,146 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+func TestServerManagerHLSRelayPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logichls")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	backup := config
+	defer func() { config = backup }()
+
+	// HLS的URL中不包含appName，使用配置的appName，没有配置时为"live"
+	for _, appName := range []string{"", "myapp"} {
+		config = &Config{}
+		config.RelayPullConfig.Enable = true
+		config.RelayPullConfig.Addr = "127.0.0.1:1"
+		config.HLSConfig.Enable = true
+		config.HLSConfig.OutPath = dir + "/"
+		config.HLSConfig.SubSession.AppName = appName
+		config.HLSConfig.SubSession.WaitPlaylistTimeoutMS = 10
+
+		sm := NewServerManager(log.DefaultBeeLogger)
+		resp := httptest.NewRecorder()
+		sm.hlsServer.ServeHTTP(resp, httptest.NewRequest("GET", "/hls/test/playlist.m3u8", nil))
+		assert.Equal(t, 404, resp.Code)
+
+		expectedAppName := appName
+		if expectedAppName == "" {
+			expectedAppName = "live"
+		}
+		sm.mutex.Lock()
+		group := sm.getGroup(expectedAppName, "test")
+		sm.mutex.Unlock()
+		assert.Equal(t, true, group != nil)
+		assert.Equal(t, expectedAppName, group.appName)
+		assert.Equal(t, "rtmp://127.0.0.1:1/"+expectedAppName+"/test", group.pullURL)
+		group.Dispose()
+	}
+}
+
+func TestRecordURLPrefix(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+
+	// http api与hls的端口不同，使用请求的主机名以及hls的端口
+	config = &Config{}
+	config.HLSConfig.SubListenAddr = ":8081"
+	assert.Equal(t, "http://example.com:8081/hls/", recordURLPrefix("example.com:8083"))
+	assert.Equal(t, "http://example.com:8081/hls/", recordURLPrefix("example.com"))
+	assert.Equal(t, "http://[::1]:8081/hls/", recordURLPrefix("[::1]:8083"))
+
+	// 共用http监听时使用hls的路径前缀
+	config.HTTPServerConfig.Enable = true
+	assert.Equal(t, "/hls/", recordURLPrefix("example.com:8080"))
+	config.HTTPServerConfig.HLSPrefix = "/media/hls/"
+	assert.Equal(t, "/media/hls/", recordURLPrefix("example.com:8080"))
+
+	config.HLSConfig.RecordURLPrefix = "http://cdn.example.com/hls/"
+	assert.Equal(t, "http://cdn.example.com/hls/", recordURLPrefix("example.com:8080"))
+}
+
+// 通过http api添加的UDP TS推送目标，group销毁重建后依然有效
+func TestServerManagerUDPTSPush(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{}
+
+	sm := NewServerManager(log.DefaultBeeLogger)
+	sm.mutex.Lock()
+	sm.getOrCreateGroup("live", "test")
+	sm.mutex.Unlock()
+	resp := sm.OnCtrlStartUDPTSPush(base.APICtrlStartUDPTSPushReq{StreamName: "test", Addr: "127.0.0.1:1"})
+	assert.Equal(t, base.ErrorCodeSucc, resp.ErrorCode)
+
+	sm.mutex.Lock()
+	sm.groupMap["test"].Dispose()
+	delete(sm.groupMap, "test")
+	group := sm.getOrCreateGroup("live", "test")
+	sm.mutex.Unlock()
+	assert.Equal(t, 1, len(group.addr2UDPTSPushSession))
+
+	// group销毁期间删除推送目标
+	sm.mutex.Lock()
+	sm.groupMap["test"].Dispose()
+	delete(sm.groupMap, "test")
+	sm.mutex.Unlock()
+	resp = sm.OnCtrlStopUDPTSPush(base.APICtrlStopUDPTSPushReq{StreamName: "test", Addr: "127.0.0.1:1"})
+	assert.Equal(t, base.ErrorCodeSucc, resp.ErrorCode)
+	resp = sm.OnCtrlStopUDPTSPush(base.APICtrlStopUDPTSPushReq{StreamName: "test", Addr: "127.0.0.1:1"})
+	assert.Equal(t, base.ErrorCodeGroupNotFound, resp.ErrorCode)
+
+	sm.mutex.Lock()
+	group = sm.getOrCreateGroup("live", "test")
+	sm.mutex.Unlock()
+	assert.Equal(t, 0, len(group.addr2UDPTSPushSession))
+	group.Dispose()
+}
+
+type hlsEventObserverMock struct {
+	ts   []base.HLSMakeTSInfo
+	m3u8 []base.HLSMakeM3U8Info
+}
+
+func (o *hlsEventObserverMock) OnHLSMakeTS(info base.HLSMakeTSInfo) {
+	o.ts = append(o.ts, info)
+}
+
+func (o *hlsEventObserverMock) OnHLSMakeM3U8(info base.HLSMakeM3U8Info) {
+	o.m3u8 = append(o.m3u8, info)
+}
+
+func TestServerManagerHLSEventObserver(t *testing.T) {
+	backup := config
+	defer func() { config = backup }()
+	config = &Config{ServerID: "1"}
+
+	sm := NewServerManager(log.DefaultBeeLogger)
+	sm.OnHLSMakeTS(base.HLSMakeTSInfo{StreamName: "test"})
+
+	o := &hlsEventObserverMock{}
+	sm.SetHLSEventObserver(o)
+	sm.OnHLSMakeTS(base.HLSMakeTSInfo{StreamName: "test"})
+	sm.OnHLSMakeM3U8(base.HLSMakeM3U8Info{StreamName: "test"})
+	assert.Equal(t, 1, len(o.ts))
+	assert.Equal(t, "1", o.ts[0].ServerID)
+	assert.Equal(t, 1, len(o.m3u8))
+	assert.Equal(t, "1", o.m3u8[0].ServerID)
+}
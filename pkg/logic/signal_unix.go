@@ -19,9 +19,9 @@ import (
 )
 
 func runSignalHandler(cb func()) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
 	s := <-c
-	log.Info("recv signal. s=%+v", s)
+	log.DefaultBeeLogger.Info("recv signal. s=%+v", s)
 	cb()
 }
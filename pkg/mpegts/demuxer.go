@@ -0,0 +1,562 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package mpegts
+
+import (
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/avc"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/hevc"
+)
+
+// TS流解析
+//
+// 支持：
+// - 任意大小的数据块输入，内部处理跨块的TS packet，以及丢失sync byte后的重新同步
+// - PAT/PMT section跨TS packet的重组，以及CRC校验
+// - 多program
+// - PES重组，PES_packet_length为0时，在下一个payload_unit_start_indicator处结束，超过maxPESSize时丢弃
+// - continuity_counter检查，出错时丢弃当前未完成的PES
+// - 各program的PCR
+//
+// 目前只输出AVC、HEVC、AAC三种类型的ES数据，其他stream_type的PID忽略
+
+// PES_packet_length为0时，PES的大小只能由下一个payload_unit_start_indicator确定
+// 为避免异常输入导致缓存无限增长，超过该大小时丢弃当前PES
+const maxPESSize = 4 * 1024 * 1024
+
+// @param frame: 各字段含义见mpegts.Frame结构体定义
+//               frame.PTS、frame.DTS 单位为90kHz，为TS流中的原始值（未减去delay，也未处理33位回绕）
+//               frame.Raw 回调结束后，内部不会再使用该内存块，上层可持有
+//               AAC 每帧回调一次，frame.Raw为包含ADTS头的完整帧
+//
+type OnFrame func(frame *Frame)
+
+type DemuxerStat struct {
+	PacketCount     uint64 // 收到的TS packet数量
+	SyncLossCount   uint64 // 为重新同步而丢弃的字节数
+	TEICount        uint64 // transport_error_indicator为1的TS packet数量
+	CCErrorCount    uint64 // continuity_counter不连续的次数
+	PSIErrorCount   uint64 // PAT、PMT解析失败或CRC错误的次数
+	PESErrorCount   uint64 // 丢弃的PES数量
+	FrameCount      uint64 // 回调的帧数量
+	DuplicateCount  uint64 // 重复的TS packet数量
+	UnknownPIDCount uint64 // 未在PAT、PMT中出现的PID的TS packet数量
+}
+
+type Program struct {
+	Number uint16
+	PMTPid uint16
+	PCRPid uint16
+
+	HasPCR bool
+	PCR    uint64 // 单位为27MHz，最近一次收到的值
+
+	Streams []ProgramStream // PMT中支持解析的ES
+}
+
+type ProgramStream struct {
+	Pid         uint16
+	PayloadType base.AVPacketPT
+}
+
+type Demuxer struct {
+	onFrame OnFrame
+
+	remain []byte
+
+	programs       map[uint16]*Program     // key: program_number
+	pmtPid2Program map[uint16]*Program     // key: program_map_PID
+	pid2Stream     map[uint16]*demuxStream // key: elementary_PID
+	pid2Section    map[uint16]*sectionBuffer
+	pid2CC         map[uint16]uint8
+
+	stat DemuxerStat
+}
+
+type demuxStream struct {
+	pid           uint16
+	streamType    uint8
+	programNumber uint16
+
+	started  bool
+	buf      []byte
+	totalLen int // PES_packet_length不为0时，整个PES的大小。为0时表示未知
+	lastCC   uint8
+}
+
+type sectionBuffer struct {
+	started bool
+	buf     []byte
+}
+
+func NewDemuxer(onFrame OnFrame) *Demuxer {
+	return &Demuxer{
+		onFrame:        onFrame,
+		programs:       make(map[uint16]*Program),
+		pmtPid2Program: make(map[uint16]*Program),
+		pid2Stream:     make(map[uint16]*demuxStream),
+		pid2Section:    make(map[uint16]*sectionBuffer),
+		pid2CC:         make(map[uint16]uint8),
+	}
+}
+
+// @param b: 任意大小的TS数据，函数调用结束后，内部不会持有该内存块
+//
+func (d *Demuxer) Feed(b []byte) {
+	var data []byte
+	if len(d.remain) != 0 {
+		d.remain = append(d.remain, b...)
+		data = d.remain
+	} else {
+		data = b
+	}
+
+	i := 0
+	for len(data)-i >= tsPacketSize {
+		if data[i] != syncByte {
+			i++
+			d.stat.SyncLossCount++
+			continue
+		}
+		// 后面还有数据时，用下一个packet的sync byte确认同步，避免把负载中的0x47误当作sync byte
+		if len(data)-i > tsPacketSize && data[i+tsPacketSize] != syncByte {
+			i++
+			d.stat.SyncLossCount++
+			continue
+		}
+		d.feedPacket(data[i : i+tsPacketSize])
+		i += tsPacketSize
+	}
+
+	if i == len(data) {
+		d.remain = d.remain[:0]
+		return
+	}
+	if len(d.remain) != 0 {
+		n := copy(d.remain, data[i:])
+		d.remain = d.remain[:n]
+	} else {
+		d.remain = append(d.remain[:0], data[i:]...)
+	}
+}
+
+// 输入结束时调用，将PES_packet_length为0且还未结束的PES回调出去
+func (d *Demuxer) Flush() {
+	for _, s := range d.pid2Stream {
+		if s.started && len(s.buf) != 0 {
+			d.emitPES(s, s.buf)
+		}
+		s.started = false
+		s.buf = nil
+	}
+}
+
+// 输入流不连续时调用，比如切换了输入源，清空continuity_counter的记录，避免之后的packet被误判为重复
+func (d *Demuxer) ResetCC() {
+	d.pid2CC = make(map[uint16]uint8)
+}
+
+func (d *Demuxer) Stat() DemuxerStat {
+	return d.stat
+}
+
+// @return 当前所有program的拷贝，顺序不固定
+func (d *Demuxer) Programs() []Program {
+	var ret []Program
+	for _, p := range d.programs {
+		ret = append(ret, *p)
+	}
+	return ret
+}
+
+func (d *Demuxer) feedPacket(packet []byte) {
+	d.stat.PacketCount++
+
+	h, err := ParseTSPacketHeader(packet)
+	if err != nil {
+		return
+	}
+	if h.Err != 0 {
+		d.stat.TEICount++
+		return
+	}
+	if h.Pid == PidNull {
+		return
+	}
+
+	pos := 4
+	var af TSPacketAdaptation
+	if h.Adaptation&0x2 != 0 {
+		af, err = ParseTSPacketAdaptation(packet[4:])
+		if err != nil {
+			return
+		}
+		pos += 1 + int(af.Length)
+		if af.PCRFlag {
+			for _, p := range d.programs {
+				if p.PCRPid == h.Pid {
+					p.HasPCR = true
+					p.PCR = af.PCR
+				}
+			}
+		}
+	}
+	if h.Adaptation&0x1 == 0 || pos >= tsPacketSize {
+		// 没有负载的packet，continuity_counter不递增
+		return
+	}
+	payload := packet[pos:]
+
+	if !d.checkCC(h, af.Discontinuity) {
+		return
+	}
+
+	if h.Pid == PidPAT {
+		d.feedSection(h, payload)
+		return
+	}
+	if _, ok := d.pmtPid2Program[h.Pid]; ok {
+		d.feedSection(h, payload)
+		return
+	}
+	if s, ok := d.pid2Stream[h.Pid]; ok {
+		s.lastCC = h.CC
+		d.feedPES(s, h, payload)
+		return
+	}
+	d.stat.UnknownPIDCount++
+}
+
+// @return 该packet是否需要继续处理
+func (d *Demuxer) checkCC(h TSPacketHeader, discontinuity bool) bool {
+	last, ok := d.pid2CC[h.Pid]
+	d.pid2CC[h.Pid] = h.CC
+	if !ok || discontinuity {
+		return true
+	}
+	if h.CC == last {
+		// 标准允许连续两个相同的packet
+		d.stat.DuplicateCount++
+		return false
+	}
+	if h.CC == (last+1)&0x0F {
+		return true
+	}
+
+	d.stat.CCErrorCount++
+	if s, ok := d.pid2Stream[h.Pid]; ok && s.started {
+		d.stat.PESErrorCount++
+		s.started = false
+		s.buf = nil
+	}
+	if sb, ok := d.pid2Section[h.Pid]; ok {
+		sb.started = false
+		sb.buf = sb.buf[:0]
+	}
+	return true
+}
+
+func (d *Demuxer) feedSection(h TSPacketHeader, payload []byte) {
+	sb, ok := d.pid2Section[h.Pid]
+	if !ok {
+		sb = &sectionBuffer{}
+		d.pid2Section[h.Pid] = sb
+	}
+
+	if h.PayloadUnitStart == 0 {
+		if !sb.started {
+			return
+		}
+		sb.buf = append(sb.buf, payload...)
+		d.tryCompleteSection(h.Pid, sb)
+		return
+	}
+
+	pointer := int(payload[0])
+	if 1+pointer > len(payload) {
+		d.stat.PSIErrorCount++
+		sb.started = false
+		sb.buf = sb.buf[:0]
+		return
+	}
+	// pointer_field之前的数据属于上一个section
+	if sb.started {
+		sb.buf = append(sb.buf, payload[1:1+pointer]...)
+		d.tryCompleteSection(h.Pid, sb)
+	}
+	sb.started = true
+	sb.buf = append(sb.buf[:0], payload[1+pointer:]...)
+	d.tryCompleteSection(h.Pid, sb)
+}
+
+func (d *Demuxer) tryCompleteSection(pid uint16, sb *sectionBuffer) {
+	for sb.started {
+		if len(sb.buf) == 0 || sb.buf[0] == 0xFF {
+			// 剩余部分为填充
+			sb.started = false
+			sb.buf = sb.buf[:0]
+			return
+		}
+		if len(sb.buf) < 3 {
+			return
+		}
+		size := 3 + int(bele.BEUint16(sb.buf[1:])&0x0FFF)
+		if len(sb.buf) < size {
+			return
+		}
+
+		d.handleSection(pid, sb.buf[:size])
+
+		n := copy(sb.buf, sb.buf[size:])
+		sb.buf = sb.buf[:n]
+	}
+}
+
+func (d *Demuxer) handleSection(pid uint16, section []byte) {
+	if len(section) < 4 || calcCRC32(section[:len(section)-4]) != bele.BEUint32(section[len(section)-4:]) {
+		d.stat.PSIErrorCount++
+		return
+	}
+
+	if pid == PidPAT {
+		pat, err := ParsePAT(section)
+		if err != nil {
+			d.stat.PSIErrorCount++
+			return
+		}
+		d.handlePAT(pat)
+		return
+	}
+
+	pmt, err := ParsePMT(section)
+	if err != nil {
+		d.stat.PSIErrorCount++
+		return
+	}
+	d.handlePMT(pid, pmt)
+}
+
+func (d *Demuxer) handlePAT(pat PAT) {
+	pmtPid2Program := make(map[uint16]*Program)
+	programs := make(map[uint16]*Program)
+	for _, ppe := range pat.ppes {
+		if ppe.pn == 0 {
+			continue
+		}
+		p, ok := d.programs[ppe.pn]
+		if !ok || p.PMTPid != ppe.pmpid {
+			p = &Program{Number: ppe.pn, PMTPid: ppe.pmpid}
+		}
+		programs[ppe.pn] = p
+		pmtPid2Program[ppe.pmpid] = p
+	}
+	d.programs = programs
+	d.pmtPid2Program = pmtPid2Program
+
+	// 删除已不存在的program的ES
+	for pid, s := range d.pid2Stream {
+		if _, ok := programs[s.programNumber]; !ok {
+			delete(d.pid2Stream, pid)
+		}
+	}
+}
+
+func (d *Demuxer) handlePMT(pid uint16, pmt PMT) {
+	p, ok := d.pmtPid2Program[pid]
+	if !ok || p.Number != pmt.pn {
+		return
+	}
+	p.PCRPid = pmt.pp
+
+	exist := make(map[uint16]struct{})
+	var streams []ProgramStream
+	for _, ppe := range pmt.ProgramElements {
+		switch ppe.StreamType {
+		case streamTypeAVC:
+			streams = append(streams, ProgramStream{Pid: ppe.Pid, PayloadType: base.AVPacketPTAVC})
+		case streamTypeHEVC:
+			streams = append(streams, ProgramStream{Pid: ppe.Pid, PayloadType: base.AVPacketPTHEVC})
+		case streamTypeAAC:
+			streams = append(streams, ProgramStream{Pid: ppe.Pid, PayloadType: base.AVPacketPTAAC})
+		default:
+			continue
+		}
+		exist[ppe.Pid] = struct{}{}
+		s, ok := d.pid2Stream[ppe.Pid]
+		if ok && s.streamType == ppe.StreamType && s.programNumber == p.Number {
+			continue
+		}
+		d.pid2Stream[ppe.Pid] = &demuxStream{
+			pid:           ppe.Pid,
+			streamType:    ppe.StreamType,
+			programNumber: p.Number,
+		}
+	}
+	p.Streams = streams
+	for esPid, s := range d.pid2Stream {
+		if s.programNumber != p.Number {
+			continue
+		}
+		if _, ok := exist[esPid]; !ok {
+			delete(d.pid2Stream, esPid)
+		}
+	}
+}
+
+func (d *Demuxer) feedPES(s *demuxStream, h TSPacketHeader, payload []byte) {
+	if h.PayloadUnitStart != 0 {
+		if s.started && len(s.buf) != 0 {
+			d.emitPES(s, s.buf)
+		}
+		s.started = true
+		s.totalLen = 0
+		s.buf = make([]byte, 0, len(payload))
+	} else if !s.started {
+		// 等待PES的起始
+		return
+	}
+	if len(s.buf)+len(payload) > maxPESSize {
+		// 丢弃后等待下一个PES的起始
+		d.stat.PESErrorCount++
+		s.started = false
+		s.buf = nil
+		return
+	}
+	s.buf = append(s.buf, payload...)
+
+	if s.totalLen == 0 && len(s.buf) >= 6 {
+		if ppl := int(bele.BEUint16(s.buf[4:])); ppl != 0 {
+			s.totalLen = 6 + ppl
+		}
+	}
+	if s.totalLen != 0 && len(s.buf) >= s.totalLen {
+		d.emitPES(s, s.buf[:s.totalLen])
+		s.started = false
+		s.buf = nil
+	}
+}
+
+func (d *Demuxer) emitPES(s *demuxStream, b []byte) {
+	pes, length, err := ParsePES(b)
+	if err != nil {
+		d.stat.PESErrorCount++
+		return
+	}
+	es := b[length:]
+	if len(es) == 0 {
+		return
+	}
+
+	frame := Frame{
+		PTS:           pes.pts,
+		DTS:           pes.dts,
+		CC:            s.lastCC,
+		Pid:           s.pid,
+		Sid:           pes.sid,
+		ProgramNumber: s.programNumber,
+	}
+
+	switch s.streamType {
+	case streamTypeAVC:
+		frame.PayloadType = base.AVPacketPTAVC
+		_ = avc.IterateNALUAnnexB(es, func(nal []byte) {
+			if len(nal) != 0 && avc.ParseNALUType(nal[0]) == avc.NALUTypeIDRSlice {
+				frame.Key = true
+			}
+		})
+		frame.Raw = es
+		d.stat.FrameCount++
+		d.onFrame(&frame)
+	case streamTypeHEVC:
+		frame.PayloadType = base.AVPacketPTHEVC
+		// HEVC的AnnexB格式与AVC相同
+		_ = avc.IterateNALUAnnexB(es, func(nal []byte) {
+			// 16~21为IRAP
+			if len(nal) != 0 {
+				t := hevc.ParseNALUType(nal[0])
+				if t >= 16 && t <= 21 {
+					frame.Key = true
+				}
+			}
+		})
+		frame.Raw = es
+		d.stat.FrameCount++
+		d.onFrame(&frame)
+	case streamTypeAAC:
+		frame.PayloadType = base.AVPacketPTAAC
+		d.emitADTS(&frame, es)
+	}
+}
+
+// 一个PES中可能包含多个ADTS帧，拆分后逐帧回调
+func (d *Demuxer) emitADTS(frame *Frame, es []byte) {
+	pts := frame.PTS
+	dts := frame.DTS
+	for len(es) >= 7 {
+		if es[0] != 0xFF || es[1]&0xF0 != 0xF0 {
+			d.stat.PESErrorCount++
+			return
+		}
+		frameLen := int(es[3]&0x03)<<11 | int(es[4])<<3 | int(es[5])>>5
+		if frameLen < 7 || frameLen > len(es) {
+			d.stat.PESErrorCount++
+			return
+		}
+		f := *frame
+		f.PTS = pts
+		f.DTS = dts
+		f.Raw = es[:frameLen]
+		d.stat.FrameCount++
+		d.onFrame(&f)
+
+		if sr := adtsSamplingFrequency(es[2]); sr != 0 {
+			duration := uint64(1024 * 90000 / sr)
+			pts += duration
+			dts += duration
+		}
+		es = es[frameLen:]
+	}
+}
+
+var adtsSamplingFrequencyTable = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// @param b: ADTS头的第3个字节
+func adtsSamplingFrequency(b uint8) int {
+	idx := int(b>>2) & 0x0F
+	if idx >= len(adtsSamplingFrequencyTable) {
+		return 0
+	}
+	return adtsSamplingFrequencyTable[idx]
+}
+
+var crc32Table [256]uint32
+
+func init() {
+	// CRC-32/MPEG-2，poly 0x04C11DB7，不反转
+	for i := 0; i < 256; i++ {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = (c << 1) ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		crc32Table[i] = c
+	}
+}
+
+func calcCRC32(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc = (crc << 8) ^ crc32Table[byte(crc>>24)^v]
+	}
+	return crc
+}
@@ -0,0 +1,272 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/siot-av/pkg/base"
+)
+
+var (
+	goldenIDR   = append([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x88}, 500)...)
+	goldenSlice = append([]byte{0, 0, 0, 1, 0x41}, bytes.Repeat([]byte{0x9a}, 30)...)
+)
+
+// 44100Hz, 2 channel, 总大小为<size>的ADTS帧
+func makeADTS(size int) []byte {
+	b := make([]byte, size)
+	b[0] = 0xFF
+	b[1] = 0xF1
+	b[2] = 0x50
+	b[3] = 0x80 | uint8(size>>11)&0x03
+	b[4] = uint8(size >> 3)
+	b[5] = uint8(size<<5) | 0x1F
+	b[6] = 0xFC
+	return b
+}
+
+func packFrames(frames []Frame) []byte {
+	var out []byte
+	out = append(out, FixedFragmentHeader...)
+	pid2CC := make(map[uint16]uint8)
+	for i := range frames {
+		frames[i].CC = pid2CC[frames[i].Pid]
+		PackTSPacket(&frames[i], func(packet []byte) {
+			out = append(out, packet...)
+		})
+		pid2CC[frames[i].Pid] = frames[i].CC
+	}
+	return out
+}
+
+func TestDemuxer(t *testing.T) {
+	adts := append(makeADTS(100), makeADTS(80)...)
+	in := []Frame{
+		{PTS: 93000, DTS: 90000, Pid: PidVideo, Sid: StreamIDVideo, Key: true, Raw: goldenIDR},
+		{PTS: 90000, DTS: 90000, Pid: PidAudio, Sid: StreamIDAudio, Raw: adts},
+		{PTS: 96000, DTS: 93000, Pid: PidVideo, Sid: StreamIDVideo, Raw: goldenSlice},
+	}
+	ts := packFrames(in)
+
+	var out []Frame
+	d := NewDemuxer(func(frame *Frame) {
+		out = append(out, *frame)
+	})
+	// 使用不规则的大小输入，并在头部加入垃圾数据
+	d.Feed([]byte{1, 2, 3})
+	for i := 0; i < len(ts); i += 100 {
+		end := i + 100
+		if end > len(ts) {
+			end = len(ts)
+		}
+		d.Feed(ts[i:end])
+	}
+	d.Flush()
+
+	assert.Equal(t, 4, len(out))
+
+	assert.Equal(t, base.AVPacketPTAVC, out[0].PayloadType)
+	assert.Equal(t, true, out[0].Key)
+	assert.Equal(t, uint64(93000+delay), out[0].PTS)
+	assert.Equal(t, uint64(90000+delay), out[0].DTS)
+	assert.Equal(t, goldenIDR, out[0].Raw)
+	assert.Equal(t, uint16(1), out[0].ProgramNumber)
+
+	assert.Equal(t, base.AVPacketPTAAC, out[1].PayloadType)
+	assert.Equal(t, 100, len(out[1].Raw))
+	assert.Equal(t, uint64(90000+delay), out[1].PTS)
+	assert.Equal(t, base.AVPacketPTAAC, out[2].PayloadType)
+	assert.Equal(t, 80, len(out[2].Raw))
+	assert.Equal(t, uint64(90000+delay+1024*90000/44100), out[2].PTS)
+
+	assert.Equal(t, base.AVPacketPTAVC, out[3].PayloadType)
+	assert.Equal(t, false, out[3].Key)
+	assert.Equal(t, goldenSlice, out[3].Raw)
+
+	stat := d.Stat()
+	assert.Equal(t, uint64(3), stat.SyncLossCount)
+	assert.Equal(t, uint64(0), stat.CCErrorCount)
+	assert.Equal(t, uint64(0), stat.PSIErrorCount)
+
+	programs := d.Programs()
+	assert.Equal(t, 1, len(programs))
+	assert.Equal(t, PidVideo, programs[0].PCRPid)
+	assert.Equal(t, true, programs[0].HasPCR)
+	// 打包时PCR使用DTS-delay
+	assert.Equal(t, uint64(90000-delay)*300, programs[0].PCR)
+}
+
+func TestDemuxer_CCError(t *testing.T) {
+	in := []Frame{
+		{PTS: 0, DTS: 0, Pid: PidVideo, Sid: StreamIDVideo, Key: true, Raw: goldenIDR},
+		{PTS: 3000, DTS: 3000, Pid: PidVideo, Sid: StreamIDVideo, Raw: goldenSlice},
+	}
+	ts := packFrames(in)
+
+	var out []Frame
+	d := NewDemuxer(func(frame *Frame) {
+		out = append(out, *frame)
+	})
+	// 去掉IDR帧的第2个packet
+	d.Feed(ts[:188*3])
+	d.Feed(ts[188*4:])
+	d.Flush()
+
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, goldenSlice, out[0].Raw)
+	assert.Equal(t, uint64(1), d.Stat().CCErrorCount)
+	assert.Equal(t, uint64(1), d.Stat().PESErrorCount)
+
+	// 重复的packet被忽略
+	out = nil
+	d = NewDemuxer(func(frame *Frame) {
+		out = append(out, *frame)
+	})
+	d.Feed(ts[:188*3])
+	d.Feed(ts[188*2:])
+	d.Flush()
+	assert.Equal(t, 2, len(out))
+	assert.Equal(t, goldenIDR, out[0].Raw)
+	assert.Equal(t, uint64(1), d.Stat().DuplicateCount)
+	assert.Equal(t, uint64(0), d.Stat().CCErrorCount)
+}
+
+func TestDemuxer_Truncated(t *testing.T) {
+	ts := packFrames([]Frame{{PTS: 0, DTS: 0, Pid: PidVideo, Sid: StreamIDVideo, Key: true, Raw: goldenIDR}})
+
+	for i := 0; i < len(ts); i++ {
+		d := NewDemuxer(func(frame *Frame) {})
+		d.Feed(ts[:i])
+		d.Flush()
+	}
+
+	// 破坏PMT的CRC
+	b := make([]byte, len(ts))
+	copy(b, ts)
+	b[188+20] ^= 0xFF
+	var n int
+	d := NewDemuxer(func(frame *Frame) { n++ })
+	d.Feed(b)
+	d.Flush()
+	assert.Equal(t, 0, n)
+	assert.Equal(t, uint64(1), d.Stat().PSIErrorCount)
+
+	// 各种畸形输入不应panic
+	_, err := ParseTSPacketHeader([]byte{0x47, 0})
+	assert.Equal(t, ErrMPEGTS, err)
+	_, err = ParseTSPacketAdaptation([]byte{7, 0x10, 0})
+	assert.Equal(t, ErrMPEGTS, err)
+	_, err = ParsePAT([]byte{0, 0xB0, 0xFF, 0, 1, 0xC1, 0, 0})
+	assert.Equal(t, ErrMPEGTS, err)
+	_, err = ParsePMT(FixedFragmentHeader[188+5 : 188+20])
+	assert.Equal(t, ErrMPEGTS, err)
+	_, _, err = ParsePES([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0xC0, 10, 0})
+	assert.Equal(t, ErrMPEGTS, err)
+}
+
+// 构造只包含一个section的PSI packet
+func makePSIPacket(pid uint16, section []byte) []byte {
+	crc := make([]byte, 4)
+	bele.BEPutUint32(crc, calcCRC32(section))
+	section = append(section, crc...)
+
+	packet := bytes.Repeat([]byte{0xFF}, 188)
+	packet[0] = syncByte
+	packet[1] = 0x40 | uint8(pid>>8)
+	packet[2] = uint8(pid)
+	packet[3] = 0x10
+	packet[4] = 0 // pointer_field
+	copy(packet[5:], section)
+	return packet
+}
+
+func TestDemuxer_MultiProgram(t *testing.T) {
+	// program 1: pmt 0x1001, video 0x100
+	// program 2: pmt 0x1002, video 0x200
+	pat := makePSIPacket(PidPAT, []byte{
+		0x00, 0xB0, 0x15, 0x00, 0x01, 0xC1, 0x00, 0x00,
+		0x00, 0x00, 0xE0, 0x10, // network_PID，需忽略
+		0x00, 0x01, 0xF0, 0x01,
+		0x00, 0x02, 0xF0, 0x02,
+	})
+	pmt1 := makePSIPacket(0x1001, []byte{
+		0x02, 0xB0, 0x12, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00,
+		0x1B, 0xE1, 0x00, 0xF0, 0x00,
+	})
+	pmt2 := makePSIPacket(0x1002, []byte{
+		0x02, 0xB0, 0x17, 0x00, 0x02, 0xC1, 0x00, 0x00, 0xE2, 0x00, 0xF0, 0x00,
+		0x24, 0xE2, 0x00, 0xF0, 0x05, 0x0A, 0x03, 'e', 'n', 'g', // 带ES_info
+	})
+
+	var ts []byte
+	ts = append(ts, pat...)
+	ts = append(ts, pmt1...)
+	ts = append(ts, pmt2...)
+	f1 := Frame{PTS: 0, DTS: 0, Pid: 0x100, Sid: StreamIDVideo, Key: true, Raw: goldenIDR}
+	PackTSPacket(&f1, func(packet []byte) {
+		ts = append(ts, packet...)
+	})
+	hevcIRAP := []byte{0, 0, 0, 1, 0x26, 0x01, 0xaf, 0x00}
+	f2 := Frame{PTS: 900, DTS: 900, Pid: 0x200, Sid: StreamIDVideo, Key: true, Raw: hevcIRAP}
+	PackTSPacket(&f2, func(packet []byte) {
+		ts = append(ts, packet...)
+	})
+
+	var out []Frame
+	d := NewDemuxer(func(frame *Frame) {
+		out = append(out, *frame)
+	})
+	d.Feed(ts)
+	d.Flush()
+
+	assert.Equal(t, 2, len(out))
+	var avcFrame, hevcFrame Frame
+	for _, f := range out {
+		if f.ProgramNumber == 1 {
+			avcFrame = f
+		} else {
+			hevcFrame = f
+		}
+	}
+	assert.Equal(t, base.AVPacketPTAVC, avcFrame.PayloadType)
+	assert.Equal(t, uint16(0x100), avcFrame.Pid)
+	assert.Equal(t, base.AVPacketPTHEVC, hevcFrame.PayloadType)
+	assert.Equal(t, uint16(2), hevcFrame.ProgramNumber)
+	assert.Equal(t, true, hevcFrame.Key)
+	assert.Equal(t, hevcIRAP, hevcFrame.Raw)
+	programs := d.Programs()
+	assert.Equal(t, 2, len(programs))
+	for _, p := range programs {
+		assert.Equal(t, 1, len(p.Streams))
+	}
+	assert.Equal(t, uint64(0), d.Stat().PSIErrorCount)
+}
+
+// PES_packet_length为0且迟迟没有下一个PES时，超过上限丢弃，不影响之后的PES
+func TestDemuxer_MaxPESSize(t *testing.T) {
+	huge := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0x9a}, maxPESSize)...)
+	ts := packFrames([]Frame{
+		{PTS: 0, DTS: 0, Pid: PidVideo, Sid: StreamIDVideo, Key: true, Raw: huge},
+		{PTS: 3000, DTS: 3000, Pid: PidVideo, Sid: StreamIDVideo, Raw: goldenSlice},
+	})
+
+	var out []Frame
+	d := NewDemuxer(func(frame *Frame) {
+		out = append(out, *frame)
+	})
+	d.Feed(ts)
+	d.Flush()
+	assert.Equal(t, uint64(1), d.Stat().PESErrorCount)
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, goldenSlice, out[0].Raw)
+}
@@ -8,8 +8,14 @@
 
 package mpegts
 
+import "errors"
+
 // MPEG: Moving Picture Experts Group
 
+var ErrMPEGTS = errors.New("lal.mpegts: fxxk")
+
+const tsPacketSize = 188
+
 // 每个TS文件都以固定的PAT，PMT开始
 var FixedFragmentHeader = []byte{
 	/* TS */
@@ -75,6 +81,7 @@ const (
 	syncByte uint8 = 0x47
 
 	PidPAT   uint16 = 0
+	PidNull  uint16 = 0x1FFF
 	PidVideo uint16 = 0x100
 	PidAudio uint16 = 0x101
 
@@ -93,9 +100,11 @@ const (
 	// <iso13818-1.pdf> <Table 2-29 Stream type assignments> <page 66/174>
 	// 0x0F ISO/IEC 13818-7 Audio with ADTS transport syntax
 	// 0x1B AVC video stream as defined in ITU-T Rec. H.264 | ISO/IEC 14496-10 Video
+	// 0x24 HEVC video stream as defined in ITU-T Rec. H.265 | ISO/IEC 23008-2
 	// -----------------------------------------------------------------------------
-	streamTypeAAC uint8 = 0x0F
-	streamTypeAVC uint8 = 0x1B
+	streamTypeAAC  uint8 = 0x0F
+	streamTypeAVC  uint8 = 0x1B
+	streamTypeHEVC uint8 = 0x24
 )
 
 // PES
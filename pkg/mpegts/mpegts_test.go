@@ -10,16 +10,41 @@ package mpegts
 
 import (
 	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
 )
 
 func TestParseFixedTSPacket(t *testing.T) {
-	h := ParseTSPacketHeader(FixedFragmentHeader)
+	h, err := ParseTSPacketHeader(FixedFragmentHeader)
+	assert.Equal(t, nil, err)
 	t.Logf("%+v", h)
-	pat := ParsePAT(FixedFragmentHeader[5:])
+	pat, err := ParsePAT(FixedFragmentHeader[5:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, pat.SearchPID(0x1001))
 	t.Logf("%+v", pat)
 
-	h = ParseTSPacketHeader(FixedFragmentHeader[188:])
+	h, err = ParseTSPacketHeader(FixedFragmentHeader[188:])
+	assert.Equal(t, nil, err)
 	t.Logf("%+v", h)
-	pmt := ParsePMT(FixedFragmentHeader[188+5:])
+	pmt, err := ParsePMT(FixedFragmentHeader[188+5:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(pmt.ProgramElements))
+	assert.IsNotNil(t, pmt.SearchPID(PidVideo))
+	assert.IsNotNil(t, pmt.SearchPID(PidAudio))
 	t.Logf("%+v", pmt)
 }
+
+func TestGenSampleAESFragmentHeader(t *testing.T) {
+	header := GenSampleAESFragmentHeader([]byte{0x12, 0x10})
+	assert.Equal(t, 188*2, len(header))
+	assert.Equal(t, FixedFragmentHeader[:188], header[:188])
+
+	section := header[188+5:]
+	pmt, err := ParsePMT(section)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(pmt.ProgramElements))
+	assert.Equal(t, uint8(StreamTypeAVCSampleAES), pmt.SearchPID(PidVideo).StreamType)
+	assert.Equal(t, uint8(StreamTypeAACSampleAES), pmt.SearchPID(PidAudio).StreamType)
+	sl := 3 + int(pmt.sl)
+	assert.Equal(t, calcCRC32(section[:sl-4]), pmt.crc32)
+}
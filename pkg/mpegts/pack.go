@@ -8,6 +8,8 @@
 
 package mpegts
 
+import "github.com/souliot/siot-av/pkg/base"
+
 type Frame struct {
 	PTS uint64
 	DTS uint64
@@ -30,6 +32,10 @@ type Frame struct {
 	// 音频AAC 格式为2字节ADTS头加raw frame
 	// 视频AVC 格式为AnnexB
 	Raw []byte
+
+	// 以下字段只在解析时（mpegts.Demuxer）填充，打包时不使用
+	PayloadType   base.AVPacketPT
+	ProgramNumber uint16
 }
 
 // @param packet: 188字节大小的TS包，注意，一次Pack对应的多个TSPacket，复用的是一块内存
@@ -181,13 +187,16 @@ func PackTSPacket(frame *Frame, onTSPacket OnTSPacket) {
 			if packet[3]&0x20 != 0 {
 				// has Adaptation
 
-				base := int(4 + packet[4]) // TS Header + Adaptation
+				// 填充字节插入到原有Adaptation的末尾，也即PES Header之前
+				// 注意，adaptation_field_length不包括自己这1字节，所以base需要加上这1字节，否则会覆盖PCR的最后1字节
+				// 原有Adaptation之后的PES Header整体后移stuffSize，所以写入位置也是后移stuffSize
+				base := int(5 + packet[4]) // TS Header + adaptation_field_length + Adaptation
 				if wpos > base {
 					// 比如有PES Header
 
 					copy(packet[base+stuffSize:], packet[base:wpos])
 				}
-				wpos = base + stuffSize
+				wpos += stuffSize
 
 				packet[4] += uint8(stuffSize) // adaptation_field_length
 				for i := 0; i < stuffSize; i++ {
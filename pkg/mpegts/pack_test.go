@@ -0,0 +1,116 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+)
+
+// 帧较小时，TS包的剩余空间填充到Adaptation中
+// 关键帧的首个TS包原本就有Adaptation（PCR），填充需要放在原有的Adaptation之后，不能覆盖PCR以及PES Header
+func TestPackTSPacket_Stuffing(t *testing.T) {
+	for _, key := range []bool{true, false} {
+		for _, pts := range []uint64{90000, 93000} {
+			// 大小覆盖一个TS包就能写完（需要填充）、刚好写满、以及第二个TS包需要填充的情况
+			for size := 5; size <= 360; size++ {
+				raw := append([]byte{0, 0, 0, 1, 0x41}, bytes.Repeat([]byte{0x9a}, size-5)...)
+				if key {
+					raw[4] = 0x65
+				}
+				in := Frame{PTS: pts, DTS: 90000, Pid: PidVideo, Sid: StreamIDVideo, Key: key, Raw: raw}
+
+				var packets [][]byte
+				PackTSPacket(&in, func(packet []byte) {
+					packets = append(packets, append([]byte(nil), packet...))
+				})
+				for _, packet := range packets {
+					assert.Equal(t, 188, len(packet))
+				}
+				h, err := ParseTSPacketHeader(packets[0])
+				assert.Equal(t, nil, err)
+				if key {
+					assert.Equal(t, uint8(3), h.Adaptation)
+					f, err := ParseTSPacketAdaptation(packets[0][4:])
+					assert.Equal(t, nil, err)
+					assert.Equal(t, true, f.RandomAccess)
+					assert.Equal(t, true, f.PCRFlag)
+					assert.Equal(t, uint64(90000-delay)*300, f.PCR)
+				}
+
+				var out []Frame
+				d := NewDemuxer(func(frame *Frame) {
+					out = append(out, *frame)
+				})
+				d.Feed(packFrames([]Frame{{PTS: pts, DTS: 90000, Pid: PidVideo, Sid: StreamIDVideo, Key: key, Raw: raw}}))
+				d.Flush()
+				assert.Equal(t, 1, len(out))
+				assert.Equal(t, key, out[0].Key)
+				assert.Equal(t, pts+delay, out[0].PTS)
+				assert.Equal(t, uint64(90000+delay), out[0].DTS)
+				assert.Equal(t, raw, out[0].Raw)
+				assert.Equal(t, uint64(0), d.Stat().PESErrorCount)
+			}
+		}
+	}
+}
+
+// 关键帧只需要一个TS包时，逐字节对比修复填充位置前后的输出
+func TestPackTSPacket_StuffingBytes(t *testing.T) {
+	raw := []byte{0, 0, 0, 1, 0x65, 0x9a, 0x9a, 0x9a, 0x9a, 0x9a}
+	pcr := make([]byte, 6)
+	packPCR(pcr, 90000-delay)
+	pts := make([]byte, 5)
+	packPTS(pts, 2, 90000+delay)
+	pesHeader := append([]byte{0, 0, 1, StreamIDVideo, 0, 18, 0x80, 0x80, 5}, pts...)
+	stuffSize := 188 - 4 - 8 - len(pesHeader) - len(raw)
+
+	// 修复后：TS Header，Adaptation（包含完整的PCR以及填充），PES Header，帧数据
+	var after []byte
+	after = append(after, syncByte, 0x41, 0x00, 0x31, uint8(7+stuffSize), 0x50)
+	after = append(after, pcr...)
+	after = append(after, bytes.Repeat([]byte{0xFF}, stuffSize)...)
+	after = append(after, pesHeader...)
+	after = append(after, raw...)
+
+	// 修复前：填充覆盖了PCR的最后1字节，帧数据又覆盖了后移的PES Header，包尾残留PTS以及0
+	var before []byte
+	before = append(before, syncByte, 0x41, 0x00, 0x31, uint8(7+stuffSize), 0x50)
+	before = append(before, pcr[:5]...)
+	before = append(before, bytes.Repeat([]byte{0xFF}, stuffSize)...)
+	before = append(before, raw...)
+	before = append(before, pts...)
+	before = append(before, make([]byte, 188-len(before))...)
+
+	var packets [][]byte
+	PackTSPacket(&Frame{PTS: 90000, DTS: 90000, Pid: PidVideo, Sid: StreamIDVideo, Key: true, Raw: raw}, func(packet []byte) {
+		packets = append(packets, append([]byte(nil), packet...))
+	})
+	assert.Equal(t, 1, len(packets))
+	assert.Equal(t, 188, len(after))
+	assert.Equal(t, 188, len(before))
+	assert.Equal(t, after, packets[0])
+	assert.Equal(t, false, bytes.Equal(before, packets[0]))
+
+	// 非关键帧没有原有的Adaptation，输出与修复前相同
+	packets = nil
+	PackTSPacket(&Frame{PTS: 90000, DTS: 90000, Pid: PidVideo, Sid: StreamIDVideo, Raw: raw}, func(packet []byte) {
+		packets = append(packets, append([]byte(nil), packet...))
+	})
+	stuffSize = 188 - 4 - len(pesHeader) - len(raw)
+	var golden []byte
+	golden = append(golden, syncByte, 0x41, 0x00, 0x31, uint8(stuffSize-1), 0)
+	golden = append(golden, bytes.Repeat([]byte{0xFF}, stuffSize-2)...)
+	golden = append(golden, pesHeader...)
+	golden = append(golden, raw...)
+	assert.Equal(t, 1, len(packets))
+	assert.Equal(t, golden, packets[0])
+}
@@ -9,6 +9,7 @@
 package mpegts
 
 import (
+	"github.com/souliot/naza/pkg/bele"
 	"github.com/souliot/naza/pkg/nazabits"
 )
 
@@ -51,13 +52,20 @@ type PATProgramElement struct {
 	pmpid uint16
 }
 
-func ParsePAT(b []byte) (pat PAT) {
-	// TODO chef: 检查长度
+// @param b 从table_id开始的section数据，不包含pointer_field
+func ParsePAT(b []byte) (pat PAT, err error) {
+	if len(b) < 8 {
+		return pat, ErrMPEGTS
+	}
 	br := nazabits.NewBitReader(b)
 	pat.tid, _ = br.ReadBits8(8)
 	pat.ssi, _ = br.ReadBits8(1)
 	_, _ = br.ReadBits8(3)
 	pat.sl, _ = br.ReadBits16(12)
+	// section_length之后还有5字节固定字段以及4字节crc
+	if pat.sl < 9 || len(b) < 3+int(pat.sl) {
+		return pat, ErrMPEGTS
+	}
 	pat.tsi, _ = br.ReadBits16(16)
 	_, _ = br.ReadBits8(2)
 	pat.vn, _ = br.ReadBits8(5)
@@ -67,21 +75,21 @@ func ParsePAT(b []byte) (pat PAT) {
 
 	length := pat.sl - 9
 
-	for i := uint16(0); i < length; i += 4 {
+	for i := uint16(0); i+4 <= length; i += 4 {
 		var ppe PATProgramElement
 		ppe.pn, _ = br.ReadBits16(16)
 		_, _ = br.ReadBits8(3)
-		// TODO chef if pn == 0
+		// program_number为0时是network_PID，一并保存，使用时跳过
 		ppe.pmpid, _ = br.ReadBits16(13)
 		pat.ppes = append(pat.ppes, ppe)
 	}
-	pat.crc32, _ = br.ReadBits32(32)
+	pat.crc32 = bele.BEUint32(b[3+int(pat.sl)-4:])
 	return
 }
 
 func (pat *PAT) SearchPID(pid uint16) bool {
 	for _, ppe := range pat.ppes {
-		if pid == ppe.pmpid {
+		if ppe.pn != 0 && pid == ppe.pmpid {
 			return true
 		}
 	}
@@ -47,9 +47,16 @@ type PES struct {
 	dts        uint64
 }
 
-func ParsePES(b []byte) (pes PES, length int) {
+// @return length PES头的大小，也即ES数据在<b>中的起始位置
+func ParsePES(b []byte) (pes PES, length int, err error) {
+	if len(b) < 9 {
+		return pes, 0, ErrMPEGTS
+	}
 	br := nazabits.NewBitReader(b)
 	pes.pscp, _ = br.ReadBits32(24)
+	if pes.pscp != 1 {
+		return pes, 0, ErrMPEGTS
+	}
 	pes.sid, _ = br.ReadBits8(8)
 	pes.ppl, _ = br.ReadBits16(16)
 
@@ -58,14 +65,22 @@ func ParsePES(b []byte) (pes PES, length int) {
 	pes.pad2, _ = br.ReadBits8(6)
 	pes.phdl, _ = br.ReadBits8(8)
 
-	_, _ = br.ReadBytes(uint(pes.phdl))
 	length = 9 + int(pes.phdl)
+	if len(b) < length {
+		return pes, 0, ErrMPEGTS
+	}
 
 	// 处理得不是特别标准
 	if pes.ptsDtsFlag&0x2 != 0 {
+		if pes.phdl < 5 {
+			return pes, 0, ErrMPEGTS
+		}
 		_, pes.pts = readPTS(b[9:])
 	}
 	if pes.ptsDtsFlag&0x1 != 0 {
+		if pes.phdl < 10 {
+			return pes, 0, ErrMPEGTS
+		}
 		_, pes.dts = readPTS(b[14:])
 	} else {
 		pes.dts = pes.pts
@@ -9,6 +9,7 @@
 package mpegts
 
 import (
+	"github.com/souliot/naza/pkg/bele"
 	"github.com/souliot/naza/pkg/nazabits"
 )
 
@@ -60,13 +61,20 @@ type PMTProgramElement struct {
 	Length     uint16
 }
 
-func ParsePMT(b []byte) (pmt PMT) {
+// @param b 从table_id开始的section数据，不包含pointer_field
+func ParsePMT(b []byte) (pmt PMT, err error) {
+	if len(b) < 12 {
+		return pmt, ErrMPEGTS
+	}
 	br := nazabits.NewBitReader(b)
 	pmt.tid, _ = br.ReadBits8(8)
 	pmt.ssi, _ = br.ReadBits8(1)
 	_, _ = br.ReadBits8(3)
 	pmt.sl, _ = br.ReadBits16(12)
-	len := pmt.sl - 13
+	// section_length之后还有9字节固定字段以及4字节crc
+	if pmt.sl < 13 || len(b) < 3+int(pmt.sl) {
+		return pmt, ErrMPEGTS
+	}
 	pmt.pn, _ = br.ReadBits16(16)
 	_, _ = br.ReadBits8(2)
 	pmt.vn, _ = br.ReadBits8(5)
@@ -77,22 +85,32 @@ func ParsePMT(b []byte) (pmt PMT) {
 	pmt.pp, _ = br.ReadBits16(13)
 	_, _ = br.ReadBits8(4)
 	pmt.pil, _ = br.ReadBits16(12)
+	if pmt.pil > pmt.sl-13 {
+		return pmt, ErrMPEGTS
+	}
 	if pmt.pil != 0 {
 		_, _ = br.ReadBytes(uint(pmt.pil))
 	}
 
-	for i := uint16(0); i < len; i += 5 {
+	length := pmt.sl - 13 - pmt.pil
+	for i := uint16(0); i+5 <= length; {
 		var ppe PMTProgramElement
 		ppe.StreamType, _ = br.ReadBits8(8)
 		_, _ = br.ReadBits8(3)
 		ppe.Pid, _ = br.ReadBits16(13)
 		_, _ = br.ReadBits8(4)
 		ppe.Length, _ = br.ReadBits16(12)
+		i += 5
+		if ppe.Length > length-i {
+			return pmt, ErrMPEGTS
+		}
 		if ppe.Length != 0 {
-			_, _ = br.ReadBits32(uint(ppe.Length))
+			_, _ = br.ReadBytes(uint(ppe.Length))
 		}
+		i += ppe.Length
 		pmt.ProgramElements = append(pmt.ProgramElements, ppe)
 	}
+	pmt.crc32 = bele.BEUint32(b[3+int(pmt.sl)-4:])
 
 	return
 }
@@ -0,0 +1,72 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package mpegts
+
+import (
+	"github.com/souliot/naza/pkg/bele"
+)
+
+// HLS SAMPLE-AES加密时，PMT中的stream_type以及描述符与未加密时不同
+//
+// MPEG-2 Stream Encryption Format for HTTP Live Streaming
+// https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HLS_Sample_Encryption/Encryption/Encryption.html
+
+const (
+	StreamTypeAVCSampleAES = 0xdb
+	StreamTypeAACSampleAES = 0xcf
+
+	descriptorTagRegistration         = 0x05
+	descriptorTagPrivateDataIndicator = 0x0f
+)
+
+// 生成SAMPLE-AES加密时TS切片开头的PAT以及PMT，与FixedFragmentHeader对应
+//
+// @param asc AAC AudioSpecificConfig，写入PMT的audio_setup_information中，可以为nil
+//
+// @return 两个TS packet，376字节
+func GenSampleAESFragmentHeader(asc []byte) []byte {
+	out := make([]byte, tsPacketSize*2)
+	copy(out, FixedFragmentHeader[:tsPacketSize])
+
+	// 视频：private_data_indicator_descriptor('zavc')
+	videoESInfo := []byte{descriptorTagPrivateDataIndicator, 4, 'z', 'a', 'v', 'c'}
+
+	// 音频：private_data_indicator_descriptor('aacd') + registration_descriptor('apad', audio_setup_information)
+	audioSetup := []byte{'z', 'a', 'a', 'c', 0, 0, 1, uint8(len(asc))}
+	audioSetup = append(audioSetup, asc...)
+	audioESInfo := []byte{descriptorTagPrivateDataIndicator, 4, 'a', 'a', 'c', 'd', descriptorTagRegistration, uint8(4 + len(audioSetup)), 'a', 'p', 'a', 'd'}
+	audioESInfo = append(audioESInfo, audioSetup...)
+
+	section := []byte{
+		0x02, 0xb0, 0x00, // table_id, section_length稍后回填
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe1, 0x00, // PCR_PID 256
+		0xf0, 0x00,
+	}
+	section = append(section, StreamTypeAVCSampleAES, 0xe1, 0x00, 0xf0, uint8(len(videoESInfo)))
+	section = append(section, videoESInfo...)
+	section = append(section, StreamTypeAACSampleAES, 0xe1, 0x01, 0xf0, uint8(len(audioESInfo)))
+	section = append(section, audioESInfo...)
+
+	// section_length为section_length字段之后的字节数，包含4字节crc
+	sl := len(section) - 3 + 4
+	section[1] |= uint8(sl >> 8)
+	section[2] = uint8(sl)
+	crc := make([]byte, 4)
+	bele.BEPutUint32(crc, calcCRC32(section))
+	section = append(section, crc...)
+
+	pmt := out[tsPacketSize:]
+	copy(pmt, []byte{0x47, 0x50, 0x01, 0x10, 0x00})
+	n := copy(pmt[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		pmt[i] = 0xff
+	}
+	return out
+}
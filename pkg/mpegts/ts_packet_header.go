@@ -51,12 +51,18 @@ type TSPacketHeader struct {
 // program_clock_reference_extension    [9b] ******
 // ----------------------------------------------------------
 type TSPacketAdaptation struct {
-	Length uint8
+	Length        uint8
+	Discontinuity bool
+	RandomAccess  bool
+	PCRFlag       bool
+	PCR           uint64 // 单位为27MHz，也即 base*300 + extension
 }
 
 // 解析4字节TS Packet header
-func ParseTSPacketHeader(b []byte) (h TSPacketHeader) {
-	// TODO chef: 检查长度
+func ParseTSPacketHeader(b []byte) (h TSPacketHeader, err error) {
+	if len(b) < 4 || b[0] != syncByte {
+		return h, ErrMPEGTS
+	}
 	br := nazabits.NewBitReader(b)
 	h.Sync, _ = br.ReadBits8(8)
 	h.Err, _ = br.ReadBits8(1)
@@ -69,9 +75,28 @@ func ParseTSPacketHeader(b []byte) (h TSPacketHeader) {
 	return
 }
 
-// TODO chef
-func ParseTSPacketAdaptation(b []byte) (f TSPacketAdaptation) {
-	br := nazabits.NewBitReader(b)
-	f.Length, _ = br.ReadBits8(8)
+// @param b 从adaptation_field_length开始的数据
+func ParseTSPacketAdaptation(b []byte) (f TSPacketAdaptation, err error) {
+	if len(b) < 1 {
+		return f, ErrMPEGTS
+	}
+	f.Length = b[0]
+	if len(b) < 1+int(f.Length) {
+		return f, ErrMPEGTS
+	}
+	if f.Length == 0 {
+		return
+	}
+	f.Discontinuity = b[1]&0x80 != 0
+	f.RandomAccess = b[1]&0x40 != 0
+	f.PCRFlag = b[1]&0x10 != 0
+	if f.PCRFlag {
+		if f.Length < 7 {
+			return f, ErrMPEGTS
+		}
+		base := uint64(b[2])<<25 | uint64(b[3])<<17 | uint64(b[4])<<9 | uint64(b[5])<<1 | uint64(b[6])>>7
+		ext := uint64(b[6]&0x01)<<8 | uint64(b[7])
+		f.PCR = base*300 + ext
+	}
 	return
 }
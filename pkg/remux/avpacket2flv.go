@@ -171,9 +171,7 @@ func AVPacket2FLVTag(pkt base.AVPacket) (tag httpflv.Tag, err error) {
 			i += 4 + naluSize
 		}
 
-		tag.Raw[httpflv.TagHeaderSize+2] = 0x0 // cts
-		tag.Raw[httpflv.TagHeaderSize+3] = 0x0
-		tag.Raw[httpflv.TagHeaderSize+4] = 0x0
+		bele.BEPutUint24(tag.Raw[httpflv.TagHeaderSize+2:], pkt.CompositionTime) // cts
 		copy(tag.Raw[httpflv.TagHeaderSize+5:], pkt.Payload)
 		bele.BEPutUint32(tag.Raw[httpflv.TagHeaderSize+int(tag.Header.DataSize):], uint32(httpflv.TagHeaderSize)+tag.Header.DataSize)
 	case base.AVPacketPTAAC:
@@ -164,9 +164,7 @@ func AVPacket2RTMPMsg(pkt base.AVPacket) (msg base.RTMPMsg, err error) {
 			i += 4 + naluSize
 		}
 
-		msg.Payload[2] = 0x0 // cts
-		msg.Payload[3] = 0x0
-		msg.Payload[4] = 0x0
+		bele.BEPutUint24(msg.Payload[2:], pkt.CompositionTime) // cts
 		copy(msg.Payload[5:], pkt.Payload)
 	case base.AVPacketPTAAC:
 		msg.Header.TimestampAbs = pkt.Timestamp
@@ -0,0 +1,343 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"bytes"
+
+	"github.com/souliot/naza/pkg/bele"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/aac"
+	"github.com/souliot/siot-av/pkg/avc"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/hevc"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+const (
+	// 等待音视频参数时，最多缓存的音视频包数量
+	maxPendingPacketNum = 512
+
+	// 输入流不连续时，不连续处前后两帧的时间戳间隔，单位毫秒
+	discontinuityGapMS = 40
+)
+
+// @param asc: AAC AudioSpecificConfig，注意，如果不存在音频，则为nil
+// @param vps, sps, pps 如果都为nil，则没有视频，如果sps, pps不为nil，则vps不为nil是H265，vps为nil是H264
+type OnAVConfig func(asc, vps, sps, pps []byte)
+
+// @param pkt: 视频为AVCC格式（4字节长度前缀），不包含vps、sps、pps、aud
+//
+//	音频为AAC raw frame，不包含ADTS头
+//	Timestamp为DTS，单位毫秒
+//	视频的CompositionTime为PTS-DTS，单位毫秒
+type OnAVPacket func(pkt base.AVPacket)
+
+// 将MPEG-TS流转换为音视频参数以及AVPacket，回调与rtsp.BaseInSessionObserver中的音视频回调保持一致，方便上层复用
+//
+// 注意，非协程安全
+type TS2AVPacket struct {
+	uniqueKey  string
+	onAVConfig OnAVConfig
+	onAVPacket OnAVPacket
+
+	demuxer       *mpegts.Demuxer
+	programNumber uint16
+	asc           []byte
+	vps           []byte
+	sps           []byte
+	pps           []byte
+	configSent    bool
+	pending       []base.AVPacket
+	gotKeyFrame   bool
+	hasBaseDTS    bool
+	baseDTS       uint64
+	lastDTS       uint64
+	dtsWrap       uint64
+	discontinuity bool   // 下一个时间戳需要重新设置基准
+	tsOffset      uint32 // 重新设置基准后，输出时间戳的偏移，单位毫秒
+	lastTimestamp uint32 // 已输出的最大时间戳，单位毫秒
+
+	log log.Logger
+}
+
+// @param uniqueKey     用于日志，一般为上层session的UniqueKey
+// @param programNumber TS流中存在多个program时，选择的program_number，为0则使用最先收到数据的program
+func NewTS2AVPacket(uniqueKey string, programNumber uint16, onAVConfig OnAVConfig, onAVPacket OnAVPacket, logger log.Logger) *TS2AVPacket {
+	r := &TS2AVPacket{
+		uniqueKey:     uniqueKey,
+		onAVConfig:    onAVConfig,
+		onAVPacket:    onAVPacket,
+		programNumber: programNumber,
+		log:           logger,
+	}
+	r.demuxer = mpegts.NewDemuxer(r.onFrame)
+	r.log.WithPrefix("pkg.remux.ts2avpacket")
+	return r
+}
+
+func (r *TS2AVPacket) Log() log.Logger {
+	if r.log == nil {
+		r.log = log.DefaultBeeLogger
+	}
+	r.log.WithPrefix("pkg.remux.ts2avpacket")
+	return r.log
+}
+
+// @param b 任意长度的TS流，不要求按188字节对齐，函数调用结束后，内部不持有该内存块
+func (r *TS2AVPacket) Feed(b []byte) {
+	r.demuxer.Feed(b)
+}
+
+// 输入流结束时调用，输出还在缓存中的最后一帧
+func (r *TS2AVPacket) Flush() {
+	r.demuxer.Flush()
+}
+
+// 输入流不连续时调用，比如HLS中的`#EXT-X-DISCONTINUITY`
+// 之后的时间戳重新设置基准，并接着之前输出的时间戳继续增长，保证输出的时间戳单调递增
+//
+// 注意，调用之前应该先调用Flush，避免不连续前后的数据混在同一帧中
+func (r *TS2AVPacket) Discontinuity() {
+	r.demuxer.ResetCC()
+	r.discontinuity = true
+}
+
+func (r *TS2AVPacket) onFrame(frame *mpegts.Frame) {
+	if r.programNumber == 0 {
+		r.programNumber = frame.ProgramNumber
+		r.Log().Info("[%s] select program. program_number=%d", r.uniqueKey, r.programNumber)
+	}
+	if frame.ProgramNumber != r.programNumber {
+		return
+	}
+
+	switch frame.PayloadType {
+	case base.AVPacketPTAVC, base.AVPacketPTHEVC:
+		r.onVideoFrame(frame)
+	case base.AVPacketPTAAC:
+		r.onAudioFrame(frame)
+	}
+}
+func (r *TS2AVPacket) onVideoFrame(frame *mpegts.Frame) {
+	isHEVC := frame.PayloadType == base.AVPacketPTHEVC
+
+	var vps, sps, pps []byte
+	var out []byte
+	err := avc.IterateNALUAnnexB(frame.Raw, func(nal []byte) {
+		if len(nal) == 0 {
+			return
+		}
+		if isHEVC {
+			switch hevc.ParseNALUType(nal[0]) {
+			case hevc.NALUTypeVPS:
+				vps = nal
+				return
+			case hevc.NALUTypeSPS:
+				sps = nal
+				return
+			case hevc.NALUTypePPS:
+				pps = nal
+				return
+			case hevc.NALUTypeAUD:
+				return
+			}
+		} else {
+			switch avc.ParseNALUType(nal[0]) {
+			case avc.NALUTypeSPS:
+				sps = nal
+				return
+			case avc.NALUTypePPS:
+				pps = nal
+				return
+			case avc.NALUTypeAUD:
+				return
+			}
+		}
+		var l [4]byte
+		bele.BEPutUint32(l[:], uint32(len(nal)))
+		out = append(out, l[:]...)
+		out = append(out, nal...)
+	})
+	if err != nil {
+		r.Log().Warn("[%s] invalid annexb video frame. err=%+v", r.uniqueKey, err)
+		return
+	}
+
+	if sps != nil && pps != nil && (!isHEVC || vps != nil) {
+		if !bytes.Equal(sps, r.sps) || !bytes.Equal(pps, r.pps) || !bytes.Equal(vps, r.vps) {
+			r.vps = append([]byte(nil), vps...)
+			if !isHEVC {
+				r.vps = nil
+			}
+			r.sps = append([]byte(nil), sps...)
+			r.pps = append([]byte(nil), pps...)
+			// 视频参数变化时重新通知上层
+			r.configSent = false
+		}
+	}
+
+	if !r.gotKeyFrame {
+		if !frame.Key {
+			return
+		}
+		r.gotKeyFrame = true
+	}
+	if len(out) == 0 {
+		return
+	}
+
+	pkt := base.AVPacket{
+		Timestamp:       r.calcTimestamp(frame.DTS),
+		PayloadType:     frame.PayloadType,
+		Payload:         out,
+		CompositionTime: calcCompositionTime(frame.PTS, frame.DTS),
+	}
+	r.output(pkt)
+}
+
+func (r *TS2AVPacket) onAudioFrame(frame *mpegts.Frame) {
+	h, err := aac.ParseADTSHeader(frame.Raw)
+	if err != nil || h.FrameLength > len(frame.Raw) {
+		r.Log().Warn("[%s] invalid adts frame. err=%+v", r.uniqueKey, err)
+		return
+	}
+	if asc := h.AudioSpecificConfig(); !bytes.Equal(asc, r.asc) {
+		r.asc = asc
+		r.configSent = false
+	}
+
+	// 有视频时，从视频关键帧开始输出，保证音视频对齐
+	if r.hasVideo() && !r.gotKeyFrame {
+		return
+	}
+
+	pkt := base.AVPacket{
+		Timestamp:   r.calcTimestamp(frame.DTS),
+		PayloadType: base.AVPacketPTAAC,
+		Payload:     frame.Raw[h.HeaderLength:h.FrameLength],
+	}
+	r.output(pkt)
+}
+
+// 音视频参数还没有全部获取到时，先缓存，比如视频关键帧早于第一个音频帧到达
+func (r *TS2AVPacket) output(pkt base.AVPacket) {
+	if !r.checkConfig() {
+		if len(r.pending) >= maxPendingPacketNum {
+			r.pending = r.pending[1:]
+		}
+		r.pending = append(r.pending, pkt)
+		return
+	}
+
+	for _, p := range r.pending {
+		r.onAVPacket(p)
+	}
+	r.pending = nil
+	r.onAVPacket(pkt)
+}
+
+// PMT中声明的音视频参数都获取到之后，通知上层
+//
+// @return 是否已经通知过上层
+func (r *TS2AVPacket) checkConfig() bool {
+	if r.configSent {
+		return true
+	}
+
+	hasAudio, hasVideo := r.streamTypes()
+	if hasAudio && r.asc == nil {
+		return false
+	}
+	if hasVideo && (r.sps == nil || r.pps == nil) {
+		return false
+	}
+
+	var asc, vps, sps, pps []byte
+	if hasAudio {
+		asc = r.asc
+	}
+	if hasVideo {
+		vps, sps, pps = r.vps, r.sps, r.pps
+	}
+	r.Log().Info("[%s] av config. hasAudio=%v, hasVideo=%v, isHEVC=%v", r.uniqueKey, hasAudio, hasVideo, vps != nil)
+	r.onAVConfig(asc, vps, sps, pps)
+	r.configSent = true
+	return true
+}
+
+func (r *TS2AVPacket) hasVideo() bool {
+	_, hasVideo := r.streamTypes()
+	return hasVideo
+}
+
+func (r *TS2AVPacket) streamTypes() (hasAudio, hasVideo bool) {
+	for _, p := range r.demuxer.Programs() {
+		if p.Number != r.programNumber {
+			continue
+		}
+		for _, stream := range p.Streams {
+			switch stream.PayloadType {
+			case base.AVPacketPTAAC:
+				hasAudio = true
+			case base.AVPacketPTAVC, base.AVPacketPTHEVC:
+				hasVideo = true
+			}
+		}
+	}
+	return
+}
+
+// 处理33位回绕，并转换为从0开始的毫秒
+func (r *TS2AVPacket) calcTimestamp(dts uint64) uint32 {
+	if r.discontinuity {
+		r.discontinuity = false
+		r.hasBaseDTS = false
+		r.lastDTS = 0
+		r.dtsWrap = 0
+		// 不知道不连续处前后两帧的实际间隔，使用一个典型的帧间隔
+		r.tsOffset = r.lastTimestamp + discontinuityGapMS
+	}
+
+	dts += r.dtsWrap
+	if r.hasBaseDTS {
+		if dts+(1<<32) < r.lastDTS {
+			r.dtsWrap += 1 << 33
+			dts += 1 << 33
+		} else if dts > r.lastDTS+(1<<32) && dts >= 1<<33 {
+			// 回绕之前的数据迟到，比如音视频交织
+			dts -= 1 << 33
+		}
+	} else {
+		r.hasBaseDTS = true
+		r.baseDTS = dts
+	}
+	if dts > r.lastDTS {
+		r.lastDTS = dts
+	}
+
+	ts := r.tsOffset
+	if dts > r.baseDTS {
+		ts += uint32((dts - r.baseDTS) / 90)
+	}
+	if ts > r.lastTimestamp {
+		r.lastTimestamp = ts
+	}
+	return ts
+}
+
+// 计算PTS-DTS，单位毫秒，处理33位回绕
+// PTS小于DTS的异常数据返回0
+func calcCompositionTime(pts, dts uint64) uint32 {
+	diff := (pts - dts) & (1<<33 - 1)
+	if diff >= 1<<32 {
+		return 0
+	}
+	return uint32(diff / 90)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+func TestCalcTimestamp(t *testing.T) {
+	r := NewTS2AVPacket("", 0, func(asc, vps, sps, pps []byte) {}, func(pkt base.AVPacket) {}, log.DefaultBeeLogger)
+	max := uint64(1<<33 - 1)
+	assert.Equal(t, uint32(0), r.calcTimestamp(max-900))
+	// 回绕
+	assert.Equal(t, uint32(20), r.calcTimestamp(900))
+	// 回绕前的迟到数据
+	assert.Equal(t, uint32(5), r.calcTimestamp(max-450))
+	assert.Equal(t, uint32(30), r.calcTimestamp(1800))
+
+	// 不连续之后，接着之前的时间戳继续增长
+	r.Discontinuity()
+	assert.Equal(t, uint32(70), r.calcTimestamp(900000))
+	assert.Equal(t, uint32(110), r.calcTimestamp(903600))
+}
+
+// 带B帧的流，PTS与DTS不同，CompositionTime需要透传到rtmp视频tag头中
+func TestTS2AVPacket_CompositionTime(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	annexb := func(nals ...[]byte) []byte {
+		var out []byte
+		for _, nal := range nals {
+			out = append(out, 0, 0, 0, 1)
+			out = append(out, nal...)
+		}
+		return out
+	}
+	adts := []byte{0xFF, 0xF1, 0x50, 0x80, 0x01, 0x1F, 0xFC, 0x21}
+
+	// 解码顺序I P B，显示顺序I B P
+	in := []mpegts.Frame{
+		{PTS: 93600, DTS: 90000, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Key: true, Raw: annexb(sps, pps, []byte{0x65, 0x88})},
+		{PTS: 90000, DTS: 90000, Pid: mpegts.PidAudio, Sid: mpegts.StreamIDAudio, Raw: adts},
+		{PTS: 100800, DTS: 93600, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Raw: annexb([]byte{0x41, 0x9a})},
+		{PTS: 97200, DTS: 97200, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Raw: annexb([]byte{0x01, 0x9e})},
+	}
+	ts := append([]byte(nil), mpegts.FixedFragmentHeader...)
+	pid2CC := make(map[uint16]uint8)
+	for i := range in {
+		in[i].CC = pid2CC[in[i].Pid]
+		mpegts.PackTSPacket(&in[i], func(packet []byte) {
+			ts = append(ts, packet...)
+		})
+		pid2CC[in[i].Pid] = in[i].CC
+	}
+
+	var out []base.AVPacket
+	r := NewTS2AVPacket("", 0, func(asc, vps, sps, pps []byte) {}, func(pkt base.AVPacket) {
+		if pkt.PayloadType == base.AVPacketPTAVC {
+			out = append(out, pkt)
+		}
+	}, log.DefaultBeeLogger)
+	r.Feed(ts)
+	r.Flush()
+
+	assert.Equal(t, 3, len(out))
+	assert.Equal(t, []uint32{0, 40, 80}, []uint32{out[0].Timestamp, out[1].Timestamp, out[2].Timestamp})
+	assert.Equal(t, []uint32{40, 80, 0}, []uint32{out[0].CompositionTime, out[1].CompositionTime, out[2].CompositionTime})
+
+	msg, err := AVPacket2RTMPMsg(out[1])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0x27, 0x01, 0x00, 0x00, 0x50}, msg.Payload[:5])
+	tag, err := AVPacket2FLVTag(out[0])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0x17, 0x01, 0x00, 0x00, 0x28}, tag.Raw[11:16])
+
+	// PTS回绕
+	assert.Equal(t, uint32(40), calcCompositionTime(900, 1<<33-2700))
+	assert.Equal(t, uint32(0), calcCompositionTime(90000, 93600))
+}
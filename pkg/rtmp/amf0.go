@@ -17,6 +17,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/souliot/naza/pkg/bele"
 	"github.com/souliot/naza/pkg/log"
@@ -29,20 +30,23 @@ var (
 )
 
 const (
-	AMF0TypeMarkerNumber     = uint8(0x00)
-	AMF0TypeMarkerBoolean    = uint8(0x01)
-	AMF0TypeMarkerString     = uint8(0x02)
-	AMF0TypeMarkerObject     = uint8(0x03)
-	AMF0TypeMarkerNull       = uint8(0x05)
-	AMF0TypeMarkerEcmaArray  = uint8(0x08)
-	AMF0TypeMarkerObjectEnd  = uint8(0x09)
-	AMF0TypeMarkerLongString = uint8(0x0c)
+	AMF0TypeMarkerNumber      = uint8(0x00)
+	AMF0TypeMarkerBoolean     = uint8(0x01)
+	AMF0TypeMarkerString      = uint8(0x02)
+	AMF0TypeMarkerObject      = uint8(0x03)
+	AMF0TypeMarkerNull        = uint8(0x05)
+	AMF0TypeMarkerEcmaArray   = uint8(0x08)
+	AMF0TypeMarkerObjectEnd   = uint8(0x09)
+	AMF0TypeMarkerStrictArray = uint8(0x0a)
+	AMF0TypeMarkerLongString  = uint8(0x0c)
+
+	// AMF3的信令和data消息中使用，表示后面的值切换为amf3编码
+	AMF0TypeMarkerAVMPlusObject = uint8(0x11)
 
 	// 还没用到的类型
 	//AMF0TypeMarkerMovieclip   = uint8(0x04)
 	//AMF0TypeMarkerUndefined   = uint8(0x06)
 	//AMF0TypeMarkerReference   = uint8(0x07)
-	//AMF0TypeMarkerStrictArray = uint8(0x0a)
 	//AMF0TypeMarkerData        = uint8(0x0b)
 	//AMF0TypeMarkerUnsupported = uint8(0x0d)
 	//AMF0TypeMarkerRecordset   = uint8(0x0e)
@@ -151,27 +155,57 @@ func (amf0) WriteObject(writer io.Writer, opa ObjectPairArray) error {
 		if _, err := writer.Write([]byte(opa[i].Key)); err != nil {
 			return err
 		}
-		switch opa[i].Value.(type) {
-		case string:
-			if err := AMF0.WriteString(writer, opa[i].Value.(string)); err != nil {
-				return err
-			}
-		case int:
-			if err := AMF0.WriteNumber(writer, float64(opa[i].Value.(int))); err != nil {
-				return err
-			}
-		case bool:
-			if err := AMF0.WriteBoolean(writer, opa[i].Value.(bool)); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("unknown value type. i=%d, v=%+v", i, opa[i].Value)
+		if err := AMF0.WriteValue(writer, opa[i].Value); err != nil {
+			return fmt.Errorf("%v. i=%d", err, i)
 		}
 	}
 	_, err := writer.Write(AMF0TypeMarkerObjectEndBytes)
 	return err
 }
 
+func (amf0) WriteStrictArray(writer io.Writer, vals []interface{}) error {
+	if _, err := writer.Write([]byte{AMF0TypeMarkerStrictArray}); err != nil {
+		return err
+	}
+	if err := bele.WriteBE(writer, uint32(len(vals))); err != nil {
+		return err
+	}
+	for i, v := range vals {
+		if err := AMF0.WriteValue(writer, v); err != nil {
+			return fmt.Errorf("%v. i=%d", err, i)
+		}
+	}
+	return nil
+}
+
+// 目前支持写入的Go类型：nil, bool, int, float64, string, []byte, time.Time, []interface{}, ObjectPairArray, []ObjectPair
+// 其中time.Time以number（毫秒）写入，[]byte（amf3的byte array）以string写入，[]interface{}以strict array写入
+func (amf0) WriteValue(writer io.Writer, val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		return AMF0.WriteNull(writer)
+	case bool:
+		return AMF0.WriteBoolean(writer, v)
+	case int:
+		return AMF0.WriteNumber(writer, float64(v))
+	case float64:
+		return AMF0.WriteNumber(writer, v)
+	case string:
+		return AMF0.WriteString(writer, v)
+	case []byte:
+		return AMF0.WriteString(writer, string(v))
+	case time.Time:
+		return AMF0.WriteNumber(writer, float64(v.UnixNano()/int64(time.Millisecond)))
+	case []ObjectPair:
+		return AMF0.WriteObject(writer, v)
+	case ObjectPairArray:
+		return AMF0.WriteObject(writer, v)
+	case []interface{}:
+		return AMF0.WriteStrictArray(writer, v)
+	}
+	return fmt.Errorf("unknown value type. v=%+v", val)
+}
+
 // ----------------------------------------------------------------------------
 // read类型的方法集合
 //
@@ -216,6 +250,15 @@ func (amf0) ReadString(b []byte) (val string, l int, err error) {
 	case AMF0TypeMarkerLongString:
 		val, l, err = AMF0.ReadLongStringWithoutType(b[1:])
 		l++
+	case AMF0TypeMarkerAVMPlusObject:
+		var v interface{}
+		if v, l, err = AMF0.ReadAVMPlusObject(b); err != nil {
+			return "", 0, err
+		}
+		var ok bool
+		if val, ok = v.(string); !ok {
+			return "", 0, ErrAMFInvalidType
+		}
 	default:
 		err = ErrAMFInvalidType
 	}
@@ -223,6 +266,16 @@ func (amf0) ReadString(b []byte) (val string, l int, err error) {
 }
 
 func (amf0) ReadNumber(b []byte) (float64, int, error) {
+	if len(b) >= 1 && b[0] == AMF0TypeMarkerAVMPlusObject {
+		v, l, err := AMF0.ReadAVMPlusObject(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, ok := v.(float64); ok {
+			return n, l, nil
+		}
+		return 0, 0, ErrAMFInvalidType
+	}
 	if len(b) < 9 {
 		return 0, 0, ErrAMFTooShort
 	}
@@ -246,6 +299,16 @@ func (amf0) ReadNull(b []byte) (int, error) {
 	if len(b) < 1 {
 		return 0, ErrAMFTooShort
 	}
+	if b[0] == AMF0TypeMarkerAVMPlusObject {
+		v, l, err := AMF0.ReadAVMPlusObject(b)
+		if err != nil {
+			return 0, err
+		}
+		if v != nil {
+			return 0, ErrAMFInvalidType
+		}
+		return l, nil
+	}
 	if b[0] != AMF0TypeMarkerNull {
 		return 0, ErrAMFInvalidType
 	}
@@ -256,6 +319,16 @@ func (amf0) ReadObject(b []byte) (ObjectPairArray, int, error) {
 	if len(b) < 1 {
 		return nil, 0, ErrAMFTooShort
 	}
+	if b[0] == AMF0TypeMarkerAVMPlusObject {
+		v, l, err := AMF0.ReadAVMPlusObject(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		if opa, ok := v.(ObjectPairArray); ok {
+			return opa, l, nil
+		}
+		return nil, 0, ErrAMFInvalidType
+	}
 	if b[0] != AMF0TypeMarkerObject {
 		return nil, 0, ErrAMFInvalidType
 	}
@@ -275,45 +348,17 @@ func (amf0) ReadObject(b []byte) (ObjectPairArray, int, error) {
 		if len(b)-index < 1 {
 			return nil, 0, ErrAMFTooShort
 		}
-		vt := b[index]
-		switch vt {
-		case AMF0TypeMarkerString:
-			v, l, err := AMF0.ReadString(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		case AMF0TypeMarkerBoolean:
-			v, l, err := AMF0.ReadBoolean(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		case AMF0TypeMarkerNumber:
-			v, l, err := AMF0.ReadNumber(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		case AMF0TypeMarkerEcmaArray:
-			v, l, err := AMF0.ReadArray(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		default:
-			return nil, 0, fmt.Errorf("unknown type. vt=%d", vt)
+		v, l, err := AMF0.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
 		}
+		ops = append(ops, ObjectPair{k, v})
+		index += l
 	}
 }
 
 // TODO chef:
 // - 实现WriteArray
-// - ReadArray和ReadObject有些代码重复
 
 func (amf0) ReadArray(b []byte) (ObjectPairArray, int, error) {
 	if len(b) < 5 {
@@ -335,32 +380,12 @@ func (amf0) ReadArray(b []byte) (ObjectPairArray, int, error) {
 		if len(b)-index < 1 {
 			return nil, 0, ErrAMFTooShort
 		}
-		vt := b[index]
-		switch vt {
-		case AMF0TypeMarkerString:
-			v, l, err := AMF0.ReadString(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		case AMF0TypeMarkerBoolean:
-			v, l, err := AMF0.ReadBoolean(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		case AMF0TypeMarkerNumber:
-			v, l, err := AMF0.ReadNumber(b[index:])
-			if err != nil {
-				return nil, 0, err
-			}
-			ops = append(ops, ObjectPair{k, v})
-			index += l
-		default:
-			return nil, 0, fmt.Errorf("unknown type. vt=%d", vt)
+		v, l, err := AMF0.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
 		}
+		ops = append(ops, ObjectPair{k, v})
+		index += l
 	}
 
 	if len(b)-index >= 3 && bytes.Equal(b[index:index+3], AMF0TypeMarkerObjectEndBytes) {
@@ -372,6 +397,32 @@ func (amf0) ReadArray(b []byte) (ObjectPairArray, int, error) {
 	return ops, index, nil
 }
 
+// 注意，元素个数由对端填写，每个元素至少占1个字节，不按元素个数预先分配内存
+func (amf0) ReadStrictArray(b []byte) ([]interface{}, int, error) {
+	if len(b) < 5 {
+		return nil, 0, ErrAMFTooShort
+	}
+	if b[0] != AMF0TypeMarkerStrictArray {
+		return nil, 0, ErrAMFInvalidType
+	}
+	count := bele.BEUint32(b[1:])
+	if int64(count) > int64(len(b)-5) {
+		return nil, 0, ErrAMFTooShort
+	}
+
+	index := 5
+	vals := make([]interface{}, 0, count)
+	for i := uint32(0); i < count; i++ {
+		v, l, err := AMF0.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		vals = append(vals, v)
+		index += l
+	}
+	return vals, index, nil
+}
+
 func (amf0) ReadObjectOrArray(b []byte) (ObjectPairArray, int, error) {
 	if len(b) < 1 {
 		return nil, 0, ErrAMFTooShort
@@ -384,3 +435,46 @@ func (amf0) ReadObjectOrArray(b []byte) (ObjectPairArray, int, error) {
 	}
 	return nil, 0, ErrAMFInvalidType
 }
+
+// 读取任意类型的值
+//
+// @return 第1个参数的Go类型参见WriteValue，另外avmplus-object切换后的amf3值参见amf3.go
+func (amf0) ReadValue(b []byte) (interface{}, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+	switch b[0] {
+	case AMF0TypeMarkerString, AMF0TypeMarkerLongString:
+		return AMF0.ReadString(b)
+	case AMF0TypeMarkerBoolean:
+		return AMF0.ReadBoolean(b)
+	case AMF0TypeMarkerNumber:
+		return AMF0.ReadNumber(b)
+	case AMF0TypeMarkerNull:
+		return nil, 1, nil
+	case AMF0TypeMarkerObject:
+		return AMF0.ReadObject(b)
+	case AMF0TypeMarkerEcmaArray:
+		return AMF0.ReadArray(b)
+	case AMF0TypeMarkerStrictArray:
+		return AMF0.ReadStrictArray(b)
+	case AMF0TypeMarkerAVMPlusObject:
+		return AMF0.ReadAVMPlusObject(b)
+	}
+	return nil, 0, fmt.Errorf("unknown type. vt=%d", b[0])
+}
+
+// 读取avmplus-object标记以及紧随其后的一个amf3值，每次调用使用独立的amf3引用表
+func (amf0) ReadAVMPlusObject(b []byte) (interface{}, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+	if b[0] != AMF0TypeMarkerAVMPlusObject {
+		return nil, 0, ErrAMFInvalidType
+	}
+	v, l, err := AMF3.ReadValue(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, l + 1, nil
+}
@@ -0,0 +1,623 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// amf3.go
+// @pure
+// 提供amf3格式的编码与解码的操作
+//
+// 参考 spec-amf-file-format-spec.pdf
+//
+// 解码后的值与Go类型的对应关系：
+// - undefined, null -> nil
+// - false, true     -> bool
+// - integer, double -> float64 （integer也转换为float64，与amf0的number保持一致，方便上层统一使用ObjectPairArray.FindNumber）
+// - string, xml     -> string
+// - date            -> time.Time
+// - byte array      -> []byte
+// - array           -> 只有dense部分时为[]interface{}，否则为ObjectPairArray（dense部分的key为下标）
+// - object          -> ObjectPairArray
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/souliot/naza/pkg/bele"
+)
+
+var (
+	ErrAMF3InvalidU29       = errors.New("lal.rtmp: invalid amf3 u29")
+	ErrAMF3InvalidReference = errors.New("lal.rtmp: invalid amf3 reference")
+	ErrAMF3Externalizable   = errors.New("lal.rtmp: amf3 externalizable object not supported")
+)
+
+const (
+	AMF3TypeMarkerUndefined = uint8(0x00)
+	AMF3TypeMarkerNull      = uint8(0x01)
+	AMF3TypeMarkerFalse     = uint8(0x02)
+	AMF3TypeMarkerTrue      = uint8(0x03)
+	AMF3TypeMarkerInteger   = uint8(0x04)
+	AMF3TypeMarkerDouble    = uint8(0x05)
+	AMF3TypeMarkerString    = uint8(0x06)
+	AMF3TypeMarkerXMLDoc    = uint8(0x07)
+	AMF3TypeMarkerDate      = uint8(0x08)
+	AMF3TypeMarkerArray     = uint8(0x09)
+	AMF3TypeMarkerObject    = uint8(0x0a)
+	AMF3TypeMarkerXML       = uint8(0x0b)
+	AMF3TypeMarkerByteArray = uint8(0x0c)
+
+	// 还没用到的类型
+	//AMF3TypeMarkerVectorInt    = uint8(0x0d)
+	//AMF3TypeMarkerVectorUint   = uint8(0x0e)
+	//AMF3TypeMarkerVectorDouble = uint8(0x0f)
+	//AMF3TypeMarkerVectorObject = uint8(0x10)
+	//AMF3TypeMarkerDictionary   = uint8(0x11)
+)
+
+const (
+	amf3IntegerMax = 0x0FFFFFFF
+	amf3IntegerMin = -0x10000000
+	amf3U29Max     = 0x1FFFFFFF
+)
+
+type amf3 struct{}
+
+var AMF3 amf3
+
+// 读取一个完整的amf3值，内部使用独立的引用表
+func (amf3) ReadValue(b []byte) (interface{}, int, error) {
+	return NewAMF3Reader().ReadValue(b)
+}
+
+// 写入一个完整的amf3值，内部使用独立的引用表
+func (amf3) WriteValue(writer io.Writer, val interface{}) error {
+	return NewAMF3Writer().WriteValue(writer, val)
+}
+
+// @return 第1个参数为读取出的u29值，第2个参数为消耗的字节大小
+func (amf3) ReadU29(b []byte) (uint32, int, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		if len(b) <= i {
+			return 0, 0, ErrAMFTooShort
+		}
+		if i == 3 {
+			v = v<<8 | uint32(b[i])
+			return v, 4, nil
+		}
+		v = v<<7 | uint32(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	// 不会走到这里
+	return 0, 0, ErrAMF3InvalidU29
+}
+
+func (amf3) WriteU29(writer io.Writer, v uint32) error {
+	var b []byte
+	switch {
+	case v < 0x80:
+		b = []byte{uint8(v)}
+	case v < 0x4000:
+		b = []byte{uint8(v>>7) | 0x80, uint8(v & 0x7F)}
+	case v < 0x200000:
+		b = []byte{uint8(v>>14) | 0x80, uint8(v>>7) | 0x80, uint8(v & 0x7F)}
+	case v <= amf3U29Max:
+		b = []byte{uint8(v>>22) | 0x80, uint8(v>>15) | 0x80, uint8(v>>8) | 0x80, uint8(v)}
+	default:
+		return ErrAMF3InvalidU29
+	}
+	_, err := writer.Write(b)
+	return err
+}
+
+// ----------------------------------------------------------------------------
+
+type amf3Traits struct {
+	className      string
+	dynamic        bool
+	externalizable bool
+	members        []string
+}
+
+// AMF3Reader 持有一次amf3解码过程中的string、object、traits三张引用表
+//
+// 注意，在amf0中通过avmplus-object标记切换到amf3时，每次切换都应该使用新的引用表
+type AMF3Reader struct {
+	stringRefs []string
+	objectRefs []interface{}
+	traitRefs  []amf3Traits
+}
+
+func NewAMF3Reader() *AMF3Reader {
+	return &AMF3Reader{}
+}
+
+// 与amf0的read类型方法一致，不会修改输入参数<b>切片的内容
+// 第2个返回值为读取时从<b>消耗的字节大小
+func (r *AMF3Reader) ReadValue(b []byte) (interface{}, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrAMFTooShort
+	}
+
+	var (
+		v   interface{}
+		l   int
+		err error
+	)
+	switch b[0] {
+	case AMF3TypeMarkerUndefined, AMF3TypeMarkerNull:
+		return nil, 1, nil
+	case AMF3TypeMarkerFalse:
+		return false, 1, nil
+	case AMF3TypeMarkerTrue:
+		return true, 1, nil
+	case AMF3TypeMarkerInteger:
+		v, l, err = r.readInteger(b[1:])
+	case AMF3TypeMarkerDouble:
+		if len(b) < 9 {
+			return nil, 0, ErrAMFTooShort
+		}
+		return bele.BEFloat64(b[1:]), 9, nil
+	case AMF3TypeMarkerString:
+		v, l, err = r.readString(b[1:])
+	case AMF3TypeMarkerXMLDoc, AMF3TypeMarkerXML:
+		v, l, err = r.readXML(b[1:])
+	case AMF3TypeMarkerDate:
+		v, l, err = r.readDate(b[1:])
+	case AMF3TypeMarkerArray:
+		v, l, err = r.readArray(b[1:])
+	case AMF3TypeMarkerObject:
+		v, l, err = r.readObject(b[1:])
+	case AMF3TypeMarkerByteArray:
+		v, l, err = r.readByteArray(b[1:])
+	default:
+		return nil, 0, ErrAMFInvalidType
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, l + 1, nil
+}
+
+func (r *AMF3Reader) readInteger(b []byte) (float64, int, error) {
+	u, l, err := AMF3.ReadU29(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	// 29位有符号整型
+	v := int32(u)
+	if v&0x10000000 != 0 {
+		v -= 0x20000000
+	}
+	return float64(v), l, nil
+}
+
+// 读取不带type marker的string，也用于object的key以及traits中的类名、成员名
+func (r *AMF3Reader) readString(b []byte) (string, int, error) {
+	u, l, err := AMF3.ReadU29(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if u&0x01 == 0 {
+		index := int(u >> 1)
+		if index >= len(r.stringRefs) {
+			return "", 0, ErrAMF3InvalidReference
+		}
+		return r.stringRefs[index], l, nil
+	}
+
+	n := int(u >> 1)
+	if len(b)-l < n {
+		return "", 0, ErrAMFTooShort
+	}
+	s := string(b[l : l+n])
+	// 空字符串不进入引用表
+	if n > 0 {
+		r.stringRefs = append(r.stringRefs, s)
+	}
+	return s, l + n, nil
+}
+
+// 读取object表中的引用，<isRef>为false时表示是inline的值，此时返回u29的剩余部分
+func (r *AMF3Reader) readObjectRef(b []byte) (ref interface{}, isRef bool, u uint32, l int, err error) {
+	u, l, err = AMF3.ReadU29(b)
+	if err != nil {
+		return
+	}
+	if u&0x01 == 0 {
+		index := int(u >> 1)
+		if index >= len(r.objectRefs) {
+			err = ErrAMF3InvalidReference
+			return
+		}
+		return r.objectRefs[index], true, 0, l, nil
+	}
+	return nil, false, u >> 1, l, nil
+}
+
+func (r *AMF3Reader) readXML(b []byte) (string, int, error) {
+	ref, isRef, n, l, err := r.readObjectRef(b)
+	if err != nil {
+		return "", 0, err
+	}
+	if isRef {
+		s, ok := ref.(string)
+		if !ok {
+			return "", 0, ErrAMF3InvalidReference
+		}
+		return s, l, nil
+	}
+	if len(b)-l < int(n) {
+		return "", 0, ErrAMFTooShort
+	}
+	s := string(b[l : l+int(n)])
+	r.objectRefs = append(r.objectRefs, s)
+	return s, l + int(n), nil
+}
+
+func (r *AMF3Reader) readDate(b []byte) (time.Time, int, error) {
+	ref, isRef, _, l, err := r.readObjectRef(b)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if isRef {
+		t, ok := ref.(time.Time)
+		if !ok {
+			return time.Time{}, 0, ErrAMF3InvalidReference
+		}
+		return t, l, nil
+	}
+	if len(b)-l < 8 {
+		return time.Time{}, 0, ErrAMFTooShort
+	}
+	ms := bele.BEFloat64(b[l:])
+	t := time.Unix(0, int64(ms)*int64(time.Millisecond))
+	r.objectRefs = append(r.objectRefs, t)
+	return t, l + 8, nil
+}
+
+func (r *AMF3Reader) readByteArray(b []byte) ([]byte, int, error) {
+	ref, isRef, n, l, err := r.readObjectRef(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if isRef {
+		ba, ok := ref.([]byte)
+		if !ok {
+			return nil, 0, ErrAMF3InvalidReference
+		}
+		return ba, l, nil
+	}
+	if len(b)-l < int(n) {
+		return nil, 0, ErrAMFTooShort
+	}
+	ba := make([]byte, n)
+	copy(ba, b[l:l+int(n)])
+	r.objectRefs = append(r.objectRefs, ba)
+	return ba, l + int(n), nil
+}
+
+func (r *AMF3Reader) readArray(b []byte) (interface{}, int, error) {
+	ref, isRef, denseCount, index, err := r.readObjectRef(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if isRef {
+		return ref, index, nil
+	}
+
+	// 先占住引用表中的位置，内部成员解析完成后再回填
+	refIndex := len(r.objectRefs)
+	r.objectRefs = append(r.objectRefs, nil)
+
+	var ops ObjectPairArray
+	for {
+		k, l, err := r.readString(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		if k == "" {
+			break
+		}
+		v, l, err := r.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		ops = append(ops, ObjectPair{k, v})
+	}
+
+	// denseCount由对端填写，每个元素至少占1个字节，超过剩余的字节数时一定是错误的数据，避免按denseCount分配过大的内存
+	if int64(denseCount) > int64(len(b)-index) {
+		return nil, 0, ErrAMFTooShort
+	}
+	dense := make([]interface{}, 0, denseCount)
+	for i := uint32(0); i < denseCount; i++ {
+		v, l, err := r.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		dense = append(dense, v)
+	}
+
+	var ret interface{}
+	if ops == nil {
+		ret = dense
+	} else {
+		for i, v := range dense {
+			ops = append(ops, ObjectPair{strconv.Itoa(i), v})
+		}
+		ret = ops
+	}
+	r.objectRefs[refIndex] = ret
+	return ret, index, nil
+}
+
+func (r *AMF3Reader) readTraits(b []byte, u uint32) (amf3Traits, int, error) {
+	// u已经去掉了object引用标记位
+	if u&0x01 == 0 {
+		index := int(u >> 1)
+		if index >= len(r.traitRefs) {
+			return amf3Traits{}, 0, ErrAMF3InvalidReference
+		}
+		return r.traitRefs[index], 0, nil
+	}
+
+	var traits amf3Traits
+	traits.externalizable = u&0x02 != 0
+	traits.dynamic = u&0x04 != 0
+	memberCount := int(u >> 3)
+
+	className, index, err := r.readString(b)
+	if err != nil {
+		return amf3Traits{}, 0, err
+	}
+	traits.className = className
+	for i := 0; i < memberCount; i++ {
+		m, l, err := r.readString(b[index:])
+		if err != nil {
+			return amf3Traits{}, 0, err
+		}
+		index += l
+		traits.members = append(traits.members, m)
+	}
+	r.traitRefs = append(r.traitRefs, traits)
+	return traits, index, nil
+}
+
+func (r *AMF3Reader) readObject(b []byte) (interface{}, int, error) {
+	ref, isRef, u, index, err := r.readObjectRef(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if isRef {
+		return ref, index, nil
+	}
+
+	traits, l, err := r.readTraits(b[index:], u)
+	if err != nil {
+		return nil, 0, err
+	}
+	index += l
+	if traits.externalizable {
+		return nil, 0, ErrAMF3Externalizable
+	}
+
+	refIndex := len(r.objectRefs)
+	r.objectRefs = append(r.objectRefs, nil)
+
+	ops := make(ObjectPairArray, 0, len(traits.members))
+	for _, k := range traits.members {
+		v, l, err := r.ReadValue(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += l
+		ops = append(ops, ObjectPair{k, v})
+	}
+	if traits.dynamic {
+		for {
+			k, l, err := r.readString(b[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			if k == "" {
+				break
+			}
+			v, l, err := r.ReadValue(b[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += l
+			ops = append(ops, ObjectPair{k, v})
+		}
+	}
+	r.objectRefs[refIndex] = ops
+	return ops, index, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// AMF3Writer 持有一次amf3编码过程中的string、traits引用表
+//
+// object没有做引用，每次都是inline写入，这是符合规范的
+type AMF3Writer struct {
+	stringRefs map[string]int
+	traitRefs  map[string]int
+}
+
+func NewAMF3Writer() *AMF3Writer {
+	return &AMF3Writer{
+		stringRefs: make(map[string]int),
+		traitRefs:  make(map[string]int),
+	}
+}
+
+// 目前支持写入的Go类型：nil, bool, int, float64, string, []byte, time.Time, []interface{}, ObjectPairArray, []ObjectPair
+func (w *AMF3Writer) WriteValue(writer io.Writer, val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		_, err := writer.Write([]byte{AMF3TypeMarkerNull})
+		return err
+	case bool:
+		marker := AMF3TypeMarkerFalse
+		if v {
+			marker = AMF3TypeMarkerTrue
+		}
+		_, err := writer.Write([]byte{marker})
+		return err
+	case int:
+		if v < amf3IntegerMin || v > amf3IntegerMax {
+			return w.writeDouble(writer, float64(v))
+		}
+		if _, err := writer.Write([]byte{AMF3TypeMarkerInteger}); err != nil {
+			return err
+		}
+		return AMF3.WriteU29(writer, uint32(v)&amf3U29Max)
+	case float64:
+		return w.writeDouble(writer, v)
+	case string:
+		if _, err := writer.Write([]byte{AMF3TypeMarkerString}); err != nil {
+			return err
+		}
+		return w.writeString(writer, v)
+	case []byte:
+		if _, err := writer.Write([]byte{AMF3TypeMarkerByteArray}); err != nil {
+			return err
+		}
+		if err := AMF3.WriteU29(writer, uint32(len(v))<<1|0x01); err != nil {
+			return err
+		}
+		_, err := writer.Write(v)
+		return err
+	case time.Time:
+		if _, err := writer.Write([]byte{AMF3TypeMarkerDate, 0x01}); err != nil {
+			return err
+		}
+		return bele.WriteBE(writer, float64(v.UnixNano()/int64(time.Millisecond)))
+	case []interface{}:
+		if _, err := writer.Write([]byte{AMF3TypeMarkerArray}); err != nil {
+			return err
+		}
+		if err := AMF3.WriteU29(writer, uint32(len(v))<<1|0x01); err != nil {
+			return err
+		}
+		// 没有associative部分，直接写入空字符串结束
+		if err := w.writeString(writer, ""); err != nil {
+			return err
+		}
+		for i := range v {
+			if err := w.WriteValue(writer, v[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []ObjectPair:
+		return w.writeObject(writer, v)
+	case ObjectPairArray:
+		return w.writeObject(writer, v)
+	}
+	return fmt.Errorf("unknown value type. v=%+v", val)
+}
+
+func (w *AMF3Writer) writeDouble(writer io.Writer, v float64) error {
+	if _, err := writer.Write([]byte{AMF3TypeMarkerDouble}); err != nil {
+		return err
+	}
+	return bele.WriteBE(writer, v)
+}
+
+func (w *AMF3Writer) writeString(writer io.Writer, s string) error {
+	if s == "" {
+		_, err := writer.Write([]byte{0x01})
+		return err
+	}
+	if index, ok := w.stringRefs[s]; ok {
+		return AMF3.WriteU29(writer, uint32(index)<<1)
+	}
+	if len(s) > amf3U29Max>>1 {
+		return ErrAMF3InvalidU29
+	}
+	w.stringRefs[s] = len(w.stringRefs)
+	if err := AMF3.WriteU29(writer, uint32(len(s))<<1|0x01); err != nil {
+		return err
+	}
+	_, err := writer.Write([]byte(s))
+	return err
+}
+
+// 以匿名的dynamic object写入，没有sealed成员
+func (w *AMF3Writer) writeObject(writer io.Writer, opa []ObjectPair) error {
+	if _, err := writer.Write([]byte{AMF3TypeMarkerObject}); err != nil {
+		return err
+	}
+
+	// 匿名dynamic object的traits都相同，第一次inline写入，之后使用引用
+	const anonymousTraitsKey = ""
+	if index, ok := w.traitRefs[anonymousTraitsKey]; ok {
+		// traits引用: U29O-traits-ref, 低两位为01
+		if err := AMF3.WriteU29(writer, uint32(index)<<2|0x01); err != nil {
+			return err
+		}
+	} else {
+		w.traitRefs[anonymousTraitsKey] = len(w.traitRefs)
+		// inline traits，dynamic，0个sealed成员: 0000 1011
+		if err := AMF3.WriteU29(writer, 0x0b); err != nil {
+			return err
+		}
+		// 类名为空
+		if err := w.writeString(writer, ""); err != nil {
+			return err
+		}
+	}
+
+	for i := range opa {
+		if opa[i].Key == "" {
+			return fmt.Errorf("empty key in amf3 dynamic object. i=%d", i)
+		}
+		if err := w.writeString(writer, opa[i].Key); err != nil {
+			return err
+		}
+		if err := w.WriteValue(writer, opa[i].Value); err != nil {
+			return err
+		}
+	}
+	return w.writeString(writer, "")
+}
+
+// ----------------------------------------------------------------------------
+
+// AMF3DataToAMF0 将RTMP AMF3 data message（type id 15）或command message（type id 17）的消息体转换为纯amf0编码
+//
+// 这两种消息的消息体以1个字节的0x00开头，之后是amf0编码的数据，其中的值可以通过amf0的avmplus-object标记切换为amf3编码
+//
+// @param b      不包含开头0x00的消息体
+// @param writer 转换后的amf0数据写入<writer>
+func AMF3DataToAMF0(b []byte, writer io.Writer) error {
+	index := 0
+	for index < len(b) {
+		v, l, err := AMF0.ReadValue(b[index:])
+		if err != nil {
+			return err
+		}
+		index += l
+		if err := AMF0.WriteValue(writer, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+)
+
+func TestAmf3_WriteU29_ReadU29(t *testing.T) {
+	cases := []struct {
+		v uint32
+		l int
+	}{
+		{0, 1},
+		{0x7F, 1},
+		{0x80, 2},
+		{0x3FFF, 2},
+		{0x4000, 3},
+		{0x1FFFFF, 3},
+		{0x200000, 4},
+		{0x1FFFFFFF, 4},
+	}
+	for _, item := range cases {
+		out := &bytes.Buffer{}
+		err := AMF3.WriteU29(out, item.v)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, item.l, out.Len())
+		v, l, err := AMF3.ReadU29(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, item.v, v)
+		assert.Equal(t, item.l, l)
+	}
+
+	err := AMF3.WriteU29(&bytes.Buffer{}, 0x20000000)
+	assert.Equal(t, ErrAMF3InvalidU29, err)
+	_, _, err = AMF3.ReadU29([]byte{0x80, 0x80})
+	assert.Equal(t, ErrAMFTooShort, err)
+}
+
+func TestAmf3_WriteValue_ReadValue(t *testing.T) {
+	now := time.Unix(1618000000, 123*int64(time.Millisecond))
+	cases := []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{nil, nil},
+		{true, true},
+		{false, false},
+		{0, float64(0)},
+		{-1, float64(-1)},
+		{0x0FFFFFFF, float64(0x0FFFFFFF)},
+		{-0x10000000, float64(-0x10000000)},
+		{0x10000000, float64(0x10000000)},
+		{1.5, 1.5},
+		{"", ""},
+		{"live", "live"},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{now, now},
+		{[]interface{}{"a", 1, true}, []interface{}{"a", float64(1), true}},
+	}
+	for _, item := range cases {
+		out := &bytes.Buffer{}
+		err := AMF3.WriteValue(out, item.in)
+		assert.Equal(t, nil, err)
+		v, l, err := AMF3.ReadValue(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, out.Len(), l)
+		assert.Equal(t, item.out, v)
+	}
+
+	err := AMF3.WriteValue(&bytes.Buffer{}, struct{}{})
+	assert.IsNotNil(t, err)
+}
+
+func TestAmf3_WriteObject_ReadObject(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewAMF3Writer()
+	objs := ObjectPairArray{
+		{Key: "app", Value: "live"},
+		{Key: "objectEncoding", Value: 3},
+		{Key: "fpad", Value: false},
+		{Key: "sub", Value: ObjectPairArray{{Key: "app", Value: "live"}}},
+	}
+	err := w.WriteValue(out, objs)
+	assert.Equal(t, nil, err)
+	// 第二次写入时，traits和string都应该使用引用
+	l1 := out.Len()
+	err = w.WriteValue(out, objs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, out.Len()-l1 < l1)
+
+	r := NewAMF3Reader()
+	v, l, err := r.ReadValue(out.Bytes())
+	assert.Equal(t, nil, err)
+	opa, ok := v.(ObjectPairArray)
+	assert.Equal(t, true, ok)
+	app, err := opa.FindString("app")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "live", app)
+	oe, err := opa.FindNumber("objectEncoding")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, oe)
+	assert.Equal(t, false, opa.Find("fpad"))
+	sub, ok := opa.Find("sub").(ObjectPairArray)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "live", sub.Find("app"))
+
+	v2, l2, err := r.ReadValue(out.Bytes()[l:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, out.Len(), l+l2)
+	assert.Equal(t, opa, v2)
+}
+
+func TestAmf3_ReadValue(t *testing.T) {
+	// 有sealed成员的typed object，第二个object为object引用
+	// [array dense=2] [assoc end]
+	//   [object inline traits, 1 sealed, class="a"] member "x" = int 1
+	//   [object ref 1]
+	gold := []byte{
+		0x09, 0x05, 0x01,
+		0x0a, 0x13, 0x03, 0x61, 0x03, 0x78, 0x04, 0x01,
+		0x0a, 0x02,
+	}
+	v, l, err := AMF3.ReadValue(gold)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(gold), l)
+	arr, ok := v.([]interface{})
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 2, len(arr))
+	assert.Equal(t, ObjectPairArray{{Key: "x", Value: float64(1)}}, arr[0])
+	assert.Equal(t, arr[0], arr[1])
+
+	// 引用越界
+	_, _, err = AMF3.ReadValue([]byte{0x06, 0x02})
+	assert.Equal(t, ErrAMF3InvalidReference, err)
+	// externalizable
+	_, _, err = AMF3.ReadValue([]byte{0x0a, 0x07, 0x03, 0x61})
+	assert.Equal(t, ErrAMF3Externalizable, err)
+	// 截断
+	for i := 0; i < len(gold); i++ {
+		_, _, err = AMF3.ReadValue(gold[:i])
+		assert.IsNotNil(t, err)
+	}
+}
+
+func TestAmf0_AVMPlusObject(t *testing.T) {
+	// AMF3 command message: 0x00 | amf0 string "connect" | amf0 number 1 | avmplus-object + amf3 object
+	out := &bytes.Buffer{}
+	_ = AMF0.WriteString(out, "connect")
+	_ = AMF0.WriteNumber(out, 1)
+	_, _ = out.Write([]byte{AMF0TypeMarkerAVMPlusObject})
+	_ = AMF3.WriteValue(out, ObjectPairArray{
+		{Key: "app", Value: "live"},
+		{Key: "tcUrl", Value: "rtmp://127.0.0.1/live"},
+	})
+	_, _ = out.Write([]byte{AMF0TypeMarkerAVMPlusObject, AMF3TypeMarkerNull})
+
+	b := out.Bytes()
+	cmd, l, err := AMF0.ReadString(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", cmd)
+	b = b[l:]
+	tid, l, err := AMF0.ReadNumber(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(1), tid)
+	b = b[l:]
+	opa, l, err := AMF0.ReadObject(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "live", opa.Find("app"))
+	b = b[l:]
+	l, err = AMF0.ReadNull(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, l)
+
+	// data message转换为amf0
+	out.Reset()
+	_ = AMF0.WriteString(out, "@setDataFrame")
+	_ = AMF0.WriteString(out, "onMetaData")
+	_, _ = out.Write([]byte{AMF0TypeMarkerAVMPlusObject})
+	_ = AMF3.WriteValue(out, ObjectPairArray{
+		{Key: "width", Value: 1280},
+		{Key: "height", Value: 720},
+		{Key: "stereo", Value: true},
+	})
+	amf0Out := &bytes.Buffer{}
+	err = AMF3DataToAMF0(out.Bytes(), amf0Out)
+	assert.Equal(t, nil, err)
+	md, err := ParseMetadata(amf0Out.Bytes())
+	assert.Equal(t, nil, err)
+	width, err := md.FindNumber("width")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1280, width)
+	assert.Equal(t, true, md.Find("stereo"))
+}
+
+// dense array以及byte array转换为amf0的strict array以及string
+func TestAMF3DataToAMF0_ArrayByteArray(t *testing.T) {
+	out := &bytes.Buffer{}
+	_ = AMF0.WriteString(out, "onTextData")
+	_, _ = out.Write([]byte{AMF0TypeMarkerAVMPlusObject})
+	_ = AMF3.WriteValue(out, ObjectPairArray{
+		{Key: "list", Value: []interface{}{float64(1), "a", true}},
+		{Key: "data", Value: []byte{'x', 'y'}},
+	})
+
+	amf0Out := &bytes.Buffer{}
+	err := AMF3DataToAMF0(out.Bytes(), amf0Out)
+	assert.Equal(t, nil, err)
+
+	b := amf0Out.Bytes()
+	name, l, err := AMF0.ReadString(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "onTextData", name)
+	opa, _, err := AMF0.ReadObject(b[l:])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []interface{}{float64(1), "a", true}, opa.Find("list"))
+	assert.Equal(t, "xy", opa.Find("data"))
+}
+
+// 对端填写的元素个数远大于实际数据时，直接返回错误，不按元素个数分配内存
+func TestAmf3_ReadArrayHugeCount(t *testing.T) {
+	// array, u29 = (0x0FFFFFFF << 1) | 1, 空的关联部分
+	_, _, err := AMF3.ReadValue([]byte{AMF3TypeMarkerArray, 0xff, 0xff, 0xff, 0xff, 0x01, 0x04, 0x01})
+	assert.Equal(t, ErrAMFTooShort, err)
+
+	b := []byte{AMF0TypeMarkerStrictArray, 0xff, 0xff, 0xff, 0xff, AMF0TypeMarkerNull}
+	_, _, err = AMF0.ReadStrictArray(b)
+	assert.Equal(t, ErrAMFTooShort, err)
+}
@@ -17,63 +17,80 @@ import (
 	"github.com/souliot/siot-av/pkg/base"
 )
 
+// ChunkDivider 记录每个chunk stream上一个message的header，新message的第一个chunk参考前一个message做header压缩（fmt1/fmt2/fmt3）
+//
+// 注意，压缩依赖对端的chunk stream状态，所以ChunkDivider只能用于一个连接，并且该连接上所有的message都需要经过它切割
 type ChunkDivider struct {
 	localChunkSize int
+	csid2Prev      map[int]*chunkStreamPrev
+}
+
+type chunkStreamPrev struct {
+	header         base.RTMPHeader
+	timestampDelta uint32 // fmt0时为绝对时间戳，与对端解析fmt3时的行为保持一致
 }
 
-var defaultChunkDivider = ChunkDivider{
-	localChunkSize: LocalChunkSize,
+func NewChunkDivider(localChunkSize int) *ChunkDivider {
+	return &ChunkDivider{
+		localChunkSize: localChunkSize,
+		csid2Prev:      make(map[int]*chunkStreamPrev),
+	}
 }
 
+// 新的 message 的第一个 chunk 始终使用 fmt0 格式，不依赖连接状态，切割结果可以在多个连接间共享
+//
 // @return 返回的内存块由内部申请，不依赖参数<message>内存块
 func Message2Chunks(message []byte, header *base.RTMPHeader) []byte {
-	return defaultChunkDivider.Message2Chunks(message, header)
+	return message2Chunks(message, header, 0, header.TimestampAbs, LocalChunkSize)
 }
 
-// TODO chef: 新的 message 的第一个 chunk 始终使用 fmt0 格式，没有参考前一个 message
+// @return 返回的内存块由内部申请，不依赖参数<message>内存块
 func (d *ChunkDivider) Message2Chunks(message []byte, header *base.RTMPHeader) []byte {
-	return message2Chunks(message, header, nil, d.localChunkSize)
+	fmt, timestamp := uint8(0), header.TimestampAbs
+	prev, exist := d.csid2Prev[header.CSID]
+	if exist {
+		fmt, timestamp = calcFirstChunkFmt(header, prev)
+	} else {
+		prev = &chunkStreamPrev{}
+		d.csid2Prev[header.CSID] = prev
+	}
+	prev.header = *header
+	prev.timestampDelta = timestamp
+	return message2Chunks(message, header, fmt, timestamp, d.localChunkSize)
 }
 
-// @param 返回头的大小
-func calcHeader(header *base.RTMPHeader, prevHeader *base.RTMPHeader, out []byte) int {
-	var index int
+// 计算新message第一个chunk的fmt，以及header中需要写入的时间戳（fmt0为绝对时间戳，其他为差值）
+func calcFirstChunkFmt(header *base.RTMPHeader, prev *chunkStreamPrev) (uint8, uint32) {
+	// 时间戳回退，或者需要使用扩展时间戳时，都使用fmt0，避免对端计算差值出错
+	if header.MsgStreamID != prev.header.MsgStreamID ||
+		header.TimestampAbs < prev.header.TimestampAbs ||
+		header.TimestampAbs >= maxTimestampInMessageHeader {
+		return 0, header.TimestampAbs
+	}
 
-	// 计算fmt和timestamp
-	fmt := uint8(0)
-	var timestamp uint32
-	if prevHeader == nil {
-		timestamp = header.TimestampAbs
-	} else {
-		if header.MsgStreamID == prevHeader.MsgStreamID {
-			fmt++
-			if header.MsgLen == prevHeader.MsgLen && header.MsgTypeID == prevHeader.MsgTypeID {
-				fmt++
-				if header.TimestampAbs == prevHeader.TimestampAbs {
-					fmt++
-				}
-			}
-			if header.TimestampAbs > maxTimestampInMessageHeader {
-				// 将数据打包成rtmp chunk发送给vlc，时间戳超过3字节最大范围时，
-				// vlc认为fmt0和fmt3两种格式，都需要携带扩展时间戳字段，并且该时间戳字段必须使用绝对时间戳。
-				timestamp = header.TimestampAbs
-			} else {
-				timestamp = header.TimestampAbs - prevHeader.TimestampAbs
-			}
-		} else {
-			timestamp = header.TimestampAbs
-		}
+	delta := header.TimestampAbs - prev.header.TimestampAbs
+	if header.MsgLen != prev.header.MsgLen || header.MsgTypeID != prev.header.MsgTypeID {
+		return 1, delta
 	}
+	if delta != prev.timestampDelta {
+		return 2, delta
+	}
+	return 3, delta
+}
 
-	// 设置fmt
-	out[index] = fmt << 6
+// 写入chunk header
+//
+// @param timestamp fmt0时为绝对时间戳，fmt1和fmt2时为时间戳差值，fmt3时只用于判断是否需要扩展时间戳
+// @return 返回头的大小
+func putChunkHeader(fmt uint8, timestamp uint32, header *base.RTMPHeader, out []byte) int {
+	var index int
 
-	// 设置csid
+	// 设置fmt和csid
+	out[index] = fmt << 6
 	if header.CSID >= 2 && header.CSID <= 63 {
 		out[index] |= uint8(header.CSID)
 		index++
 	} else if header.CSID >= 64 && header.CSID <= 319 {
-		// value 0
 		index++
 		out[index] = uint8(header.CSID - 64)
 		index++
@@ -110,15 +127,15 @@ func calcHeader(header *base.RTMPHeader, prevHeader *base.RTMPHeader, out []byte
 
 	// 设置扩展时间戳
 	if timestamp > maxTimestampInMessageHeader {
-		//log.DefaultBeeLogger.Debug("CHEFERASEME %+v %+v %d %d", header, prevHeader, timestamp, index)
 		bele.BEPutUint32(out[index:], timestamp)
 		index += 4
 	}
-
 	return index
 }
 
-func message2Chunks(message []byte, header *base.RTMPHeader, prevHeader *base.RTMPHeader, chunkSize int) []byte {
+// @param firstFmt       message第一个chunk的fmt，之后的chunk都是fmt3
+// @param firstTimestamp message第一个chunk header中的时间戳，参见putChunkHeader
+func message2Chunks(message []byte, header *base.RTMPHeader, firstFmt uint8, firstTimestamp uint32, chunkSize int) []byte {
 	//if header.CSID < minCSID || header.CSID > maxCSID {
 	//	return nil, ErrRTMP
 	//}
@@ -139,7 +156,15 @@ func message2Chunks(message []byte, header *base.RTMPHeader, prevHeader *base.RT
 	// NOTICE 和srs交互时，发现srs要求message中的非第一个chunk不能使用fmt0
 	// 将message切割成chunk放入chunk body中
 	for i := 0; i < numOfChunk; i++ {
-		headLen := calcHeader(header, prevHeader, out[index:])
+		var headLen int
+		if i == 0 {
+			headLen = putChunkHeader(firstFmt, firstTimestamp, header, out[index:])
+		} else {
+			// 将数据打包成rtmp chunk发送给vlc，时间戳超过3字节最大范围时，
+			// vlc认为fmt0和fmt3两种格式，都需要携带扩展时间戳字段，并且该时间戳字段必须使用绝对时间戳。
+			// 使用扩展时间戳时第一个chunk一定是fmt0，所以这里沿用第一个chunk的时间戳即可
+			headLen = putChunkHeader(3, firstTimestamp, header, out[index:])
+		}
 		index += headLen
 
 		if i != numOfChunk-1 {
@@ -149,7 +174,6 @@ func message2Chunks(message []byte, header *base.RTMPHeader, prevHeader *base.RT
 			copy(out[index:], message[i*chunkSize:i*chunkSize+lastChunkSize])
 			index += lastChunkSize
 		}
-		prevHeader = header
 	}
 
 	return out[:index]
@@ -9,6 +9,8 @@
 package rtmp
 
 import (
+	"crypto/tls"
+
 	"github.com/souliot/siot-av/pkg/base"
 	"github.com/souliot/naza/pkg/log"
 )
@@ -25,6 +27,12 @@ type PullSessionOption struct {
 	PullTimeoutMS int
 
 	ReadAVTimeoutMS int
+
+	// 只有rtmps时使用，如果为nil，则使用默认配置
+	TLSConfig *tls.Config
+
+	// 见ClientSessionOption.StrictHandshake
+	StrictHandshake bool
 }
 
 var defaultPullSessionOption = PullSessionOption{
@@ -44,6 +52,8 @@ func NewPullSession(modOptions ...ModPullSessionOption) *PullSession {
 		core: NewClientSession(CSTPullSession, log.DefaultBeeLogger, func(option *ClientSessionOption) {
 			option.DoTimeoutMS = opt.PullTimeoutMS
 			option.ReadAVTimeoutMS = opt.ReadAVTimeoutMS
+			option.TLSConfig = opt.TLSConfig
+			option.StrictHandshake = opt.StrictHandshake
 		}),
 	}
 }
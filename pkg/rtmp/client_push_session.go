@@ -9,6 +9,8 @@
 package rtmp
 
 import (
+	"crypto/tls"
+
 	"github.com/souliot/siot-av/pkg/base"
 	"github.com/souliot/naza/pkg/log"
 )
@@ -16,7 +18,8 @@ import (
 type PushSession struct {
 	IsFresh bool
 
-	core *ClientSession
+	core    *ClientSession
+	divider *ChunkDivider
 }
 
 type PushSessionOption struct {
@@ -25,6 +28,12 @@ type PushSessionOption struct {
 	PushTimeoutMS int
 
 	WriteAVTimeoutMS int
+
+	// 只有rtmps时使用，如果为nil，则使用默认配置
+	TLSConfig *tls.Config
+
+	// 见ClientSessionOption.StrictHandshake
+	StrictHandshake bool
 }
 
 var defaultPushSessionOption = PushSessionOption{
@@ -41,9 +50,12 @@ func NewPushSession(modOptions ...ModPushSessionOption) *PushSession {
 	}
 	return &PushSession{
 		IsFresh: true,
+		divider: NewChunkDivider(LocalChunkSize),
 		core: NewClientSession(CSTPushSession, log.DefaultBeeLogger, func(option *ClientSessionOption) {
 			option.DoTimeoutMS = opt.PushTimeoutMS
 			option.WriteAVTimeoutMS = opt.WriteAVTimeoutMS
+			option.TLSConfig = opt.TLSConfig
+			option.StrictHandshake = opt.StrictHandshake
 		}),
 	}
 }
@@ -57,6 +69,13 @@ func (s *PushSession) AsyncWrite(msg []byte) error {
 	return s.core.AsyncWrite(msg)
 }
 
+// 使用本连接的ChunkDivider切割message后发送，chunk header会根据同一chunk stream的上一个message做压缩
+//
+// 注意，一旦开始使用WriteMsg发送音视频数据，后续的音视频数据都需要使用WriteMsg发送，不能再混用AsyncWrite
+func (s *PushSession) WriteMsg(msg base.RTMPMsg) error {
+	return s.core.AsyncWrite(s.divider.Message2Chunks(msg.Payload, &msg.Header))
+}
+
 func (s *PushSession) Flush() error {
 	return s.core.Flush()
 }
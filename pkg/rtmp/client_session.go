@@ -10,6 +10,7 @@ package rtmp
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -38,7 +39,7 @@ type ClientSession struct {
 	packer         *MessagePacker
 	chunkComposer  *ChunkComposer
 	urlCtx         base.URLContext
-	hc             HandshakeClientSimple
+	hc             HandshakeClientComplex
 	peerWinAckSize int
 
 	conn         connection.Connection
@@ -67,6 +68,12 @@ type ClientSessionOption struct {
 	DoTimeoutMS      int // 从发起连接（包含了建立连接的时间）到收到publish或play信令结果的超时
 	ReadAVTimeoutMS  int // 读取音视频数据的超时
 	WriteAVTimeoutMS int // 发送音视频数据的超时
+
+	// 只有rtmps时使用，如果为nil，则使用默认配置，并以url中的host作为ServerName
+	TLSConfig *tls.Config
+
+	// 复杂握手时是否严格校验s2的digest，为false时校验失败只打印警告日志，兼容不规范的服务端
+	StrictHandshake bool
 }
 
 var defaultClientSessOption = ClientSessionOption{
@@ -235,12 +242,14 @@ func (s *ClientSession) doContext(ctx context.Context, rawURL string) error {
 			return
 		}
 
-		s.runReadLoop()
+		errChan <- s.runReadLoop()
 	}()
 
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
+	case err := <-errChan:
+		return err
 	case <-s.doResultChan:
 		return nil
 	}
@@ -269,6 +278,7 @@ func (s *ClientSession) streamNameWithRawQuery() string {
 	return fmt.Sprintf("%s?%s", s.urlCtx.LastItemOfPath, s.urlCtx.RawQuery)
 }
 
+// rtmps时，在tcp连接建立后完成tls握手
 func (s *ClientSession) tcpConnect() error {
 	s.Log().Info("[%s] > tcp connect.", s.UniqueKey)
 	var err error
@@ -276,8 +286,18 @@ func (s *ClientSession) tcpConnect() error {
 	s.stat.RemoteAddr = s.urlCtx.HostWithPort
 
 	var conn net.Conn
-	if conn, err = net.Dial("tcp", s.urlCtx.HostWithPort); err != nil {
-		return err
+	if s.urlCtx.Scheme == "rtmps" {
+		tlsConfig := s.option.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: s.urlCtx.Host}
+		}
+		if conn, err = tls.Dial("tcp", s.urlCtx.HostWithPort, tlsConfig); err != nil {
+			return err
+		}
+	} else {
+		if conn, err = net.Dial("tcp", s.urlCtx.HostWithPort); err != nil {
+			return err
+		}
 	}
 
 	s.conn = connection.New(conn, func(option *connection.Option) {
@@ -294,7 +314,10 @@ func (s *ClientSession) handshake() error {
 	}
 
 	if err := s.hc.ReadS0S1S2(s.conn); err != nil {
-		return err
+		if err != ErrHandshakeDigest || s.option.StrictHandshake {
+			return err
+		}
+		s.Log().Warn("[%s] handshake s2 digest mismatch, ignore.", s.UniqueKey)
 	}
 	s.Log().Info("[%s] < R Handshake S0+S1+S2.", s.UniqueKey)
 
@@ -305,9 +328,9 @@ func (s *ClientSession) handshake() error {
 	return nil
 }
 
-func (s *ClientSession) runReadLoop() {
+func (s *ClientSession) runReadLoop() error {
 	// TODO chef: 这里是否应该主动关闭conn，考虑对端发送非法协议数据，增加一个对应的测试看看
-	_ = s.chunkComposer.RunLoop(s.conn, s.doMsg)
+	return s.chunkComposer.RunLoop(s.conn, s.doMsg)
 }
 
 func (s *ClientSession) doMsg(stream *Stream) error {
@@ -320,8 +343,12 @@ func (s *ClientSession) doMsg(stream *Stream) error {
 		return s.doProtocolControlMessage(stream)
 	case base.RTMPTypeIDCommandMessageAMF0:
 		return s.doCommandMessage(stream)
+	case base.RTMPTypeIDCommandMessageAMF3:
+		return s.doCommandMessageAMF3(stream)
 	case base.RTMPTypeIDMetadata:
 		return s.doDataMessageAMF0(stream)
+	case base.RTMPTypeIDDataMessageAMF3:
+		return s.doDataMessageAMF3(stream)
 	case base.RTMPTypeIDAck:
 		return s.doAck(stream)
 	case base.RTMPTypeIDUserControl:
@@ -363,6 +390,33 @@ func (s *ClientSession) doDataMessageAMF0(stream *Stream) error {
 	return nil
 }
 
+func (s *ClientSession) doDataMessageAMF3(stream *Stream) error {
+	msg, err := stream.toAMF0DataMsg()
+	if err != nil {
+		return err
+	}
+
+	val, _, err := AMF0.ReadString(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if val == "|RtmpSampleAccess" {
+		s.Log().Debug("[%s] < R |RtmpSampleAccess, ignore.", s.UniqueKey)
+		return nil
+	}
+	s.onReadRTMPAVMsg(msg)
+	return nil
+}
+
+func (s *ClientSession) doCommandMessageAMF3(stream *Stream) error {
+	// 去除前面的0就是AMF0的数据，其中的值可能以avmplus-object标记切换为AMF3编码
+	if stream.msg.len() < 1 {
+		return ErrAMFTooShort
+	}
+	stream.msg.consumed(1)
+	return s.doCommandMessage(stream)
+}
+
 func (s *ClientSession) doCommandMessage(stream *Stream) error {
 	cmd, err := stream.msg.readStringWithType()
 	if err != nil {
@@ -379,6 +433,8 @@ func (s *ClientSession) doCommandMessage(stream *Stream) error {
 		s.Log().Warn("[%s] < R onBWDone. ignore.", s.UniqueKey)
 	case "_result":
 		return s.doResultMessage(stream, tid)
+	case "_error":
+		return s.doErrorMessage(stream, tid)
 	case "onStatus":
 		return s.doOnStatusMessage(stream, tid)
 	default:
@@ -400,6 +456,11 @@ func (s *ClientSession) doOnStatusMessage(stream *Stream, tid int) error {
 	if err != nil {
 		return err
 	}
+	if level, _ := infos.FindString("level"); level == "error" {
+		description, _ := infos.FindString("description")
+		s.Log().Error("[%s] < R onStatus('%s'). description=%s", s.UniqueKey, code, description)
+		return &StatusError{Code: code, Description: description}
+	}
 	switch s.t {
 	case CSTPushSession:
 		switch code {
@@ -475,6 +536,25 @@ func (s *ClientSession) doResultMessage(stream *Stream, tid int) error {
 	return nil
 }
 
+// 对端拒绝时返回StatusError，结束会话
+func (s *ClientSession) doErrorMessage(stream *Stream, tid int) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	infos, err := stream.msg.readObjectWithType()
+	if err != nil {
+		return err
+	}
+	se := &StatusError{}
+	se.Code, _ = infos.FindString("code")
+	se.Description, _ = infos.FindString("description")
+	if ex, ok := infos.Find("ex").(ObjectPairArray); ok {
+		se.Redirect, _ = ex.FindString("redirect")
+	}
+	s.Log().Error("[%s] < R _error('%s'). tid=%d, description=%s, redirect=%s", s.UniqueKey, se.Code, tid, se.Description, se.Redirect)
+	return se
+}
+
 func (s *ClientSession) doProtocolControlMessage(stream *Stream) error {
 	if stream.msg.len() < 4 {
 		return ErrRTMP
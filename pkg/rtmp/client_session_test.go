@@ -0,0 +1,49 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+)
+
+// 复杂握手的s2 digest校验失败时，默认只打印警告日志并继续发送c2，开启StrictHandshake时握手失败
+func TestClientSessionHandshakeLooseS2(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		session := NewClientSession(CSTPullSession, log.DefaultBeeLogger, func(option *ClientSessionOption) {
+			option.StrictHandshake = strict
+		})
+		session.conn = connection.New(c1)
+
+		done := make(chan error, 1)
+		go func() {
+			var hs HandshakeServer
+			_ = hs.ReadC0C1(c2)
+			hs.s0s1s2[s0s1s2Len-1] ^= 0xFF
+			_ = hs.WriteS0S1S2(c2)
+			done <- hs.ReadC2(c2)
+		}()
+		err := session.handshake()
+		if strict {
+			assert.Equal(t, ErrHandshakeDigest, err)
+			_ = c1.Close()
+			assert.IsNotNil(t, <-done)
+		} else {
+			assert.Equal(t, nil, err)
+			assert.Equal(t, nil, <-done)
+			_ = c1.Close()
+		}
+		_ = c2.Close()
+	}
+}
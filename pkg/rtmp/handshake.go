@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"io"
 	"time"
 
@@ -32,8 +33,11 @@ const (
 	s0s1s2Len = 3073
 )
 
+var ErrHandshakeDigest = errors.New("lal.rtmp: handshake digest mismatch")
+
 const (
 	clientPartKeyLen = 30
+	clientFullKeyLen = 62
 	serverPartKeyLen = 36
 	serverFullKeyLen = 68
 	keyLen           = 32
@@ -67,6 +71,9 @@ var serverKey = []byte{
 	0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
 }
 
+// 复杂模式下，客户端c1中offset字段为0，digest位于c1的固定位置
+const c1DigestOffs = 12
+
 var random1528Buf []byte
 
 type HandshakeClient interface {
@@ -88,6 +95,7 @@ type HandshakeClientComplex struct {
 type HandshakeServer struct {
 	isSimpleMode bool
 	s0s1s2       []byte
+	s1DigestOffs int // 复杂模式下s1中digest的位置，用于校验c2
 }
 
 func (c *HandshakeClientSimple) WriteC0C1(writer io.Writer) error {
@@ -140,7 +148,7 @@ func (c *HandshakeClientComplex) WriteC0C1(writer io.Writer) error {
 	c.c0c1[11] = 0
 	c.c0c1[12] = 0
 	// digest
-	makeDigestWithoutCenterPart(c.c0c1[1:], 12, clientKey[:clientPartKeyLen], c.c0c1[13:])
+	makeDigestWithoutCenterPart(c.c0c1[1:], c1DigestOffs, clientKey[:clientPartKeyLen], c.c0c1[1+c1DigestOffs:])
 	_, err := writer.Write(c.c0c1)
 	return err
 }
@@ -153,10 +161,37 @@ func (c *HandshakeClientComplex) ReadS0S1S2(reader io.Reader) error {
 	//if s0s1s2[0] != version {
 	//	return ErrRTMP
 	//}
-	// TODO chef: 这里复杂模式的 c2 构造没有完全按照规范
-	// nginx rtmp module 作为 server 端时，不会校验 c2 内容
-	c.c2 = append(c.c2, s0s1s2[s0s1Len:]...)
+	s1 := s0s1s2[1:s0s1Len]
+	s2 := s0s1s2[s0s1Len:]
+
+	s1DigestOffs := findDigest(s1, 8, serverKey[:serverPartKeyLen])
+	if s1DigestOffs == -1 {
+		s1DigestOffs = findDigest(s1, 764+8, serverKey[:serverPartKeyLen])
+	}
+	if s1DigestOffs == -1 {
+		// 对端使用简单模式握手，c2使用s1的拷贝
+		log.DefaultBeeLogger.Debug("handshake server in simple mode.")
+		c.c2 = append(c.c2, s1...)
+		return nil
+	}
 
+	// c2由随机数据和尾部的digest组成，digest的key由s1的digest生成
+	c2Key := makeDigest(s1[s1DigestOffs:s1DigestOffs+keyLen], clientKey[:clientFullKeyLen])
+	c.c2 = make([]byte, c2Len)
+	random1528(c.c2)
+	makeDigestWithoutCenterPart(c.c2, c2Len-keyLen, c2Key, c.c2[c2Len-keyLen:])
+
+	// 校验s2，有的server即使s1是复杂模式，s2依然回显c1，此时也认为是合法的
+	// 校验失败时c2依然可用，由调用方决定是否继续握手
+	if !bytes.Equal(s2, c.c0c1[1:]) {
+		c1Digest := c.c0c1[1+c1DigestOffs : 1+c1DigestOffs+keyLen]
+		s2Key := makeDigest(c1Digest, serverKey[:serverFullKeyLen])
+		digest := make([]byte, keyLen)
+		makeDigestWithoutCenterPart(s2, s2Len-keyLen, s2Key, digest)
+		if !bytes.Equal(digest, s2[s2Len-keyLen:]) {
+			return ErrHandshakeDigest
+		}
+	}
 	return nil
 }
 
@@ -196,6 +231,7 @@ func (s *HandshakeServer) ReadC0C1(reader io.Reader) (err error) {
 		offs := int(s1[8]) + int(s1[9]) + int(s1[10]) + int(s1[11])
 		offs = (offs % 728) + 12
 		makeDigestWithoutCenterPart(s.s0s1s2[1:s0s1Len], offs, serverKey[:serverPartKeyLen], s.s0s1s2[1+offs:])
+		s.s1DigestOffs = offs
 
 		// s2
 		// make digest to s2 suffix position
@@ -218,6 +254,21 @@ func (s *HandshakeServer) ReadC2(reader io.Reader) error {
 	if _, err := io.ReadAtLeast(reader, c2, c2Len); err != nil {
 		return err
 	}
+	if s.isSimpleMode {
+		return nil
+	}
+
+	// 有的客户端在复杂模式下依然回显s1，此时也认为是合法的
+	s1 := s.s0s1s2[1:s0s1Len]
+	if bytes.Equal(c2, s1) {
+		return nil
+	}
+	c2Key := makeDigest(s1[s.s1DigestOffs:s.s1DigestOffs+keyLen], clientKey[:clientFullKeyLen])
+	digest := make([]byte, keyLen)
+	makeDigestWithoutCenterPart(c2, c2Len-keyLen, c2Key, digest)
+	if !bytes.Equal(digest, c2[c2Len-keyLen:]) {
+		return ErrHandshakeDigest
+	}
 	return nil
 }
 
@@ -53,6 +53,81 @@ func TestHandshakeComplex(t *testing.T) {
 	assert.Equal(t, nil, err)
 }
 
+func TestHandshakeComplexDigest(t *testing.T) {
+	var err error
+
+	// 复杂模式下c2的digest校验失败
+	{
+		var hc HandshakeClientComplex
+		var hs HandshakeServer
+		b := &bytes.Buffer{}
+		_ = hc.WriteC0C1(b)
+		_ = hs.ReadC0C1(b)
+		_ = hs.WriteS0S1S2(b)
+		err = hc.ReadS0S1S2(b)
+		assert.Equal(t, nil, err)
+		hc.c2[c2Len-1] ^= 0xFF
+		_ = hc.WriteC2(b)
+		err = hs.ReadC2(b)
+		assert.Equal(t, ErrHandshakeDigest, err)
+	}
+
+	// 复杂模式下s2的digest校验失败
+	{
+		var hc HandshakeClientComplex
+		var hs HandshakeServer
+		b := &bytes.Buffer{}
+		_ = hc.WriteC0C1(b)
+		_ = hs.ReadC0C1(b)
+		hs.s0s1s2[s0s1s2Len-1] ^= 0xFF
+		_ = hs.WriteS0S1S2(b)
+		err = hc.ReadS0S1S2(b)
+		assert.Equal(t, ErrHandshakeDigest, err)
+		// 校验失败时依然生成c2，由调用方决定是否继续握手
+		_ = hc.WriteC2(b)
+		err = hs.ReadC2(b)
+		assert.Equal(t, nil, err)
+	}
+
+	// 复杂模式的c2由s1的digest生成，不应是s2的拷贝
+	{
+		var hc HandshakeClientComplex
+		var hs HandshakeServer
+		b := &bytes.Buffer{}
+		_ = hc.WriteC0C1(b)
+		_ = hs.ReadC0C1(b)
+		_ = hs.WriteS0S1S2(b)
+		_ = hc.ReadS0S1S2(b)
+		assert.Equal(t, false, bytes.Equal(hc.c2, hs.s0s1s2[s0s1Len:]))
+	}
+
+	// 复杂模式的客户端与简单模式的服务端握手，c2使用s1的拷贝
+	{
+		var hc HandshakeClientComplex
+		b := &bytes.Buffer{}
+		_ = hc.WriteC0C1(b)
+		s0s1s2 := make([]byte, s0s1s2Len)
+		s0s1s2[0] = version
+		copy(s0s1s2[1:], []byte{1, 2, 3, 4})
+		copy(s0s1s2[s0s1Len:], hc.c0c1[1:])
+		err = hc.ReadS0S1S2(bytes.NewReader(s0s1s2))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, s0s1s2[1:s0s1Len], hc.c2)
+	}
+
+	// 复杂模式的服务端收到回显s1的c2
+	{
+		var hc HandshakeClientComplex
+		var hs HandshakeServer
+		b := &bytes.Buffer{}
+		_ = hc.WriteC0C1(b)
+		_ = hs.ReadC0C1(b)
+		_, _ = b.Write(hs.s0s1s2[1:s0s1Len])
+		err = hs.ReadC2(b)
+		assert.Equal(t, nil, err)
+	}
+}
+
 func BenchmarkHandshakeSimple(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		var hc HandshakeClientSimple
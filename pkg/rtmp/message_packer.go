@@ -202,6 +202,50 @@ func (packer *MessagePacker) writeOnStatusPlay(writer io.Writer, streamID int) e
 	return err
 }
 
+// 回复level为error的onStatus，比如NetStream.Publish.BadName
+func (packer *MessagePacker) writeOnStatusError(writer io.Writer, streamID int, code string, description string) error {
+	packer.writeMessageHeader(csidOverStream, 0, base.RTMPTypeIDCommandMessageAMF0, streamID)
+	_ = AMF0.WriteString(packer.b, "onStatus")
+	_ = AMF0.WriteNumber(packer.b, 0)
+	_ = AMF0.WriteNull(packer.b)
+	objs := []ObjectPair{
+		{Key: "level", Value: "error"},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	_ = AMF0.WriteObject(packer.b, objs)
+	raw := packer.b.Bytes()
+	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
+	_, err := packer.b.WriteTo(writer)
+	return err
+}
+
+// 回复connect失败，比如NetConnection.Connect.Rejected
+//
+// @param redirect 不为空时，携带ex.redirect，引导客户端连接到其他地址
+func (packer *MessagePacker) writeConnectError(writer io.Writer, tid int, code string, description string, redirect string) error {
+	packer.writeMessageHeader(csidOverConnection, 0, base.RTMPTypeIDCommandMessageAMF0, 0)
+	_ = AMF0.WriteString(packer.b, "_error")
+	_ = AMF0.WriteNumber(packer.b, float64(tid))
+	_ = AMF0.WriteNull(packer.b)
+	objs := []ObjectPair{
+		{Key: "level", Value: "error"},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	if redirect != "" {
+		objs = append(objs, ObjectPair{Key: "ex", Value: []ObjectPair{
+			{Key: "code", Value: 302},
+			{Key: "redirect", Value: redirect},
+		}})
+	}
+	_ = AMF0.WriteObject(packer.b, objs)
+	raw := packer.b.Bytes()
+	bele.BEPutUint24(raw[4:], uint32(len(raw)-12))
+	_, err := packer.b.WriteTo(writer)
+	return err
+}
+
 func (packer *MessagePacker) writeStreamIsRecorded(writer io.Writer, streamID uint32) error {
 	packer.writeMessageHeader(csidProtocolControl, 6, base.RTMPTypeIDUserControl, 0)
 	_ = bele.WriteBE(packer.b, uint16(base.RTMPUserControlRecorded))
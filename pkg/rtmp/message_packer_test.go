@@ -14,6 +14,7 @@ import (
 
 	"github.com/souliot/naza/pkg/assert"
 	"github.com/souliot/naza/pkg/fake"
+	"github.com/souliot/siot-av/pkg/base"
 )
 
 func TestWriteMessageHandler(t *testing.T) {
@@ -152,3 +153,97 @@ func BenchmarkMessagePacker(b *testing.B) {
 		_ = packer.writeConnect(mw, "live", "rtmp://127.0.0.1/live", true)
 	}
 }
+
+func TestChunkDivider(t *testing.T) {
+	golden := []struct {
+		header base.RTMPHeader
+		fmt    uint8
+	}{
+		// 第一个message只能使用fmt0
+		{base.RTMPHeader{CSID: 6, MsgLen: 3, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 100}, 0},
+		// 长度不同
+		{base.RTMPHeader{CSID: 6, MsgLen: 4, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 140}, 1},
+		// 长度、类型相同，时间戳差值与上一个不同
+		{base.RTMPHeader{CSID: 6, MsgLen: 4, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 200}, 2},
+		// 时间戳差值相同
+		{base.RTMPHeader{CSID: 6, MsgLen: 4, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 260}, 3},
+		// 其他chunk stream不影响
+		{base.RTMPHeader{CSID: 4, MsgLen: 2, MsgTypeID: base.RTMPTypeIDAudio, MsgStreamID: 1, TimestampAbs: 230}, 0},
+		{base.RTMPHeader{CSID: 6, MsgLen: 4, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 320}, 3},
+		// 时间戳回退
+		{base.RTMPHeader{CSID: 6, MsgLen: 4, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 10}, 0},
+		// 跨越chunk，后续chunk为fmt3
+		{base.RTMPHeader{CSID: 6, MsgLen: 10, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 50}, 1},
+		// 扩展时间戳
+		{base.RTMPHeader{CSID: 6, MsgLen: 10, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 0x1000000}, 0},
+		{base.RTMPHeader{CSID: 6, MsgLen: 10, MsgTypeID: base.RTMPTypeIDVideo, MsgStreamID: 1, TimestampAbs: 0x1000010}, 0},
+	}
+
+	buf := &bytes.Buffer{}
+	d := NewChunkDivider(4)
+	for i, item := range golden {
+		payload := bytes.Repeat([]byte{uint8(i)}, int(item.header.MsgLen))
+		chunks := d.Message2Chunks(payload, &item.header)
+		assert.Equal(t, item.fmt, chunks[0]>>6)
+		_, _ = buf.Write(chunks)
+	}
+
+	// 使用ChunkComposer解析，header和payload应该与原始数据一致
+	var i int
+	composer := NewChunkComposer()
+	composer.SetPeerChunkSize(4)
+	err := composer.RunLoop(buf, func(stream *Stream) error {
+		msg := stream.toAVMsg()
+		assert.Equal(t, golden[i].header, msg.Header)
+		assert.Equal(t, bytes.Repeat([]byte{uint8(i)}, int(golden[i].header.MsgLen)), msg.Payload)
+		i++
+		return nil
+	})
+	assert.IsNotNil(t, err)
+	assert.Equal(t, len(golden), i)
+
+	// 包级别的Message2Chunks不依赖状态，始终使用fmt0
+	chunks := Message2Chunks([]byte{1, 2, 3}, &golden[3].header)
+	assert.Equal(t, uint8(0), chunks[0]>>6)
+}
+
+func TestWriteStatusError(t *testing.T) {
+	var (
+		err    error
+		packer = NewMessagePacker()
+		buf    = &bytes.Buffer{}
+		infos  ObjectPairArray
+	)
+
+	readInfos := func(cmd string) {
+		composer := NewChunkComposer()
+		composer.SetPeerChunkSize(uint32(LocalChunkSize))
+		_ = composer.RunLoop(buf, func(stream *Stream) error {
+			c, err := stream.msg.readStringWithType()
+			assert.Equal(t, nil, err)
+			assert.Equal(t, cmd, c)
+			_, err = stream.msg.readNumberWithType()
+			assert.Equal(t, nil, err)
+			assert.Equal(t, nil, stream.msg.readNull())
+			infos, err = stream.msg.readObjectWithType()
+			assert.Equal(t, nil, err)
+			return nil
+		})
+	}
+
+	err = packer.writeConnectError(buf, 1, StatusCodeConnectRejected, "redirect", "rtmp://127.0.0.1:19350/live")
+	assert.Equal(t, nil, err)
+	readInfos("_error")
+	assert.Equal(t, "error", infos.Find("level"))
+	assert.Equal(t, StatusCodeConnectRejected, infos.Find("code"))
+	ex, ok := infos.Find("ex").(ObjectPairArray)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "rtmp://127.0.0.1:19350/live", ex.Find("redirect"))
+
+	err = packer.writeOnStatusError(buf, 1, StatusCodePublishBadName, "stream already publishing")
+	assert.Equal(t, nil, err)
+	readInfos("onStatus")
+	assert.Equal(t, StatusCodePublishBadName, infos.Find("code"))
+	assert.Equal(t, "stream already publishing", infos.Find("description"))
+	assert.Equal(t, nil, infos.Find("ex"))
+}
@@ -10,10 +10,45 @@ package rtmp
 
 import (
 	"errors"
+	"fmt"
 )
 
 var ErrRTMP = errors.New("lal.rtmp: fxxk")
 
+// level为error的_error以及onStatus信令中的code
+const (
+	StatusCodeConnectRejected = "NetConnection.Connect.Rejected"
+	StatusCodePublishBadName  = "NetStream.Publish.BadName"
+)
+
+// StatusError 对应level为error的_error或onStatus信令
+//
+// 客户端收到对端的拒绝信令时返回该错误
+// 服务端的上层代码也可以在回调中返回该错误，自定义回复给客户端的code、description以及ex.redirect
+type StatusError struct {
+	Code        string
+	Description string
+	Redirect    string // 只在NetConnection.Connect.Rejected中使用，对应ex.redirect，引导客户端连接到其他地址
+}
+
+func (e *StatusError) Error() string {
+	if e.Redirect != "" {
+		return fmt.Sprintf("lal.rtmp: %s. description=%s, redirect=%s", e.Code, e.Description, e.Redirect)
+	}
+	return fmt.Sprintf("lal.rtmp: %s. description=%s", e.Code, e.Description)
+}
+
+// 将上层返回的错误转换为StatusError，非StatusError时使用默认的code
+func toStatusError(err error, defaultCode string) *StatusError {
+	if se, ok := err.(*StatusError); ok {
+		if se.Code == "" {
+			return &StatusError{Code: defaultCode, Description: se.Description, Redirect: se.Redirect}
+		}
+		return se
+	}
+	return &StatusError{Code: defaultCode, Description: err.Error()}
+}
+
 const (
 	CSIDAMF   = 5
 	CSIDAudio = 6
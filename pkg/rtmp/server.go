@@ -9,31 +9,46 @@
 package rtmp
 
 import (
+	"crypto/tls"
 	"net"
+	"sync"
 
 	"github.com/souliot/naza/pkg/log"
 )
 
 type ServerObserver interface {
-	OnRTMPConnect(session *ServerSession, opa ObjectPairArray)
-	OnNewRTMPPubSession(session *ServerSession) bool // 返回true则允许推流，返回false则强制关闭这个连接
+	OnRTMPConnect(session *ServerSession, opa ObjectPairArray) error // 返回非nil则回复NetConnection.Connect.Rejected并关闭这个连接，详见StatusError
+	OnNewRTMPPubSession(session *ServerSession) error                // 返回nil则允许推流，返回非nil则回复NetStream.Publish.BadName并关闭这个连接
 	OnDelRTMPPubSession(session *ServerSession)
 	OnNewRTMPSubSession(session *ServerSession) bool // 返回true则允许拉流，返回false则强制关闭这个连接
 	OnDelRTMPSubSession(session *ServerSession)
 }
 
+type ServerConfig struct {
+	Enable        bool   `json:"enable"`
+	Addr          string `json:"addr"`
+	EnableRTMPS   bool   `json:"enable_rtmps"`
+	RTMPSAddr     string `json:"rtmps_addr"`
+	RTMPSCertFile string `json:"rtmps_cert_file"`
+	RTMPSKeyFile  string `json:"rtmps_key_file"`
+
+	// 复杂握手时是否严格校验c2的digest，为false时校验失败只打印警告日志，兼容不规范的客户端
+	StrictHandshake bool `json:"strict_handshake"`
+}
+
 type Server struct {
 	observer ServerObserver
-	addr     string
+	config   ServerConfig
 	ln       net.Listener
+	rtmpsLn  net.Listener
 	log      log.Logger
 }
 
-func NewServer(observer ServerObserver, addr string, logger log.Logger) *Server {
+func NewServer(observer ServerObserver, config ServerConfig, logger log.Logger) *Server {
 	logger.WithPrefix("pkg.rtmp.server")
 	return &Server{
 		observer: observer,
-		addr:     addr,
+		config:   config,
 		log:      logger,
 	}
 }
@@ -45,37 +60,89 @@ func (s *Server) Log() log.Logger {
 	return s.log
 }
 func (server *Server) Listen() (err error) {
-	if server.ln, err = net.Listen("tcp", server.addr); err != nil {
-		return
+	if server.config.Enable {
+		if server.ln, err = net.Listen("tcp", server.config.Addr); err != nil {
+			return
+		}
+		server.Log().Info("start rtmp server listen. addr=%s", server.config.Addr)
+	}
+
+	if server.config.EnableRTMPS {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(server.config.RTMPSCertFile, server.config.RTMPSKeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if server.rtmpsLn, err = tls.Listen("tcp", server.config.RTMPSAddr, tlsConfig); err != nil {
+			return
+		}
+		server.Log().Info("start rtmps server listen. addr=%s", server.config.RTMPSAddr)
 	}
-	server.Log().Info("start rtmp server listen. addr=%s", server.addr)
 	return
 }
 
+// 阻塞直到所有监听都结束，返回值为第一个结束的监听的错误
 func (server *Server) RunLoop() error {
-	for {
-		conn, err := server.ln.Accept()
-		if err != nil {
-			return err
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	runAccept := func(ln net.Listener) {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+				return
+			}
+			go server.handleTCPConnect(conn)
 		}
-		go server.handleTCPConnect(conn)
 	}
+
+	if server.ln != nil {
+		wg.Add(1)
+		go runAccept(server.ln)
+	}
+	if server.rtmpsLn != nil {
+		wg.Add(1)
+		go runAccept(server.rtmpsLn)
+	}
+
+	wg.Wait()
+	return firstErr
 }
 
 func (server *Server) Dispose() {
-	if server.ln == nil {
-		return
+	if server.ln != nil {
+		if err := server.ln.Close(); err != nil {
+			server.Log().Error(err)
+		}
 	}
-	if err := server.ln.Close(); err != nil {
-		server.Log().Error(err)
+
+	if server.rtmpsLn != nil {
+		if err := server.rtmpsLn.Close(); err != nil {
+			server.Log().Error(err)
+		}
 	}
 }
 
 func (server *Server) handleTCPConnect(conn net.Conn) {
 	server.Log().Info("accept a rtmp connection. remoteAddr=%s", conn.RemoteAddr().String())
 	session := NewServerSession(server, conn, server.log)
+	session.strictHandshake = server.config.StrictHandshake
 	err := session.RunLoop()
 	server.Log().Info("[%s] rtmp loop done. err=%v", session.UniqueKey, err)
+	// 拒绝connect或publish时，session主动结束，需要在这里关闭连接
+	session.Dispose()
+	server.delSession(session)
+}
+
+func (server *Server) delSession(session *ServerSession) {
 	switch session.t {
 	case ServerSessionTypeUnknown:
 	// noop
@@ -87,17 +154,17 @@ func (server *Server) handleTCPConnect(conn net.Conn) {
 }
 
 // ServerSessionObserver
-func (server *Server) OnRTMPConnect(session *ServerSession, opa ObjectPairArray) {
-	server.observer.OnRTMPConnect(session, opa)
+func (server *Server) OnRTMPConnect(session *ServerSession, opa ObjectPairArray) error {
+	return server.observer.OnRTMPConnect(session, opa)
 }
 
 // ServerSessionObserver
-func (server *Server) OnNewRTMPPubSession(session *ServerSession) {
-	if !server.observer.OnNewRTMPPubSession(session) {
-		server.Log().Warn("dispose PubSession since pub exist.")
-		session.Dispose()
-		return
+func (server *Server) OnNewRTMPPubSession(session *ServerSession) error {
+	if err := server.observer.OnNewRTMPPubSession(session); err != nil {
+		server.Log().Warn("[%s] reject PubSession. err=%v", session.UniqueKey, err)
+		return err
 	}
+	return nil
 }
 
 // ServerSessionObserver
@@ -23,9 +23,10 @@ import (
 
 // TODO chef: 没有进化成Pub Sub时的超时释放
 
+// OnRTMPConnect和OnNewRTMPPubSession返回非nil时，拒绝客户端的connect或publish，返回*StatusError时可以自定义回复的信令内容
 type ServerSessionObserver interface {
-	OnRTMPConnect(session *ServerSession, opa ObjectPairArray)
-	OnNewRTMPPubSession(session *ServerSession) // 上层代码应该在这个事件回调中注册音视频数据的监听
+	OnRTMPConnect(session *ServerSession, opa ObjectPairArray) error
+	OnNewRTMPPubSession(session *ServerSession) error // 上层代码应该在这个事件回调中注册音视频数据的监听
 	OnNewRTMPSubSession(session *ServerSession)
 }
 
@@ -61,6 +62,8 @@ type ServerSession struct {
 	chunkComposer *ChunkComposer
 	packer        *MessagePacker
 
+	strictHandshake bool // 见ServerConfig.StrictHandshake
+
 	conn         connection.Connection
 	prevConnStat connection.Stat
 	staleStat    *connection.Stat
@@ -199,7 +202,10 @@ func (s *ServerSession) handshake() error {
 	}
 
 	if err := s.hs.ReadC2(s.conn); err != nil {
-		return err
+		if err != ErrHandshakeDigest || s.strictHandshake {
+			return err
+		}
+		s.Log().Warn("[%s] handshake c2 digest mismatch, ignore.", s.UniqueKey)
 	}
 	s.Log().Info("[%s] < R Handshake C2.", s.UniqueKey)
 	return nil
@@ -217,6 +223,8 @@ func (s *ServerSession) doMsg(stream *Stream) error {
 		return s.doCommandAFM3Message(stream)
 	case base.RTMPTypeIDMetadata:
 		return s.doDataMessageAMF0(stream)
+	case base.RTMPTypeIDDataMessageAMF3:
+		return s.doDataMessageAMF3(stream)
 	case base.RTMPTypeIDAck:
 		return s.doACK(stream)
 	case base.RTMPTypeIDAudio:
@@ -330,11 +338,37 @@ func (s *ServerSession) doCommandMessage(stream *Stream) error {
 }
 
 func (s *ServerSession) doCommandAFM3Message(stream *Stream) error {
-	//去除前面的0就是AMF0的数据
+	// 去除前面的0就是AMF0的数据，其中的值可能以avmplus-object标记切换为AMF3编码，由amf0的read类型方法处理
+	if stream.msg.len() < 1 {
+		return ErrAMFTooShort
+	}
 	stream.msg.consumed(1)
 	return s.doCommandMessage(stream)
 }
 
+func (s *ServerSession) doDataMessageAMF3(stream *Stream) error {
+	if s.t != ServerSessionTypePub {
+		s.Log().Error("[%s] read amf3 data message but server session not pub type.", s.UniqueKey)
+		return ErrRTMP
+	}
+
+	msg, err := stream.toAMF0DataMsg()
+	if err != nil {
+		return err
+	}
+
+	val, _, err := AMF0.ReadString(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if val == "|RtmpSampleAccess" {
+		s.Log().Debug("[%s] < R |RtmpSampleAccess, ignore.", s.UniqueKey)
+		return nil
+	}
+	s.avObserver.OnReadRTMPAVMsg(msg)
+	return nil
+}
+
 func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 	val, err := stream.msg.readObjectWithType()
 	if err != nil {
@@ -350,8 +384,6 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 	}
 	s.Log().Info("[%s] < R connect('%s'). tcUrl=%s", s.UniqueKey, s.appName, s.tcURL)
 
-	s.observer.OnRTMPConnect(s, val)
-
 	s.Log().Info("[%s] > W Window Acknowledgement Size %d.", s.UniqueKey, windowAcknowledgementSize)
 	if err := s.packer.writeWinAckSize(s.conn, windowAcknowledgementSize); err != nil {
 		return err
@@ -367,6 +399,16 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 		return err
 	}
 
+	// 携带ex.redirect时信令长度可能超过默认chunk size，所以在设置完chunk size之后再回复
+	if err := s.observer.OnRTMPConnect(s, val); err != nil {
+		se := toStatusError(err, StatusCodeConnectRejected)
+		s.Log().Info("[%s] > W _error('%s'). description=%s, redirect=%s", s.UniqueKey, se.Code, se.Description, se.Redirect)
+		if err := s.packer.writeConnectError(s.conn, tid, se.Code, se.Description, se.Redirect); err != nil {
+			return err
+		}
+		return se
+	}
+
 	s.Log().Info("[%s] > W _result('NetConnection.Connect.Success').", s.UniqueKey)
 	oe, err := val.FindNumber("objectEncoding")
 	if oe != 0 && oe != 3 {
@@ -410,6 +452,17 @@ func (s *ServerSession) doPublish(tid int, stream *Stream) (err error) {
 	s.Log().Debug("[%s] pubType=%s", s.UniqueKey, pubType)
 	s.Log().Info("[%s] < R publish('%s')", s.UniqueKey, s.streamNameWithRawQuery)
 
+	if err := s.observer.OnNewRTMPPubSession(s); err != nil {
+		se := toStatusError(err, StatusCodePublishBadName)
+		s.Log().Info("[%s] > W onStatus('%s'). description=%s", s.UniqueKey, se.Code, se.Description)
+		if err := s.packer.writeOnStatusError(s.conn, MSID1, se.Code, se.Description); err != nil {
+			return err
+		}
+		return se
+	}
+	// 上层已经注册了该session，之后回复信令失败时，也需要在session结束时通知上层移除
+	s.t = ServerSessionTypePub
+
 	s.Log().Info("[%s] > W onStatus('NetStream.Publish.Start').", s.UniqueKey)
 	if err := s.packer.writeOnStatusPublish(s.conn, MSID1); err != nil {
 		return err
@@ -418,9 +471,6 @@ func (s *ServerSession) doPublish(tid int, stream *Stream) (err error) {
 	// 回复完信令后修改 connection 的属性
 	s.modConnProps()
 
-	s.t = ServerSessionTypePub
-	s.observer.OnNewRTMPPubSession(s)
-
 	return nil
 }
 
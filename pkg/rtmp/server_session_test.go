@@ -0,0 +1,109 @@
+// Copyright 2021, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+)
+
+// 写入总是失败的连接
+type writeFailConn struct {
+	net.Conn
+}
+
+func (c *writeFailConn) Write(b []byte) (int, error) {
+	return 0, errors.New("write fail")
+}
+
+func (c *writeFailConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+}
+
+func (c *writeFailConn) Close() error {
+	return nil
+}
+
+type serverSessionTestObserver struct {
+	pubs map[*ServerSession]bool
+}
+
+func (o *serverSessionTestObserver) OnRTMPConnect(session *ServerSession, opa ObjectPairArray) error {
+	return nil
+}
+
+func (o *serverSessionTestObserver) OnNewRTMPPubSession(session *ServerSession) error {
+	o.pubs[session] = true
+	return nil
+}
+
+func (o *serverSessionTestObserver) OnDelRTMPPubSession(session *ServerSession) {
+	delete(o.pubs, session)
+}
+
+func (o *serverSessionTestObserver) OnNewRTMPSubSession(session *ServerSession) bool {
+	return true
+}
+
+func (o *serverSessionTestObserver) OnDelRTMPSubSession(session *ServerSession) {
+}
+
+// 上层接受推流后，回复NetStream.Publish.Start失败，session结束时依然需要通知上层移除
+func TestServerSessionPublishWriteFail(t *testing.T) {
+	o := &serverSessionTestObserver{pubs: make(map[*ServerSession]bool)}
+	server := NewServer(o, ServerConfig{}, log.DefaultBeeLogger)
+	session := NewServerSession(server, &writeFailConn{}, log.DefaultBeeLogger)
+
+	var buf bytes.Buffer
+	_ = AMF0.WriteNull(&buf)
+	_ = AMF0.WriteString(&buf, "test")
+	_ = AMF0.WriteString(&buf, "live")
+	stream := NewStream(log.DefaultBeeLogger)
+	stream.msg.reserve(uint32(buf.Len()))
+	copy(stream.msg.buf[stream.msg.e:], buf.Bytes())
+	stream.msg.produced(uint32(buf.Len()))
+
+	err := session.doPublish(0, stream)
+	assert.IsNotNil(t, err)
+	assert.Equal(t, 1, len(o.pubs))
+
+	session.Dispose()
+	server.delSession(session)
+	assert.Equal(t, 0, len(o.pubs))
+}
+
+// 复杂握手的c2 digest校验失败时，默认只打印警告日志，开启StrictHandshake时握手失败
+func TestServerSessionHandshakeLooseC2(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		session := NewServerSession(nil, c1, log.DefaultBeeLogger)
+		session.strictHandshake = strict
+
+		go func() {
+			var hc HandshakeClientComplex
+			_ = hc.WriteC0C1(c2)
+			_ = hc.ReadS0S1S2(c2)
+			hc.c2[c2Len-1] ^= 0xFF
+			_ = hc.WriteC2(c2)
+		}()
+		err := session.handshake()
+		if strict {
+			assert.Equal(t, ErrHandshakeDigest, err)
+		} else {
+			assert.Equal(t, nil, err)
+		}
+		_ = c1.Close()
+		_ = c2.Close()
+	}
+}
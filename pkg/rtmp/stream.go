@@ -9,6 +9,7 @@
 package rtmp
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 
@@ -68,6 +69,29 @@ func (stream *Stream) toAVMsg() base.RTMPMsg {
 	}
 }
 
+// 将AMF3 data message转换为AMF0 data message，上层可以统一按AMF0的metadata处理
+//
+// 注意，不会修改stream自身的header，因为chunk composer后续的chunk需要复用header
+//
+// @return 返回的Payload为新申请的独立内存块
+func (stream *Stream) toAMF0DataMsg() (base.RTMPMsg, error) {
+	if stream.msg.len() < 1 {
+		return base.RTMPMsg{}, ErrAMFTooShort
+	}
+	// 去除前面的0，后面是amf0的数据，其中的值可能以avmplus-object标记切换为amf3编码
+	buf := &bytes.Buffer{}
+	if err := AMF3DataToAMF0(stream.msg.buf[stream.msg.b+1:stream.msg.e], buf); err != nil {
+		return base.RTMPMsg{}, err
+	}
+	header := stream.header
+	header.MsgTypeID = base.RTMPTypeIDMetadata
+	header.MsgLen = uint32(buf.Len())
+	return base.RTMPMsg{
+		Header:  header,
+		Payload: buf.Bytes(),
+	}, nil
+}
+
 func (msg *StreamMsg) reserve(n uint32) {
 	bufCap := uint32(cap(msg.buf))
 	nn := bufCap - msg.e
@@ -0,0 +1,324 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package udpts
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+const (
+	// 每个UDP包包含7个TS packet，1316字节，不超过以太网MTU
+	tsPacketNumPerDatagram = 7
+	datagramSize           = tsPacketNumPerDatagram * 188
+
+	// 开启PCR平滑发送时，最多缓存的UDP包数量，超过后丢弃新的数据
+	maxPacingQueueNum = 4096
+	// 缓存的UDP包数量超过该值时，不再等待，尽快发送
+	pacingCatchUpNum = maxPacingQueueNum / 2
+	// PCR跳跃超过该值（或者往回跳），重新设置发送基准
+	maxPCRJump = 27000000
+)
+
+type PushSession struct {
+	UniqueKey  string
+	appName    string
+	streamName string
+	config     PushConfig
+
+	conn *net.UDPConn
+
+	m         sync.Mutex
+	disposed  bool
+	started   bool   // 收到第一个boundary之后才开始发送
+	buf       []byte // 不足一个UDP包的数据
+	psiHeader []byte // PAT和PMT，每个boundary前插入
+	psiCC     uint8
+
+	pacingChan chan pacingDatagram
+	exitChan   chan struct{}
+	dropNum    int
+
+	currConnStat connection.StatAtomic
+	prevConnStat connection.Stat
+	staleStat    *connection.Stat
+	stat         base.StatSession
+	log          log.Logger
+}
+
+type pacingDatagram struct {
+	b      []byte
+	hasPCR bool
+	pcr    uint64
+}
+
+func NewPushSession(appName, streamName string, config PushConfig, logger log.Logger) *PushSession {
+	uk := base.GenUniqueKey(base.UKPUDPTSPushSession)
+	s := &PushSession{
+		UniqueKey:  uk,
+		appName:    appName,
+		streamName: streamName,
+		config:     config,
+		psiHeader:  append([]byte(nil), mpegts.FixedFragmentHeader...),
+		exitChan:   make(chan struct{}),
+		stat: base.StatSession{
+			Protocol:   base.ProtocolUDPTS,
+			SessionID:  uk,
+			RemoteAddr: config.Addr,
+			StartTime:  time.Now().Format("2006-01-02 15:04:05.999"),
+		},
+		log: logger,
+	}
+	s.log.WithPrefix("pkg.udpts.push_session")
+	s.log.Info("[%s] lifecycle new udp ts PushSession. session=%p, streamName=%s, addr=%s", uk, s, streamName, config.Addr)
+	return s
+}
+
+func (s *PushSession) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.udpts.push_session")
+	return s.log
+}
+
+// 建立UDP socket，并根据配置设置TTL，开启PCR平滑发送时启动发送协程
+func (s *PushSession) Start() error {
+	addr, err := net.ResolveUDPAddr("udp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	if s.config.TTL > 0 {
+		if err = setTTL(conn, s.config.TTL, addr.IP.IsMulticast()); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	_ = conn.SetWriteBuffer(4 * 1024 * 1024)
+	s.conn = conn
+
+	if s.config.PCRPacing {
+		s.pacingChan = make(chan pacingDatagram, maxPacingQueueNum)
+		go s.runPacingLoop()
+	}
+	s.Log().Info("[%s] start udp ts push. addr=%s, ttl=%d, pcr_pacing=%t", s.UniqueKey, s.config.Addr, s.config.TTL, s.config.PCRPacing)
+	return nil
+}
+
+// @param b        TS流，与hls.MuxerObserver.OnTSPackets中的rawFrame相同，函数调用结束后，内部不持有该内存块
+// @param boundary 为true时，在数据前插入PAT和PMT
+func (s *PushSession) WriteTSPackets(b []byte, boundary bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.disposed || s.conn == nil {
+		return
+	}
+
+	if boundary {
+		s.started = true
+		s.psiHeader[3] = s.psiHeader[3]&0xF0 | s.psiCC
+		s.psiHeader[188+3] = s.psiHeader[188+3]&0xF0 | s.psiCC
+		s.psiCC = (s.psiCC + 1) & 0x0F
+		s.buf = append(s.buf, s.psiHeader...)
+	}
+	if !s.started {
+		return
+	}
+	s.buf = append(s.buf, b...)
+
+	var i int
+	for ; i+datagramSize <= len(s.buf); i += datagramSize {
+		s.send(s.buf[i : i+datagramSize])
+	}
+	s.buf = append(s.buf[:0], s.buf[i:]...)
+}
+
+func (s *PushSession) Dispose() {
+	s.Log().Info("[%s] lifecycle dispose udp ts PushSession. session=%p", s.UniqueKey, s)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.disposed {
+		return
+	}
+	s.disposed = true
+	close(s.exitChan)
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *PushSession) Addr() string {
+	return s.config.Addr
+}
+
+func (s *PushSession) AppName() string {
+	return s.appName
+}
+
+func (s *PushSession) StreamName() string {
+	return s.streamName
+}
+
+func (s *PushSession) GetStat() base.StatSession {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stat.WroteBytesSum = s.currConnStat.WroteBytesSum.Load()
+	return s.stat
+}
+
+func (s *PushSession) UpdateStat(interval uint32) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	wroteBytesSum := s.currConnStat.WroteBytesSum.Load()
+	wDiff := wroteBytesSum - s.prevConnStat.WroteBytesSum
+	s.stat.WriteBitrate = int(wDiff * 8 / 1024 / uint64(interval))
+	s.stat.Bitrate = s.stat.WriteBitrate
+	s.prevConnStat.WroteBytesSum = wroteBytesSum
+}
+
+func (s *PushSession) IsAlive() (readAlive, writeAlive bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	wroteBytesSum := s.currConnStat.WroteBytesSum.Load()
+	if s.staleStat == nil {
+		s.staleStat = new(connection.Stat)
+		s.staleStat.WroteBytesSum = wroteBytesSum
+		return true, true
+	}
+
+	writeAlive = !(wroteBytesSum-s.staleStat.WroteBytesSum == 0)
+	s.staleStat.WroteBytesSum = wroteBytesSum
+	return true, writeAlive
+}
+
+// 注意，调用方持有锁
+func (s *PushSession) send(b []byte) {
+	if s.pacingChan == nil {
+		s.write(b)
+		return
+	}
+
+	d := pacingDatagram{b: append([]byte(nil), b...)}
+	d.pcr, d.hasPCR = findPCR(b)
+	select {
+	case s.pacingChan <- d:
+	default:
+		// 避免日志过多，只打印第一次以及之后每1000次
+		if s.dropNum%1000 == 0 {
+			s.Log().Warn("[%s] pacing queue full, drop datagram. dropped=%d", s.UniqueKey, s.dropNum+1)
+		}
+		s.dropNum++
+	}
+}
+
+func (s *PushSession) write(b []byte) {
+	n, err := s.conn.Write(b)
+	if err != nil {
+		// UDP发送失败（比如对端ICMP不可达）不中断推送
+		return
+	}
+	s.currConnStat.WroteBytesSum.Add(uint64(n))
+}
+
+// 按照PCR的节奏发送UDP包
+//
+// 带有PCR的包，发送时间为 基准墙上时间 + (PCR - 基准PCR)
+// 两个PCR之间的包，使用上一个PCR区间估算出的每个包的平均间隔，均匀发送
+func (s *PushSession) runPacingLoop() {
+	var (
+		hasBase    bool
+		pcrBase    uint64
+		wallBase   time.Time
+		lastPCR    uint64
+		lastTarget time.Time
+		interval   time.Duration // 两个PCR之间，每个UDP包的平均发送间隔
+		count      int           // 距离上一个PCR的UDP包数量
+	)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		var d pacingDatagram
+		select {
+		case d = <-s.pacingChan:
+		case <-s.exitChan:
+			return
+		}
+
+		now := time.Now()
+		target := now
+		count++
+		if d.hasPCR {
+			if !hasBase || d.pcr < lastPCR || d.pcr-lastPCR > maxPCRJump {
+				hasBase = true
+				pcrBase = d.pcr
+				wallBase = now
+				interval = 0
+			} else {
+				target = wallBase.Add(time.Duration((d.pcr-pcrBase)*1000/27) * time.Nanosecond)
+				interval = target.Sub(lastTarget) / time.Duration(count)
+				// 发送已经严重落后，重新设置基准
+				if now.Sub(target) > time.Second {
+					pcrBase = d.pcr
+					wallBase = now
+					target = now
+				}
+			}
+			lastPCR = d.pcr
+			lastTarget = target
+			count = 0
+		} else if hasBase && interval > 0 {
+			target = lastTarget.Add(interval * time.Duration(count))
+		}
+
+		if len(s.pacingChan) < pacingCatchUpNum {
+			if wait := target.Sub(now); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-s.exitChan:
+					return
+				}
+			}
+		}
+
+		s.m.Lock()
+		if !s.disposed {
+			s.write(d.b)
+		}
+		s.m.Unlock()
+	}
+}
+
+// 查找UDP包中第一个携带PCR的TS packet
+func findPCR(b []byte) (pcr uint64, ok bool) {
+	for i := 0; i+188 <= len(b); i += 188 {
+		h, err := mpegts.ParseTSPacketHeader(b[i:])
+		if err != nil || h.Adaptation&0x2 == 0 {
+			continue
+		}
+		f, err := mpegts.ParseTSPacketAdaptation(b[i+4 : i+188])
+		if err != nil || !f.PCRFlag {
+			continue
+		}
+		return f.PCR, true
+	}
+	return 0, false
+}
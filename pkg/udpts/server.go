@@ -0,0 +1,166 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package udpts
+
+import (
+	"net"
+	"time"
+
+	"github.com/souliot/naza/pkg/log"
+)
+
+type ServerObserver interface {
+	// 通知上层有新的输入流，收到第一个UDP包时回调
+	// 返回值： true则允许推流，false则丢弃数据，超时后再次尝试
+	OnNewUDPTSPubSession(session *PubSession) bool
+
+	// 超时没有收到数据，或session被上层Dispose后回调
+	OnDelUDPTSPubSession(session *PubSession)
+}
+
+type Server struct {
+	observer ServerObserver
+	config   ServerConfig
+	timeout  time.Duration
+
+	conn *net.UDPConn
+
+	// 以下字段只在RunLoop协程中访问
+	session      *PubSession
+	rejectedTime time.Time // 上层拒绝推流的时间，超时前丢弃数据
+	lastReadTime time.Time
+
+	log log.Logger
+}
+
+func NewServer(observer ServerObserver, config ServerConfig, logger log.Logger) *Server {
+	logger.WithPrefix("pkg.udpts.server")
+	timeout := config.TimeoutMS
+	if timeout <= 0 {
+		timeout = defaultTimeoutMS
+	}
+	return &Server{
+		observer: observer,
+		config:   config,
+		timeout:  time.Duration(timeout) * time.Millisecond,
+		log:      logger,
+	}
+}
+
+func (s *Server) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.udpts.server")
+	return s.log
+}
+
+func (server *Server) Listen() (err error) {
+	addr, err := net.ResolveUDPAddr("udp", server.config.Addr)
+	if err != nil {
+		return
+	}
+
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if server.config.Interface != "" {
+			if ifi, err = net.InterfaceByName(server.config.Interface); err != nil {
+				return
+			}
+		}
+		if server.conn, err = net.ListenMulticastUDP("udp", ifi, addr); err != nil {
+			return
+		}
+		server.Log().Info("start udp ts server listen multicast. addr=%s, interface=%s, stream=%s", server.config.Addr, server.config.Interface, server.config.StreamName)
+	} else {
+		if server.conn, err = net.ListenUDP("udp", addr); err != nil {
+			return
+		}
+		server.Log().Info("start udp ts server listen. addr=%s, stream=%s", server.config.Addr, server.config.StreamName)
+	}
+	// 码率较高时，默认的接收缓冲区容易溢出
+	_ = server.conn.SetReadBuffer(4 * 1024 * 1024)
+	return
+}
+
+// 监听地址，Listen成功后有效，方便使用0端口时获取实际端口
+func (server *Server) LocalAddr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+func (server *Server) RunLoop() error {
+	b := make([]byte, maxDatagramSize)
+	for {
+		// 周期性超时，用于检查输入流是否结束
+		_ = server.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, rAddr, err := server.conn.ReadFromUDP(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				server.checkTimeout()
+				continue
+			}
+			server.delSession()
+			return err
+		}
+		server.lastReadTime = time.Now()
+		server.onReadUDPPacket(b[:n], rAddr)
+	}
+}
+
+func (server *Server) Dispose() {
+	if server.conn == nil {
+		return
+	}
+	if err := server.conn.Close(); err != nil {
+		server.Log().Error(err)
+	}
+}
+
+func (server *Server) onReadUDPPacket(b []byte, rAddr *net.UDPAddr) {
+	if server.session != nil && server.session.isDisposed() {
+		server.delSession()
+	}
+
+	if server.session == nil {
+		if !server.rejectedTime.IsZero() && time.Since(server.rejectedTime) < server.timeout {
+			return
+		}
+		server.rejectedTime = time.Time{}
+
+		session := NewPubSession(server.config.AppName, server.config.StreamName, server.config.ProgramNumber, rAddr.String(), server.log)
+		if !server.observer.OnNewUDPTSPubSession(session) {
+			server.Log().Warn("[%s] udp ts PubSession rejected. stream=%s", session.UniqueKey, server.config.StreamName)
+			server.rejectedTime = time.Now()
+			return
+		}
+		server.session = session
+	}
+
+	server.session.feed(b)
+}
+
+func (server *Server) checkTimeout() {
+	if server.session == nil {
+		return
+	}
+	if server.session.isDisposed() || time.Since(server.lastReadTime) >= server.timeout {
+		server.Log().Warn("[%s] udp ts PubSession timeout or disposed. stream=%s", server.session.UniqueKey, server.config.StreamName)
+		server.delSession()
+	}
+}
+
+func (server *Server) delSession() {
+	if server.session == nil {
+		return
+	}
+	session := server.session
+	server.session = nil
+	_ = session.Dispose()
+	server.observer.OnDelUDPTSPubSession(session)
+}
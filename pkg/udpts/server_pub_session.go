@@ -0,0 +1,189 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package udpts
+
+import (
+	"sync"
+	"time"
+
+	"github.com/souliot/naza/pkg/connection"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/remux"
+)
+
+// 与rtsp.BaseInSessionObserver中的音视频回调保持一致，方便上层复用
+type PubSessionObserver interface {
+	// @param asc: AAC AudioSpecificConfig，注意，如果不存在音频，则为nil
+	// @param vps, sps, pps 如果都为nil，则没有视频，如果sps, pps不为nil，则vps不为nil是H265，vps为nil是H264
+	OnAVConfig(asc, vps, sps, pps []byte)
+
+	// @param pkt: 视频为AVCC格式（4字节长度前缀），不包含vps、sps、pps、aud
+	//             音频为AAC raw frame，不包含ADTS头
+	//             Timestamp为DTS，单位毫秒
+	OnAVPacket(pkt base.AVPacket)
+}
+
+type PubSession struct {
+	UniqueKey  string
+	appName    string
+	streamName string
+	remoteAddr string
+
+	m        sync.Mutex
+	observer PubSessionObserver
+	disposed bool
+
+	// 只在Server的读协程中访问
+	remuxer *remux.TS2AVPacket
+
+	currConnStat connection.StatAtomic
+	prevConnStat connection.Stat
+	staleStat    *connection.Stat
+	stat         base.StatSession
+	log          log.Logger
+}
+
+func NewPubSession(appName, streamName string, programNumber uint16, remoteAddr string, logger log.Logger) *PubSession {
+	uk := base.GenUniqueKey(base.UKPUDPTSPubSession)
+	s := &PubSession{
+		UniqueKey:  uk,
+		appName:    appName,
+		streamName: streamName,
+		remoteAddr: remoteAddr,
+		stat: base.StatSession{
+			Protocol:   base.ProtocolUDPTS,
+			SessionID:  uk,
+			RemoteAddr: remoteAddr,
+			StartTime:  time.Now().Format("2006-01-02 15:04:05.999"),
+		},
+		log: logger,
+	}
+	s.remuxer = remux.NewTS2AVPacket(uk, programNumber, s.onAVConfig, s.onAVPacket, logger)
+	s.log.WithPrefix("pkg.udpts.server_pub_session")
+	s.log.Info("[%s] lifecycle new udp ts PubSession. session=%p, streamName=%s, remoteAddr=%s", uk, s, streamName, remoteAddr)
+	return s
+}
+
+func (s *PubSession) Log() log.Logger {
+	if s.log == nil {
+		s.log = log.DefaultBeeLogger
+	}
+	s.log.WithPrefix("pkg.udpts.server_pub_session")
+	return s.log
+}
+
+// 设置回调监听对象后，才开始回调数据，之前的数据直接丢弃
+func (s *PubSession) SetObserver(observer PubSessionObserver) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.observer = observer
+}
+
+// 注意，Dispose只做标记，Server收到下一个UDP包或超时时，会回调上层删除该session
+func (s *PubSession) Dispose() error {
+	s.Log().Info("[%s] lifecycle dispose udp ts PubSession. session=%p", s.UniqueKey, s)
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.disposed = true
+	s.observer = nil
+	return nil
+}
+
+func (s *PubSession) URL() string {
+	return "udp://" + s.remoteAddr
+}
+
+func (s *PubSession) AppName() string {
+	return s.appName
+}
+
+func (s *PubSession) StreamName() string {
+	return s.streamName
+}
+
+func (s *PubSession) RawQuery() string {
+	return ""
+}
+
+func (s *PubSession) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+func (s *PubSession) GetStat() base.StatSession {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.stat.ReadBytesSum = s.currConnStat.ReadBytesSum.Load()
+	return s.stat
+}
+
+func (s *PubSession) UpdateStat(interval uint32) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	readBytesSum := s.currConnStat.ReadBytesSum.Load()
+	rDiff := readBytesSum - s.prevConnStat.ReadBytesSum
+	s.stat.ReadBitrate = int(rDiff * 8 / 1024 / uint64(interval))
+	s.stat.Bitrate = s.stat.ReadBitrate
+	s.prevConnStat.ReadBytesSum = readBytesSum
+}
+
+func (s *PubSession) IsAlive() (readAlive, writeAlive bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	readBytesSum := s.currConnStat.ReadBytesSum.Load()
+	if s.staleStat == nil {
+		s.staleStat = new(connection.Stat)
+		s.staleStat.ReadBytesSum = readBytesSum
+		return true, true
+	}
+
+	readAlive = !(readBytesSum-s.staleStat.ReadBytesSum == 0)
+	s.staleStat.ReadBytesSum = readBytesSum
+	return readAlive, true
+}
+
+func (s *PubSession) isDisposed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.disposed
+}
+
+// callback by Server
+func (s *PubSession) feed(b []byte) {
+	s.currConnStat.ReadBytesSum.Add(uint64(len(b)))
+	s.m.Lock()
+	observer := s.observer
+	s.m.Unlock()
+	if observer == nil {
+		return
+	}
+	s.remuxer.Feed(b)
+}
+
+// callback by remux.TS2AVPacket
+func (s *PubSession) onAVConfig(asc, vps, sps, pps []byte) {
+	s.m.Lock()
+	observer := s.observer
+	s.m.Unlock()
+	if observer == nil {
+		return
+	}
+	observer.OnAVConfig(asc, vps, sps, pps)
+}
+
+// callback by remux.TS2AVPacket
+func (s *PubSession) onAVPacket(pkt base.AVPacket) {
+	s.m.Lock()
+	observer := s.observer
+	s.m.Unlock()
+	if observer == nil {
+		return
+	}
+	observer.OnAVPacket(pkt)
+}
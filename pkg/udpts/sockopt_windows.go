@@ -0,0 +1,34 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+// +build windows
+
+package udpts
+
+import (
+	"net"
+	"syscall"
+)
+
+func setTTL(conn *net.UDPConn, ttl int, multicast bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	opt := syscall.IP_TTL
+	if multicast {
+		opt = syscall.IP_MULTICAST_TTL
+	}
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, opt, ttl)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,58 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package udpts
+
+import "errors"
+
+// 接收UDP承载的MPEG-TS流（单播或组播），作为输入流
+//
+// 每个Server监听一个地址，对应一路流
+//
+// 另外，PushSession将group的TS流通过UDP发送给指定地址（单播或组播）
+
+var ErrUDPTS = errors.New("lal.udpts: fxxk")
+
+const (
+	defaultTimeoutMS = 10000
+
+	// 单个UDP包的最大大小
+	maxDatagramSize = 65535
+)
+
+type ServerConfig struct {
+	AppName    string `json:"app_name"`
+	StreamName string `json:"stream_name"`
+
+	// 监听地址，格式为host:port
+	// host为组播地址时，加入该组播组
+	Addr string `json:"addr"`
+
+	// 加入组播组时使用的网卡名，为空则由系统选择
+	Interface string `json:"interface"`
+
+	// TS流中存在多个program时，选择的program_number，为0则使用最先收到数据的program
+	ProgramNumber uint16 `json:"program_number"`
+
+	// 超过该时长没有收到数据，则认为输入流结束，为0则使用默认值
+	TimeoutMS int `json:"timeout_ms"`
+}
+
+type PushConfig struct {
+	// 配置文件中使用，表示该项对应的流，通过HTTP API添加时不需要
+	StreamName string `json:"stream_name"`
+
+	// 目标地址，格式为host:port，host可以为组播地址
+	Addr string `json:"addr"`
+
+	// IP TTL，目标为组播地址时设置组播TTL，为0则使用系统默认值
+	TTL int `json:"ttl"`
+
+	// 为true时，按照PCR的节奏平滑发送，否则收到数据后立即发送
+	PCRPacing bool `json:"pcr_pacing"`
+}
@@ -0,0 +1,250 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/souliot/siot-av
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package udpts
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/souliot/naza/pkg/assert"
+	"github.com/souliot/naza/pkg/log"
+	"github.com/souliot/siot-av/pkg/base"
+	"github.com/souliot/siot-av/pkg/mpegts"
+)
+
+var (
+	goldenSPS = []byte{0x67, 0x64, 0x00, 0x1f}
+	goldenPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+	goldenIDR = []byte{0x65, 0x88, 0x84, 0x00}
+	goldenP   = []byte{0x41, 0x9a, 0x26, 0x00}
+	// 44100Hz, 2 channel, 4字节raw数据
+	goldenADTS = []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, 1, 2, 3, 4}
+)
+
+type testObserver struct {
+	m       sync.Mutex
+	asc     []byte
+	sps     []byte
+	pps     []byte
+	pkts    []base.AVPacket
+	newChan chan *PubSession
+	delChan chan *PubSession
+}
+
+func (o *testObserver) OnAVConfig(asc, vps, sps, pps []byte) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.asc, o.sps, o.pps = asc, sps, pps
+}
+
+func (o *testObserver) OnAVPacket(pkt base.AVPacket) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.pkts = append(o.pkts, pkt)
+}
+
+func (o *testObserver) OnNewUDPTSPubSession(session *PubSession) bool {
+	session.SetObserver(o)
+	o.newChan <- session
+	return true
+}
+
+func (o *testObserver) OnDelUDPTSPubSession(session *PubSession) {
+	o.delChan <- session
+}
+
+func annexb(nals ...[]byte) []byte {
+	var out []byte
+	for _, nal := range nals {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nal...)
+	}
+	return out
+}
+
+func makeTS() []byte {
+	var out []byte
+	out = append(out, mpegts.FixedFragmentHeader...)
+	onPacket := func(packet []byte) {
+		out = append(out, packet...)
+	}
+	var videoCC, audioCC uint8
+	frames := []mpegts.Frame{
+		// 关键帧之前的非关键帧需要丢弃
+		{PTS: 90000, DTS: 90000, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Raw: annexb(goldenP)},
+		{PTS: 93600, DTS: 93600, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Key: true, Raw: annexb([]byte{0x09, 0xf0}, goldenSPS, goldenPPS, goldenIDR)},
+		{PTS: 93600, DTS: 93600, Pid: mpegts.PidAudio, Sid: mpegts.StreamIDAudio, Raw: goldenADTS},
+		{PTS: 97200, DTS: 97200, Pid: mpegts.PidVideo, Sid: mpegts.StreamIDVideo, Raw: annexb(goldenP)},
+	}
+	for i := range frames {
+		f := &frames[i]
+		if f.Pid == mpegts.PidVideo {
+			f.CC = videoCC
+			mpegts.PackTSPacket(f, onPacket)
+			videoCC = f.CC
+		} else {
+			f.CC = audioCC
+			mpegts.PackTSPacket(f, onPacket)
+			audioCC = f.CC
+		}
+	}
+	return out
+}
+
+func TestPubSession(t *testing.T) {
+	o := &testObserver{}
+	session := NewPubSession("live", "test", 0, "127.0.0.1:1234", log.DefaultBeeLogger)
+	session.SetObserver(o)
+	ts := makeTS()
+	// 模拟7个TS packet一个UDP包
+	for i := 0; i < len(ts); i += 1316 {
+		end := i + 1316
+		if end > len(ts) {
+			end = len(ts)
+		}
+		session.feed(ts[i:end])
+	}
+	session.remuxer.Flush()
+
+	assert.Equal(t, []byte{0x12, 0x10}, o.asc)
+	assert.Equal(t, goldenSPS, o.sps)
+	assert.Equal(t, goldenPPS, o.pps)
+	assert.Equal(t, 3, len(o.pkts))
+
+	assert.Equal(t, base.AVPacketPTAVC, o.pkts[0].PayloadType)
+	assert.Equal(t, uint32(0), o.pkts[0].Timestamp)
+	assert.Equal(t, append([]byte{0, 0, 0, 4}, goldenIDR...), o.pkts[0].Payload)
+
+	assert.Equal(t, base.AVPacketPTAAC, o.pkts[1].PayloadType)
+	assert.Equal(t, uint32(0), o.pkts[1].Timestamp)
+	assert.Equal(t, []byte{1, 2, 3, 4}, o.pkts[1].Payload)
+
+	assert.Equal(t, base.AVPacketPTAVC, o.pkts[2].PayloadType)
+	assert.Equal(t, uint32(40), o.pkts[2].Timestamp)
+
+	stat := session.GetStat()
+	assert.Equal(t, base.ProtocolUDPTS, stat.Protocol)
+	assert.Equal(t, uint64(len(ts)), stat.ReadBytesSum)
+}
+
+func TestServer(t *testing.T) {
+	o := &testObserver{
+		newChan: make(chan *PubSession, 1),
+		delChan: make(chan *PubSession, 1),
+	}
+	server := NewServer(o, ServerConfig{
+		AppName:    "live",
+		StreamName: "test",
+		Addr:       "127.0.0.1:0",
+		TimeoutMS:  100,
+	}, log.DefaultBeeLogger)
+	err := server.Listen()
+	assert.Equal(t, nil, err)
+	go server.RunLoop()
+	defer server.Dispose()
+
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+
+	ts := makeTS()
+	for i := 0; i < len(ts); i += 1316 {
+		end := i + 1316
+		if end > len(ts) {
+			end = len(ts)
+		}
+		_, _ = conn.Write(ts[i:end])
+	}
+
+	var session *PubSession
+	select {
+	case session = <-o.newChan:
+	case <-time.After(time.Second):
+		t.Fatal("new session timeout")
+	}
+	assert.Equal(t, "test", session.StreamName())
+	assert.Equal(t, "live", session.AppName())
+
+	select {
+	case s := <-o.delChan:
+		assert.Equal(t, session, s)
+	case <-time.After(3 * time.Second):
+		t.Fatal("del session timeout")
+	}
+
+	o.m.Lock()
+	assert.Equal(t, goldenSPS, o.sps)
+	o.m.Unlock()
+}
+
+func TestPushSession(t *testing.T) {
+	for _, pacing := range []bool{false, true} {
+		lconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Equal(t, nil, err)
+
+		session := NewPushSession("live", "test", PushConfig{
+			Addr:      lconn.LocalAddr().String(),
+			TTL:       8,
+			PCRPacing: pacing,
+		}, log.DefaultBeeLogger)
+		err = session.Start()
+		assert.Equal(t, nil, err)
+
+		// 去掉makeTS中的PAT和PMT，模拟hls.Muxer的回调
+		frames := makeTS()[2*188:]
+		// boundary之前的数据需要丢弃
+		session.WriteTSPackets(frames, false)
+		for i := 0; i < 3; i++ {
+			session.WriteTSPackets(frames, true)
+		}
+
+		// 3 * (2个PSI + frames)
+		total := 3 * (2*188 + len(frames))
+		b := make([]byte, maxDatagramSize)
+		var n, datagramNum int
+		var psiCCList []uint8
+		for n+datagramSize <= total {
+			_ = lconn.SetReadDeadline(time.Now().Add(time.Second))
+			l, _, err := lconn.ReadFromUDP(b)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, datagramSize, l)
+			for i := 0; i < l; i += 188 {
+				h, err := mpegts.ParseTSPacketHeader(b[i:])
+				assert.Equal(t, nil, err)
+				if h.Pid == mpegts.PidPAT {
+					psiCCList = append(psiCCList, h.CC)
+				}
+			}
+			n += l
+			datagramNum++
+		}
+		assert.Equal(t, total/datagramSize, datagramNum)
+		assert.Equal(t, []uint8{0, 1, 2}, psiCCList)
+
+		stat := session.GetStat()
+		assert.Equal(t, uint64(n), stat.WroteBytesSum)
+
+		session.Dispose()
+		// Dispose之后不再发送
+		session.WriteTSPackets(frames, true)
+		_ = lconn.Close()
+	}
+}
+
+func TestFindPCR(t *testing.T) {
+	ts := makeTS()
+	_, ok := findPCR(ts[:3*188])
+	assert.Equal(t, false, ok)
+	// 关键帧的第一个packet带有PCR
+	pcr, ok := findPCR(ts[3*188:])
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint64(93600-63000)*300, pcr)
+}